@@ -0,0 +1,140 @@
+package main
+
+import (
+    "errors"
+)
+
+var errZeroDivisor = errors.New("evaluation error: zero_divisor")
+
+// eval evaluates an arithmetic expression. There are only integers.
+func eval(s bindings, e expression) (number, error) {
+    switch t := walk(s, e).(type) {
+    case number:
+        return t, nil
+    case variable:
+        return 0, errInstantiation
+    case list:
+        // "a" evaluates to the character code of a
+        if t.tail == emptylist {
+            return eval(s, t.head)
+        }
+    case process:
+        switch len(t.args) {
+        case 1:
+            x, err := eval(s, t.args[0])
+            if err != nil {
+                return 0, err
+            }
+            return evalUnary(t, x)
+        case 2:
+            x, err := eval(s, t.args[0])
+            if err != nil {
+                return 0, err
+            }
+            y, err := eval(s, t.args[1])
+            if err != nil {
+                return 0, err
+            }
+            return evalBinary(t, x, y)
+        }
+    }
+    return 0, typeError("evaluable", e)
+}
+
+func evalUnary(p process, x number) (number, error) {
+    switch p.functor {
+    case "-":
+        return -x, nil
+    case "+":
+        return x, nil
+    case "abs":
+        return max(x, -x), nil
+    case "sign":
+        switch {
+        case x > 0:
+            return 1, nil
+        case x < 0:
+            return -1, nil
+        }
+        return 0, nil
+    case "\\":
+        return ^x, nil
+    }
+    return 0, typeError("evaluable", symbol(p.functor+"/1"))
+}
+
+func evalBinary(p process, x, y number) (number, error) {
+    switch p.functor {
+    case "+":
+        return x + y, nil
+    case "-":
+        return x - y, nil
+    case "*":
+        return x * y, nil
+    case "/", "//", "rem", "mod":
+        if y == 0 {
+            return 0, errZeroDivisor
+        }
+        switch p.functor {
+        case "rem":
+            return x % y, nil
+        case "mod":
+            // the sign follows the divisor
+            m := x % y
+            if m != 0 && (m < 0) != (y < 0) {
+                m += y
+            }
+            return m, nil
+        }
+        return x / y, nil
+    case "min":
+        return min(x, y), nil
+    case "max":
+        return max(x, y), nil
+    case ">>":
+        return x >> y, nil
+    case "<<":
+        return x << y, nil
+    case "/\\":
+        return x & y, nil
+    case "\\/":
+        return x | y, nil
+    case "xor":
+        return x ^ y, nil
+    case "**", "^":
+        if y < 0 {
+            return 0, typeError("nonnegative exponent", y)
+        }
+        r := number(1)
+        for ; y > 0; y >>= 1 {
+            if y&1 == 1 {
+                r *= x
+            }
+            x *= x
+        }
+        return r, nil
+    }
+    return 0, typeError("evaluable", symbol(p.functor+"/2"))
+}
+
+func builtinIs(m *machine, args []expression) bool {
+    n, err := eval(m.state.sub, args[1])
+    if err != nil {
+        return m.throw(err)
+    }
+    return m.unify(args[0], n)
+}
+
+func compareNumbers(f func(a, b number) bool) builtin {
+    return func(m *machine, args []expression) bool {
+        a, err := eval(m.state.sub, args[0])
+        if err != nil {
+            return m.throw(err)
+        }
+        b, err := eval(m.state.sub, args[1])
+        if err != nil {
+            return m.throw(err)
+        }
+        return f(a, b)
+    }
+}
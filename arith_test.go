@@ -0,0 +1,84 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestEval(t *testing.T) {
+    for _, tt := range []struct{
+        expr string
+        want number
+        err  bool
+    }{
+        {expr: "1 + 2 * 3", want: 7},
+        {expr: "(1 + 2) * 3", want: 9},
+        {expr: "7 - 2 - 1", want: 4},
+        {expr: "- 7 // 2", want: -3},
+        {expr: "7 rem -2", want: 1},
+        {expr: "-7 mod 2", want: 1},
+        {expr: "7 mod -2", want: -1},
+        {expr: "abs(-3) + sign(-3)", want: 2},
+        {expr: "min(2, 3) * max(2, 3)", want: 6},
+        {expr: "1 << 4 >> 2", want: 4},
+        {expr: "5 /\\ 3 + (5 \\/ 3) + (5 xor 3)", want: 14},
+        {expr: "\\ 0", want: -1},
+        {expr: "2 ** 10", want: 1024},
+        {expr: "2 ^ 3 ^ 2", want: 512},
+        {expr: "\"a\"", want: 97},
+        {expr: "1 / 0", err: true},
+        {expr: "1 mod 0", err: true},
+        {expr: "2 ** -1", err: true},
+        {expr: "foo + 1", err: true},
+        {expr: "X + 1", err: true},
+    }{
+        e, _, err := parseTerm(map[string]variable{}, tokenize(tt.expr), 1200)
+        if err != nil {
+            t.Fatalf("%s: %v", tt.expr, err)
+        }
+        got, err := eval(newSubstitution(), e)
+        if (err != nil) != tt.err {
+            t.Errorf("%s: %v", tt.expr, err)
+            continue
+        }
+        if got != tt.want {
+            t.Errorf("%s: got %d want %d", tt.expr, got, tt.want)
+        }
+    }
+}
+
+func TestArithmetic(t *testing.T) {
+    rules := `
+    len([], 0).
+    len([_|T], N) :- len(T, M), N is M + 1.
+    fib(0, 0).
+    fib(1, 1).
+    fib(N, F) :- N > 1, A is N - 1, B is N - 2, fib(A, FA), fib(B, FB), F is FA + FB.
+    between(L, H, L) :- L =< H.
+    between(L, H, X) :- L < H, M is L + 1, between(M, H, X).
+    bad(X) :- X is Y + 1.`
+    i := NewInterpreter(compileProcedures(MustParseRules(rules)))
+    for query, want := range map[string][]number{
+        "len([a, b, c], X)": {3},
+        "fib(15, X)":        {610},
+        "between(1, 3, X)":  {1, 2, 3},
+        "X is 6 // 2":       {3},
+    }{
+        got := []number{}
+        for _, ans := range mustInterpret(t, i, query) {
+            got = append(got, ans["X"].(number))
+        }
+        if len(got) != len(want) {
+            t.Errorf("%s: got %v want %v", query, got, want)
+            continue
+        }
+        for n := range got {
+            if got[n] != want[n] {
+                t.Errorf("%s: got %v want %v", query, got, want)
+            }
+        }
+    }
+    _, err := i.solve(proc("bad", 1), []expression{variable(0)}, state{sub: i.store(), vc: 1}, func(state) bool { return true })
+    if err != errInstantiation {
+        t.Errorf("got %v want %v", err, errInstantiation)
+    }
+}
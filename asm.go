@@ -0,0 +1,276 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Assemble reads procedures in the notation bowen.pl uses for compiled code:
+//
+//   procedure(append/3, [
+//       clause(xrtable(nil), 1, [const, 1, var, 1, var, 1, exit]),
+//       ...
+//   ]).
+//
+// Operands count from 1, as they are arg/3 indices into the xrtable term
+// and the vars term there, except the offsets of try and jump. Functors
+// in the xr table are written Name/Arity, procedures procedure(Name/Arity),
+// or procedure(Module, Name/Arity) for one of a module, and anything else
+// is a constant.
+// The code is verified, so whatever assembles is safe to install.
+func Assemble(input string) ([]procedure, error) {
+    tokens := tokenize(input)
+    procs := []procedure{}
+    for len(tokens) > 0 {
+        t, n, err := parseTerm(map[string]variable{}, tokens, 1200)
+        if err != nil {
+            return nil, err
+        }
+        if len(tokens) <= n || tokens[n] != Period {
+            return nil, syntaxError{"expected period"}
+        }
+        tokens = tokens[n+1:]
+        p, err := assembleProcedure(t)
+        if err != nil {
+            return nil, err
+        }
+        procs = append(procs, p)
+    }
+    return procs, nil
+}
+
+func assembleProcedure(e expression) (procedure, error) {
+    t, ok := e.(process)
+    if !ok || t.functor != "procedure" || t.arity() != 2 {
+        return procedure{}, fmt.Errorf("expected procedure(Name/Arity, Clauses), found %s", e.PrintExpression())
+    }
+    name, arity, ok := predicateIndicator(t.args[0])
+    if !ok {
+        return procedure{}, fmt.Errorf("expected Name/Arity, found %s", t.args[0].PrintExpression())
+    }
+    p := procedure{name: name, arity: arity}
+    clauses, ok := listElements(t.args[1])
+    if !ok {
+        return procedure{}, fmt.Errorf("%s/%d: expected a list of clauses", name, arity)
+    }
+    for n, c := range clauses {
+        cl, err := assembleClause(c)
+        if err != nil {
+            return procedure{}, fmt.Errorf("%s/%d clause %d: %w", name, arity, n, err)
+        }
+        p.clauses = append(p.clauses, cl)
+    }
+    if err := verifyProcedure(p); err != nil {
+        return procedure{}, err
+    }
+    return p, nil
+}
+
+func assembleClause(e expression) (clause, error) {
+    t, ok := e.(process)
+    if !ok || t.functor != "clause" || t.arity() != 3 {
+        return clause{}, fmt.Errorf("expected clause(XR, NVars, Codes), found %s", e.PrintExpression())
+    }
+    c := clause{xrTable: xrTable{}}
+    switch xr := t.args[0].(type) {
+    case symbol:
+        if xr != "xrtable" {
+            return clause{}, fmt.Errorf("expected xrtable, found %s", xr)
+        }
+    case process:
+        if xr.functor != "xrtable" {
+            return clause{}, fmt.Errorf("expected xrtable, found %s", xr)
+        }
+        for _, arg := range xr.args {
+            x, err := assembleEntry(arg)
+            if err != nil {
+                return clause{}, err
+            }
+            c.xrTable = append(c.xrTable, x)
+        }
+    default:
+        return clause{}, fmt.Errorf("expected xrtable, found %s", xr.PrintExpression())
+    }
+    n, ok := t.args[1].(number)
+    if !ok || n < 0 {
+        return clause{}, fmt.Errorf("expected number of vars, found %s", t.args[1].PrintExpression())
+    }
+    c.numVars = int(n)
+    codes, ok := listElements(t.args[2])
+    if !ok {
+        return clause{}, fmt.Errorf("expected a list of codes")
+    }
+    for i := 0; i < len(codes); i++ {
+        s, ok := codes[i].(symbol)
+        ins, known := opcodes[string(s)]
+        if !ok || !known {
+            return clause{}, fmt.Errorf("unknown instruction %s", codes[i].PrintExpression())
+        }
+        c.bytecodes = append(c.bytecodes, ins)
+        if !ins.hasOperand() {
+            continue
+        }
+        i++
+        if i >= len(codes) {
+            return clause{}, fmt.Errorf("%s without operand", ins)
+        }
+        operand, ok := codes[i].(number)
+        if !ok {
+            return clause{}, fmt.Errorf("%s with operand %s", ins, codes[i].PrintExpression())
+        }
+        c.bytecodes = append(c.bytecodes, instruction(operand)-operandBase(ins))
+    }
+    return c, nil
+}
+
+func assembleEntry(e expression) (entry, error) {
+    switch t := e.(type) {
+    case number:
+        return integer(t), nil
+    case symbol:
+        return atom(t), nil
+    case process:
+        if name, arity, ok := predicateIndicator(t); ok {
+            return functor(name, arity), nil
+        }
+        if t.functor == "procedure" && t.arity() == 1 {
+            if name, arity, ok := predicateIndicator(t.args[0]); ok {
+                return proc(name, arity), nil
+            }
+        }
+        if m, ok := t.args[0].(symbol); ok && t.functor == "procedure" && t.arity() == 2 {
+            if name, arity, ok := predicateIndicator(t.args[1]); ok {
+                return moduleProc(moduleName(m), name, arity), nil
+            }
+        }
+    }
+    return nil, fmt.Errorf("bad xr entry %s", e.PrintExpression())
+}
+
+var opcodes = map[string]instruction{}
+
+func init() {
+    for ins, name := range opcodeNames {
+        opcodes[name] = ins
+    }
+}
+
+// predicateIndicator reads Name/Arity
+func predicateIndicator(e expression) (string, int, bool) {
+    p, ok := e.(process)
+    if !ok || p.functor != "/" || p.arity() != 2 {
+        return "", 0, false
+    }
+    name, ok := p.args[0].(symbol)
+    if !ok {
+        return "", 0, false
+    }
+    arity, ok := p.args[1].(number)
+    if !ok || arity < 0 {
+        return "", 0, false
+    }
+    return string(name), int(arity), true
+}
+
+// listElements returns the elements of a proper list
+func listElements(e expression) ([]expression, bool) {
+    elems := []expression{}
+    for {
+        switch t := e.(type) {
+        case list:
+            elems = append(elems, t.head)
+            e = t.tail
+            continue
+        case symbol:
+            return elems, t == emptylist
+        }
+        return nil, false
+    }
+}
+
+// term is the clause as a clause(XR, NVars, Codes) term, which
+// assembleClause reads back
+func (c clause) term() expression {
+    xr := []expression{}
+    for _, e := range c.xrTable {
+        switch t := e.(type) {
+        case integer:
+            xr = append(xr, number(t))
+        case atom:
+            xr = append(xr, symbol(t))
+        case functorEntry:
+            xr = append(xr, indicator(t))
+        case procEntry:
+            args := []expression{indicator(t.functorEntry)}
+            if t.module != "" {
+                args = append([]expression{symbol(t.module)}, args...)
+            }
+            xr = append(xr, process{functor: "procedure", args: args})
+        }
+    }
+    codes := []expression{}
+    for pc := 0; pc < len(c.bytecodes); pc++ {
+        ins := c.bytecodes[pc]
+        codes = append(codes, symbol(ins.String()))
+        if ins.hasOperand() && pc+1 < len(c.bytecodes) {
+            pc++
+            codes = append(codes, number(c.bytecodes[pc]+operandBase(ins)))
+        }
+    }
+    return process{functor: "clause", args: []expression{
+        compound("xrtable", xr), number(c.numVars), makeList(codes, emptylist),
+    }}
+}
+
+// operandBase is what operands of ins count from when written: 1 for
+// indices and vars, 0 for offsets
+func operandBase(ins instruction) instruction {
+    if ins.isJump() {
+        return 0
+    }
+    return 1
+}
+
+// indicator is the Name/Arity term for a functor
+func indicator(f functorEntry) expression {
+    return process{functor: "/", args: []expression{symbol(f.name), number(f.arity)}}
+}
+
+// assembly writes a procedure in the notation Assemble reads
+func (p procedure) assembly() string {
+    clauses := []string{}
+    for _, c := range p.clauses {
+        xr := []string{}
+        for _, e := range c.xrTable {
+            switch t := e.(type) {
+            case integer:
+                xr = append(xr, t.printEntry())
+            case atom:
+                xr = append(xr, symbol(t).quoted())
+            case functorEntry:
+                xr = append(xr, fmt.Sprintf("%s/%d", symbol(t.name).quoted(), t.arity))
+            case procEntry:
+                if t.module != "" {
+                    xr = append(xr, fmt.Sprintf("procedure(%s, %s/%d)", symbol(t.module).quoted(), symbol(t.name).quoted(), t.arity))
+                    continue
+                }
+                xr = append(xr, fmt.Sprintf("procedure(%s/%d)", symbol(t.name).quoted(), t.arity))
+            }
+        }
+        table := "xrtable"
+        if len(xr) > 0 {
+            table = fmt.Sprintf("xrtable(%s)", strings.Join(xr, ", "))
+        }
+        codes := []string{}
+        for pc := 0; pc < len(c.bytecodes); pc++ {
+            ins := c.bytecodes[pc]
+            codes = append(codes, ins.String())
+            if ins.hasOperand() && pc+1 < len(c.bytecodes) {
+                pc++
+                codes = append(codes, fmt.Sprintf("%d", c.bytecodes[pc]+operandBase(ins)))
+            }
+        }
+        clauses = append(clauses, fmt.Sprintf("    clause(%s, %d,\n        [%s])", table, c.numVars, strings.Join(codes, ", ")))
+    }
+    return fmt.Sprintf("procedure(%s/%d, [\n%s]).\n", symbol(p.name).quoted(), p.arity, strings.Join(clauses, ",\n"))
+}
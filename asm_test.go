@@ -0,0 +1,133 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// as written in bowen.pl
+var appendAssembly = `
+procedure( append/3, [
+    clause( xrtable(nil), 1,
+        [ const, 1,                         % nil
+          var,   1,                         % L
+          var,   1,                         % L
+          exit]),
+    clause( xrtable(cons/2, procedure(append/3)), 4,
+        [ functor, 1, var, 1, var, 2, pop,  % cons(X, L1)
+          var, 3,                           % L2
+          functor, 1, var, 1, var, 4, pop,  % cons(X, L3)
+          enter,
+          var, 2, var, 3, var, 4, call, 2,  % append(L1, L2, L3)
+          exit])]).
+`
+
+func TestAssemble(t *testing.T) {
+    procs, err := Assemble(appendAssembly)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // assembly has no source positions
+    want := compileProcedure(MustParseRules(appendRules))
+    for i := range want.clauses {
+        want.clauses[i].pos = position{}
+    }
+    if !reflect.DeepEqual(procs, []procedure{want}) {
+        t.Errorf("got %v want %v", procs, want)
+    }
+    // and back again
+    procs, err = Assemble(want.assembly())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(procs, []procedure{want}) {
+        t.Errorf("got %v want %v", procs, want)
+    }
+}
+
+func TestAssembleErrors(t *testing.T) {
+    for i, tt := range []struct{
+        input string
+        err   string
+    }{
+        {
+            input: "procedure(p/1, [clause(xrtable(a), 0, [const, 2, exit])]).",
+            err:   "const xr index 1 out of range",
+        },
+        {
+            input: "procedure(p/1, [clause(xrtable(f/1), 1, [functor, 1, var, 1, exit])]).",
+            err:   "exit inside functor",
+        },
+        {
+            input: "procedure(p/1, [clause(xrtable(f/1), 1, [var, 1, pop, exit])]).",
+            err:   "pop without functor",
+        },
+        {
+            input: "procedure(p/0, [clause(xrtable, 0, [goto, exit])]).",
+            err:   "unknown instruction goto",
+        },
+        {
+            input: "procedure(p/0, [clause(xrtable, 0, [enter, call])]).",
+            err:   "call without operand",
+        },
+        {
+            input: "procedure(p/0, [clause(xrtable(f(x)), 0, [exit])]).",
+            err:   "bad xr entry f(x)",
+        },
+        {
+            input: "procedure(p, []).",
+            err:   "expected Name/Arity",
+        },
+        {
+            input: "procedure(p/0, [clause(xrtable, 0, [exit])])",
+            err:   "expected period",
+        },
+    }{
+        _, err := Assemble(tt.input)
+        if err == nil || !strings.Contains(err.Error(), tt.err) {
+            t.Errorf("%d: got %v want %s", i, err, tt.err)
+        }
+    }
+}
+
+// Hand-written code for things the compiler does not emit, or only rarely
+func TestExecuteAssembled(t *testing.T) {
+    for n, tt := range []struct{
+        code  string
+        query string
+        want  []string
+    }{
+        {
+            // nested functors built in a body, then matched in a head
+            code: `
+            procedure(p/1, [clause(xrtable(f/2, g/1, a, procedure(q/1)), 1,
+                [var, 1, enter, functor, 1, functor, 2, const, 3, pop, var, 1, pop, call, 4, exit])]).
+            procedure(q/1, [clause(xrtable(f/2, g/1), 1,
+                [functor, 1, functor, 2, var, 1, pop, var, 1, pop, exit])]).`,
+            query: "p(X)",
+            want:  []string{"a"},
+        },
+        {
+            // '.'/2 builds lists, and matches lists from the parser
+            code: `
+            procedure(p/1, [clause(xrtable('.'/2, a, nil), 0, [functor, 1, const, 2, const, 3, pop, exit])]).`,
+            query: "p(X)",
+            want:  []string{"[a]"},
+        },
+    }{
+        procs, err := Assemble(tt.code)
+        if err != nil {
+            t.Errorf("%d: %v", n, err)
+            continue
+        }
+        i := NewInterpreter(procs)
+        got := []string{}
+        for _, ans := range mustInterpret(t, i, tt.query) {
+            got = append(got, ans["X"].PrintExpression())
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%d: got %v want %v", n, got, tt.want)
+        }
+    }
+}
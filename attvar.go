@@ -0,0 +1,479 @@
+package main
+
+import (
+    "fmt"
+    "reflect"
+    "strings"
+)
+
+// attributes are what an attributed variable is bound to in the store.
+// Walking stops there, so to the rest of the machine it is unbound, but
+// binding it wakes the hook of each module it has an attribute for.
+type attributes []attribute
+
+type attribute struct {
+    module string
+    value  expression
+}
+
+func (a attributes) PrintExpression() string {
+    attrs := []string{}
+    for _, at := range a {
+        attrs = append(attrs, fmt.Sprintf("%s: %s", at.module, at.value.PrintExpression()))
+    }
+    return fmt.Sprintf("attributes(%s)", strings.Join(attrs, ", "))
+}
+
+// a wakeup is an attributed variable unification bound to value
+type wakeup struct {
+    attrs attributes
+    value expression
+}
+
+// wakeups are kept in the store, so backtracking drops them
+type wakeups []wakeup
+
+func (w wakeups) PrintExpression() string {
+    return fmt.Sprintf("wakeups(%d)", len(w))
+}
+
+// wakeVar is where the store keeps the wakeups not yet run
+const wakeVar = variable(-1)
+
+func pendingWakeups(s bindings) wakeups {
+    if e, ok := s.get(wakeVar); ok {
+        return e.(wakeups)
+    }
+    return nil
+}
+
+// an attrHook gives the goals to run when a variable with an attribute
+// of its module is bound to other. Modules without one have their
+// M:attr_unify_hook(Value, Other) called.
+type attrHook func(m *machine, value, other expression) []process
+
+var attrHooks map[string]attrHook
+
+func init() {
+    attrHooks = map[string]attrHook{
+        "freeze": freezeHook,
+        "dif":    goalsHook,
+        "when":   goalsHook,
+        "clpfd":  fdHook,
+    }
+}
+
+// wake calls the goals of the hooks woken by the unifications since the
+// last check, if there are any, to go on with pc once they succeed
+func (m *machine) wake(pc []instruction) (ok, called bool) {
+    goals := []process{}
+    // hooks written in Go can bind variables, waking more
+    for w := pendingWakeups(m.state.sub); len(w) > 0; w = pendingWakeups(m.state.sub) {
+        m.state.sub = m.state.sub.put(wakeVar, wakeups(nil))
+        for _, wu := range w {
+            for _, a := range wu.attrs {
+                hook, ok := attrHooks[a.module]
+                if !ok {
+                    hook = userHook(a.module)
+                }
+                goals = append(goals, hook(m, a.value, wu.value)...)
+            }
+        }
+    }
+    if len(goals) == 0 {
+        return true, false
+    }
+    m.cont = &frame{pc: pc, xr: m.xr, vo: m.state.vo, cutB: m.cutB, depth: m.state.depth, inv: m.trace.current(), next: m.cont}
+    return m.arrive(proc("call", 1), []expression{conjunction(goals)}), true
+}
+
+// exitCode is what is left of a clause at its EXIT
+var exitCode = []instruction{EXIT}
+
+func userHook(module string) attrHook {
+    return func(m *machine, value, other expression) []process {
+        hook := process{functor: "attr_unify_hook", args: []expression{value, other}}
+        return []process{{functor: ":", args: []expression{symbol(module), hook}}}
+    }
+}
+
+// getAttr finds the attribute of v for module; v has to be walked already
+func (m *machine) getAttr(v variable, module string) (expression, bool) {
+    return getAttr(m.state.sub, v, module)
+}
+
+func getAttr(sub bindings, v variable, module string) (expression, bool) {
+    e, _ := sub.get(v)
+    a, _ := e.(attributes)
+    for _, at := range a {
+        if at.module == module {
+            return at.value, true
+        }
+    }
+    return nil, false
+}
+
+// putAttr sets the attribute of v for module, copying the attributes
+// as older states may still have them
+func (m *machine) putAttr(v variable, module string, value expression) {
+    e, _ := m.state.sub.get(v)
+    a, _ := e.(attributes)
+    out := make(attributes, 0, len(a)+1)
+    found := false
+    for _, at := range a {
+        if at.module == module {
+            at.value = value
+            found = true
+        }
+        out = append(out, at)
+    }
+    if !found {
+        out = append(out, attribute{module: module, value: value})
+    }
+    m.state.sub = m.state.sub.put(v, out)
+    m.state.attributed = true
+}
+
+// attrVariable gets the variable an attribute goes on
+func (m *machine) attrVariable(e expression) (variable, error) {
+    switch t := walk(m.state.sub, e).(type) {
+    case variable:
+        return t, nil
+    default:
+        return 0, typeError("variable", t)
+    }
+}
+
+func builtinPutAttr(m *machine, args []expression) bool {
+    v, err := m.attrVariable(args[0])
+    if err != nil {
+        return m.throw(err)
+    }
+    module, err := m.atomArg(args[1])
+    if err != nil {
+        return m.throw(err)
+    }
+    m.putAttr(v, module, args[2])
+    return true
+}
+
+// get_attr(V, M, Value) fails if V is not a variable with an attribute for M
+func builtinGetAttr(m *machine, args []expression) bool {
+    module, err := m.atomArg(args[1])
+    if err != nil {
+        return m.throw(err)
+    }
+    v, ok := walk(m.state.sub, args[0]).(variable)
+    if !ok {
+        return false
+    }
+    value, ok := m.getAttr(v, module)
+    return ok && m.unify(args[2], value)
+}
+
+// del_attr(V, M) always succeeds. With no attributes left, binding V
+// wakes nothing.
+func builtinDelAttr(m *machine, args []expression) bool {
+    module, err := m.atomArg(args[1])
+    if err != nil {
+        return m.throw(err)
+    }
+    v, ok := walk(m.state.sub, args[0]).(variable)
+    if !ok {
+        return true
+    }
+    e, _ := m.state.sub.get(v)
+    a, _ := e.(attributes)
+    out := attributes{}
+    for _, at := range a {
+        if at.module != module {
+            out = append(out, at)
+        }
+    }
+    if len(out) < len(a) {
+        m.state.sub = m.state.sub.put(v, out)
+    }
+    return true
+}
+
+// addAttrGoal adds goal to the list of goals v has for module, unless
+// it is there already
+func (m *machine) addAttrGoal(v variable, module string, goal expression) {
+    goals := []expression{}
+    if value, ok := m.getAttr(v, module); ok {
+        goals, _ = listElements(walk(m.state.sub, value))
+    }
+    for _, g := range goals {
+        if reflect.DeepEqual(walkstar(m.state.sub, g), walkstar(m.state.sub, goal)) {
+            return
+        }
+    }
+    m.putAttr(v, module, makeList(append(goals, goal), emptylist))
+}
+
+// goalsHook calls the goals in the list of the attribute
+func goalsHook(m *machine, value, other expression) []process {
+    goals, _ := listElements(walk(m.state.sub, value))
+    out := []process{}
+    for _, g := range goals {
+        if p, ok := walk(m.state.sub, g).(process); ok {
+            out = append(out, p)
+        }
+    }
+    return out
+}
+
+// the clauses the constraints answer with: call the goal now, or
+// succeed leaving it to wait
+var (
+    freezeClauses = compileProcedure(MustParseRules("freeze(_, G) :- call(G). freeze(_, _).")).clauses
+    whenClauses   = compileProcedure(MustParseRules("when(_, G) :- call(G). when(_, _).")).clauses
+    wokenClauses  = compileProcedure(MustParseRules("'$when'(_, _, G) :- call(G). '$when'(_, _, _).")).clauses
+)
+
+// freeze(X, G) calls G once X is bound, which may be right away
+func generateFreeze(m *machine, args []expression) ([]clause, error) {
+    if _, err := m.callable(args[1]); err != nil {
+        return nil, err
+    }
+    v, ok := walk(m.state.sub, args[0]).(variable)
+    if !ok {
+        return freezeClauses[:1], nil
+    }
+    m.addFrozen(v, args[1])
+    return freezeClauses[1:], nil
+}
+
+// addFrozen adds goal to those frozen on v, after any already there
+func (m *machine) addFrozen(v variable, goal expression) {
+    if old, ok := m.getAttr(v, "freeze"); ok {
+        goal = process{functor: Comma, args: []expression{old, goal}}
+    }
+    m.putAttr(v, "freeze", goal)
+}
+
+// binding a frozen variable to another variable has that one wait
+// for the goals as well, before its own
+func freezeHook(m *machine, goal, other expression) []process {
+    if v, ok := walk(m.state.sub, other).(variable); ok {
+        if old, ok := m.getAttr(v, "freeze"); ok {
+            goal = process{functor: Comma, args: []expression{goal, old}}
+        }
+        m.putAttr(v, "freeze", goal)
+        return nil
+    }
+    return []process{{functor: "call", args: []expression{goal}}}
+}
+
+// dif(X, Y) holds while X and Y cannot be made equal. While they could,
+// it waits on every variable that making them equal would bind.
+func builtinDif(m *machine, args []expression) bool {
+    vars, ok := m.unifier(args[0], args[1])
+    if !ok {
+        return true
+    }
+    if len(vars) == 0 {
+        return false
+    }
+    goal := walkstar(m.state.sub, process{functor: "dif", args: args})
+    for _, v := range vars {
+        m.addAttrGoal(v, "dif", goal)
+    }
+    return true
+}
+
+func (m *machine) unifier(x, y expression) ([]variable, bool) {
+    return unifier(m.state.sub, m.state.vc, x, y)
+}
+
+// unifier reports whether x and y unify, and which variables unifying
+// them would bind, leaving s as it was. When a variable would be bound
+// to another, both are in the list.
+func unifier(s bindings, vc int, x, y expression) ([]variable, bool) {
+    vars := termVariables(walkstar(s, x), termVariables(walkstar(s, y), nil))
+    // a trail keeps the bindings, so undo them ourselves
+    mark := s.mark(vc)
+    s1, ok := unify(s, x, y)
+    bound := []variable{}
+    if ok {
+        seen := map[variable]bool{}
+        add := func(v variable) {
+            if !seen[v] {
+                seen[v] = true
+                bound = append(bound, v)
+            }
+        }
+        for _, v := range vars {
+            w := walk(s1, v)
+            if w == expression(v) {
+                continue
+            }
+            add(v)
+            if wv, ok := w.(variable); ok {
+                add(wv)
+            }
+        }
+    }
+    s.undo(mark, vc)
+    return bound, ok
+}
+
+// termVariables appends the variables of a walked term to vars, in
+// order of first appearance
+func termVariables(e expression, vars []variable) []variable {
+    switch t := e.(type) {
+    case variable:
+        for _, v := range vars {
+            if v == t {
+                return vars
+            }
+        }
+        return append(vars, t)
+    case list:
+        return termVariables(t.tail, termVariables(t.head, vars))
+    case process:
+        for _, arg := range t.args {
+            vars = termVariables(arg, vars)
+        }
+    }
+    return vars
+}
+
+// when(Cond, G) calls G once Cond holds. Cond is nonvar(X), ground(X),
+// ?=(X, Y), or a conjunction or disjunction of those.
+func generateWhen(m *machine, args []expression) ([]clause, error) {
+    return m.when(m.fresh(), args[0], args[1], whenClauses)
+}
+
+// '$when'(Done, Cond, G) is what a woken when/2 calls. Done is bound once
+// G has been called, so of the variables it waits on only the first to
+// be bound gets to call it.
+func generateWhenWoken(m *machine, args []expression) ([]clause, error) {
+    if _, ok := walk(m.state.sub, args[0]).(variable); !ok {
+        return wokenClauses[1:], nil
+    }
+    return m.when(args[0], args[1], args[2], wokenClauses)
+}
+
+func (m *machine) when(done, cond, goal expression, clauses []clause) ([]clause, error) {
+    if _, err := m.callable(goal); err != nil {
+        return nil, err
+    }
+    ready, wait, err := m.whenCondition(cond)
+    if err != nil {
+        return nil, err
+    }
+    if ready {
+        m.unify(done, true_value)
+        return clauses[:1], nil
+    }
+    entry := walkstar(m.state.sub, process{functor: "$when", args: []expression{done, cond, goal}})
+    for _, v := range wait {
+        m.addAttrGoal(v, "when", entry)
+    }
+    return clauses[1:], nil
+}
+
+// whenCondition reports whether cond holds, and if not the variables
+// to wait on until it might
+func (m *machine) whenCondition(cond expression) (bool, []variable, error) {
+    t, ok := walk(m.state.sub, cond).(process)
+    switch {
+    case isVariable(walk(m.state.sub, cond)):
+        return false, nil, errInstantiation
+    case !ok:
+    case t.functor == "nonvar" && t.arity() == 1:
+        if v, ok := walk(m.state.sub, t.args[0]).(variable); ok {
+            return false, []variable{v}, nil
+        }
+        return true, nil, nil
+    case t.functor == "ground" && t.arity() == 1:
+        vars := termVariables(walkstar(m.state.sub, t.args[0]), nil)
+        if len(vars) == 0 {
+            return true, nil, nil
+        }
+        return false, vars[:1], nil
+    case t.functor == "?=" && t.arity() == 2:
+        vars, ok := m.unifier(t.args[0], t.args[1])
+        return !ok || len(vars) == 0, vars, nil
+    case t.functor == Comma && t.arity() == 2:
+        ready, wait, err := m.whenCondition(t.args[0])
+        if err != nil || !ready {
+            return ready, wait, err
+        }
+        return m.whenCondition(t.args[1])
+    case t.functor == ";" && t.arity() == 2:
+        ready, wait, err := m.whenCondition(t.args[0])
+        if err != nil || ready {
+            return ready, wait, err
+        }
+        ready, more, err := m.whenCondition(t.args[1])
+        if err != nil || ready {
+            return ready, more, err
+        }
+        return false, append(wait, more...), nil
+    }
+    return false, nil, fmt.Errorf("domain error: when condition expected, found %s", walkstar(m.state.sub, cond).PrintExpression())
+}
+
+// residualGoals are the goals still waiting on the variables of terms,
+// and on the variables of those goals in turn: what an answer leaves
+// to be proven
+func residualGoals(st state, terms []expression) []expression {
+    out := []expression{}
+    queue := []variable{}
+    for _, t := range terms {
+        queue = termVariables(walkstar(st.sub, t), queue)
+    }
+    seen := map[variable]bool{}
+    printed := map[string]bool{}
+    for len(queue) > 0 {
+        v := queue[0]
+        queue = queue[1:]
+        if seen[v] {
+            continue
+        }
+        seen[v] = true
+        e, _ := st.sub.get(v)
+        a, _ := e.(attributes)
+        for _, at := range a {
+            for _, g := range residuals(st, v, at) {
+                g = walkstar(st.sub, g)
+                if k := g.PrintExpression(); !printed[k] {
+                    printed[k] = true
+                    out = append(out, g)
+                    queue = termVariables(g, queue)
+                }
+            }
+        }
+    }
+    return out
+}
+
+// residuals are the goals an attribute of v stands for. Those of dif/2
+// and when/2 that no longer wait on anything are left out.
+func residuals(st state, v variable, at attribute) []expression {
+    switch at.module {
+    case "freeze":
+        return []expression{process{functor: "freeze", args: []expression{v, at.value}}}
+    case "dif", "when":
+        goals, _ := listElements(walk(st.sub, at.value))
+        out := []expression{}
+        for _, g := range goals {
+            p, ok := walk(st.sub, g).(process)
+            switch {
+            case !ok:
+            case p.functor == "dif":
+                if vars, ok := unifier(st.sub, st.vc, p.args[0], p.args[1]); ok && len(vars) > 0 {
+                    out = append(out, p)
+                }
+            case p.functor == "$when" && isVariable(walk(st.sub, p.args[0])):
+                out = append(out, process{functor: "when", args: p.args[1:]})
+            }
+        }
+        return out
+    case "clpfd":
+        return fdResiduals(st, v, at.value.(fdVar))
+    }
+    return []expression{process{functor: "put_attr", args: []expression{v, symbol(at.module), at.value}}}
+}
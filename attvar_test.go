@@ -0,0 +1,131 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+var attvarRules = `
+    domain:attr_unify_hook(D, Y) :- member(Y, D).
+    in(X, D) :- put_attr(X, domain, D).
+    maybe(X) :- put_attr(X, m, a).
+    maybe(_).
+    p(1).
+    p(2).
+    p(3).
+`
+
+func TestAttributedVariables(t *testing.T) {
+    for _, s := range stores {
+        var out strings.Builder
+        i := NewInterpreter(compileProcedures(MustParseRules(attvarRules)))
+        i.setStore(s.store)
+        i.setOutput(&out)
+        for _, tt := range []struct{
+            query string
+            vars  []string
+            want  []string
+            out   string
+        }{
+            {query: "call((put_attr(X, m, a), get_attr(X, m, V)))", vars: []string{"V"}, want: []string{"a"}},
+            {query: "call((put_attr(X, m, a), put_attr(X, m, b), get_attr(X, m, V)))", vars: []string{"V"}, want: []string{"b"}},
+            {query: "call((put_attr(X, m, a), del_attr(X, m), get_attr(X, m, _)))", want: []string{}},
+            {query: "get_attr(a, m, _)", want: []string{}},
+            // attributes are undone on backtracking
+            {query: "call((maybe(X), get_attr(X, m, V)))", vars: []string{"V"}, want: []string{"a"}},
+            // a user hook filters bindings
+            {query: "call((in(X, [1, 3]), p(X)))", vars: []string{"X"}, want: []string{"1", "3"}},
+            {query: "call((in(X, [1, 3]), X = Y, p(Y)))", vars: []string{"Y"}, want: []string{"1", "3"}},
+            // freeze
+            {query: "call((freeze(X, writeln(X)), X = a))", vars: []string{"X"}, want: []string{"a"}, out: "a\n"},
+            {query: "call((freeze(X, X > 1), p(X)))", vars: []string{"X"}, want: []string{"2", "3"}},
+            {query: "call((freeze(X, writeln(x)), freeze(Y, writeln(y)), X = Y, Y = 1))", want: []string{""}, out: "x\ny\n"},
+            {query: "call((freeze(X, fail), X = Y))", want: []string{""}},
+            {query: "freeze(1, writeln(now))", want: []string{""}, out: "now\n"},
+            // dif
+            {query: "call((dif(X, a), p(X)))", vars: []string{"X"}, want: []string{"1", "2", "3"}},
+            {query: "call((dif(X, 2), p(X)))", vars: []string{"X"}, want: []string{"1", "3"}},
+            {query: "call((dif(X, Y), X = Y))", want: []string{}},
+            {query: "call((dif(f(X, Y), f(1, 2)), X = 1, Y = 2))", want: []string{}},
+            {query: "call((dif(f(X, Y), f(1, 2)), X = 1, Y = 3))", want: []string{""}},
+            {query: "dif(a, a)", want: []string{}},
+            {query: "dif(a, b)", want: []string{""}},
+            // when
+            {query: "call((when(nonvar(X), writeln(X)), X = f(a)))", want: []string{""}, out: "f(a)\n"},
+            {query: "call((when(ground(X-Y), writeln(X-Y)), X = 1, Y = 2))", want: []string{""}, out: "1-2\n"},
+            {query: "call((when((nonvar(X) ; nonvar(Y)), writeln(w)), X = 1, Y = 2))", want: []string{""}, out: "w\n"},
+            {query: "call((when(?=(X, Y), writeln(decided)), X = a, Y = b))", want: []string{""}, out: "decided\n"},
+            {query: "call((when(nonvar(X), X > 1), p(X)))", vars: []string{"X"}, want: []string{"2", "3"}},
+        }{
+            out.Reset()
+            got, err := answers(i, tt.query, tt.vars...)
+            if err != nil {
+                t.Errorf("%s: %s: %v", s.name, tt.query, err)
+                continue
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("%s: %s: got %v want %v", s.name, tt.query, got, tt.want)
+            }
+            if out.String() != tt.out && tt.out != "" {
+                t.Errorf("%s: %s: wrote %q want %q", s.name, tt.query, out.String(), tt.out)
+            }
+        }
+    }
+}
+
+func TestAttributedVariableErrors(t *testing.T) {
+    i := NewInterpreter(nil)
+    for _, query := range []string{
+        "put_attr(a, m, 1)",
+        "put_attr(_, M, 1)",
+        "freeze(_, 1)",
+        "when(_, true)",
+        "when(foo(_), true)",
+    }{
+        if _, err := answers(i, query); err == nil {
+            t.Errorf("%s: expected error", query)
+        }
+    }
+}
+
+// Goals still waiting are part of the answer
+func TestResidualGoals(t *testing.T) {
+    for _, s := range stores {
+        i := NewInterpreter(nil)
+        i.setStore(s.store)
+        // X and Y in want are replaced by what they are bound to
+        for _, tt := range []struct{
+            query string
+            want  string
+        }{
+            {query: "freeze(X, writeln(X))", want: "[freeze(X,writeln(X))]"},
+            {query: "dif(X, a)", want: "[dif(X,a)]"},
+            {query: "call((dif(f(X, Y), f(1, 2)), X = 3))", want: ""},
+            {query: "when(nonvar(X), writeln(X))", want: "[when(nonvar(X),writeln(X))]"},
+            {query: "call((when(nonvar(X), true), X = 1))", want: ""},
+            {query: "put_attr(X, m, 1)", want: "[put_attr(X,m,1)]"},
+            // a goal waiting on two variables is given once
+            {query: "call((dif(X, Y), freeze(Y, true), Z = X))", want: "[dif(X,Y),freeze(Y,true)]"},
+        }{
+            answers, err := i.interpretContext(t.Context(), tt.query, Limits{})
+            if err != nil || len(answers) != 1 {
+                t.Errorf("%s: %s: got %v %v", s.name, tt.query, answers, err)
+                continue
+            }
+            got := ""
+            if r, ok := answers[0][residualKey]; ok {
+                got = r.PrintExpression()
+            }
+            want := tt.want
+            for _, name := range []string{"X", "Y"} {
+                if e, ok := answers[0][name]; ok {
+                    want = strings.ReplaceAll(want, name, e.PrintExpression())
+                }
+            }
+            if got != want {
+                t.Errorf("%s: %s: got %s want %s", s.name, tt.query, got, want)
+            }
+        }
+    }
+}
@@ -7,6 +7,7 @@ type substitution struct {
 	left   *substitution
 	right  *substitution
 	height int
+	size   int
 }
 
 func NewAVL() *substitution {
@@ -20,6 +21,7 @@ func (n *substitution) copyNode() *substitution {
 		left:   n.left,
 		right:  n.right,
 		height: n.height,
+		size:   n.size,
 	}
 }
 
@@ -28,30 +30,31 @@ func (n *substitution) Insert(k variable, v expression) *substitution {
 	return tree
 }
 
-// immutable update. boolean indicate actual new insertion happened
+// immutable update, replacing the value of a key already there.
+// boolean indicate actual new insertion happened
 func (n *substitution) insert(k variable, v expression) (*substitution, bool) {
 	if n == nil {
-		return &substitution{key: k, value: v, height: 1}, true
+		return &substitution{key: k, value: v, height: 1, size: 1}, true
 	}
+	newn := n.copyNode()
 	if n.key == k {
-		return n, false
+		newn.value = v
+		return newn, false
 	}
 	if n.key < k {
 		left, inserted := n.left.insert(k, v)
+		newn.left = left
 		if !inserted {
-			return n, false
+			return newn, false
 		}
-		newn := n.copyNode()
-		newn.left = left
 		return newn.rebalance(), true
 	}
 	// n.key > k
 	right, inserted := n.right.insert(k, v)
+	newn.right = right
 	if !inserted {
-		return n, false
+		return newn, false
 	}
-	newn := n.copyNode()
-	newn.right = right
 	return newn.rebalance(), true
 }
 
@@ -111,6 +114,14 @@ func (n *substitution) rebalance() *substitution {
 
 func (n *substitution) resetHeight() {
 	n.height = max(n.left.getHeight(), n.right.getHeight()) + 1
+	n.size = n.left.getSize() + n.right.getSize() + 1
+}
+
+func (n *substitution) getSize() int {
+	if n == nil {
+		return 0
+	}
+	return n.size
 }
 
 func (n *substitution) Lookup(k variable) (expression, bool) {
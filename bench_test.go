@@ -0,0 +1,135 @@
+package main
+
+import (
+    "os"
+    "runtime"
+    "testing"
+)
+
+// The classic Prolog benchmarks, loaded from testdata through the parser
+// and compiler. Each reports logical inferences per second, allocations per
+// inference and the peak number of bound variables, for both binding stores.
+var benchmarkPrograms = []struct{
+    name  string
+    file  string
+    query string
+    all   bool   // find all answers instead of just the first
+    want  string // last argument in the first answer
+}{
+    {
+        name:  "nrev",
+        file:  "testdata/nrev.pl",
+        query: "bench(L)",
+        want:  "[30,29,28,27,26,25,24,23,22,21,20,19,18,17,16,15,14,13,12,11,10,9,8,7,6,5,4,3,2,1]",
+    },
+    {
+        name:  "queens",
+        file:  "testdata/queens.pl",
+        query: "queens(6, Qs)",
+        all:   true,
+        want:  "[2,4,6,1,3,5]",
+    },
+    {
+        name:  "zebra",
+        file:  "testdata/zebra.pl",
+        query: "zebra(Owner, Water)",
+        want:  "norwegian",
+    },
+    {
+        name:  "crypt",
+        file:  "testdata/crypt.pl",
+        query: "crypt(Digits)",
+        want:  "[3,4,8,2,8,2,7,8,4,6,9,6,9,7,4,4]",
+    },
+    {
+        name:  "tak",
+        file:  "testdata/tak.pl",
+        query: "tak(18, 12, 6, A)",
+        want:  "7",
+    },
+}
+
+var stores = []struct{
+    name  string
+    store func() bindings
+}{
+    {"avl", newSubstitution},
+    {"trail", newTrail},
+}
+
+func loadProgram(tb testing.TB, file string) *interpreter {
+    tb.Helper()
+    b, err := os.ReadFile(file)
+    if err != nil {
+        tb.Fatal(err)
+    }
+    return NewInterpreter(compileProcedures(MustParseRules(string(b))))
+}
+
+// runProgram runs the query of a benchmark program, returning
+// the last argument of its first answer
+func runProgram(i *interpreter, query string, all bool) (string, stats, error) {
+    p, b := MustParseProcesses(query)
+    var first string
+    st, err := i.solve(proc(p[0].functor, p[0].arity()), p[0].args, state{sub: i.store(), vc: len(b)}, func(ans state) bool {
+        if first == "" {
+            first = walkstar(ans.sub, p[0].args[len(p[0].args)-1]).PrintExpression()
+        }
+        return all
+    })
+    return first, st, err
+}
+
+func TestBenchmarkPrograms(t *testing.T) {
+    for _, tt := range benchmarkPrograms {
+        for _, s := range stores {
+            i := loadProgram(t, tt.file)
+            i.setStore(s.store)
+            got, _, err := runProgram(i, tt.query, tt.all)
+            if err != nil {
+                t.Errorf("%s/%s: %v", tt.name, s.name, err)
+                continue
+            }
+            if got != tt.want {
+                t.Errorf("%s/%s: got %s want %s", tt.name, s.name, got, tt.want)
+            }
+        }
+    }
+}
+
+func benchmarkProgram(b *testing.B, name string) {
+    for _, tt := range benchmarkPrograms {
+        if tt.name != name {
+            continue
+        }
+        for _, s := range stores {
+            b.Run(s.name, func(b *testing.B) {
+                i := loadProgram(b, tt.file)
+                i.setStore(s.store)
+                var inferences, peak int
+                var before, after runtime.MemStats
+                runtime.ReadMemStats(&before)
+                b.ResetTimer()
+                for n := 0; n < b.N; n++ {
+                    _, st, err := runProgram(i, tt.query, tt.all)
+                    if err != nil {
+                        b.Fatal(err)
+                    }
+                    inferences += st.inferences
+                    peak = max(peak, st.peakBindings)
+                }
+                b.StopTimer()
+                runtime.ReadMemStats(&after)
+                b.ReportMetric(float64(inferences)/b.Elapsed().Seconds(), "LIPS")
+                b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(inferences), "allocs/inference")
+                b.ReportMetric(float64(peak), "peak-bindings")
+            })
+        }
+    }
+}
+
+func BenchmarkNrev(b *testing.B)   { benchmarkProgram(b, "nrev") }
+func BenchmarkQueens(b *testing.B) { benchmarkProgram(b, "queens") }
+func BenchmarkZebra(b *testing.B)  { benchmarkProgram(b, "zebra") }
+func BenchmarkCrypt(b *testing.B)  { benchmarkProgram(b, "crypt") }
+func BenchmarkTak(b *testing.B)    { benchmarkProgram(b, "tak") }
@@ -0,0 +1,611 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+)
+
+// a builtin is a deterministic procedure written in Go. It gets the
+// arguments of the call and either succeeds, after updating the bindings
+// of the machine, or fails. Errors are raised with m.throw.
+type builtin func(m *machine, args []expression) bool
+
+var builtins map[procEntry]builtin
+
+// a generator is a nondeterministic builtin. It answers with clauses,
+// which are then tried as if they were those of a procedure.
+type generator func(m *machine, args []expression) ([]clause, error)
+
+var generators map[procEntry]generator
+
+func init() {
+    builtins = map[procEntry]builtin{
+        proc("true", 0):  func(*machine, []expression) bool { return true },
+        proc("fail", 0):  func(*machine, []expression) bool { return false },
+        proc("false", 0): func(*machine, []expression) bool { return false },
+        proc("!", 0):     builtinCut,
+        proc("=", 2):     builtinUnify,
+        proc("\\=", 2):   builtinNotUnify,
+        proc("unify_with_occurs_check", 2): builtinUnifyWithOccursCheck,
+        proc("is", 2):    builtinIs,
+        proc("=:=", 2):   compareNumbers(func(a, b number) bool { return a == b }),
+        proc("=\\=", 2):  compareNumbers(func(a, b number) bool { return a != b }),
+        proc("<", 2):     compareNumbers(func(a, b number) bool { return a < b }),
+        proc(">", 2):     compareNumbers(func(a, b number) bool { return a > b }),
+        proc("=<", 2):    compareNumbers(func(a, b number) bool { return a <= b }),
+        proc(">=", 2):    compareNumbers(func(a, b number) bool { return a >= b }),
+        proc("listing", 1): builtinListing,
+        proc("$disassemble", 1): builtinDisassemble,
+        proc("qcompile", 1): builtinQcompile,
+        proc("functor", 3): builtinFunctor,
+        proc("arg", 3):     builtinArg,
+        proc("=..", 2):     builtinUniv,
+        proc("writeln", 1): builtinWriteln,
+        proc("assertz", 1): builtinAssertz,
+        proc("compile_clause", 2): builtinCompileClause,
+        proc("load_compiled", 1):  builtinLoadCompiled,
+        proc("$depth_limit_set", 2):   builtinDepthLimitSet,
+        proc("$depth_limit_exit", 4):  builtinDepthLimitExit,
+        proc("$depth_limit_redo", 1):  builtinDepthLimitRedo,
+        proc("$depth_limit_false", 3): builtinDepthLimitFalse,
+        proc("$time_limit_set", 1):    builtinTimeLimitSet,
+        proc("trace", 0):   builtinTrace,
+        proc("notrace", 0): builtinNotrace,
+        proc("spy", 1):     builtinSpy,
+        proc("nospy", 1):   builtinNospy,
+        proc("leash", 1):   builtinLeash,
+        proc("put_attr", 3): builtinPutAttr,
+        proc("get_attr", 3): builtinGetAttr,
+        proc("del_attr", 2): builtinDelAttr,
+        proc("dif", 2):      builtinDif,
+        proc("#=", 2):            builtinFDCompare("#="),
+        proc("#\\=", 2):          builtinFDCompare("#\\="),
+        proc("#<", 2):            builtinFDCompare("#<"),
+        proc("#>", 2):            builtinFDCompare("#>"),
+        proc("#=<", 2):           builtinFDCompare("#=<"),
+        proc("#>=", 2):           builtinFDCompare("#>="),
+        proc("in", 2):            builtinIn,
+        proc("ins", 2):           builtinIns,
+        proc("all_different", 1): builtinAllDifferent,
+        proc("all_distinct", 1):  builtinAllDistinct,
+        proc("sum", 3):           builtinSum,
+        proc("set_prolog_flag", 2): builtinSetPrologFlag,
+    }
+    generators = map[procEntry]generator{
+        proc("clause", 2): generateClause,
+        proc("call", 1):   generateCall,
+        proc("call", 2):   generateCallN,
+        proc("call", 3):   generateCallN,
+        proc("call", 4):   generateCallN,
+        proc("call", 5):   generateCallN,
+        proc("call", 6):   generateCallN,
+        proc("call", 7):   generateCallN,
+        proc("call", 8):   generateCallN,
+        proc(";", 2):      generateOr,
+        proc("->", 2):     generateIfThen,
+        proc("\\+", 1):    generateNot,
+        proc("phrase", 2): generatePhrase2,
+        proc("phrase", 3): generatePhrase3,
+        proc("call_with_depth_limit", 3): generateCallWithDepthLimit,
+        proc("call_with_time_limit", 2):  generateCallWithTimeLimit,
+        proc("$depth_limit_true", 4):     generateDepthLimitTrue,
+        proc("parallel", 1):              generateParallel,
+        proc("profile", 1):               generateProfile,
+        proc("freeze", 2):                generateFreeze,
+        proc("when", 2):                  generateWhen,
+        proc("$when", 3):                 generateWhenWoken,
+        proc("label", 1):                 generateLabel,
+        proc("labeling", 2):              generateLabeling,
+        proc(":", 2):                     generateQualified,
+        proc("current_prolog_flag", 2):   generateCurrentPrologFlag,
+        proc("current_atom", 1):          generateCurrentAtom,
+    }
+}
+
+var errInstantiation = errors.New("arguments are not sufficiently instantiated")
+
+func typeError(want string, e expression) error {
+    return fmt.Errorf("type error: %s expected, found %s", want, e.PrintExpression())
+}
+
+// throw aborts the query with err
+func (m *machine) throw(err error) bool {
+    m.err = err
+    return false
+}
+
+func (m *machine) unify(u, v expression) bool {
+    sub, ok := unify(m.state.sub, u, v)
+    if !ok {
+        return false
+    }
+    m.state.sub = sub
+    return true
+}
+
+func builtinCut(m *machine, args []expression) bool {
+    m.cut()
+    return true
+}
+
+// cut removes all choicepoints made since the clause we are in was called
+func (m *machine) cut() {
+    m.cutTo(m.cutB)
+}
+
+// cutTo drops the choices above height h
+func (m *machine) cutTo(h int) {
+    if m.par != nil {
+        for _, cp := range m.choices[h:] {
+            if cp.fork != nil {
+                cp.fork.cancelled.Store(true)
+            }
+        }
+    }
+    m.choices = m.choices[:h]
+}
+
+func builtinUnify(m *machine, args []expression) bool {
+    return m.unify(args[0], args[1])
+}
+
+func builtinNotUnify(m *machine, args []expression) bool {
+    // a trail keeps bindings from a failed unification, so undo them ourselves
+    mark := m.state.sub.mark(m.state.vc)
+    _, ok := unify(m.state.sub, args[0], args[1])
+    m.state.sub = m.state.sub.undo(mark, m.state.vc)
+    return !ok
+}
+
+func builtinUnifyWithOccursCheck(m *machine, args []expression) bool {
+    sub, ok := unifyWithOccursCheck(m.state.sub, args[0], args[1])
+    if !ok {
+        return false
+    }
+    m.state.sub = sub
+    return true
+}
+
+// lookupProcedures finds the procedures for a predicate indicator,
+// either Name/Arity or just Name for all arities, optionally M:
+func (m *machine) lookupProcedures(e expression) ([]procedure, error) {
+    e = walkstar(m.state.sub, e)
+    name, arity := e, expression(nil)
+    if p, ok := e.(process); ok && p.functor == "/" && p.arity() == 2 {
+        name, arity = p.args[0], p.args[1]
+    }
+    // M:Name/Arity reads as (M:Name)/Arity
+    module := ""
+    if p, ok := name.(process); ok && p.functor == ":" && p.arity() == 2 {
+        mod, ok := p.args[0].(symbol)
+        if !ok {
+            return nil, typeError("module", p.args[0])
+        }
+        module, name = moduleName(mod), p.args[1]
+    }
+    s, ok := name.(symbol)
+    if !ok {
+        return nil, typeError("predicate indicator", e)
+    }
+    if n, ok := arity.(number); ok {
+        p, ok := m.program.procedure(moduleProc(module, string(s), int(n)))
+        if !ok {
+            return nil, nil
+        }
+        return []procedure{p}, nil
+    }
+    if arity != nil {
+        return nil, typeError("predicate indicator", e)
+    }
+    procs := []procedure{}
+    m.program.eachProcedure(func(k procEntry, p procedure) {
+        if k.name == string(s) && k.module == module && p.from == "" {
+            procs = append(procs, p)
+        }
+    })
+    sort.Slice(procs, func(i, j int) bool { return procs[i].arity < procs[j].arity })
+    return procs, nil
+}
+
+func builtinListing(m *machine, args []expression) bool {
+    procs, err := m.lookupProcedures(args[0])
+    if err != nil {
+        return m.throw(err)
+    }
+    for _, p := range procs {
+        if err := p.listing(m.out); err != nil {
+            return m.throw(err)
+        }
+    }
+    return true
+}
+
+func builtinDisassemble(m *machine, args []expression) bool {
+    procs, err := m.lookupProcedures(args[0])
+    if err != nil {
+        return m.throw(err)
+    }
+    for _, p := range procs {
+        p.disassemble(m.out)
+    }
+    return true
+}
+
+// callable gets the procedure a goal would call, in module M for M:G
+func (m *machine) callable(e expression) (procEntry, error) {
+    module := ""
+    t := walk(m.state.sub, e)
+    for {
+        q, ok := t.(process)
+        if !ok || q.functor != ":" || q.arity() != 2 {
+            break
+        }
+        mod, err := m.atomArg(q.args[0])
+        if err != nil {
+            return procEntry{}, err
+        }
+        module, t = moduleName(symbol(mod)), walk(m.state.sub, q.args[1])
+    }
+    switch t := t.(type) {
+    case variable:
+        return procEntry{}, errInstantiation
+    case symbol:
+        return moduleProc(module, string(t), 0), nil
+    case process:
+        return moduleProc(module, t.functor, t.arity()), nil
+    default:
+        return procEntry{}, typeError("callable", t)
+    }
+}
+
+// clause(H, B) unifies with every clause of the procedure of H in turn,
+// using the decompiler to get the clauses back from their bytecode
+func generateClause(m *machine, args []expression) ([]clause, error) {
+    p, err := m.callable(args[0])
+    if err != nil {
+        return nil, err
+    }
+    pr, ok := m.program.procedure(p)
+    if !ok && isBuiltin(p.unqualified()) {
+        return nil, fmt.Errorf("permission error: cannot access private procedure %s", p.unqualified().printEntry())
+    }
+    rules, err := pr.decompile()
+    if err != nil {
+        return nil, err
+    }
+    // a qualified head comes back qualified, to unify with it
+    q, qualified := walk(m.state.sub, args[0]).(process)
+    qualified = qualified && q.functor == ":" && q.arity() == 2
+    clauses := []clause{}
+    for _, r := range rules {
+        head := goalTerm(r.head)
+        if qualified {
+            head = process{functor: ":", args: []expression{q.args[0], head}}
+        }
+        fact := rule{head: process{functor: "clause", args: []expression{head, r.bodyTerm()}}}
+        clauses = append(clauses, compileClause(fact))
+    }
+    return clauses, nil
+}
+
+// atomArg gets the name of an atom argument
+func (m *machine) atomArg(e expression) (string, error) {
+    switch t := walk(m.state.sub, e).(type) {
+    case variable:
+        return "", errInstantiation
+    case symbol:
+        return string(t), nil
+    default:
+        return "", typeError("atom", t)
+    }
+}
+
+// intArg gets the value of an integer argument
+func (m *machine) intArg(e expression) (int, error) {
+    switch t := walk(m.state.sub, e).(type) {
+    case variable:
+        return 0, errInstantiation
+    case number:
+        return int(t), nil
+    default:
+        return 0, typeError("integer", t)
+    }
+}
+
+func builtinQcompile(m *machine, args []expression) bool {
+    path, err := m.atomArg(args[0])
+    if err != nil {
+        return m.throw(err)
+    }
+    if _, err := qcompile(path); err != nil {
+        return m.throw(err)
+    }
+    return true
+}
+
+// call(G) is tried as the clause call(G) :- G, compiled on the spot.
+// Cut inside G only cuts G.
+func generateCall(m *machine, args []expression) ([]clause, error) {
+    if _, err := m.callable(args[0]); err != nil {
+        return nil, err
+    }
+    g := walkstar(m.state.sub, args[0])
+    body, err := toGoals(g)
+    if err != nil {
+        return nil, typeError("callable", g)
+    }
+    r := rule{head: process{functor: "call", args: []expression{g}}, body: body}
+    return []clause{compileClause(renumberVariables(r))}, nil
+}
+
+// A;B, C->T and \+G are compiled inline in clauses. Called as goals made
+// while running, such as by call/N, they are tried as the clause G :- G,
+// compiled on the spot like the one of call/1, so a cut in them only
+// cuts them.
+func generateOr(m *machine, args []expression) ([]clause, error) {
+    return m.controlClause(";", args)
+}
+
+func generateIfThen(m *machine, args []expression) ([]clause, error) {
+    return m.controlClause("->", args)
+}
+
+func generateNot(m *machine, args []expression) ([]clause, error) {
+    return m.controlClause("\\+", args)
+}
+
+func (m *machine) controlClause(name string, args []expression) ([]clause, error) {
+    head := process{functor: name}
+    for _, arg := range args {
+        if _, err := m.callable(arg); err != nil {
+            return nil, err
+        }
+        head.args = append(head.args, walkstar(m.state.sub, arg))
+    }
+    r := rule{head: head, body: []process{head}}
+    return []clause{compileClause(renumberVariables(r))}, nil
+}
+
+// ifThen gets C and T of C->T, which may be in a module
+func ifThen(e expression) (expression, expression, bool) {
+    switch t := e.(type) {
+    case process:
+        if t.functor == "->" && t.arity() == 2 {
+            return t.args[0], t.args[1], true
+        }
+        if t.functor == ":" && t.arity() == 2 {
+            c, then, ok := ifThen(t.args[1])
+            qualify := func(g expression) expression {
+                return process{functor: ":", args: []expression{t.args[0], g}}
+            }
+            return qualify(c), qualify(then), ok
+        }
+    }
+    return nil, nil, false
+}
+
+// call(G, Args...) calls G with Args added to its args
+func generateCallN(m *machine, args []expression) ([]clause, error) {
+    head := []expression{}
+    for _, arg := range args {
+        head = append(head, walkstar(m.state.sub, arg))
+    }
+    g, err := addArgs(head[0], head[1:]...)
+    if err != nil {
+        return nil, err
+    }
+    body, err := toGoals(g)
+    if err != nil {
+        return nil, typeError("callable", head[0])
+    }
+    r := rule{head: process{functor: "call", args: head}, body: body}
+    return []clause{compileClause(renumberVariables(r))}, nil
+}
+
+// fresh allocates a new variable
+func (m *machine) fresh() variable {
+    v := variable(m.state.vc)
+    m.state.vc++
+    return v
+}
+
+// compound builds Name(Args...), which is an atom without args
+func compound(name string, args []expression) expression {
+    if len(args) == 0 {
+        return symbol(name)
+    }
+    return makeCompound(name, args)
+}
+
+// functor(T, Name, Arity) takes a term apart or builds one with fresh args
+func builtinFunctor(m *machine, args []expression) bool {
+    switch t := walk(m.state.sub, args[0]).(type) {
+    case variable:
+        name, arity := walk(m.state.sub, args[1]), walk(m.state.sub, args[2])
+        n, ok := arity.(number)
+        switch {
+        case isVariable(name) || isVariable(arity):
+            return m.throw(errInstantiation)
+        case !ok:
+            return m.throw(typeError("integer", arity))
+        case n == 0:
+            if _, ok := name.(list); ok {
+                return m.throw(typeError("atomic", name))
+            }
+            if _, ok := name.(process); ok {
+                return m.throw(typeError("atomic", name))
+            }
+            return m.unify(t, name)
+        case n < 0:
+            return m.throw(fmt.Errorf("domain error: not_less_than_zero expected, found %d", n))
+        }
+        s, ok := name.(symbol)
+        if !ok {
+            return m.throw(typeError("atom", name))
+        }
+        fargs := make([]expression, n)
+        for i := range fargs {
+            fargs[i] = m.fresh()
+        }
+        return m.unify(t, compound(string(s), fargs))
+    case list:
+        return m.unify(args[1], symbol(listFunctor.name)) && m.unify(args[2], number(2))
+    case process:
+        return m.unify(args[1], symbol(t.functor)) && m.unify(args[2], number(t.arity()))
+    default:
+        return m.unify(args[1], t) && m.unify(args[2], number(0))
+    }
+}
+
+// arg(N, T, A) unifies A with the Nth argument of T, counting from 1
+func builtinArg(m *machine, args []expression) bool {
+    n, ok := walk(m.state.sub, args[0]).(number)
+    if !ok {
+        if isVariable(walk(m.state.sub, args[0])) {
+            return m.throw(errInstantiation)
+        }
+        return m.throw(typeError("integer", walk(m.state.sub, args[0])))
+    }
+    var targs []expression
+    switch t := walk(m.state.sub, args[1]).(type) {
+    case variable:
+        return m.throw(errInstantiation)
+    case list:
+        targs = []expression{t.head, t.tail}
+    case process:
+        targs = t.args
+    default:
+        return m.throw(typeError("compound", t))
+    }
+    if n < 1 || int(n) > len(targs) {
+        return false
+    }
+    return m.unify(args[2], targs[n-1])
+}
+
+// T =.. [Name|Args]
+func builtinUniv(m *machine, args []expression) bool {
+    switch t := walk(m.state.sub, args[0]).(type) {
+    case variable:
+        l := walkstar(m.state.sub, args[1])
+        elems, ok := listElements(l)
+        if !ok {
+            return m.throw(errInstantiation)
+        }
+        if len(elems) == 0 {
+            return m.throw(fmt.Errorf("domain error: non_empty_list expected, found %s", l.PrintExpression()))
+        }
+        if len(elems) == 1 {
+            return m.unify(t, elems[0])
+        }
+        s, ok := elems[0].(symbol)
+        if !ok {
+            return m.throw(typeError("atom", elems[0]))
+        }
+        return m.unify(t, makeCompound(string(s), elems[1:]))
+    case list:
+        return m.unify(args[1], makeList([]expression{symbol(listFunctor.name), t.head, t.tail}, emptylist))
+    case process:
+        return m.unify(args[1], makeList(append([]expression{symbol(t.functor)}, t.args...), emptylist))
+    default:
+        return m.unify(args[1], makeList([]expression{t}, emptylist))
+    }
+}
+
+func isVariable(e expression) bool {
+    _, ok := e.(variable)
+    return ok
+}
+
+func builtinWriteln(m *machine, args []expression) bool {
+    fmt.Fprintln(m.out, walkstar(m.state.sub, args[0]).PrintExpression())
+    return true
+}
+
+// assertz adds a clause at the end of its procedure. Calls already
+// made keep the clauses they started with.
+func builtinAssertz(m *machine, args []expression) bool {
+    t := walkstar(m.state.sub, args[0])
+    p, r, err := m.clauseRule(t)
+    if err != nil {
+        return m.throw(err)
+    }
+    if err := modifiable(p); err != nil {
+        return m.throw(err)
+    }
+    c := compileClause(renumberVariables(r))
+    if err := verifyClause(c, p.arity); err != nil {
+        return m.throw(err)
+    }
+    prog, _ := m.update(func(prog *Program) (*Program, error) {
+        return prog.assertz(p, c), nil
+    })
+    m.program = prog
+    return true
+}
+
+// modifiable checks that p is not a builtin
+func modifiable(p procEntry) error {
+    if isBuiltin(p) {
+        return fmt.Errorf("permission error: cannot modify static procedure %s", p.printEntry())
+    }
+    return nil
+}
+
+// clauseRule reads a clause term Head :- Body or Head, and gets the
+// procedure it is for. M:Clause is a clause of module M.
+func (m *machine) clauseRule(t expression) (procEntry, rule, error) {
+    if q, ok := t.(process); ok && q.functor == ":" && q.arity() == 2 {
+        if c, ok := q.args[1].(process); ok && c.functor == Turnstile && c.arity() == 2 {
+            t = process{functor: Turnstile, args: []expression{
+                process{functor: ":", args: []expression{q.args[0], c.args[0]}},
+                process{functor: ":", args: []expression{q.args[0], c.args[1]}},
+            }}
+        }
+    }
+    head := t
+    if p, ok := t.(process); ok && p.functor == Turnstile && p.arity() == 2 {
+        head = p.args[0]
+    }
+    if _, err := m.callable(head); err != nil {
+        return procEntry{}, rule{}, err
+    }
+    r, err := toRule(t)
+    if err != nil {
+        return procEntry{}, rule{}, typeError("callable", t)
+    }
+    pe, h := qualifiedHead("", r.head)
+    r.head = h
+    return pe, r, nil
+}
+
+// compile_clause(Clause, Compiled) gives the clause(XR, NVars, Codes)
+// term that the compiler makes of Clause
+func builtinCompileClause(m *machine, args []expression) bool {
+    _, r, err := m.clauseRule(walkstar(m.state.sub, args[0]))
+    if err != nil {
+        return m.throw(err)
+    }
+    return m.unify(args[1], compileClause(renumberVariables(r)).term())
+}
+
+// load_compiled(procedure(Name/Arity, Clauses)) assembles the clauses
+// and installs them, replacing the procedure
+func builtinLoadCompiled(m *machine, args []expression) bool {
+    p, err := assembleProcedure(walkstar(m.state.sub, args[0]))
+    if err != nil {
+        return m.throw(err)
+    }
+    if err := modifiable(p.entry()); err != nil {
+        return m.throw(err)
+    }
+    prog, err := m.update(func(prog *Program) (*Program, error) {
+        return prog.install(p)
+    })
+    if err != nil {
+        return m.throw(err)
+    }
+    m.program = prog
+    return true
+}
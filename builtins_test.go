@@ -0,0 +1,187 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// answers runs a query and prints the named variables of each answer
+func answers(i *interpreter, query string, vars ...string) ([]string, error) {
+    p, b := MustParseProcesses(query)
+    got := []string{}
+    _, err := i.solve(proc(p[0].functor, p[0].arity()), p[0].args, state{sub: i.store(), vc: len(b)}, func(st state) bool {
+        s := []string{}
+        for _, v := range vars {
+            s = append(s, walkstar(st.sub, b[v]).PrintExpression())
+        }
+        got = append(got, strings.Join(s, " "))
+        return true
+    })
+    return got, err
+}
+
+func TestTermBuiltins(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(`
+    twice(X) :- call(X), call(X).
+    first(X, L) :- call((member(X, L), !)).
+    q(1).
+    q(2).
+    ite(X) :- member(X, [1, 2, 3]), (X >= 2 -> ! ; true).
+    or(X) :- member(X, [1, 2, 3]), (X >= 2, ! ; true).
+    not(X) :- member(X, [1, 2]), \+ (!, fail).
+    cond(X) :- member(X, [1, 2, 3]), ((!, X > 1) -> true ; true).`)))
+    for n, tt := range []struct{
+        query string
+        vars  []string
+        want  []string
+        err   bool
+    }{
+        {query: "functor(f(a, b), N, A)", vars: []string{"N", "A"}, want: []string{"f 2"}},
+        {query: "functor([a], N, A)", vars: []string{"N", "A"}, want: []string{". 2"}},
+        {query: "functor(foo, N, A)", vars: []string{"N", "A"}, want: []string{"foo 0"}},
+        {query: "functor(3, N, A)", vars: []string{"N", "A"}, want: []string{"3 0"}},
+        {query: "functor(T, vars, 0)", vars: []string{"T"}, want: []string{"vars"}},
+        {query: "call((functor(T, vars, 2), T = vars(a, b)))", vars: []string{"T"}, want: []string{"vars(a,b)"}},
+        {query: "call((functor(T, '.', 2), T = [a]))", vars: []string{"T"}, want: []string{"[a]"}},
+        {query: "functor(T, N, 2)", err: true},
+        {query: "functor(T, f(a), 1)", err: true},
+        {query: "arg(2, f(a, b), X)", vars: []string{"X"}, want: []string{"b"}},
+        {query: "arg(2, [a, b], X)", vars: []string{"X"}, want: []string{"[b]"}},
+        {query: "arg(3, f(a, b), X)", want: []string{}},
+        {query: "arg(N, f(a), X)", err: true},
+        {query: "arg(1, foo, X)", err: true},
+        {query: "f(a, B) =.. L", vars: []string{"L"}, want: []string{"[f,a,v#0]"}},
+        {query: "[a] =.. L", vars: []string{"L"}, want: []string{"[.,a,nil]"}},
+        {query: "foo =.. L", vars: []string{"L"}, want: []string{"[foo]"}},
+        {query: "T =.. [g, 1, 2]", vars: []string{"T"}, want: []string{"g(1,2)"}},
+        {query: "T =.. [7]", vars: []string{"T"}, want: []string{"7"}},
+        {query: "T =.. [F, 1]", err: true},
+        {query: "member(X, [a, b, c])", vars: []string{"X"}, want: []string{"a", "b", "c"}},
+        {query: "call(q(X))", vars: []string{"X"}, want: []string{"1", "2"}},
+        {query: "twice(q(X))", vars: []string{"X"}, want: []string{"1", "2"}},
+        {query: "first(X, [a, b, c])", vars: []string{"X"}, want: []string{"a"}},
+        {query: "call((q(X), X > 1))", vars: []string{"X"}, want: []string{"2"}},
+        {query: "(X = a ; X = b)", vars: []string{"X"}, want: []string{"a", "b"}},
+        {query: "(q(X) -> Y = yes ; Y = no)", vars: []string{"X", "Y"}, want: []string{"1 yes"}},
+        {query: "(q(3) -> Y = yes ; Y = no)", vars: []string{"Y"}, want: []string{"no"}},
+        {query: "(q(X) -> true)", vars: []string{"X"}, want: []string{"1"}},
+        {query: "(q(3) -> true)", want: []string{}},
+        {query: "\\+ q(3)", want: []string{""}},
+        {query: "\\+ q(X)", want: []string{}},
+        {query: "call((\\+ X = 1, true ; X = 2))", vars: []string{"X"}, want: []string{"2"}},
+        // a cut in a branch cuts the clause, one in a condition only that
+        {query: "ite(X)", vars: []string{"X"}, want: []string{"1", "2"}},
+        {query: "or(X)", vars: []string{"X"}, want: []string{"1", "2"}},
+        {query: "not(X)", vars: []string{"X"}, want: []string{"1", "2"}},
+        {query: "cond(X)", vars: []string{"X"}, want: []string{"1", "2", "3"}},
+        {query: "call(;, (X = 1, !), X = 2)", vars: []string{"X"}, want: []string{"1"}},
+        {query: "(X ; true)", err: true},
+        {query: "call(X)", err: true},
+        {query: "call(1)", err: true},
+    }{
+        got, err := answers(i, tt.query, tt.vars...)
+        if (err != nil) != tt.err {
+            t.Errorf("%d: %s: unexpected error %v", n, tt.query, err)
+            continue
+        }
+        if !tt.err && !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%d: %s: got %v want %v", n, tt.query, got, tt.want)
+        }
+    }
+}
+
+func TestAssertz(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(`
+    add(X) :- assertz(p(X)).
+    copy :- p(X), Y is X * 10, assertz(p(Y)), fail.
+    copy.`)))
+    mustInterpret(t, i, "add(1)")
+    mustInterpret(t, i, "add(2)")
+    mustInterpret(t, i, "assertz((double(X, Y) :- p(X), Y is 2 * X))")
+    // copy sees the clauses p had when it was called, not the ones it adds
+    mustInterpret(t, i, "copy")
+    got, err := answers(i, "p(X)", "X")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := []string{"1", "2", "10", "20"}; !reflect.DeepEqual(got, want) {
+        t.Errorf("got %v want %v", got, want)
+    }
+    got, err = answers(i, "double(X, Y)", "Y")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := []string{"2", "4", "20", "40"}; !reflect.DeepEqual(got, want) {
+        t.Errorf("got %v want %v", got, want)
+    }
+    for _, q := range []string{"assertz(X)", "assertz(3)", "assertz((X :- true))", "assertz(true)"} {
+        if _, err := answers(i, q); err == nil {
+            t.Errorf("%s: expected error", q)
+        }
+    }
+}
+
+func TestBowen(t *testing.T) {
+    procs, err := loadFile("bowen.pl")
+    if err != nil {
+        t.Fatal(err)
+    }
+    i := NewInterpreter(procs)
+    var sb strings.Builder
+    i.setOutput(&sb)
+    if got := mustInterpret(t, i, "run"); len(got) != 1 {
+        t.Errorf("got %d answers want 1", len(got))
+    }
+    if got, want := sb.String(), "cons(a,cons(b,cons(c,nil)))\n"; got != want {
+        t.Errorf("got %q want %q", got, want)
+    }
+}
+
+func TestCompileClause(t *testing.T) {
+    i := NewInterpreter(nil)
+    got, err := answers(i, "compile_clause((append(cons(X, L1), L2, cons(X, L3)) :- append(L1, L2, L3)), C)", "C")
+    if err != nil {
+        t.Fatal(err)
+    }
+    // as in bowen.pl
+    want := "clause(xrtable(cons/2,procedure(append/3)),4,[functor,1,var,1,var,2,pop,var,3,functor,1,var,1,var,4,pop,enter,var,2,var,3,var,4,call,2,exit])"
+    if len(got) != 1 || got[0] != want {
+        t.Errorf("got %v want %s", got, want)
+    }
+    got, err = answers(i, "compile_clause(p, C)", "C")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := "clause(xrtable,0,[exit])"; len(got) != 1 || got[0] != want {
+        t.Errorf("got %v want %s", got, want)
+    }
+    if _, err := answers(i, "compile_clause(X, C)"); err == nil {
+        t.Error("expected error compiling a variable")
+    }
+}
+
+func TestLoadCompiled(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(`
+    compile_all(Name/Arity, Clauses) :- compile_each(Clauses, Compiled), load_compiled(procedure(Name/Arity, Compiled)).
+    compile_each([], []).
+    compile_each([C|Cs], [B|Bs]) :- compile_clause(C, B), compile_each(Cs, Bs).`)))
+    mustInterpret(t, i, "compile_all(app/3, [app([], L, L), (app([X|A], B, [X|C]) :- app(A, B, C))])")
+    got, err := answers(i, "app(X, Y, [1, 2])", "X", "Y")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := []string{"nil [1,2]", "[1] [2]", "[1,2] nil"}; !reflect.DeepEqual(got, want) {
+        t.Errorf("got %v want %v", got, want)
+    }
+    for _, q := range []string{
+        "load_compiled(procedure(p/1, [clause(xrtable, 0, [exit])]))",
+        "load_compiled(procedure(p/0, [clause(xrtable, 0, [var, 1, exit])]))",
+        "load_compiled(procedure(true/0, [clause(xrtable, 0, [exit])]))",
+        "load_compiled(foo)",
+    } {
+        if _, err := answers(i, q); err == nil {
+            t.Errorf("%s: expected error", q)
+        }
+    }
+}
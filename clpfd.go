@@ -0,0 +1,1368 @@
+package main
+
+import (
+    "cmp"
+    "fmt"
+    "slices"
+    "sort"
+    "strings"
+)
+
+// CLP(FD): constraints over integers. A constrained variable has a clpfd
+// attribute with its domain and the propagators it is in. Propagators
+// narrow domains until nothing changes; a variable left with one value
+// is bound to it. Backtracking restores domains like any other binding.
+
+// integers this far from zero count as inf and sup, so bounds can be
+// added and multiplied without overflowing
+const fdSup = int64(1) << 60
+
+// a domain is a set of integers: all of lo..hi, or the runs of values
+// of lo..hi it lists
+type domain struct {
+    lo, hi int64
+    runs   []span // nil when all of lo..hi is in it; else in order, apart
+}
+
+// a span is the values lo..hi
+type span struct {
+    lo, hi int64
+}
+
+var (
+    fullDomain  = domain{lo: -fdSup, hi: fdSup}
+    emptyDomain = domain{lo: 1, hi: 0}
+)
+
+func interval(lo, hi int64) domain {
+    return domain{lo: clampFD(lo), hi: clampFD(hi)}
+}
+
+// fromSpans makes the domain of spans in order, merging those that meet
+func fromSpans(spans []span) domain {
+    out := []span{}
+    for _, s := range spans {
+        if s.lo > s.hi {
+            continue
+        }
+        if n := len(out); n > 0 && s.lo <= out[n-1].hi+1 {
+            out[n-1].hi = max(out[n-1].hi, s.hi)
+            continue
+        }
+        out = append(out, s)
+    }
+    switch len(out) {
+    case 0:
+        return emptyDomain
+    case 1:
+        return domain{lo: out[0].lo, hi: out[0].hi}
+    }
+    return domain{lo: out[0].lo, hi: out[len(out)-1].hi, runs: out}
+}
+
+// spans are the runs of d, in order
+func (d domain) spans() []span {
+    switch {
+    case d.empty():
+        return nil
+    case d.runs == nil:
+        return []span{{d.lo, d.hi}}
+    }
+    return d.runs
+}
+
+func (d domain) empty() bool {
+    return d.lo > d.hi
+}
+
+func (d domain) finite() bool {
+    return d.lo > -fdSup && d.hi < fdSup
+}
+
+func (d domain) contains(v int64) bool {
+    if v < d.lo || v > d.hi {
+        return false
+    }
+    if d.runs == nil {
+        return true
+    }
+    i := sort.Search(len(d.runs), func(i int) bool { return d.runs[i].hi >= v })
+    return d.runs[i].lo <= v
+}
+
+// fixed reports the value of a domain with just one
+func (d domain) fixed() (int64, bool) {
+    return d.lo, d.lo == d.hi
+}
+
+func (d domain) size() int64 {
+    switch {
+    case d.empty():
+        return 0
+    case !d.finite():
+        return fdSup
+    }
+    n := int64(0)
+    for _, s := range d.spans() {
+        n += s.hi - s.lo + 1
+    }
+    return n
+}
+
+func (d domain) equal(o domain) bool {
+    return d.lo == o.lo && d.hi == o.hi && slices.Equal(d.runs, o.runs)
+}
+
+func (d domain) withBounds(lo, hi int64) domain {
+    lo, hi = max(d.lo, lo), min(d.hi, hi)
+    switch {
+    case lo > hi:
+        return emptyDomain
+    case d.runs == nil:
+        return domain{lo: lo, hi: hi}
+    }
+    return d.intersect(domain{lo: lo, hi: hi})
+}
+
+func (d domain) intersect(o domain) domain {
+    if d.runs == nil && o.runs == nil {
+        return d.withBounds(o.lo, o.hi)
+    }
+    a, b := d.spans(), o.spans()
+    out := []span{}
+    for len(a) > 0 && len(b) > 0 {
+        if lo, hi := max(a[0].lo, b[0].lo), min(a[0].hi, b[0].hi); lo <= hi {
+            out = append(out, span{lo, hi})
+        }
+        if a[0].hi < b[0].hi {
+            a = a[1:]
+        } else {
+            b = b[1:]
+        }
+    }
+    return fromSpans(out)
+}
+
+// remove takes v out of d
+func (d domain) remove(v int64) domain {
+    if !d.contains(v) {
+        return d
+    }
+    out := []span{}
+    for _, s := range d.spans() {
+        if s.lo <= v && v <= s.hi {
+            out = append(out, span{s.lo, v - 1}, span{v + 1, s.hi})
+            continue
+        }
+        out = append(out, s)
+    }
+    return fromSpans(out)
+}
+
+func (d domain) union(o domain) domain {
+    spans := append(slices.Clone(d.spans()), o.spans()...)
+    slices.SortFunc(spans, func(a, b span) int { return cmp.Compare(a.lo, b.lo) })
+    return fromSpans(spans)
+}
+
+// values calls yield with the values of a finite domain, from low to
+// high, until it returns false
+func (d domain) values(yield func(int64) bool) {
+    for _, s := range d.spans() {
+        for v := s.lo; v <= s.hi; v++ {
+            if !yield(v) {
+                return
+            }
+        }
+    }
+}
+
+// term is the domain as in/2 takes it: runs of values joined by \/
+func (d domain) term() expression {
+    if d.empty() {
+        return process{functor: "..", args: []expression{number(1), number(0)}}
+    }
+    var out expression
+    for _, s := range d.spans() {
+        var t expression = number(s.lo)
+        if s.lo != s.hi {
+            t = process{functor: "..", args: []expression{boundTerm(s.lo), boundTerm(s.hi)}}
+        }
+        if out == nil {
+            out = t
+            continue
+        }
+        out = process{functor: "\\/", args: []expression{out, t}}
+    }
+    return out
+}
+
+func boundTerm(b int64) expression {
+    switch {
+    case b <= -fdSup:
+        return symbol("inf")
+    case b >= fdSup:
+        return symbol("sup")
+    }
+    return number(b)
+}
+
+func clampFD(n int64) int64 {
+    return max(-fdSup, min(fdSup, n))
+}
+
+// saturating arithmetic on bounds: anything beyond inf or sup stays there
+func addFD(a, b int64) int64 {
+    return clampFD(a + b)
+}
+
+func mulFD(a, b int64) int64 {
+    if a == 0 || b == 0 {
+        return 0
+    }
+    if abs(a) >= fdSup/abs(b) {
+        if (a < 0) != (b < 0) {
+            return -fdSup
+        }
+        return fdSup
+    }
+    return clampFD(a * b)
+}
+
+func abs(a int64) int64 {
+    if a < 0 {
+        return -a
+    }
+    return a
+}
+
+// floorDiv and ceilDiv divide a bound by a nonzero constant
+func floorDiv(a, b int64) int64 {
+    if abs(a) >= fdSup {
+        return mulFD(a, b/abs(b))
+    }
+    q := a / b
+    if (a%b != 0) && ((a < 0) != (b < 0)) {
+        q--
+    }
+    return q
+}
+
+func ceilDiv(a, b int64) int64 {
+    if abs(a) >= fdSup {
+        return mulFD(a, b/abs(b))
+    }
+    q := a / b
+    if (a%b != 0) && ((a < 0) == (b < 0)) {
+        q++
+    }
+    return q
+}
+
+// fdVar is the clpfd attribute of a variable
+type fdVar struct {
+    dom   domain
+    props []*propagator
+}
+
+func (f fdVar) PrintExpression() string {
+    return f.dom.term().PrintExpression()
+}
+
+// fdVar gets the clpfd attribute of v; without one v can be anything
+func (m *machine) fdVar(v variable) (fdVar, bool) {
+    return fdVarIn(m.state.sub, v)
+}
+
+func fdVarIn(sub bindings, v variable) (fdVar, bool) {
+    a, ok := getAttr(sub, v, "clpfd")
+    if !ok {
+        return fdVar{dom: fullDomain}, false
+    }
+    return a.(fdVar), true
+}
+
+// fdDom is the domain of an integer or variable; other terms have none
+func fdDom(sub bindings, e expression) domain {
+    switch t := walk(sub, e).(type) {
+    case number:
+        return interval(int64(t), int64(t))
+    case variable:
+        f, _ := fdVarIn(sub, t)
+        return f.dom
+    }
+    return emptyDomain
+}
+
+// a propagator narrows the domains of its variables to what its
+// constraint allows, failing if that leaves nothing
+type propagator struct {
+    goal     expression   // the constraint it is for, for residual goals
+    vars     []expression // the variables it narrows
+    run      func(s *fdSolver) bool
+    entailed func(sub bindings) bool // whether the domains make it hold whatever the values
+}
+
+// residual reports whether the constraint still says something the
+// domains of its variables do not
+func (p *propagator) residual(sub bindings) bool {
+    return !p.entailed(sub)
+}
+
+// allFixed is entailment for propagators that only narrow bounds: once
+// every variable has its value, they have checked it
+func allFixed(vars []expression) func(bindings) bool {
+    return func(sub bindings) bool {
+        for _, x := range vars {
+            if _, ok := fdDom(sub, x).fixed(); !ok {
+                return false
+            }
+        }
+        return true
+    }
+}
+
+// an fdSolver runs propagators until none of them narrows anything
+type fdSolver struct {
+    m      *machine
+    queue  []*propagator
+    queued map[*propagator]bool
+    fixed  []variable // left with one value, to be bound once done
+    steps  int
+}
+
+func (m *machine) fdSolver() *fdSolver {
+    return &fdSolver{m: m, queued: map[*propagator]bool{}}
+}
+
+func (s *fdSolver) enqueue(p *propagator) {
+    if !s.queued[p] {
+        s.queued[p] = true
+        s.queue = append(s.queue, p)
+    }
+}
+
+// dom is the domain of an integer or variable; other terms have none
+func (s *fdSolver) dom(e expression) domain {
+    return fdDom(s.m.state.sub, e)
+}
+
+// narrow intersects the domain of e with d, waking the propagators of
+// e if that changes it
+func (s *fdSolver) narrow(e expression, d domain) bool {
+    switch t := walk(s.m.state.sub, e).(type) {
+    case number:
+        return d.contains(int64(t))
+    case variable:
+        f, _ := s.m.fdVar(t)
+        nd := f.dom.intersect(d)
+        if nd.empty() {
+            return false
+        }
+        if nd.equal(f.dom) {
+            if _, ok := s.m.getAttr(t, "clpfd"); !ok {
+                s.m.putAttr(t, "clpfd", f)
+            }
+            return true
+        }
+        f.dom = nd
+        s.m.putAttr(t, "clpfd", f)
+        for _, p := range f.props {
+            s.enqueue(p)
+        }
+        if _, ok := nd.fixed(); ok {
+            s.fixed = append(s.fixed, t)
+        }
+        return true
+    }
+    return false
+}
+
+func (s *fdSolver) bounds(e expression, lo, hi int64) bool {
+    return s.narrow(e, interval(lo, hi))
+}
+
+// run propagates to a fixpoint, then binds the variables left with one value
+func (s *fdSolver) run() bool {
+    for len(s.queue) > 0 {
+        p := s.queue[0]
+        s.queue = s.queue[1:]
+        delete(s.queued, p)
+        if !p.run(s) {
+            return false
+        }
+        // bounds can creep up one at a time for a long while
+        s.steps++
+        if s.steps%checkInterval == 0 && s.m.ctx != nil && s.m.ctx.Err() != nil {
+            return s.m.throw(s.m.ctx.Err())
+        }
+    }
+    for _, v := range s.fixed {
+        x, ok := walk(s.m.state.sub, v).(variable)
+        if !ok {
+            continue
+        }
+        f, _ := s.m.fdVar(x)
+        n, _ := f.dom.fixed()
+        if !s.m.fdBind(x, n) {
+            return false
+        }
+    }
+    return true
+}
+
+// fdBind binds v to n. Its propagators have seen n already, so only
+// other attributes are woken.
+func (m *machine) fdBind(v variable, n int64) bool {
+    e, _ := m.state.sub.get(v)
+    a, _ := e.(attributes)
+    out := attributes{}
+    for _, at := range a {
+        if at.module != "clpfd" {
+            out = append(out, at)
+        }
+    }
+    m.state.sub = m.state.sub.put(v, out)
+    return m.unify(v, number(n))
+}
+
+// fdPost adds the propagators of a new constraint and propagates
+func (m *machine) fdPost(props []*propagator) bool {
+    s := m.fdSolver()
+    for _, p := range props {
+        for _, x := range p.vars {
+            if v, ok := walk(m.state.sub, x).(variable); ok {
+                f, _ := m.fdVar(v)
+                f.props = append(f.props[:len(f.props):len(f.props)], p)
+                m.putAttr(v, "clpfd", f)
+            }
+        }
+        s.enqueue(p)
+    }
+    return s.run()
+}
+
+// fdHook runs when a constrained variable is bound: to an integer in its
+// domain, or to another variable, which then gets the intersection of
+// both domains and the propagators of both
+func fdHook(m *machine, value, other expression) []process {
+    f := value.(fdVar)
+    s := m.fdSolver()
+    for _, p := range f.props {
+        s.enqueue(p)
+    }
+    ok := false
+    switch t := walk(m.state.sub, other).(type) {
+    case number:
+        ok = f.dom.contains(int64(t))
+    case variable:
+        g, _ := m.fdVar(t)
+        g.props = append(g.props[:len(g.props):len(g.props)], f.props...)
+        m.putAttr(t, "clpfd", g)
+        ok = s.narrow(t, f.dom)
+    }
+    if ok && s.run() {
+        return nil
+    }
+    return []process{{functor: "fail"}}
+}
+
+// a linear expression is the sum of its terms plus k
+type linear struct {
+    terms []fdTerm
+    k     int64
+}
+
+type fdTerm struct {
+    c int64
+    x variable
+}
+
+func (l linear) scale(c int64) linear {
+    out := linear{k: mulFD(l.k, c)}
+    for _, t := range l.terms {
+        out.terms = append(out.terms, fdTerm{c: mulFD(t.c, c), x: t.x})
+    }
+    return out
+}
+
+// plus adds two linear expressions, with one term per variable
+func (l linear) plus(o linear) linear {
+    out := linear{k: addFD(l.k, o.k)}
+    for _, t := range append(l.terms[:len(l.terms):len(l.terms)], o.terms...) {
+        found := false
+        for i := range out.terms {
+            if out.terms[i].x == t.x {
+                out.terms[i].c = addFD(out.terms[i].c, t.c)
+                found = true
+            }
+        }
+        if !found {
+            out.terms = append(out.terms, t)
+        }
+    }
+    terms := out.terms[:0]
+    for _, t := range out.terms {
+        if t.c != 0 {
+            terms = append(terms, t)
+        }
+    }
+    out.terms = terms
+    return out
+}
+
+func (l linear) vars() []expression {
+    out := []expression{}
+    for _, t := range l.terms {
+        out = append(out, t.x)
+    }
+    return out
+}
+
+// an fdBuilder collects the propagators a constraint is posted as. Products
+// of variables need one of their own, with a variable for the product.
+type fdBuilder struct {
+    m     *machine
+    goal  expression
+    props []*propagator
+}
+
+func (b *fdBuilder) linearize(e expression) (linear, error) {
+    switch t := walk(b.m.state.sub, e).(type) {
+    case number:
+        return linear{k: clampFD(int64(t))}, nil
+    case variable:
+        return linear{terms: []fdTerm{{c: 1, x: t}}}, nil
+    case process:
+        args := make([]linear, len(t.args))
+        for i, arg := range t.args {
+            l, err := b.linearize(arg)
+            if err != nil {
+                return linear{}, err
+            }
+            args[i] = l
+        }
+        switch {
+        case t.functor == "+" && t.arity() == 2:
+            return args[0].plus(args[1]), nil
+        case t.functor == "-" && t.arity() == 2:
+            return args[0].plus(args[1].scale(-1)), nil
+        case t.functor == "-" && t.arity() == 1:
+            return args[0].scale(-1), nil
+        case t.functor == "+" && t.arity() == 1:
+            return args[0], nil
+        case t.functor == "*" && t.arity() == 2:
+            switch {
+            case len(args[0].terms) == 0:
+                return args[1].scale(args[0].k), nil
+            case len(args[1].terms) == 0:
+                return args[0].scale(args[1].k), nil
+            }
+            x, y, z := b.variable(args[0]), b.variable(args[1]), b.m.fresh()
+            b.times(x, y, z)
+            return linear{terms: []fdTerm{{c: 1, x: z}}}, nil
+        case t.functor == "abs" && t.arity() == 1:
+            return b.function(t.functor, args)
+        case (t.functor == "min" || t.functor == "max" || t.functor == "mod" || t.functor == "//") && t.arity() == 2:
+            return b.function(t.functor, args)
+        }
+    }
+    return linear{}, typeError("clpfd expression", walkstar(b.m.state.sub, e))
+}
+
+// variable is a variable equal to l
+func (b *fdBuilder) variable(l linear) variable {
+    if len(l.terms) == 1 && l.terms[0].c == 1 && l.k == 0 {
+        return l.terms[0].x
+    }
+    v := b.m.fresh()
+    b.linear(l.plus(linear{terms: []fdTerm{{c: -1, x: v}}}), "#=")
+    return v
+}
+
+// linear adds the propagator for l op 0, op being #=, #\= or #=<
+func (b *fdBuilder) linear(l linear, op string) {
+    p := &propagator{goal: b.goal, vars: l.vars()}
+    switch op {
+    case "#=":
+        neg := l.scale(-1)
+        p.run = func(s *fdSolver) bool { return s.linearLE(l) && s.linearLE(neg) }
+        p.entailed = func(sub bindings) bool {
+            lo, hi := l.bounds(sub)
+            return lo == 0 && hi == 0
+        }
+    case "#\\=":
+        p.run = func(s *fdSolver) bool { return s.linearNE(l) }
+        p.entailed = l.neEntailed
+    default:
+        p.run = func(s *fdSolver) bool { return s.linearLE(l) }
+        p.entailed = func(sub bindings) bool {
+            _, hi := l.bounds(sub)
+            return hi <= 0
+        }
+    }
+    b.props = append(b.props, p)
+}
+
+// bounds are the least and the most l can be
+func (l linear) bounds(sub bindings) (int64, int64) {
+    lo, hi := l.k, l.k
+    for _, t := range l.terms {
+        d := fdDom(sub, t.x)
+        a, b := mulFD(t.c, d.lo), mulFD(t.c, d.hi)
+        lo, hi = addFD(lo, min(a, b)), addFD(hi, max(a, b))
+    }
+    return lo, hi
+}
+
+// neEntailed reports whether l cannot be 0. With one variable left, the
+// value it cannot have may be a hole in its domain.
+func (l linear) neEntailed(sub bindings) bool {
+    if lo, hi := l.bounds(sub); lo > 0 || hi < 0 {
+        return true
+    }
+    rest, last := l.k, -1
+    for i, t := range l.terms {
+        n, ok := fdDom(sub, t.x).fixed()
+        if !ok {
+            if last >= 0 {
+                return false
+            }
+            last = i
+            continue
+        }
+        rest = addFD(rest, mulFD(t.c, n))
+    }
+    if last < 0 {
+        return rest != 0
+    }
+    t := l.terms[last]
+    return rest%t.c != 0 || !fdDom(sub, t.x).contains(-rest/t.c)
+}
+
+// linearLE narrows the bounds of the terms of l so that l =< 0 can hold:
+// every term is at most minus the least the others can add up to
+func (s *fdSolver) linearLE(l linear) bool {
+    mins := make([]int64, len(l.terms))
+    total, infinite := l.k, 0
+    for i, t := range l.terms {
+        d := s.dom(t.x)
+        if d.empty() {
+            return false
+        }
+        mins[i] = mulFD(t.c, d.lo)
+        if t.c < 0 {
+            mins[i] = mulFD(t.c, d.hi)
+        }
+        if abs(mins[i]) >= fdSup {
+            infinite++
+            continue
+        }
+        total = addFD(total, mins[i])
+    }
+    if infinite == 0 && total > 0 {
+        return false
+    }
+    for i, t := range l.terms {
+        rest := total
+        switch {
+        case abs(mins[i]) >= fdSup && infinite > 1:
+            continue
+        case abs(mins[i]) < fdSup && infinite > 0:
+            continue
+        case abs(mins[i]) < fdSup:
+            rest = addFD(total, -mins[i])
+        }
+        // c*x =< -rest
+        if t.c > 0 {
+            if !s.bounds(t.x, -fdSup, floorDiv(-rest, t.c)) {
+                return false
+            }
+            continue
+        }
+        if !s.bounds(t.x, ceilDiv(-rest, t.c), fdSup) {
+            return false
+        }
+    }
+    return true
+}
+
+// linearNE takes out the one value the last variable of l cannot have
+func (s *fdSolver) linearNE(l linear) bool {
+    rest, last := l.k, -1
+    for i, t := range l.terms {
+        n, ok := s.dom(t.x).fixed()
+        if !ok {
+            if last >= 0 {
+                return true
+            }
+            last = i
+            continue
+        }
+        rest = addFD(rest, mulFD(t.c, n))
+    }
+    if last < 0 {
+        return rest != 0
+    }
+    t := l.terms[last]
+    if rest%t.c != 0 {
+        return true
+    }
+    x := t.x
+    return s.narrow(x, s.dom(x).remove(-rest/t.c))
+}
+
+// times adds the propagator for x*y = z, on bounds
+func (b *fdBuilder) times(x, y, z variable) {
+    p := &propagator{goal: b.goal, vars: []expression{x, y, z}}
+    p.entailed = allFixed(p.vars)
+    p.run = func(s *fdSolver) bool {
+        dx, dy := s.dom(x), s.dom(y)
+        products := []int64{mulFD(dx.lo, dy.lo), mulFD(dx.lo, dy.hi), mulFD(dx.hi, dy.lo), mulFD(dx.hi, dy.hi)}
+        if !s.bounds(z, min(products[0], products[1], products[2], products[3]), max(products[0], products[1], products[2], products[3])) {
+            return false
+        }
+        return s.quotient(x, y, z) && s.quotient(y, x, z)
+    }
+    b.props = append(b.props, p)
+}
+
+// quotient narrows x to z/y once y is known
+func (s *fdSolver) quotient(x, y, z variable) bool {
+    n, ok := s.dom(y).fixed()
+    if !ok || n == 0 {
+        return true
+    }
+    dz := s.dom(z)
+    lo, hi := ceilDiv(dz.lo, n), floorDiv(dz.hi, n)
+    if n < 0 {
+        lo, hi = ceilDiv(dz.hi, n), floorDiv(dz.lo, n)
+    }
+    return s.bounds(x, lo, hi)
+}
+
+// function adds the propagator for z = f(args), f being abs, min, max,
+// mod or //, and gives z. Constants are worked out right away.
+func (b *fdBuilder) function(f string, args []linear) (linear, error) {
+    constant := true
+    for _, a := range args {
+        constant = constant && len(a.terms) == 0
+    }
+    if constant {
+        var n number
+        var err error
+        if len(args) == 1 {
+            n, err = evalUnary(process{functor: f}, number(args[0].k))
+        } else {
+            n, err = evalBinary(process{functor: f}, number(args[0].k), number(args[1].k))
+        }
+        return linear{k: clampFD(int64(n))}, err
+    }
+    vars := []expression{}
+    for _, a := range args {
+        vars = append(vars, b.variable(a))
+    }
+    z := b.m.fresh()
+    vars = append(vars, z)
+    run := fdFunctions[f]
+    b.props = append(b.props, &propagator{
+        goal:     b.goal,
+        vars:     vars,
+        run:      func(s *fdSolver) bool { return run(s, vars) },
+        entailed: allFixed(vars),
+    })
+    return linear{terms: []fdTerm{{c: 1, x: z}}}, nil
+}
+
+// the propagators for z = f(x) and z = f(x, y), given x, z or x, y, z.
+// They only narrow bounds.
+var fdFunctions = map[string]func(s *fdSolver, v []expression) bool{
+    "abs": fdAbs,
+    "min": fdMin,
+    "max": fdMax,
+    "mod": fdMod,
+    "//":  fdDiv,
+}
+
+func fdAbs(s *fdSolver, v []expression) bool {
+    x, z := v[0], v[1]
+    dx := s.dom(x)
+    lo, hi := dx.lo, dx.hi
+    switch {
+    case lo >= 0:
+    case hi <= 0:
+        lo, hi = -hi, -lo
+    default:
+        lo, hi = 0, max(-lo, hi)
+    }
+    if !s.bounds(z, lo, hi) {
+        return false
+    }
+    dz := s.dom(z)
+    if !s.bounds(x, -dz.hi, dz.hi) {
+        return false
+    }
+    // x is at least dz.lo away from 0, on whichever side it can be
+    switch dx = s.dom(x); {
+    case dx.lo > -dz.lo:
+        return s.bounds(x, dz.lo, fdSup)
+    case dx.hi < dz.lo:
+        return s.bounds(x, -fdSup, -dz.lo)
+    }
+    return true
+}
+
+func fdMin(s *fdSolver, v []expression) bool {
+    x, y, z := v[0], v[1], v[2]
+    dx, dy := s.dom(x), s.dom(y)
+    if !s.bounds(z, min(dx.lo, dy.lo), min(dx.hi, dy.hi)) {
+        return false
+    }
+    dz := s.dom(z)
+    if !s.bounds(x, dz.lo, fdSup) || !s.bounds(y, dz.lo, fdSup) {
+        return false
+    }
+    // once one of them is sure to be the least, it is z
+    switch dx, dy = s.dom(x), s.dom(y); {
+    case dx.hi <= dy.lo:
+        return s.bounds(x, dz.lo, dz.hi)
+    case dy.hi <= dx.lo:
+        return s.bounds(y, dz.lo, dz.hi)
+    }
+    return true
+}
+
+func fdMax(s *fdSolver, v []expression) bool {
+    x, y, z := v[0], v[1], v[2]
+    dx, dy := s.dom(x), s.dom(y)
+    if !s.bounds(z, max(dx.lo, dy.lo), max(dx.hi, dy.hi)) {
+        return false
+    }
+    dz := s.dom(z)
+    if !s.bounds(x, -fdSup, dz.hi) || !s.bounds(y, -fdSup, dz.hi) {
+        return false
+    }
+    switch dx, dy = s.dom(x), s.dom(y); {
+    case dx.lo >= dy.hi:
+        return s.bounds(x, dz.lo, dz.hi)
+    case dy.lo >= dx.hi:
+        return s.bounds(y, dz.lo, dz.hi)
+    }
+    return true
+}
+
+// fdDiv is for //, which truncates toward zero
+func fdDiv(s *fdSolver, v []expression) bool {
+    x, y, z := v[0], v[1], v[2]
+    if !s.narrow(y, s.dom(y).remove(0)) {
+        return false
+    }
+    dx, dy := s.dom(x), s.dom(y)
+    if dy.lo < 0 && dy.hi > 0 {
+        // y can have either sign: z is no further from zero than x
+        m := max(abs(dx.lo), abs(dx.hi))
+        return s.bounds(z, -m, m)
+    }
+    // with the sign of y known, x // y only grows or shrinks with
+    // either, so it is at its least and most at the corners
+    qs := []int64{truncDiv(dx.lo, dy.lo), truncDiv(dx.lo, dy.hi), truncDiv(dx.hi, dy.lo), truncDiv(dx.hi, dy.hi)}
+    return s.bounds(z, min(qs[0], qs[1], qs[2], qs[3]), max(qs[0], qs[1], qs[2], qs[3]))
+}
+
+// fdMod is for mod, which has the sign of y
+func fdMod(s *fdSolver, v []expression) bool {
+    x, y, z := v[0], v[1], v[2]
+    if !s.narrow(y, s.dom(y).remove(0)) {
+        return false
+    }
+    dx, dy := s.dom(x), s.dom(y)
+    a, xfixed := dx.fixed()
+    b, yfixed := dy.fixed()
+    switch {
+    case xfixed && yfixed:
+        n, _ := evalBinary(process{functor: "mod"}, number(a), number(b))
+        return s.bounds(z, int64(n), int64(n))
+    case dy.lo > 0 && dx.lo >= 0 && dx.hi < dy.lo:
+        // x mod y is x
+        if !s.bounds(z, dx.lo, dx.hi) {
+            return false
+        }
+        dz := s.dom(z)
+        return s.bounds(x, dz.lo, dz.hi)
+    case dy.lo > 0:
+        return s.bounds(z, 0, addFD(dy.hi, -1))
+    case dy.hi < 0:
+        return s.bounds(z, addFD(dy.lo, 1), 0)
+    }
+    return s.bounds(z, addFD(dy.lo, 1), addFD(dy.hi, -1))
+}
+
+// truncDiv divides a bound by a nonzero bound, rounding toward zero
+func truncDiv(a, b int64) int64 {
+    if abs(a) >= fdSup {
+        return mulFD(a, b/abs(b))
+    }
+    return a / b
+}
+
+// fdConstrain posts l op r, op being one of the comparisons
+func (m *machine) fdConstrain(op string, l, r expression) bool {
+    b := &fdBuilder{m: m, goal: walkstar(m.state.sub, process{functor: op, args: []expression{l, r}})}
+    ll, err := b.linearize(l)
+    if err != nil {
+        return m.throw(err)
+    }
+    rl, err := b.linearize(r)
+    if err != nil {
+        return m.throw(err)
+    }
+    d := ll.plus(rl.scale(-1))
+    switch op {
+    case "#=", "#\\=", "#=<":
+        b.linear(d, op)
+    case "#<":
+        b.linear(d.plus(linear{k: 1}), "#=<")
+    case "#>=":
+        b.linear(d.scale(-1), "#=<")
+    case "#>":
+        b.linear(d.scale(-1).plus(linear{k: 1}), "#=<")
+    }
+    return m.fdPost(b.props)
+}
+
+func builtinFDCompare(op string) builtin {
+    return func(m *machine, args []expression) bool {
+        return m.fdConstrain(op, args[0], args[1])
+    }
+}
+
+// fdDomain reads a domain: N, L..H with inf and sup for no bound, or
+// domains joined by \/
+func (m *machine) fdDomain(e expression) (domain, error) {
+    switch t := walk(m.state.sub, e).(type) {
+    case variable:
+        return domain{}, errInstantiation
+    case number:
+        return interval(int64(t), int64(t)), nil
+    case process:
+        switch {
+        case t.functor == ".." && t.arity() == 2:
+            lo, err := m.fdBound(t.args[0])
+            if err != nil {
+                return domain{}, err
+            }
+            hi, err := m.fdBound(t.args[1])
+            if err != nil {
+                return domain{}, err
+            }
+            if lo > hi {
+                return emptyDomain, nil
+            }
+            return interval(lo, hi), nil
+        case t.functor == "\\/" && t.arity() == 2:
+            a, err := m.fdDomain(t.args[0])
+            if err != nil {
+                return domain{}, err
+            }
+            b, err := m.fdDomain(t.args[1])
+            if err != nil {
+                return domain{}, err
+            }
+            return a.union(b), nil
+        }
+    }
+    return domain{}, typeError("clpfd domain", walkstar(m.state.sub, e))
+}
+
+func (m *machine) fdBound(e expression) (int64, error) {
+    switch t := walk(m.state.sub, e).(type) {
+    case variable:
+        return 0, errInstantiation
+    case number:
+        return clampFD(int64(t)), nil
+    case symbol:
+        switch t {
+        case "inf":
+            return -fdSup, nil
+        case "sup":
+            return fdSup, nil
+        }
+    case process:
+        if t.functor == "-" && t.arity() == 1 {
+            if n, ok := walk(m.state.sub, t.args[0]).(number); ok {
+                return clampFD(-int64(n)), nil
+            }
+        }
+    }
+    return 0, typeError("clpfd bound", walkstar(m.state.sub, e))
+}
+
+// fdIn narrows x to d
+func (m *machine) fdIn(x expression, d domain) bool {
+    switch t := walk(m.state.sub, x).(type) {
+    case number, variable:
+    default:
+        return m.throw(typeError("integer", t))
+    }
+    s := m.fdSolver()
+    return s.narrow(x, d) && s.run()
+}
+
+func builtinIn(m *machine, args []expression) bool {
+    d, err := m.fdDomain(args[1])
+    if err != nil {
+        return m.throw(err)
+    }
+    return m.fdIn(args[0], d)
+}
+
+func builtinIns(m *machine, args []expression) bool {
+    d, err := m.fdDomain(args[1])
+    if err != nil {
+        return m.throw(err)
+    }
+    xs, err := m.fdList(args[0])
+    if err != nil {
+        return m.throw(err)
+    }
+    for _, x := range xs {
+        if !m.fdIn(x, d) {
+            return false
+        }
+    }
+    return true
+}
+
+// fdList gets the elements of a list of integers and variables
+func (m *machine) fdList(e expression) ([]expression, error) {
+    xs, ok := listElements(walkstar(m.state.sub, e))
+    if !ok {
+        if isVariable(walk(m.state.sub, e)) {
+            return nil, errInstantiation
+        }
+        return nil, typeError("list", walkstar(m.state.sub, e))
+    }
+    for _, x := range xs {
+        switch x.(type) {
+        case number, variable:
+        default:
+            return nil, typeError("integer", x)
+        }
+    }
+    return xs, nil
+}
+
+// all_different(Xs) takes the value of every variable that has one out
+// of the domains of the others
+func builtinAllDifferent(m *machine, args []expression) bool {
+    return m.allDifferent(args[0], "all_different", false)
+}
+
+// all_distinct(Xs) also fails as soon as the variables left have fewer
+// values between them than there are variables
+func builtinAllDistinct(m *machine, args []expression) bool {
+    return m.allDifferent(args[0], "all_distinct", true)
+}
+
+func (m *machine) allDifferent(e expression, name string, counting bool) bool {
+    xs, err := m.fdList(e)
+    if err != nil {
+        return m.throw(err)
+    }
+    p := &propagator{goal: process{functor: name, args: []expression{makeList(xs, emptylist)}}, vars: xs}
+    // once no two of them can have the same value, there is nothing left to say
+    p.entailed = func(sub bindings) bool {
+        for i, x := range xs {
+            for _, y := range xs[i+1:] {
+                if !fdDom(sub, x).intersect(fdDom(sub, y)).empty() {
+                    return false
+                }
+            }
+        }
+        return true
+    }
+    p.run = func(s *fdSolver) bool {
+        for i, x := range xs {
+            n, ok := s.dom(x).fixed()
+            if !ok {
+                continue
+            }
+            for j, y := range xs {
+                if i != j && !s.narrow(y, s.dom(y).remove(n)) {
+                    return false
+                }
+            }
+        }
+        if !counting {
+            return true
+        }
+        return s.enoughValues(xs)
+    }
+    return m.fdPost([]*propagator{p})
+}
+
+// enoughValues checks the pigeonhole principle on the variables of xs
+func (s *fdSolver) enoughValues(xs []expression) bool {
+    union, vars := emptyDomain, int64(0)
+    for _, x := range xs {
+        d := s.dom(x)
+        if _, ok := d.fixed(); ok {
+            continue
+        }
+        union = union.union(d)
+        if !union.finite() {
+            return true
+        }
+        vars++
+    }
+    return union.size() >= vars
+}
+
+// sum(Xs, Op, Value) is the sum of Xs compared to Value by Op
+func builtinSum(m *machine, args []expression) bool {
+    xs, err := m.fdList(args[0])
+    if err != nil {
+        return m.throw(err)
+    }
+    op, err := m.atomArg(args[1])
+    if err != nil {
+        return m.throw(err)
+    }
+    if _, ok := builtins[proc(op, 2)]; !ok || !strings.HasPrefix(op, "#") {
+        return m.throw(fmt.Errorf("domain error: clpfd comparison expected, found %s", op))
+    }
+    var sum expression = number(0)
+    for i, x := range xs {
+        if i == 0 {
+            sum = x
+            continue
+        }
+        sum = process{functor: "+", args: []expression{sum, x}}
+    }
+    return m.fdConstrain(op, sum, args[2])
+}
+
+// the options of labeling/2: which variable to label first, in which
+// order to try its values, how to split its domain, and what to optimise
+type labelingOptions struct {
+    choice   string // leftmost, ff, ffc, min or max
+    order    string // up or down
+    branch   string // step, enum or bisect
+    optimise []process     // min(Expr) and max(Expr), the first first
+    rest     []expression // the options without the first of optimise
+}
+
+func (m *machine) labelingOptions(e expression) (labelingOptions, error) {
+    opts := labelingOptions{choice: "leftmost", order: "up", branch: "step"}
+    terms, ok := listElements(walkstar(m.state.sub, e))
+    if !ok {
+        return opts, typeError("list", walkstar(m.state.sub, e))
+    }
+    for _, t := range terms {
+        switch t {
+        case symbol("leftmost"), symbol("ff"), symbol("ffc"), symbol("min"), symbol("max"):
+            opts.choice = string(t.(symbol))
+        case symbol("up"), symbol("down"):
+            opts.order = string(t.(symbol))
+        case symbol("step"), symbol("enum"), symbol("bisect"):
+            opts.branch = string(t.(symbol))
+        default:
+            if p, ok := t.(process); ok && (p.functor == "min" || p.functor == "max") && p.arity() == 1 {
+                if len(opts.optimise) > 0 {
+                    opts.rest = append(opts.rest, t)
+                }
+                opts.optimise = append(opts.optimise, p)
+                continue
+            }
+            if isVariable(t) {
+                return opts, errInstantiation
+            }
+            return opts, fmt.Errorf("domain error: labeling option expected, found %s", t.PrintExpression())
+        }
+        opts.rest = append(opts.rest, t)
+    }
+    return opts, nil
+}
+
+// better reports whether a variable with f is to be labeled before one
+// with g, going by the choice option
+func (o labelingOptions) better(f, g fdVar) bool {
+    switch o.choice {
+    case "ff":
+        return f.dom.size() < g.dom.size()
+    case "ffc":
+        if f.dom.size() != g.dom.size() {
+            return f.dom.size() < g.dom.size()
+        }
+        return len(f.props) > len(g.props)
+    case "min":
+        return f.dom.lo < g.dom.lo
+    case "max":
+        return f.dom.hi > g.dom.hi
+    }
+    return false
+}
+
+var (
+    labelClauses    = compileProcedure(MustParseRules("label(Vs) :- labeling([], Vs).")).clauses
+    labelingClauses = compileProcedure(MustParseRules("labeling(_, _).")).clauses
+    extremumClauses = compileProcedure(MustParseRules("extremum(Opts, Vs, Expr, V) :- labeling(Opts, Vs), V #= Expr.")).clauses
+)
+
+func generateLabel(m *machine, args []expression) ([]clause, error) {
+    return labelClauses, nil
+}
+
+// labeling(Options, Vars) picks a variable of Vars and tries its values,
+// a clause for each branch, labeling the rest in the body:
+//
+//   labeling(Options, Vars) :- X = Value, labeling(Options, Vars).
+//   labeling(Options, Vars) :- X #\= Value, labeling(Options, Vars).
+func generateLabeling(m *machine, args []expression) ([]clause, error) {
+    opts, err := m.labelingOptions(args[0])
+    if err != nil {
+        return nil, err
+    }
+    xs, err := m.fdList(args[1])
+    if err != nil {
+        return nil, err
+    }
+    if len(opts.optimise) > 0 {
+        return m.optimise(opts, args)
+    }
+    var x variable
+    var best fdVar
+    found := false
+    for _, e := range xs {
+        v, ok := e.(variable)
+        if !ok {
+            continue
+        }
+        f, _ := m.fdVar(v)
+        if !f.dom.finite() {
+            return nil, errInstantiation
+        }
+        if !found || opts.better(f, best) {
+            x, best, found = v, f, true
+        }
+    }
+    if !found {
+        return labelingClauses, nil
+    }
+    head := process{functor: "labeling", args: []expression{walkstar(m.state.sub, args[0]), walkstar(m.state.sub, args[1])}}
+    goal := func(functor string, n int64) process {
+        return process{functor: functor, args: []expression{x, number(n)}}
+    }
+    branches := [][]process{}
+    d := best.dom
+    switch opts.branch {
+    case "step":
+        n := d.lo
+        if opts.order == "down" {
+            n = d.hi
+        }
+        branches = append(branches, []process{goal("=", n)}, []process{goal("#\\=", n)})
+    case "enum":
+        d.values(func(n int64) bool {
+            branches = append(branches, []process{goal("=", n)})
+            return true
+        })
+        if opts.order == "down" {
+            for i, j := 0, len(branches)-1; i < j; i, j = i+1, j-1 {
+                branches[i], branches[j] = branches[j], branches[i]
+            }
+        }
+    case "bisect":
+        mid := floorDiv(d.lo+d.hi, 2)
+        branches = append(branches, []process{goal("#=<", mid)}, []process{goal("#>", mid)})
+        if opts.order == "down" {
+            branches[0], branches[1] = branches[1], branches[0]
+        }
+    }
+    clauses := []clause{}
+    for _, b := range branches {
+        r := rule{head: head, body: append(b, head)}
+        clauses = append(clauses, compileClause(renumberVariables(r)))
+    }
+    return clauses, nil
+}
+
+// optimise labels for the best value of the first min(Expr) or
+// max(Expr) option, then for every worse one in turn:
+//
+//   labeling(Options, Vars) :- Expr #= Best, labeling(Rest, Vars).
+//   labeling(Options, Vars) :- Expr #\= Best, labeling(Options, Vars).
+func (m *machine) optimise(opts labelingOptions, args []expression) ([]clause, error) {
+    o := opts.optimise[0]
+    rest := makeList(opts.rest, emptylist)
+    best, ok, err := m.extremum(o, rest, args[1])
+    if err != nil || !ok {
+        return nil, err
+    }
+    head := process{functor: "labeling", args: []expression{walkstar(m.state.sub, args[0]), walkstar(m.state.sub, args[1])}}
+    expr := walkstar(m.state.sub, o.args[0])
+    at := process{functor: "#=", args: []expression{expr, number(best)}}
+    other := process{functor: "#\\=", args: []expression{expr, number(best)}}
+    clauses := []clause{}
+    for _, r := range []rule{
+        {head: head, body: []process{at, {functor: "labeling", args: []expression{rest, head.args[1]}}}},
+        {head: head, body: []process{other, head}},
+    } {
+        clauses = append(clauses, compileClause(renumberVariables(r)))
+    }
+    return clauses, nil
+}
+
+// extremum finds the best value of the expression of o over the
+// labelings of vars, by branch and bound: once a labeling is found, the
+// next has to beat it
+func (m *machine) extremum(o process, opts, vars expression) (int64, bool, error) {
+    expr := walkstar(m.state.sub, o.args[0])
+    better := "#<"
+    if o.functor == "max" {
+        better = "#>"
+    }
+    best, found := int64(0), false
+    for {
+        sub := m.subMachine()
+        mark := m.state.sub.mark(m.state.vc)
+        ok := true
+        if found {
+            ok = sub.fdConstrain(better, expr, number(best))
+        }
+        v := sub.fresh()
+        var value expression
+        if ok {
+            sub.loop(sub.try(extremumClauses, []expression{opts, vars, expr, v}, nil, sub.state), func(ans state) bool {
+                value = walk(ans.sub, v)
+                return false
+            })
+        }
+        m.stats.inferences += sub.stats.inferences
+        m.state.sub = m.state.sub.undo(mark, m.state.vc)
+        switch n := value.(type) {
+        case nil:
+            return best, found, sub.err
+        case number:
+            best, found = int64(n), true
+        default:
+            // labeling left some variable of the expression free
+            return 0, false, errInstantiation
+        }
+    }
+}
+
+// fdResiduals are the goals a clpfd attribute stands for: the domain
+// of v and the constraints between it and other variables
+func fdResiduals(st state, v variable, f fdVar) []expression {
+    out := []expression{}
+    if !f.dom.equal(fullDomain) {
+        out = append(out, process{functor: "in", args: []expression{v, f.dom.term()}})
+    }
+    for _, p := range f.props {
+        if p.residual(st.sub) {
+            out = append(out, p.goal)
+        }
+    }
+    return out
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "sort"
+    "sync"
+)
+
+// A Coverage counts, for every clause of the program, how often its head
+// unified and how often its body completed, over all queries run with
+// it. Set it as the coverage of an interpreter.
+type Coverage struct {
+    mu     sync.Mutex
+    counts map[clauseKey]*ClauseCounts
+}
+
+// ClauseCounts are what coverage knows about one clause. For a fact the
+// body completes whenever the head unifies.
+type ClauseCounts struct {
+    Heads, Bodies int
+}
+
+// clauses are known by their procedure and their place in it
+type clauseKey struct {
+    p procEntry
+    n int
+}
+
+func NewCoverage() *Coverage {
+    return &Coverage{counts: map[clauseKey]*ClauseCounts{}}
+}
+
+// a coverer counts for one query, adding to its coverage when the
+// query is done. Like the profiler it works from the ports of the
+// debugger: a body completes when its goal exits.
+type coverer struct {
+    coverage *Coverage
+    counts   map[clauseKey]*ClauseCounts
+}
+
+func newCoverer(c *Coverage) *coverer {
+    return &coverer{coverage: c, counts: map[clauseKey]*ClauseCounts{}}
+}
+
+func (c *coverer) count(inv *invocation) *ClauseCounts {
+    k := clauseKey{p: inv.p, n: inv.clause}
+    cc, ok := c.counts[k]
+    if !ok {
+        cc = &ClauseCounts{}
+        c.counts[k] = cc
+    }
+    return cc
+}
+
+// enter counts the head of the clause inv is running unifying
+func (c *coverer) enter(inv *invocation) {
+    if inv != nil && inv.clauses != nil {
+        c.count(inv).Heads++
+    }
+}
+
+// exit counts the clause inv ran completing; a fact has no ENTER, so
+// its head unifying is counted here too
+func (c *coverer) exit(inv *invocation) {
+    if inv.clauses == nil {
+        return
+    }
+    cc := c.count(inv)
+    if !inv.clauses[inv.clause].hasBody() {
+        cc.Heads++
+    }
+    cc.Bodies++
+}
+
+func (c *coverer) finish() {
+    c.coverage.mu.Lock()
+    defer c.coverage.mu.Unlock()
+    for k, cc := range c.counts {
+        total, ok := c.coverage.counts[k]
+        if !ok {
+            total = &ClauseCounts{}
+            c.coverage.counts[k] = total
+        }
+        total.Heads += cc.Heads
+        total.Bodies += cc.Bodies
+    }
+}
+
+// hasBody reports whether the clause is a rule rather than a fact
+func (c clause) hasBody() bool {
+    for pc := 0; pc < len(c.bytecodes); pc++ {
+        if c.bytecodes[pc] == ENTER {
+            return true
+        }
+        if c.bytecodes[pc].hasOperand() {
+            pc++
+        }
+    }
+    return false
+}
+
+// Clause returns the counts for clause n, from 0, of procedure name/arity
+func (c *Coverage) Clause(name string, arity, n int) ClauseCounts {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if cc, ok := c.counts[clauseKey{p: proc(name, arity), n: n}]; ok {
+        return *cc
+    }
+    return ClauseCounts{}
+}
+
+// clauseCoverage is a line of a coverage report
+type clauseCoverage struct {
+    clauseKey
+    ClauseCounts
+    pos  position
+    fact bool
+}
+
+// report lists the counts for every clause of prog, by source position.
+// The library is left out.
+func (c *Coverage) report(prog *Program) []clauseCoverage {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    out := []clauseCoverage{}
+    prog.eachProcedure(func(pe procEntry, p procedure) {
+        for n, cl := range p.clauses {
+            if cl.pos.file == libraryFile {
+                continue
+            }
+            k := clauseKey{p: pe, n: n}
+            cc := clauseCoverage{clauseKey: k, pos: cl.pos, fact: !cl.hasBody()}
+            if counts, ok := c.counts[k]; ok {
+                cc.ClauseCounts = *counts
+            }
+            out = append(out, cc)
+        }
+    })
+    sort.Slice(out, func(i, j int) bool {
+        a, b := out[i], out[j]
+        switch {
+        case a.pos.file != b.pos.file:
+            return a.pos.file < b.pos.file
+        case a.pos.line != b.pos.line:
+            return a.pos.line < b.pos.line
+        case a.p != b.p:
+            return a.p.printEntry() < b.p.printEntry()
+        }
+        return a.n < b.n
+    })
+    return out
+}
+
+// WriteText writes a line for every clause of prog, and a summary
+func (c *Coverage) WriteText(w io.Writer, prog *Program) error {
+    clauses := c.report(prog)
+    heads, bodies := 0, 0
+    for _, cc := range clauses {
+        if cc.Heads > 0 {
+            heads++
+        }
+        if cc.Bodies > 0 {
+            bodies++
+        }
+        if _, err := fmt.Fprintf(w, "%s: %s clause %d: head %d, body %d\n", cc.pos, cc.p.printEntry(), cc.n+1, cc.Heads, cc.Bodies); err != nil {
+            return err
+        }
+    }
+    _, err := fmt.Fprintf(w, "%d clauses: %d heads unified, %d bodies completed\n", len(clauses), heads, bodies)
+    return err
+}
+
+// WriteLCOV writes the coverage of the clauses of prog read from files
+// as an LCOV tracefile. Every procedure is a function. The line of a
+// clause counts its head unifying; for rules the body completing is
+// a branch on the same line.
+func (c *Coverage) WriteLCOV(w io.Writer, prog *Program) error {
+    files := []string{}
+    byFile := map[string][]clauseCoverage{}
+    for _, cc := range c.report(prog) {
+        if cc.pos.file == "" {
+            continue
+        }
+        if _, ok := byFile[cc.pos.file]; !ok {
+            files = append(files, cc.pos.file)
+        }
+        byFile[cc.pos.file] = append(byFile[cc.pos.file], cc)
+    }
+    for _, file := range files {
+        fmt.Fprintf(w, "TN:\nSF:%s\n", file)
+        procs := []procEntry{}
+        first := map[procEntry]int{}
+        calls := map[procEntry]int{}
+        for _, cc := range byFile[file] {
+            if _, ok := first[cc.p]; !ok {
+                procs = append(procs, cc.p)
+                first[cc.p] = cc.pos.line
+            }
+            calls[cc.p] += cc.Heads
+        }
+        hit := 0
+        for _, p := range procs {
+            fmt.Fprintf(w, "FN:%d,%s\n", first[p], p.printEntry())
+        }
+        for _, p := range procs {
+            fmt.Fprintf(w, "FNDA:%d,%s\n", calls[p], p.printEntry())
+            if calls[p] > 0 {
+                hit++
+            }
+        }
+        fmt.Fprintf(w, "FNF:%d\nFNH:%d\n", len(procs), hit)
+        branches, taken := 0, 0
+        for n, cc := range byFile[file] {
+            if cc.fact {
+                continue
+            }
+            fmt.Fprintf(w, "BRDA:%d,%d,0,%d\n", cc.pos.line, n, cc.Bodies)
+            branches++
+            if cc.Bodies > 0 {
+                taken++
+            }
+        }
+        fmt.Fprintf(w, "BRF:%d\nBRH:%d\n", branches, taken)
+        // clauses sharing a line share its count
+        lines := []int{}
+        heads := map[int]int{}
+        for _, cc := range byFile[file] {
+            if _, ok := heads[cc.pos.line]; !ok {
+                lines = append(lines, cc.pos.line)
+            }
+            heads[cc.pos.line] += cc.Heads
+        }
+        hit = 0
+        for _, line := range lines {
+            fmt.Fprintf(w, "DA:%d,%d\n", line, heads[line])
+            if heads[line] > 0 {
+                hit++
+            }
+        }
+        if _, err := fmt.Fprintf(w, "LF:%d\nLH:%d\nend_of_record\n", len(lines), hit); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestCoverage(t *testing.T) {
+    procs, err := loadFile("testdata/nrev.pl")
+    if err != nil {
+        t.Fatal(err)
+    }
+    i := NewInterpreter(procs)
+    i.coverage = NewCoverage()
+    if _, _, err := runProgram(i, "bench(L)", false); err != nil {
+        t.Fatal(err)
+    }
+    for _, tt := range []struct{
+        name   string
+        arity  int
+        clause int
+        want   ClauseCounts
+    }{
+        {name: "app", arity: 3, clause: 0, want: ClauseCounts{Heads: 30, Bodies: 30}},
+        {name: "app", arity: 3, clause: 1, want: ClauseCounts{Heads: 435, Bodies: 435}},
+        {name: "nrev", arity: 2, clause: 0, want: ClauseCounts{Heads: 1, Bodies: 1}},
+        {name: "nrev", arity: 2, clause: 1, want: ClauseCounts{Heads: 30, Bodies: 30}},
+        {name: "bench", arity: 1, clause: 0, want: ClauseCounts{Heads: 1, Bodies: 1}},
+    }{
+        if got := i.coverage.Clause(tt.name, tt.arity, tt.clause); got != tt.want {
+            t.Errorf("%s/%d clause %d: got %+v want %+v", tt.name, tt.arity, tt.clause, got, tt.want)
+        }
+    }
+}
+
+// A head can unify without the body completing
+func TestCoverageBodyFails(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(`
+        p(X) :- q(X), r(X).
+        p(3).
+        q(1).
+        q(2).
+        r(2).
+        s.
+    `)))
+    i.coverage = NewCoverage()
+    if _, err := answers(i, "p(X)", "X"); err != nil {
+        t.Fatal(err)
+    }
+    var sb strings.Builder
+    if err := i.coverage.WriteText(&sb, i.program()); err != nil {
+        t.Fatal(err)
+    }
+    want := `line 2: p/1 clause 1: head 1, body 1
+line 3: p/1 clause 2: head 1, body 1
+line 4: q/1 clause 1: head 1, body 1
+line 5: q/1 clause 2: head 1, body 1
+line 6: r/1 clause 1: head 1, body 1
+line 7: s/0 clause 1: head 0, body 0
+6 clauses: 5 heads unified, 5 bodies completed
+`
+    if got := sb.String(); got != want {
+        t.Errorf("got\n%s\nwant\n%s", got, want)
+    }
+    i.coverage = NewCoverage()
+    if _, err := answers(i, "p(1)"); err != nil {
+        t.Fatal(err)
+    }
+    if got := i.coverage.Clause("p", 1, 0); got != (ClauseCounts{Heads: 1, Bodies: 0}) {
+        t.Errorf("got %+v", got)
+    }
+}
+
+func TestWriteLCOV(t *testing.T) {
+    procs, err := loadFile("testdata/nrev.pl")
+    if err != nil {
+        t.Fatal(err)
+    }
+    i := NewInterpreter(procs)
+    i.coverage = NewCoverage()
+    if _, _, err := runProgram(i, "bench(L)", false); err != nil {
+        t.Fatal(err)
+    }
+    var sb strings.Builder
+    if err := i.coverage.WriteLCOV(&sb, i.program()); err != nil {
+        t.Fatal(err)
+    }
+    want := `TN:
+SF:testdata/nrev.pl
+FN:4,app/3
+FN:7,nrev/2
+FN:10,bench/1
+FNDA:465,app/3
+FNDA:31,nrev/2
+FNDA:1,bench/1
+FNF:3
+FNH:3
+BRDA:5,1,0,435
+BRDA:8,3,0,30
+BRDA:10,4,0,1
+BRF:3
+BRH:3
+DA:4,30
+DA:5,435
+DA:7,1
+DA:8,30
+DA:10,1
+LF:5
+LH:5
+end_of_record
+`
+    if got := sb.String(); got != want {
+        t.Errorf("got\n%s\nwant\n%s", got, want)
+    }
+}
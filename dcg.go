@@ -0,0 +1,176 @@
+package main
+
+// Grammar rules are translated into clauses when they are read. Every
+// nonterminal gets two more args: the list it starts parsing at and what
+// is left of it after. So
+//
+//   greeting --> [hello], name.
+//
+// is read as
+//
+//   greeting(S0, S) :- S0 = [hello|S1], name(S1, S).
+//
+// A body can have terminal lists, which strings are too, {Goal} for
+// plain goals, call(G, Args...) for a nonterminal made while running,
+// !, and ;, -> and \+ as in clauses. A head Head, Pushback puts the list
+// Pushback back in front of what is left after Head.
+
+// dcgRule translates Head --> Body into the clause it stands for.
+// fresh makes the variables for the lists in between.
+func dcgRule(head, body expression, fresh func() variable) (expression, error) {
+    s0, s := fresh(), fresh()
+    var pushback expression
+    if p, ok := head.(process); ok && p.functor == Comma && p.arity() == 2 {
+        head, pushback = p.args[0], p.args[1]
+    }
+    h, err := addArgs(head, s0, s)
+    if err != nil {
+        return nil, err
+    }
+    if pushback == nil {
+        b, err := dcgBody(body, s0, s, fresh)
+        if err != nil {
+            return nil, err
+        }
+        return process{functor: Turnstile, args: []expression{h, b}}, nil
+    }
+    mid := fresh()
+    b, err := dcgBody(body, s0, mid, fresh)
+    if err != nil {
+        return nil, err
+    }
+    pb, err := dcgTerminals(pushback, s, mid)
+    if err != nil {
+        return nil, err
+    }
+    return process{functor: Turnstile, args: []expression{h, process{functor: Comma, args: []expression{b, pb}}}}, nil
+}
+
+// dcgBody translates a grammar body parsing from s0 to s into a goal
+func dcgBody(b, s0, s expression, fresh func() variable) (expression, error) {
+    switch t := b.(type) {
+    case variable:
+        return process{functor: "phrase", args: []expression{t, s0, s}}, nil
+    case list:
+        return dcgTerminals(t, s0, s)
+    case symbol:
+        switch t {
+        case emptylist:
+            return unifyGoal(s0, s), nil
+        case "!":
+            return process{functor: Comma, args: []expression{t, unifyGoal(s0, s)}}, nil
+        }
+    case process:
+        switch {
+        case t.functor == Comma && t.arity() == 2:
+            mid := fresh()
+            left, err := dcgBody(t.args[0], s0, mid, fresh)
+            if err != nil {
+                return nil, err
+            }
+            right, err := dcgBody(t.args[1], mid, s, fresh)
+            if err != nil {
+                return nil, err
+            }
+            return process{functor: Comma, args: []expression{left, right}}, nil
+        case (t.functor == ";" || t.functor == Commit) && t.arity() == 2:
+            left, err := dcgBody(t.args[0], s0, s, fresh)
+            if err != nil {
+                return nil, err
+            }
+            right, err := dcgBody(t.args[1], s0, s, fresh)
+            if err != nil {
+                return nil, err
+            }
+            return process{functor: ";", args: []expression{left, right}}, nil
+        case t.functor == "->" && t.arity() == 2:
+            mid := fresh()
+            cond, err := dcgBody(t.args[0], s0, mid, fresh)
+            if err != nil {
+                return nil, err
+            }
+            then, err := dcgBody(t.args[1], mid, s, fresh)
+            if err != nil {
+                return nil, err
+            }
+            return process{functor: "->", args: []expression{cond, then}}, nil
+        case t.functor == "\\+" && t.arity() == 1:
+            g, err := dcgBody(t.args[0], s0, fresh(), fresh)
+            if err != nil {
+                return nil, err
+            }
+            return process{functor: Comma, args: []expression{process{functor: "\\+", args: []expression{g}}, unifyGoal(s0, s)}}, nil
+        case t.functor == "{}" && t.arity() == 1:
+            return process{functor: Comma, args: []expression{t.args[0], unifyGoal(s0, s)}}, nil
+        }
+    }
+    return addArgs(b, s0, s)
+}
+
+// dcgTerminals is the goal for a list of terminals between s0 and s
+func dcgTerminals(e, s0, s expression) (expression, error) {
+    elems, ok := listElements(e)
+    if !ok {
+        return nil, typeError("list", e)
+    }
+    return unifyGoal(s0, makeList(elems, s)), nil
+}
+
+func unifyGoal(a, b expression) expression {
+    return process{functor: "=", args: []expression{a, b}}
+}
+
+// addArgs adds args to the end of the args of a callable term, keeping
+// the module of M:G
+func addArgs(g expression, args ...expression) (expression, error) {
+    switch t := g.(type) {
+    case variable:
+        return nil, errInstantiation
+    case symbol:
+        return process{functor: string(t), args: args}, nil
+    case process:
+        if t.functor == ":" && t.arity() == 2 {
+            inner, err := addArgs(t.args[1], args...)
+            if err != nil {
+                return nil, err
+            }
+            return process{functor: ":", args: []expression{t.args[0], inner}}, nil
+        }
+        return process{functor: t.functor, args: append(append([]expression{}, t.args...), args...)}, nil
+    }
+    return nil, typeError("callable", g)
+}
+
+// phrase(G, L) is phrase(G, L, [])
+func generatePhrase2(m *machine, args []expression) ([]clause, error) {
+    return m.phrase(args[0], args[1], emptylist, args)
+}
+
+// phrase(G, L, R) parses L with the grammar body G, leaving R
+func generatePhrase3(m *machine, args []expression) ([]clause, error) {
+    return m.phrase(args[0], args[1], args[2], args)
+}
+
+// phrase is tried as the clause phrase(G, L, R) :- Body, with Body the
+// translation of G, compiled on the spot
+func (m *machine) phrase(g, l, rest expression, args []expression) ([]clause, error) {
+    g = walkstar(m.state.sub, g)
+    if isVariable(g) {
+        return nil, errInstantiation
+    }
+    l, rest = walkstar(m.state.sub, l), walkstar(m.state.sub, rest)
+    b, err := dcgBody(g, l, rest, m.fresh)
+    if err != nil {
+        return nil, err
+    }
+    body, err := toGoals(b)
+    if err != nil {
+        return nil, typeError("callable", g)
+    }
+    head := []expression{}
+    for _, arg := range args {
+        head = append(head, walkstar(m.state.sub, arg))
+    }
+    r := rule{head: process{functor: "phrase", args: head}, body: body}
+    return []clause{compileClause(renumberVariables(r))}, nil
+}
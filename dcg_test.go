@@ -0,0 +1,115 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+)
+
+var dcgRules = `
+    greeting --> [hello], name.
+    name --> [world].
+    name --> [prolog].
+    digits([D|T]) --> digit(D), digits(T).
+    digits([D]) --> digit(D).
+    digit(D) --> [D], { D >= 48, D =< 57 }.
+    abc --> "abc".
+    peek(X), [X] --> [X].
+    opt(yes) --> [a], !.
+    opt(no) --> [].
+    item(X) --> [X].
+    pair(G) --> call(G, x), call(G, y).
+    anything([]) --> [].
+    anything([X|T]) --> [X], anything(T).
+    ab --> ([a] -> [b] ; [c]).
+    either --> [a] ; [b].
+    neg --> \+ [x], [y].
+    guarded(X) --> ([X] -> [] ; []), [z].
+    g --> ([a], ! ; [b]).
+    g --> [a].
+`
+
+func TestDCG(t *testing.T) {
+    for _, s := range stores {
+        i := NewInterpreter(compileProcedures(MustParseRules(dcgRules)))
+        i.setStore(s.store)
+        for _, tt := range []struct{
+            query string
+            vars  []string
+            want  []string
+            err   bool
+        }{
+            {query: "phrase(greeting, [hello, world])", want: []string{""}},
+            {query: "phrase(greeting, [hello, X])", vars: []string{"X"}, want: []string{"world", "prolog"}},
+            {query: "phrase(greeting, [hello])", want: []string{}},
+            {query: "phrase(digits(Ds), \"42\")", vars: []string{"Ds"}, want: []string{"[52,50]"}},
+            {query: "phrase(digits(Ds), \"4x\")", want: []string{}},
+            {query: "phrase(abc, \"abc\")", want: []string{""}},
+            {query: "phrase(abc, \"abd\")", want: []string{}},
+            // pushback leaves what it looked at
+            {query: "phrase(peek(X), [a, b], R)", vars: []string{"X", "R"}, want: []string{"a [a,b]"}},
+            {query: "phrase(opt(X), [a], R)", vars: []string{"X", "R"}, want: []string{"yes nil"}},
+            {query: "phrase(opt(X), [b], R)", vars: []string{"X", "R"}, want: []string{"no [b]"}},
+            {query: "phrase(pair(item), [x, y])", want: []string{""}},
+            {query: "phrase(pair(item), [y, x])", want: []string{}},
+            {query: "phrase(anything(X), [a, b], R)", vars: []string{"X", "R"}, want: []string{"nil [a,b]", "[a] [b]", "[a,b] nil"}},
+            // bodies that are not nonterminals
+            {query: "phrase(([a], {X = 1}, [b]), [a, b])", vars: []string{"X"}, want: []string{"1"}},
+            {query: "phrase([], L)", vars: []string{"L"}, want: []string{"nil"}},
+            {query: "call(item, X, [z], R)", vars: []string{"X", "R"}, want: []string{"z nil"}},
+            // control constructs
+            {query: "phrase(ab, [a, b])", want: []string{""}},
+            {query: "phrase(ab, [c])", want: []string{""}},
+            {query: "phrase(ab, [a, c])", want: []string{}},
+            {query: "phrase(either, [X])", vars: []string{"X"}, want: []string{"a", "b"}},
+            {query: "phrase(neg, [y])", want: []string{""}},
+            {query: "phrase(neg, [x])", want: []string{}},
+            {query: "phrase(neg, [y], R)", vars: []string{"R"}, want: []string{"nil"}},
+            // the condition commits to its first answer
+            {query: "phrase(guarded(X), [a, z])", vars: []string{"X"}, want: []string{"a"}},
+            {query: "phrase(guarded(a), [z])", want: []string{""}},
+            // a cut in a branch cuts the rule
+            {query: "phrase(g, [a])", want: []string{""}},
+            {query: "phrase(([a] -> [] ; [b]), L)", vars: []string{"L"}, want: []string{"[a]"}},
+            {query: "phrase(_, [a])", err: true},
+            {query: "phrase(1, [a])", err: true},
+            {query: "call(_, a)", err: true},
+        }{
+            got, err := answers(i, tt.query, tt.vars...)
+            if (err != nil) != tt.err {
+                t.Errorf("%s: %s: %v", s.name, tt.query, err)
+                continue
+            }
+            if !tt.err && !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("%s: %s: got %v want %v", s.name, tt.query, got, tt.want)
+            }
+        }
+    }
+}
+
+func TestDCGTranslation(t *testing.T) {
+    for _, tt := range []struct{
+        rule string
+        want string
+    }{
+        {rule: "a --> [x], b.", want: "a(A,B) :- A = [x|C],b(C,B)."},
+        {rule: "a --> [].", want: "a(A,B) :- A = B."},
+        {rule: "a(X) --> b(X), {c(X)}, !.", want: "a(A,B,C) :- b(A,B,D),c(A),D = E,!,E = C."},
+        {rule: "a, [x] --> b.", want: "a(A,B) :- b(A,C),B = [x|C]."},
+        {rule: "a --> call(G, y), X.", want: "a(A,B) :- call(C,y,A,D),phrase(E,D,B)."},
+        {rule: "a --> m:b.", want: "a(A,B) :- m:b(A,B)."},
+    }{
+        rules, err := ParseRules(tt.rule)
+        if err != nil || len(rules) != 1 {
+            t.Errorf("%s: %v", tt.rule, err)
+            continue
+        }
+        if got := nameVariables(rules[0]).String(); got != tt.want {
+            t.Errorf("%s: got %s want %s", tt.rule, got, tt.want)
+        }
+    }
+    for _, bad := range []string{"a, b --> c.", "a --> 1.", "X --> a.", "a --> [x|_]."} {
+        if _, err := ParseRules(bad); err == nil {
+            t.Errorf("%s: expected error", bad)
+        }
+    }
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+)
+
+// Port is where execution enters or leaves the box of a goal, in the
+// four port model Byrd designed for the DEC-10 Prolog debugger
+type Port int
+
+const (
+    CallPort Port = iota
+    ExitPort
+    RedoPort
+    FailPort
+)
+
+var portNames = []string{"Call", "Exit", "Redo", "Fail"}
+
+func (p Port) String() string {
+    return portNames[p]
+}
+
+// A TraceEvent is what the debugger reports at a port
+type TraceEvent struct {
+    Port       Port
+    Depth      int        // 1 for the query itself
+    Invocation int        // numbers the calls, so the ports of one call can be matched
+    Goal       expression // with the bindings at the port applied
+    Bindings   bindings
+    Spy        bool // the goal has a spy point
+    Leashed    bool // an interactive debugger should stop here and ask
+}
+
+func (e TraceEvent) String() string {
+    spy := "   "
+    if e.Spy {
+        spy = " * "
+    }
+    return fmt.Sprintf("%s%s: (%d) %s", spy, e.Port, e.Depth, e.Goal.PrintExpression())
+}
+
+// TraceAction says how to go on after a port
+type TraceAction int
+
+const (
+    TraceCreep TraceAction = iota // on to the next port
+    TraceSkip                     // at call or redo: run the goal without stopping until it exits or fails
+    TraceLeap                     // stop tracing until a spy point
+    TraceFail                     // make the goal fail
+    TraceRetry                    // go back to the call of the goal, undoing what it did
+    TraceAbort                    // stop the query with ErrAborted
+)
+
+// A TraceHook is called at every port the debugger stops at
+type TraceHook func(TraceEvent) TraceAction
+
+var ErrAborted = errors.New("execution aborted")
+
+// the debugger is shared by the queries of an interpreter, like the
+// debugging state of a Prolog session. Whether a query stops at every
+// port starts out as tracing says, but is kept by the query itself.
+type debugger struct {
+    mu      sync.Mutex
+    tracing bool // queries start out stopping at every port, not only at spy points
+    spy     map[procEntry]bool
+    leash   uint // bit per port
+    hook    TraceHook
+}
+
+const allPorts = 1<<CallPort | 1<<ExitPort | 1<<RedoPort | 1<<FailPort
+
+func newDebugger() *debugger {
+    return &debugger{spy: map[procEntry]bool{}, leash: allPorts}
+}
+
+// active reports whether a query has to be traced at all
+func (d *debugger) active() bool {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    return d.tracing || len(d.spy) > 0
+}
+
+func (d *debugger) setTracing(on bool) {
+    d.mu.Lock()
+    d.tracing = on
+    d.mu.Unlock()
+}
+
+// SetTraceHook has the debugger call h at the ports it stops at, instead
+// of printing them. Turn tracing on with trace/0 or spy points with spy/1.
+func (i *interpreter) SetTraceHook(h TraceHook) {
+    i.debug.mu.Lock()
+    i.debug.hook = h
+    i.debug.mu.Unlock()
+}
+
+// an invocation is a call as the debugger sees it: a box with four ports.
+// It keeps what is needed to retry the call.
+type invocation struct {
+    id      int
+    depth   int
+    p       procEntry
+    args    []expression
+    parent  *invocation
+    state   state // before the call
+    mark    int
+    cont    *frame
+    cutB    int
+    choices int  // height of choices at the call
+    exited  bool // left through exit and not yet gone back into
+    path    int  // call path, when profiling
+    clauses []clause // of the procedure called, nil for builtins
+    clause  int      // which of them is being run
+    exits   *exit    // before the call, when explaining
+    tabled  bool     // answered from a table
+}
+
+// tracing is the debugging state of a single query. Machines only have
+// one while debugging, and then do not use last call optimisation:
+// every call needs a frame to find its way out through the exit port.
+type tracing struct {
+    *debugger
+    on      bool        // stop at every port, as trace/0 or a creep asked
+    inv     *invocation // the goal the current clause belongs to
+    skip    *invocation // the goal being skipped, if any
+    calls   int
+    prof    *profiler // set when profiling
+    cover   *coverer  // set when measuring coverage
+    explain bool
+    exits   *exit // of the goals proven so far, when explaining
+}
+
+func (t *tracing) current() *invocation {
+    if t == nil {
+        return nil
+    }
+    return t.inv
+}
+
+// startTracing makes the query being run traceable from here on
+func (m *machine) startTracing() {
+    if m.trace == nil {
+        m.debug.mu.Lock()
+        m.trace = &tracing{debugger: m.debug, on: m.debug.tracing}
+        m.debug.mu.Unlock()
+    }
+}
+
+// finish adds what the query counted to the profile and coverage
+func (t *tracing) finish() {
+    if t == nil {
+        return
+    }
+    if t.prof != nil {
+        t.prof.finish()
+    }
+    if t.cover != nil {
+        t.cover.finish()
+    }
+}
+
+// port reports inv at port p if the debugger stops there, and returns
+// what to do next
+func (m *machine) port(p Port, inv *invocation) TraceAction {
+    t := m.trace
+    if t.prof != nil {
+        t.prof.port(p, inv)
+    }
+    if t.cover != nil && p == ExitPort {
+        t.cover.exit(inv)
+    }
+    if t.explain && p == ExitPort {
+        t.exits = &exit{inv: inv, goal: walkstar(m.state.sub, compound(inv.p.name, inv.args)), prev: t.exits}
+    }
+    if t.skip != nil {
+        if t.skip != inv || p == CallPort || p == RedoPort {
+            return TraceCreep
+        }
+        t.skip = nil
+    }
+    t.mu.Lock()
+    spy := t.spy[inv.p]
+    stop := t.on || spy
+    leashed := t.leash&(1<<p) != 0
+    hook := t.hook
+    t.mu.Unlock()
+    if !stop {
+        return TraceCreep
+    }
+    sub := inv.state.sub
+    if p == ExitPort {
+        sub = m.state.sub
+    }
+    ev := TraceEvent{
+        Port:       p,
+        Depth:      inv.depth,
+        Invocation: inv.id,
+        Goal:       walkstar(sub, compound(inv.p.name, inv.args)),
+        Bindings:   sub,
+        Spy:        spy,
+        Leashed:    leashed,
+    }
+    action := TraceCreep
+    if hook != nil {
+        action = hook(ev)
+    } else {
+        fmt.Fprintln(m.out, ev)
+    }
+    switch action {
+    case TraceLeap:
+        t.on = false
+    case TraceSkip:
+        if p == CallPort || p == RedoPort {
+            t.skip = inv
+        }
+        t.on = true
+    case TraceAbort:
+    default:
+        t.on = true
+    }
+    return action
+}
+
+// traceCall opens the box of a call to p(args) at its call port
+func (m *machine) traceCall(p procEntry, args []expression) bool {
+    t := m.trace
+    t.calls++
+    st := m.state
+    st.depth--
+    inv := &invocation{
+        id:      t.calls,
+        depth:   m.state.depth,
+        p:       p,
+        args:    args,
+        parent:  t.inv,
+        state:   st,
+        mark:    st.sub.mark(st.vc),
+        cont:    m.cont,
+        cutB:    m.cutB,
+        choices: len(m.choices),
+        path:    -1,
+        exits:   t.exits,
+    }
+    t.inv = inv
+    switch m.port(CallPort, inv) {
+    case TraceFail:
+        return m.failGoal(inv)
+    case TraceAbort:
+        return m.throw(ErrAborted)
+    }
+    return true
+}
+
+// traceExit reports the exit port of the goal the current clause belongs
+// to. If the debugger asks for anything but going on, done is set and
+// ok is what executeExit should return.
+func (m *machine) traceExit() (ok, done bool) {
+    inv := m.trace.inv
+    if inv == nil {
+        return true, false
+    }
+    switch m.port(ExitPort, inv) {
+    case TraceFail:
+        return m.failGoal(inv), true
+    case TraceRetry:
+        return m.retry(inv), true
+    case TraceAbort:
+        return m.throw(ErrAborted), true
+    }
+    inv.exited = true
+    return true, false
+}
+
+// traceBacktrack is backtrack reporting the fail ports of the goals it
+// leaves and the redo ports of those it goes back into
+func (m *machine) traceBacktrack() bool {
+    t := m.trace
+next:
+    for m.err == nil {
+        var target *invocation
+        if len(m.choices) > 0 {
+            target = m.choices[len(m.choices)-1].inv
+        }
+        // fail out of every goal that is not an ancestor of target.
+        // Those that exited left no choicepoint, so are not gone back into.
+        for x, y := t.inv, target; x != nil && x != y; {
+            if y != nil && y.depth > x.depth {
+                y = y.parent
+                continue
+            }
+            t.inv = x
+            if x.exited {
+                x.exited = false
+                x = x.parent
+                continue
+            }
+            switch m.port(FailPort, x) {
+            case TraceRetry:
+                if m.retry(x) {
+                    return true
+                }
+                continue next
+            case TraceAbort:
+                return m.throw(ErrAborted)
+            }
+            x = x.parent
+        }
+        if len(m.choices) == 0 {
+            return false
+        }
+        cp := m.choices[len(m.choices)-1]
+        m.choices = m.choices[:len(m.choices)-1]
+        // the choicepoint was made when its goal was called, or for a
+        // disjunction in the clause of it
+        switch {
+        case cp.next != nil:
+            t.exits = cp.exits
+        case cp.inv != nil:
+            t.exits = cp.inv.exits
+        }
+        st := cp.state
+        st.sub = st.sub.undo(cp.mark, st.vc)
+        // go back into the goals that exited, outermost first
+        redo := []*invocation{}
+        for inv := cp.inv; inv != nil && inv.exited; inv = inv.parent {
+            redo = append(redo, inv)
+        }
+        for n := len(redo) - 1; n >= 0; n-- {
+            inv := redo[n]
+            inv.exited = false
+            t.inv = inv
+            switch m.port(RedoPort, inv) {
+            case TraceFail:
+                m.failGoal(inv)
+                continue next
+            case TraceRetry:
+                if m.retry(inv) {
+                    return true
+                }
+                continue next
+            case TraceAbort:
+                return m.throw(ErrAborted)
+            }
+        }
+        t.inv = cp.inv
+        if cp.next != nil {
+            return m.resume(cp.next, st)
+        }
+        return m.try(cp.alts, cp.args, cp.cont, st)
+    }
+    return false
+}
+
+// failGoal makes inv fail, dropping the choicepoints it left
+func (m *machine) failGoal(inv *invocation) bool {
+    m.choices = m.choices[:min(len(m.choices), inv.choices)]
+    m.trace.inv = inv
+    return false
+}
+
+// retry goes back to the call of inv, undoing everything since
+func (m *machine) retry(inv *invocation) bool {
+    m.choices = m.choices[:min(len(m.choices), inv.choices)]
+    st := inv.state
+    st.sub = st.sub.undo(inv.mark, st.vc)
+    m.state = st
+    m.cont = inv.cont
+    m.cutB = inv.cutB
+    m.trace.inv = inv.parent
+    m.trace.exits = inv.exits
+    return m.arrive(inv.p, inv.args)
+}
+
+// trace turns tracing on for the rest of the query and for the queries
+// that start after it
+func builtinTrace(m *machine, args []expression) bool {
+    m.debug.setTracing(true)
+    m.startTracing()
+    m.trace.on = true
+    return true
+}
+
+func builtinNotrace(m *machine, args []expression) bool {
+    m.debug.setTracing(false)
+    if m.trace != nil {
+        m.trace.on = false
+    }
+    return true
+}
+
+// spy(P) sets a spy point on the procedures P names, as Name/Arity or
+// Name for all arities. The debugger stops at their ports even when
+// it is not tracing.
+func builtinSpy(m *machine, args []expression) bool {
+    procs, err := m.lookupProcedures(args[0])
+    if err != nil {
+        return m.throw(err)
+    }
+    if len(procs) == 0 {
+        return m.throw(fmt.Errorf("no procedure %s to spy", walkstar(m.state.sub, args[0]).PrintExpression()))
+    }
+    m.debug.mu.Lock()
+    for _, p := range procs {
+        m.debug.spy[p.entry()] = true
+    }
+    m.debug.mu.Unlock()
+    m.startTracing()
+    return true
+}
+
+func builtinNospy(m *machine, args []expression) bool {
+    procs, err := m.lookupProcedures(args[0])
+    if err != nil {
+        return m.throw(err)
+    }
+    m.debug.mu.Lock()
+    for _, p := range procs {
+        delete(m.debug.spy, p.entry())
+    }
+    m.debug.mu.Unlock()
+    return true
+}
+
+// leash(Ports) sets the ports an interactive debugger stops at: a port
+// (call, exit, redo or fail), a list of them, all or none. +Ports and
+// -Ports add to and remove from those leashed already.
+func builtinLeash(m *machine, args []expression) bool {
+    e := walkstar(m.state.sub, args[0])
+    m.debug.mu.Lock()
+    defer m.debug.mu.Unlock()
+    leash := m.debug.leash
+    if p, ok := e.(process); ok && p.arity() == 1 && (p.functor == "+" || p.functor == "-") {
+        ports, err := leashPorts(p.args[0])
+        if err != nil {
+            return m.throw(err)
+        }
+        if p.functor == "+" {
+            m.debug.leash = leash | ports
+        } else {
+            m.debug.leash = leash &^ ports
+        }
+        return true
+    }
+    ports, err := leashPorts(e)
+    if err != nil {
+        return m.throw(err)
+    }
+    m.debug.leash = ports
+    return true
+}
+
+func leashPorts(e expression) (uint, error) {
+    switch t := e.(type) {
+    case variable:
+        return 0, errInstantiation
+    case symbol:
+        switch t {
+        case "all":
+            return allPorts, nil
+        case "none", emptylist:
+            return 0, nil
+        }
+        for p, name := range portNames {
+            if strings.EqualFold(string(t), name) {
+                return 1 << p, nil
+            }
+        }
+    case list:
+        ports := uint(0)
+        elems, ok := listElements(t)
+        if !ok {
+            return 0, typeError("list", t)
+        }
+        for _, elem := range elems {
+            p, err := leashPorts(elem)
+            if err != nil {
+                return 0, err
+            }
+            ports |= p
+        }
+        return ports, nil
+    }
+    return 0, typeError("port", e)
+}
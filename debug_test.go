@@ -0,0 +1,282 @@
+package main
+
+import (
+    "errors"
+    "reflect"
+    "sort"
+    "strings"
+    "testing"
+)
+
+var traceRules = `
+    p(X) :- q(X), r(X).
+    q(1).
+    q(2).
+    r(2).
+    s(X) :- member(X, [a, b]), X \= a.`
+
+// traceQuery runs query with tracing on. The hook answers with the
+// action in actions for an event, once, and creeps otherwise.
+func traceQuery(i *interpreter, query string, actions map[string]TraceAction) (events, got []string, err error) {
+    i.SetTraceHook(func(ev TraceEvent) TraceAction {
+        s := strings.TrimSpace(ev.String())
+        events = append(events, s)
+        if a, ok := actions[s]; ok {
+            delete(actions, s)
+            return a
+        }
+        return TraceCreep
+    })
+    if _, err := i.interpret("trace"); err != nil {
+        return nil, nil, err
+    }
+    got, err = answers(i, query, "X")
+    i.debug.setTracing(false)
+    return events, got, err
+}
+
+func TestTrace(t *testing.T) {
+    for n, tt := range []struct{
+        query   string
+        actions map[string]TraceAction
+        events  []string
+        want    []string
+        err     error
+    }{
+        {
+            query: "p(X)",
+            events: []string{
+                "Call: (1) p(v#0)",
+                "Call: (2) q(v#1)",
+                "Exit: (2) q(1)",
+                "Call: (2) r(1)",
+                "Fail: (2) r(1)",
+                "Redo: (2) q(v#1)",
+                "Exit: (2) q(2)",
+                "Call: (2) r(2)",
+                "Exit: (2) r(2)",
+                "Exit: (1) p(2)",
+            },
+            want: []string{"2"},
+        },
+        {
+            // redo goes back into member/2 through s/1, which exited
+            query: "call((s(X), X = c))",
+            events: []string{
+                "Call: (1) call((s(v#0),v#0 = c))",
+                "Call: (2) s(v#5)",
+                "Call: (3) member(v#7,[a,b])",
+                "Exit: (3) member(a,[a,b])",
+                "Call: (3) a \\= a",
+                "Fail: (3) a \\= a",
+                "Redo: (3) member(v#7,[a,b])",
+                "Call: (4) member(v#12,[b])",
+                "Exit: (4) member(b,[b])",
+                "Exit: (3) member(b,[a,b])",
+                "Call: (3) b \\= a",
+                "Exit: (3) b \\= a",
+                "Exit: (2) s(b)",
+                "Call: (2) b = c",
+                "Fail: (2) b = c",
+                "Redo: (2) s(v#5)",
+                "Redo: (3) member(v#7,[a,b])",
+                "Redo: (4) member(v#12,[b])",
+                "Call: (5) member(v#17,nil)",
+                "Fail: (5) member(v#17,nil)",
+                "Fail: (4) member(v#12,[b])",
+                "Fail: (3) member(v#7,[a,b])",
+                "Fail: (2) s(v#5)",
+                "Fail: (1) call((s(v#0),v#0 = c))",
+            },
+            want: []string{},
+        },
+        {
+            query:   "p(X)",
+            actions: map[string]TraceAction{"Call: (1) p(v#0)": TraceSkip},
+            events:  []string{"Call: (1) p(v#0)", "Exit: (1) p(2)"},
+            want:    []string{"2"},
+        },
+        {
+            query:   "p(X)",
+            actions: map[string]TraceAction{"Call: (2) q(v#1)": TraceFail},
+            events:  []string{"Call: (1) p(v#0)", "Call: (2) q(v#1)", "Fail: (2) q(v#1)", "Fail: (1) p(v#0)"},
+            want:    []string{},
+        },
+        {
+            // failing at exit drops the choicepoint q/1 left
+            query:   "p(X)",
+            actions: map[string]TraceAction{"Exit: (2) q(1)": TraceFail},
+            events:  []string{"Call: (1) p(v#0)", "Call: (2) q(v#1)", "Exit: (2) q(1)", "Fail: (2) q(v#1)", "Fail: (1) p(v#0)"},
+            want:    []string{},
+        },
+        {
+            query:   "p(X)",
+            actions: map[string]TraceAction{"Exit: (1) p(2)": TraceRetry},
+            events: []string{
+                "Call: (1) p(v#0)", "Call: (2) q(v#1)", "Exit: (2) q(1)", "Call: (2) r(1)", "Fail: (2) r(1)",
+                "Redo: (2) q(v#1)", "Exit: (2) q(2)", "Call: (2) r(2)", "Exit: (2) r(2)", "Exit: (1) p(2)",
+                "Call: (1) p(v#0)", "Call: (2) q(v#1)", "Exit: (2) q(1)", "Call: (2) r(1)", "Fail: (2) r(1)",
+                "Redo: (2) q(v#1)", "Exit: (2) q(2)", "Call: (2) r(2)", "Exit: (2) r(2)", "Exit: (1) p(2)",
+            },
+            want: []string{"2"},
+        },
+        {
+            query:   "p(X)",
+            actions: map[string]TraceAction{"Call: (2) r(1)": TraceAbort},
+            events:  []string{"Call: (1) p(v#0)", "Call: (2) q(v#1)", "Exit: (2) q(1)", "Call: (2) r(1)"},
+            want:    []string{},
+            err:     ErrAborted,
+        },
+    }{
+        i := NewInterpreter(compileProcedures(MustParseRules(traceRules)))
+        events, got, err := traceQuery(i, tt.query, tt.actions)
+        if !errors.Is(err, tt.err) {
+            t.Errorf("%d: got error %v want %v", n, err, tt.err)
+        }
+        if !reflect.DeepEqual(events, tt.events) {
+            t.Errorf("%d: got events\n%s\nwant\n%s", n, strings.Join(events, "\n"), strings.Join(tt.events, "\n"))
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%d: got %v want %v", n, got, tt.want)
+        }
+    }
+}
+
+func TestSpy(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(traceRules)))
+    events := []string{}
+    i.SetTraceHook(func(ev TraceEvent) TraceAction {
+        events = append(events, ev.String())
+        return TraceLeap
+    })
+    mustInterpret(t, i, "spy(r/1)")
+    if got := mustInterpret(t, i, "p(X)"); len(got) != 1 {
+        t.Errorf("got %v", got)
+    }
+    want := []string{" * Call: (2) r(1)", " * Fail: (2) r(1)", " * Call: (2) r(2)", " * Exit: (2) r(2)"}
+    if !reflect.DeepEqual(events, want) {
+        t.Errorf("got %q want %q", events, want)
+    }
+    mustInterpret(t, i, "nospy(r)")
+    events = nil
+    mustInterpret(t, i, "p(X)")
+    if len(events) > 0 {
+        t.Errorf("got %q after nospy", events)
+    }
+    if i.debug.active() {
+        t.Error("debugger still active")
+    }
+}
+
+// Creeping on from a spy point traces the rest of that query only
+func TestCreepPerQuery(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(traceRules)))
+    events := []string{}
+    i.SetTraceHook(func(ev TraceEvent) TraceAction {
+        events = append(events, strings.TrimSpace(ev.String()))
+        return TraceCreep
+    })
+    mustInterpret(t, i, "spy(r/1)")
+    mustInterpret(t, i, "p(X)")
+    want := []string{"* Call: (2) r(1)", "* Fail: (2) r(1)", "Redo: (2) q(v#1)", "Exit: (2) q(2)", "* Call: (2) r(2)", "* Exit: (2) r(2)", "Exit: (1) p(2)"}
+    if !reflect.DeepEqual(events, want) {
+        t.Errorf("got %q want %q", events, want)
+    }
+    events = nil
+    mustInterpret(t, i, "q(X)")
+    if len(events) > 0 {
+        t.Errorf("got %q in the next query", events)
+    }
+}
+
+// Tracing every port does not change the answers
+func TestTracePrograms(t *testing.T) {
+    for _, tt := range benchmarkPrograms {
+        if tt.name == "tak" || tt.name == "zebra" {
+            continue
+        }
+        for _, s := range stores {
+            i := loadProgram(t, tt.file)
+            i.setStore(s.store)
+            _, b := MustParseProcesses(tt.query)
+            vars := []string{}
+            for name := range b {
+                vars = append(vars, name)
+            }
+            sort.Strings(vars)
+            want, err := answers(i, tt.query, vars...)
+            if err != nil {
+                t.Fatal(err)
+            }
+            ports := 0
+            i.SetTraceHook(func(TraceEvent) TraceAction {
+                ports++
+                return TraceCreep
+            })
+            mustInterpret(t, i, "trace")
+            got, err := answers(i, tt.query, vars...)
+            i.debug.setTracing(false)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(got, want) {
+                t.Errorf("%s/%s: got %v want %v", tt.name, s.name, got, want)
+            }
+            if ports == 0 {
+                t.Errorf("%s/%s: no ports traced", tt.name, s.name)
+            }
+        }
+    }
+}
+
+func TestLeash(t *testing.T) {
+    for n, tt := range []struct{
+        leash string
+        want  uint
+    }{
+        {leash: "all", want: allPorts},
+        {leash: "none", want: 0},
+        {leash: "[call, fail]", want: 1<<CallPort | 1<<FailPort},
+        {leash: "-exit", want: allPorts &^ (1 << ExitPort)},
+        {leash: "+redo", want: allPorts},
+    }{
+        i := NewInterpreter(nil)
+        mustInterpret(t, i, "leash(" + tt.leash + ")")
+        if i.debug.leash != tt.want {
+            t.Errorf("%d: got %b want %b", n, i.debug.leash, tt.want)
+        }
+    }
+}
+
+func TestREPL(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(traceRules)))
+    in := strings.Join([]string{
+        "q(X).", ";",
+        "q(X).", "",
+        "q(X),",
+        "r(X).",
+        "leash(-exit).",
+        "trace.",
+        "p(X).", "", "s", "", "x", "f", "", "",
+        "notrace.", "",
+        "q(",
+    }, "\n")
+    var sb strings.Builder
+    runREPL(i, strings.NewReader(in), &sb)
+    want := `?- X = 1 X = 2.
+?- X = 1 ?- X = 2.
+?- true.
+?- true.
+?-    Call: (1) p(v#0) ?    Call: (2) q(v#1) ?    Exit: (2) q(1)
+   Call: (2) r(1) ?    Fail: (2) r(1) ? creep (c or return), skip (s), leap (l), fail (f), retry (r), abort (a)
+   Fail: (2) r(1) ?    Redo: (2) q(v#1) ?    Exit: (2) q(2)
+   Call: (2) r(2) ?    Exit: (2) r(2)
+   Exit: (1) p(2)
+X = 2.
+?-    Call: (1) notrace ? true.
+?- 
+`
+    if got := sb.String(); got != want {
+        t.Errorf("got\n%s\nwant\n%s", got, want)
+    }
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+    "fmt"
+    "io"
+)
+
+// decompileClause replays the bytecode of a clause of name/arity, building
+// up terms instead of matching them, to get back the rule it came from.
+// Variables come back numbered as the compiler saw them.
+func decompileClause(name string, arity int, c clause) (rule, error) {
+    d := decompiler{c: c}
+    args, pc, err := d.terms(0)
+    if err != nil {
+        return rule{}, err
+    }
+    if len(args) != arity {
+        return rule{}, fmt.Errorf("head of %s/%d with %d args", name, arity, len(args))
+    }
+    r := rule{head: process{functor: name, args: args}}
+    end := len(c.bytecodes) - 1
+    if pc > end || c.bytecodes[end] != EXIT {
+        return rule{}, fmt.Errorf("clause without exit")
+    }
+    switch {
+    case c.bytecodes[pc] == EXIT && pc != end:
+        return rule{}, fmt.Errorf("exit before end of clause")
+    case c.bytecodes[pc] == EXIT:
+        return r, nil
+    case c.bytecodes[pc] != ENTER:
+        return rule{}, fmt.Errorf("%s inside head", c.bytecodes[pc])
+    }
+    goals, jump, err := d.goals(pc+1, end)
+    if err != nil {
+        return rule{}, err
+    }
+    if jump >= 0 {
+        return rule{}, fmt.Errorf("jump out of the body")
+    }
+    guard, body, ok := splitAt(goals, marker{ins: COMMIT})
+    if ok {
+        if r.guard, err = bodyGoals(guard); err != nil {
+            return rule{}, err
+        }
+        goals = body
+    }
+    if r.body, err = bodyGoals(goals); err != nil {
+        return rule{}, err
+    }
+    return r, nil
+}
+
+// a decompiler reads back the code of a clause
+type decompiler struct {
+    c clause
+}
+
+// a marker stands for a COMMIT or CUT among the goals decompiled, until
+// the goals around it are put together
+type marker struct {
+    ins     instruction
+    operand instruction
+}
+
+func (m marker) PrintExpression() string {
+    return fmt.Sprintf("%s %d", m.ins, m.operand)
+}
+
+// operand reads the operand of the instruction at pc
+func (d decompiler) operand(pc int) (instruction, error) {
+    ins := d.c.bytecodes[pc]
+    if pc+1 >= len(d.c.bytecodes) {
+        return 0, fmt.Errorf("%s without operand", ins)
+    }
+    operand := d.c.bytecodes[pc+1]
+    if !ins.isJump() && ins != VAR && ins != MARK && ins != CUT && (operand < 0 || int(operand) >= len(d.c.xrTable)) {
+        return 0, fmt.Errorf("%s with xr index %d out of range", ins, operand)
+    }
+    if ins.isJump() && operand < 0 {
+        return 0, fmt.Errorf("%s backwards", ins)
+    }
+    return operand, nil
+}
+
+// terms reads the terms built from pc on, up to the first instruction
+// that does not build a term, and returns where that is
+func (d decompiler) terms(pc int) ([]expression, int, error) {
+    args := []expression{}
+    // args of the enclosing terms while we are inside a functor
+    stack := [][]expression{}
+    functors := []functorEntry{}
+    for ; pc < len(d.c.bytecodes); pc++ {
+        ins := d.c.bytecodes[pc]
+        if ins != CONST && ins != VAR && ins != FUNCTOR && ins != POP {
+            break
+        }
+        var operand instruction
+        if ins.hasOperand() {
+            var err error
+            if operand, err = d.operand(pc); err != nil {
+                return nil, 0, err
+            }
+            pc++
+        }
+        switch ins {
+        case CONST:
+            switch t := d.c.xrTable[operand].(type) {
+            case integer:
+                args = append(args, number(t))
+            case atom:
+                args = append(args, symbol(t))
+            default:
+                return nil, 0, fmt.Errorf("const on %s", t.printEntry())
+            }
+        case VAR:
+            args = append(args, variable(operand))
+        case FUNCTOR:
+            f, ok := d.c.xrTable[operand].(functorEntry)
+            if !ok {
+                return nil, 0, fmt.Errorf("functor on %s", d.c.xrTable[operand].printEntry())
+            }
+            stack = append(stack, args)
+            functors = append(functors, f)
+            args = []expression{}
+        case POP:
+            if len(stack) == 0 {
+                return nil, 0, fmt.Errorf("pop with empty stack")
+            }
+            f := functors[len(functors)-1]
+            if len(args) != f.arity {
+                return nil, 0, fmt.Errorf("functor %s with %d args", f.printEntry(), len(args))
+            }
+            t := makeCompound(f.name, args)
+            args = append(stack[len(stack)-1], t)
+            stack = stack[:len(stack)-1]
+            functors = functors[:len(functors)-1]
+        }
+    }
+    if len(stack) > 0 {
+        return nil, 0, fmt.Errorf("functor without pop")
+    }
+    return args, pc, nil
+}
+
+// goals reads the goals of the code from pc to end. Code ending in a JUMP
+// is the first branch of a disjunction: jump is its offset, else -1.
+func (d decompiler) goals(pc, end int) (goals []expression, jump int, err error) {
+    for pc < end {
+        var args []expression
+        if args, pc, err = d.terms(pc); err != nil {
+            return nil, 0, err
+        }
+        if pc >= end {
+            return nil, 0, fmt.Errorf("args without a call")
+        }
+        ins := d.c.bytecodes[pc]
+        if ins != CALL && len(args) > 0 {
+            return nil, 0, fmt.Errorf("args before %s", ins)
+        }
+        var operand instruction
+        if ins.hasOperand() {
+            if operand, err = d.operand(pc); err != nil {
+                return nil, 0, err
+            }
+        }
+        switch ins {
+        case CALL:
+            p, ok := d.c.xrTable[operand].(procEntry)
+            if !ok {
+                return nil, 0, fmt.Errorf("call on %s", d.c.xrTable[operand].printEntry())
+            }
+            if len(args) != p.arity {
+                return nil, 0, fmt.Errorf("malformed call of %s", p.printEntry())
+            }
+            g := goalTerm(process{functor: p.name, args: args})
+            if p.module != "" {
+                g = process{functor: ":", args: []expression{symbol(p.module), g}}
+            }
+            goals = append(goals, g)
+            pc += 2
+        case COMMIT:
+            goals = append(goals, marker{ins: COMMIT})
+            pc++
+        case CUT:
+            goals = append(goals, marker{ins: CUT, operand: operand})
+            pc += 2
+        case JUMP:
+            if pc+2 != end {
+                return nil, 0, fmt.Errorf("jump inside a branch")
+            }
+            return goals, int(operand), nil
+        case TRY:
+            g, next, err := d.disjunction(pc+2, pc+2+int(operand), end)
+            if err != nil {
+                return nil, 0, err
+            }
+            goals = append(goals, g)
+            pc = next
+        case MARK:
+            if pc+2 >= end || d.c.bytecodes[pc+2] != TRY {
+                return nil, 0, fmt.Errorf("mark without try")
+            }
+            offset, err := d.operand(pc+2)
+            if err != nil {
+                return nil, 0, err
+            }
+            g, next, err := d.ifThenElse(operand, pc+4, pc+4+int(offset), end)
+            if err != nil {
+                return nil, 0, err
+            }
+            goals = append(goals, g)
+            pc = next
+        case ENTER, EXIT:
+            return nil, 0, fmt.Errorf("%s inside the body", ins)
+        default:
+            return nil, 0, fmt.Errorf("unknown instruction %d", ins)
+        }
+    }
+    return goals, -1, nil
+}
+
+// disjunction reads A;B from the code of A at pc, and that of B at else,
+// and returns where it ends
+func (d decompiler) disjunction(pc, els, end int) (expression, int, error) {
+    left, right, next, err := d.branches(pc, els, end)
+    if err != nil {
+        return nil, 0, err
+    }
+    if right == nil {
+        return nil, 0, fmt.Errorf("try without jump")
+    }
+    return process{functor: ";", args: []expression{goalsTerm(left), goalsTerm(right)}}, next, nil
+}
+
+// ifThenElse reads C->T;E or \+G, from the code after the MARK of
+// barrier v at pc, the else branch at els, and returns where it ends
+func (d decompiler) ifThenElse(v instruction, pc, els, end int) (expression, int, error) {
+    left, right, next, err := d.branches(pc, els, end)
+    if err != nil {
+        return nil, 0, err
+    }
+    cond, then, ok := splitAt(left, marker{ins: CUT, operand: v})
+    if !ok {
+        return nil, 0, fmt.Errorf("mark without cut")
+    }
+    isFail := func(goals []expression) bool {
+        return len(goals) == 1 && goals[0] == symbol("fail")
+    }
+    switch {
+    case right == nil && isFail(then):
+        return process{functor: "\\+", args: []expression{goalsTerm(cond)}}, next, nil
+    case right == nil:
+        return nil, 0, fmt.Errorf("try without jump")
+    }
+    g := process{functor: "->", args: []expression{goalsTerm(cond), goalsTerm(then)}}
+    if isFail(right) {
+        return g, next, nil
+    }
+    return process{functor: ";", args: []expression{g, goalsTerm(right)}}, next, nil
+}
+
+// branches reads the goals from pc to els, and if they end in a JUMP those
+// from els to where it goes. right is nil if there is no JUMP.
+func (d decompiler) branches(pc, els, end int) (left, right []expression, next int, err error) {
+    if els > end {
+        return nil, nil, 0, fmt.Errorf("try past the end of the body")
+    }
+    left, jump, err := d.goals(pc, els)
+    if err != nil {
+        return nil, nil, 0, err
+    }
+    if jump < 0 {
+        return left, nil, els, nil
+    }
+    next = els + jump
+    if next > end {
+        return nil, nil, 0, fmt.Errorf("jump past the end of the body")
+    }
+    right, jump, err = d.goals(els, next)
+    if err != nil {
+        return nil, nil, 0, err
+    }
+    if jump >= 0 {
+        return nil, nil, 0, fmt.Errorf("jump at the end of a branch")
+    }
+    if right == nil {
+        right = []expression{}
+    }
+    return left, right, next, nil
+}
+
+// splitAt splits goals at m, if it is there
+func splitAt(goals []expression, m marker) ([]expression, []expression, bool) {
+    for i, g := range goals {
+        if g == m {
+            return goals[:i], goals[i+1:], true
+        }
+    }
+    return goals, nil, false
+}
+
+// goalsTerm is decompiled goals as a conjunction, with any marker in them
+// left for bodyGoals to find
+func goalsTerm(goals []expression) expression {
+    if len(goals) == 0 {
+        return true_value
+    }
+    body := goals[len(goals)-1]
+    for i := len(goals) - 2; i >= 0; i-- {
+        body = process{functor: Comma, args: []expression{goals[i], body}}
+    }
+    return body
+}
+
+// bodyGoals are decompiled goals as those of a rule
+func bodyGoals(goals []expression) ([]process, error) {
+    out := []process{}
+    for _, g := range goals {
+        if hasMarker(g) {
+            return nil, fmt.Errorf("misplaced %s", g.PrintExpression())
+        }
+        p, err := toProcess(g)
+        if err != nil {
+            return nil, err
+        }
+        out = append(out, p)
+    }
+    return out, nil
+}
+
+func hasMarker(e expression) bool {
+    switch t := e.(type) {
+    case marker:
+        return true
+    case process:
+        if isControl(t) {
+            for _, arg := range t.args {
+                if hasMarker(arg) {
+                    return true
+                }
+            }
+        }
+    }
+    return false
+}
+
+// bodyTerm is the body of a rule as a single conjunction, or true for
+// a fact. A guarded rule has Guard | Body.
+func (r rule) bodyTerm() expression {
+    if r.guard != nil {
+        return process{functor: Commit, args: []expression{conjunction(r.guard), conjunction(r.body)}}
+    }
+    return conjunction(r.body)
+}
+
+func conjunction(goals []process) expression {
+    if len(goals) == 0 {
+        return true_value
+    }
+    var body expression = goalTerm(goals[len(goals)-1])
+    for i := len(goals)-2; i >= 0; i-- {
+        body = process{functor: Comma, args: []expression{goalTerm(goals[i]), body}}
+    }
+    return body
+}
+
+// goalTerm is the term for a goal: atoms are not processes in terms
+func goalTerm(p process) expression {
+    if p.arity() == 0 {
+        return symbol(p.functor)
+    }
+    return p
+}
+
+func (p procedure) decompile() ([]rule, error) {
+    rules := []rule{}
+    for _, c := range p.clauses {
+        r, err := decompileClause(p.name, p.arity, c)
+        if err != nil {
+            return nil, err
+        }
+        // calls within the module need no module
+        for _, goals := range [][]process{r.guard, r.body} {
+            for i, g := range goals {
+                if pe, inner := qualifiedGoal(g); p.module != "" && pe.module == p.module {
+                    goals[i] = inner
+                }
+            }
+        }
+        rules = append(rules, r)
+    }
+    return rules, nil
+}
+
+// listing writes the clauses of a procedure back as Prolog source,
+// with variables named A, B, ... as they occur
+func (p procedure) listing(w io.Writer) error {
+    rules, err := p.decompile()
+    if err != nil {
+        return err
+    }
+    if p.table != nil {
+        fmt.Fprintln(w, p.table.directive(proc(p.name, p.arity)))
+    }
+    if p.meta != nil {
+        fmt.Fprintf(w, ":- meta_predicate %s.\n", compound(p.name, metaArgs(p.meta)).PrintExpression())
+    }
+    for _, r := range rules {
+        r = nameVariables(r)
+        if p.module != "" {
+            r.head = process{functor: ":", args: []expression{symbol(p.module), goalTerm(r.head)}}
+        }
+        fmt.Fprintln(w, r)
+    }
+    fmt.Fprintln(w)
+    return nil
+}
+
+func nameVariables(r rule) rule {
+    names := map[variable]expression{}
+    return r.mapVariables(func(v variable) expression {
+        if s, ok := names[v]; ok {
+            return s
+        }
+        n := len(names)
+        s := symbol(string(rune('A' + n%26)))
+        if n >= 26 {
+            s = symbol(fmt.Sprintf("%c%d", 'A'+n%26, n/26))
+        }
+        names[v] = s
+        return s
+    })
+}
+
+// mapVariables replaces every variable in the rule with f of it
+func (r rule) mapVariables(f func(variable) expression) rule {
+    var mapv func(e expression) expression
+    mapv = func(e expression) expression {
+        switch t := e.(type) {
+        case variable:
+            return f(t)
+        case list:
+            return list{head: mapv(t.head), tail: mapv(t.tail)}
+        case process:
+            args := make([]expression, len(t.args))
+            for i, arg := range t.args {
+                args[i] = mapv(arg)
+            }
+            return process{functor: t.functor, args: args}
+        }
+        return e
+    }
+    out := rule{head: mapv(r.head).(process), pos: r.pos}
+    if r.guard != nil {
+        out.guard = []process{}
+    }
+    for _, p := range r.guard {
+        out.guard = append(out.guard, mapv(p).(process))
+    }
+    for _, p := range r.body {
+        out.body = append(out.body, mapv(p).(process))
+    }
+    return out
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+    "math/rand"
+    "reflect"
+    "strings"
+    "testing"
+    "testing/quick"
+)
+
+// randomRule generates rules shaped like the ones the parser produces
+type randomRule struct {
+    rule rule
+}
+
+func (randomRule) Generate(r *rand.Rand, size int) reflect.Value {
+    var term func(depth int) expression
+    term = func(depth int) expression {
+        n := r.Intn(6)
+        if depth <= 0 {
+            n = r.Intn(3)
+        }
+        switch n {
+        case 0:
+            return variable(r.Intn(6))
+        case 1:
+            return symbol([]string{"a", "b", "nil", "foo"}[r.Intn(4)])
+        case 2:
+            return number(r.Int63n(200) - 100)
+        case 3:
+            return list{head: term(depth-1), tail: term(depth-1)}
+        }
+        args := make([]expression, 1+r.Intn(3))
+        for i := range args {
+            args[i] = term(depth-1)
+        }
+        return process{functor: []string{"f", "g", "cons"}[r.Intn(3)], args: args}
+    }
+    goal := func() process {
+        p := process{functor: []string{"p", "q", "append"}[r.Intn(3)]}
+        for n := r.Intn(4); n > 0; n-- {
+            p.args = append(p.args, term(3))
+        }
+        return p
+    }
+    // goals of a body are sometimes control constructs, which a
+    // conjunction can be a branch of
+    var control func(depth int, branch bool) expression
+    control = func(depth int, branch bool) expression {
+        n := r.Intn(10)
+        if depth <= 0 {
+            n = 0
+        }
+        sub := func() expression {
+            return control(depth-1, true)
+        }
+        switch {
+        case n == 1:
+            return process{functor: ";", args: []expression{sub(), sub()}}
+        case n == 2:
+            return process{functor: "->", args: []expression{sub(), sub()}}
+        case n == 3:
+            return process{functor: ";", args: []expression{process{functor: "->", args: []expression{sub(), sub()}}, sub()}}
+        case n == 4:
+            return process{functor: "\\+", args: []expression{sub()}}
+        case n == 5 && branch:
+            return process{functor: Comma, args: []expression{goalTerm(goal()), sub()}}
+        }
+        return goalTerm(goal())
+    }
+    rr := randomRule{rule{head: goal()}}
+    for n := r.Intn(4); n > 0; n-- {
+        g, _ := toProcess(control(2, false))
+        rr.rule.body = append(rr.rule.body, g)
+    }
+    return reflect.ValueOf(rr)
+}
+
+// guardedRule is a randomRule with its first body goal as a guard
+type guardedRule struct {
+    rule
+}
+
+func (guardedRule) Generate(r *rand.Rand, size int) reflect.Value {
+    rr := randomRule{}.Generate(r, size).Interface().(randomRule).rule
+    if len(rr.body) > 0 {
+        rr.guard, rr.body = rr.body[:1], rr.body[1:]
+    }
+    return reflect.ValueOf(guardedRule{rr})
+}
+
+func TestDecompileRoundTrip(t *testing.T) {
+    f := func(rr randomRule) bool {
+        c := compileClause(rr.rule)
+        got, err := decompileClause(rr.rule.head.functor, rr.rule.head.arity(), c)
+        if err != nil {
+            t.Logf("%s: %v", rr.rule, err)
+            return false
+        }
+        if got.String() != rr.rule.String() {
+            t.Logf("got %s want %s", got, rr.rule)
+            return false
+        }
+        return reflect.DeepEqual(compileClause(got), c)
+    }
+    if err := quick.Check(f, &quick.Config{MaxCount: 1000}); err != nil {
+        t.Error(err)
+    }
+}
+
+func TestDecompileGuards(t *testing.T) {
+    f := func(gr guardedRule) bool {
+        c := compileClause(gr.rule)
+        got, err := decompileClause(gr.rule.head.functor, gr.rule.head.arity(), c)
+        if err != nil {
+            t.Logf("%s: %v", gr.rule, err)
+            return false
+        }
+        return got.String() == gr.rule.String() && reflect.DeepEqual(compileClause(got), c)
+    }
+    if err := quick.Check(f, &quick.Config{MaxCount: 1000}); err != nil {
+        t.Error(err)
+    }
+}
+
+func TestDecompileMalformed(t *testing.T) {
+    for i, tt := range []clause{
+        {bytecodes: []instruction{CONST, 0, EXIT}},
+        {xrTable: xrTable{functor("f", 1)}, bytecodes: []instruction{FUNCTOR, 0, VAR, 0, EXIT}},
+        {xrTable: xrTable{functor("f", 1)}, bytecodes: []instruction{POP, EXIT}},
+        {xrTable: xrTable{proc("p", 0)}, bytecodes: []instruction{VAR, 0, CALL, 0, EXIT}},
+        {bytecodes: []instruction{VAR, 0}},
+        {bytecodes: []instruction{COMMIT, EXIT}},
+    }{
+        if _, err := decompileClause("p", 1, tt); err == nil {
+            t.Errorf("%d: expected error decompiling %s", i, tt)
+        }
+    }
+}
+
+func TestClause(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(`
+    len([], 0).
+    len([_|T], N) :- len(T, M), N is M + 1.
+    run :- len([a], 1).`)))
+    for n, tt := range []struct{
+        query string
+        want []string
+    }{
+        {
+            query: "clause(len(X, Y), B)",
+            want: []string{"nil 0 true", "[v#3|v#4] v#5 len(v#4,v#6),v#5 is v#6+1"},
+        },
+        {
+            query: "clause(run, B)",
+            want: []string{"_ _ len([a],1)"},
+        },
+        {
+            query: "clause(len(X, 1), true)",
+            want: []string{},
+        },
+    }{
+        got := []string{}
+        for _, ans := range mustInterpret(t, i, tt.query) {
+            s := []string{}
+            for _, v := range []string{"X", "Y", "B"} {
+                if e, ok := ans[v]; ok {
+                    s = append(s, e.PrintExpression())
+                } else {
+                    s = append(s, "_")
+                }
+            }
+            got = append(got, strings.Join(s, " "))
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%d: got %q want %q", n, got, tt.want)
+        }
+    }
+}
+
+// the clauses of builtins are private
+func TestClausePrivate(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(`run :- true.`)))
+    for _, query := range []string{"clause(X is 1, B)", "clause(call(run), B)", "clause(m:true, B)"} {
+        _, err := answers(i, query)
+        if err == nil || !strings.HasPrefix(err.Error(), "permission error") {
+            t.Errorf("%s: got %v want a permission error", query, err)
+        }
+    }
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+    "fmt"
+    "math/rand"
+    "sort"
+    "strings"
+    "testing"
+)
+
+// The oracle is a literal transliteration of arrive/2 and execute/6 from
+// bowen.pl. Like the paper it works on Prolog terms throughout: code is a
+// list of opcode atoms and operands counting from 1, the xr table and the
+// variables of a clause are compound terms indexed with arg/3, and the
+// args of a call are built up in a difference list. Where bowen.pl uses
+// backtracking, the oracle calls its success continuation k once per
+// solution; bindings are a persistent substitution, so there is nothing
+// to undo. It is slow and recursive on purpose.
+type oracle struct {
+    procedures map[procEntry]expression // list of clause(XR, NVars, PC) terms
+    vc         int
+    steps      int
+    err        error
+}
+
+// a run of the oracle gives up after this many steps
+const oracleMaxSteps = 1000000
+
+var errOracleSteps = fmt.Errorf("oracle ran out of steps")
+
+func newOracle(procs []procedure) *oracle {
+    o := &oracle{procedures: map[procEntry]expression{}}
+    for _, p := range procs {
+        clauses := []expression{}
+        for _, c := range p.clauses {
+            clauses = append(clauses, c.term())
+        }
+        o.procedures[proc(p.name, p.arity)] = makeList(clauses, emptylist)
+    }
+    return o
+}
+
+func (o *oracle) fresh() variable {
+    o.vc++
+    return variable(o.vc - 1)
+}
+
+// arg(N, T, A) for a compound T
+func arg(s bindings, n, t expression) expression {
+    i := walk(s, n).(number)
+    switch c := walk(s, t).(type) {
+    case list:
+        return []expression{c.head, c.tail}[i-1]
+    case process:
+        return c.args[i-1]
+    }
+    panic("arg/3 on atomic")
+}
+
+// arrive(Proc, Args, Cont) :-
+//     procedure(Proc, Clauses), !,
+//     member(clause(XR, NVars, PC), Clauses),
+//     functor(Vars, vars, NVars),
+//     execute(PC, XR, Vars, Cont, Args, []).
+// arrive(Name/_Arity, Args, Cont) :-
+//     Proc =.. [Name|Args],
+//     call(Proc),
+//     execute([exit],_,_,Cont,_,_).
+func (o *oracle) arrive(s bindings, p, args, cont expression, k func(bindings)) {
+    pi := walk(s, p).(process)
+    name := walk(s, pi.args[0]).(symbol)
+    arity := walk(s, pi.args[1]).(number)
+    if clauses, ok := o.procedures[proc(string(name), int(arity))]; ok {
+        elems, _ := listElements(clauses)
+        for _, c := range elems {
+            if o.err != nil {
+                return
+            }
+            cl := c.(process)
+            vars := make([]expression, cl.args[1].(number))
+            for i := range vars {
+                vars[i] = o.fresh()
+            }
+            o.execute(s, cl.args[2], cl.args[0], compound("vars", vars), cont, args, emptylist, k)
+        }
+        return
+    }
+    callArgs, _ := listElements(walkstar(s, args))
+    b, ok := builtins[proc(string(name), len(callArgs))]
+    if !ok {
+        o.err = fmt.Errorf("unknown procedure %s/%d", name, arity)
+        return
+    }
+    i := NewInterpreter(nil)
+    m := &machine{Engine: i.newEngine(nil, Limits{}), program: i.program(), state: state{sub: s, vc: o.vc}}
+    if !b(m, callArgs) {
+        o.err = m.err
+        return
+    }
+    o.vc = m.state.vc
+    o.execute(m.state.sub, makeList([]expression{symbol("exit")}, emptylist), o.fresh(), o.fresh(), cont, o.fresh(), o.fresh(), k)
+}
+
+func (o *oracle) execute(s bindings, pc, xr, vars, cont, args, astack expression, k func(bindings)) {
+    if o.err != nil {
+        return
+    }
+    o.steps++
+    if o.steps > oracleMaxSteps {
+        o.err = errOracleSteps
+        return
+    }
+    code := walk(s, pc).(list)
+    rest := walk(s, code.tail)
+    // [Arg|Arest]
+    cons := func(s bindings) (bindings, expression, expression, bool) {
+        arg, arest := o.fresh(), o.fresh()
+        s, ok := unify(s, args, list{head: arg, tail: arest})
+        return s, arg, arest, ok
+    }
+    switch walk(s, code.head) {
+    // execute([const, X|PC], XR, Vars, Cont, [Arg|Arest], Astack) :- !,
+    //     arg(X, XR, Arg),
+    //     execute(PC, XR, Vars, Cont, Arest, Astack).
+    case symbol("const"):
+        r := rest.(list)
+        s, a, arest, ok := cons(s)
+        if !ok {
+            return
+        }
+        if s, ok = unify(s, arg(s, r.head, xr), a); ok {
+            o.execute(s, r.tail, xr, vars, cont, arest, astack, k)
+        }
+    // execute([var, V|PC], XR, Vars, Cont, [Arg|Arest], Astack) :- !,
+    //     arg(V, Vars, Arg),
+    //     execute(PC, XR, Vars, Cont, Arest, Astack).
+    case symbol("var"):
+        r := rest.(list)
+        s, a, arest, ok := cons(s)
+        if !ok {
+            return
+        }
+        if s, ok = unify(s, arg(s, r.head, vars), a); ok {
+            o.execute(s, r.tail, xr, vars, cont, arest, astack, k)
+        }
+    // execute([functor, X|PC], XR, Vars, Cont, [Arg|Arest], Astack) :- !,
+    //     arg(X, XR, Fatom/Farity),
+    //     functor(Arg, Fatom, Farity),
+    //     Arg =.. [Fatom|Args],
+    //     execute(PC, XR, Vars, Cont, Args, [Arest|Astack]).
+    case symbol("functor"):
+        r := rest.(list)
+        s, a, arest, ok := cons(s)
+        if !ok {
+            return
+        }
+        f := walk(s, arg(s, r.head, xr)).(process)
+        fatom, farity := walk(s, f.args[0]).(symbol), walk(s, f.args[1]).(number)
+        fargs := []expression{}
+        switch t := walk(s, a).(type) {
+        case variable:
+            for i := 0; i < int(farity); i++ {
+                fargs = append(fargs, o.fresh())
+            }
+            s = s.put(t, compound(string(fatom), fargs))
+        case list:
+            if fatom != "." || farity != 2 {
+                return
+            }
+            fargs = []expression{t.head, t.tail}
+        case process:
+            if t.functor != string(fatom) || t.arity() != int(farity) {
+                return
+            }
+            fargs = t.args
+        default:
+            return
+        }
+        o.execute(s, r.tail, xr, vars, cont, makeList(fargs, emptylist), list{head: arest, tail: astack}, k)
+    // execute([pop|PC], XR, Vars, Cont, [], [Args|Astack]) :- !,
+    //     execute(PC, XR, Vars, Cont, Args, Astack).
+    case symbol("pop"):
+        s, ok := unify(s, args, emptylist)
+        if !ok {
+            return
+        }
+        a, as := o.fresh(), o.fresh()
+        if s, ok = unify(s, astack, list{head: a, tail: as}); ok {
+            o.execute(s, rest, xr, vars, cont, a, as, k)
+        }
+    // execute([enter|PC], XR, Vars, Cont, [], []) :- !,
+    //     execute(PC, XR, Vars, Cont, Args, Args).
+    case symbol("enter"):
+        s, ok := unify(s, args, emptylist)
+        if !ok {
+            return
+        }
+        if s, ok = unify(s, astack, emptylist); ok {
+            a := o.fresh()
+            o.execute(s, rest, xr, vars, cont, a, a, k)
+        }
+    // execute([call, X|PC], XR, Vars, Cont, [], Args) :- !,
+    //     arg(X, XR, procedure(Proc)),
+    //     arrive(Proc, Args, [frame(PC, XR, Vars)|Cont]).
+    case symbol("call"):
+        r := rest.(list)
+        s, ok := unify(s, args, emptylist)
+        if !ok {
+            return
+        }
+        p := walk(s, arg(s, r.head, xr)).(process)
+        frame := process{functor: "frame", args: []expression{r.tail, xr, vars}}
+        o.arrive(s, p.args[0], astack, list{head: frame, tail: cont}, k)
+    // execute([exit], _, _, [frame(PC, XR, Vars)|Cont], [], []) :- !,
+    //     execute(PC, XR, Vars, Cont, Args, Args).
+    // execute([exit], _, _, [], [], []) :- !.
+    case symbol("exit"):
+        s, ok := unify(s, args, emptylist)
+        if !ok {
+            return
+        }
+        if s, ok = unify(s, astack, emptylist); !ok {
+            return
+        }
+        if c, ok := walk(s, cont).(list); ok {
+            f := walk(s, c.head).(process)
+            a := o.fresh()
+            o.execute(s, f.args[0], f.args[1], f.args[2], c.tail, a, a, k)
+            return
+        }
+        k(s)
+    default:
+        panic(fmt.Sprintf("oracle: no execute clause for %s", code.head.PrintExpression()))
+    }
+}
+
+// at most this many answers are compared for each query
+const differentialMaxAnswers = 50
+
+// answer prints the args of the query as they are bound, renaming
+// variables in order of appearance so both sides can be compared
+func answer(s bindings, args []expression) string {
+    goal := process{functor: "answer", args: make([]expression, len(args))}
+    for i, a := range args {
+        goal.args[i] = walkstar(s, a)
+    }
+    return nameVariables(rule{head: goal}).head.String()
+}
+
+func runVM(rules []rule, query process, nvars int) ([]string, error) {
+    i := NewInterpreter(compileProcedures(rules))
+    answers := []string{}
+    _, err := i.solve(proc(query.functor, query.arity()), query.args, state{sub: i.store(), vc: nvars}, func(st state) bool {
+        answers = append(answers, answer(st.sub, query.args))
+        return len(answers) < differentialMaxAnswers
+    })
+    return answers, err
+}
+
+func runOracle(rules []rule, query process, nvars int) ([]string, error) {
+    o := newOracle(compileProcedures(rules))
+    o.vc = nvars
+    answers := []string{}
+    pi := indicator(functor(query.functor, query.arity()))
+    func() {
+        // the oracle has no other way to stop early than to unwind
+        defer func() {
+            if r := recover(); r != nil && r != errStopOracle {
+                panic(r)
+            }
+        }()
+        o.arrive(NewAVL(), pi, makeList(query.args, emptylist), emptylist, func(s bindings) {
+            answers = append(answers, answer(s, query.args))
+            if len(answers) >= differentialMaxAnswers {
+                panic(errStopOracle)
+            }
+        })
+    }()
+    return answers, o.err
+}
+
+var errStopOracle = fmt.Errorf("enough answers")
+
+// diverges runs the query both ways and describes any difference.
+// It returns errOracleSteps if the oracle gave up, when nothing is known.
+func diverges(rules []rule, query string) (string, error) {
+    p, b := MustParseProcesses(query)
+    got, gotErr := runVM(rules, p[0], len(b))
+    want, wantErr := runOracle(rules, p[0], len(b))
+    if wantErr == errOracleSteps {
+        return "", wantErr
+    }
+    if (gotErr != nil) != (wantErr != nil) {
+        return fmt.Sprintf("vm error %v, oracle error %v", gotErr, wantErr), nil
+    }
+    sort.Strings(got)
+    sort.Strings(want)
+    if strings.Join(got, "\n") != strings.Join(want, "\n") {
+        return fmt.Sprintf("vm answers %q, oracle answers %q", got, want), nil
+    }
+    return "", nil
+}
+
+// minimize drops whole clauses and then single body goals for as
+// long as the program keeps failing the check
+func minimize(rules []rule, fails func([]rule) bool) []rule {
+    for shrunk := true; shrunk; {
+        shrunk = false
+        for i := 0; i < len(rules); i++ {
+            candidate := append(append([]rule{}, rules[:i]...), rules[i+1:]...)
+            if fails(candidate) {
+                rules, shrunk = candidate, true
+                i--
+            }
+        }
+        for i := 0; i < len(rules); i++ {
+            for j := 0; j < len(rules[i].body); j++ {
+                r := rules[i]
+                r.body = append(append([]process{}, r.body[:j]...), r.body[j+1:]...)
+                candidate := append([]rule{}, rules...)
+                candidate[i] = r
+                if fails(candidate) {
+                    rules, shrunk = candidate, true
+                    j--
+                }
+            }
+        }
+    }
+    return rules
+}
+
+func reproducer(rules []rule, query string) string {
+    var sb strings.Builder
+    for _, r := range rules {
+        fmt.Fprintln(&sb, nameVariables(r))
+    }
+    fmt.Fprintf(&sb, "?- %s.", query)
+    return sb.String()
+}
+
+func checkDifferential(t *testing.T, name string, rules []rule, query string) {
+    t.Helper()
+    d, err := diverges(rules, query)
+    if err != nil {
+        // an unchecked case must not pass as one that agrees
+        t.Errorf("%s: %s: %v", name, query, err)
+        return
+    }
+    if d == "" {
+        return
+    }
+    min := minimize(rules, func(rs []rule) bool {
+        defer func() { recover() }()
+        d, err := diverges(rs, query)
+        return err == nil && d != ""
+    })
+    t.Errorf("%s: %s\nminimized reproducer:\n%s", name, d, reproducer(min, query))
+}
+
+var differentialCorpus = []struct{
+    name    string
+    program string
+    queries []string
+}{
+    {
+        name:    "append",
+        program: appendRules + `
+            app([], L, L).
+            app([X|L1], L2, [X|L3]) :- app(L1, L2, L3).`,
+        queries: []string{
+            "append(cons(a, cons(b, nil)), cons(c, nil), L)",
+            "append(L, X, cons(a, cons(b, cons(c, nil))))",
+            "app(X, Y, [1,2,3,4])",
+            "app([A|B], C, [x,y])",
+            "app(X, [c], Y)",
+        },
+    },
+    {
+        name: "arithmetic",
+        program: `
+            len([], 0).
+            len([_|T], N) :- len(T, M), N is M + 1.
+            fib(0, 0).
+            fib(1, 1).
+            fib(N, F) :- N > 1, N1 is N - 1, N2 is N - 2, fib(N1, F1), fib(N2, F2), F is F1 + F2.
+            between(L, H, L) :- L =< H.
+            between(L, H, X) :- L < H, L1 is L + 1, between(L1, H, X).`,
+        queries: []string{
+            "len([a,b,c,d], N)",
+            "fib(10, F)",
+            "between(1, 5, X)",
+        },
+    },
+    {
+        name: "nested terms",
+        program: `
+            p(f(X, g(Y, [X|Y])), Y).
+            p(h, [a]).
+            q(X, Y) :- p(X, Y), r(Y).
+            r([]).
+            r([_|T]) :- r(T).
+            s(X) :- q(f(A, g(B, C)), X), t(foo(A, B, C)).
+            t(foo(_, _, _)).`,
+        queries: []string{
+            "p(A, B)",
+            "q(A, B)",
+            "q(f(1, g(Y, Z)), [2])",
+            "s(X)",
+        },
+    },
+}
+
+func TestDifferential(t *testing.T) {
+    for _, tt := range differentialCorpus {
+        rules := MustParseRules(tt.program)
+        for _, q := range tt.queries {
+            checkDifferential(t, tt.name, rules, q)
+        }
+    }
+    if testing.Short() {
+        return
+    }
+    for _, tt := range benchmarkPrograms {
+        if tt.name != "nrev" && tt.name != "zebra" {
+            continue // the others use cut, which bowen.pl does not have
+        }
+        checkDifferential(t, tt.name, loadRules(t, tt.file), tt.query)
+    }
+}
+
+// Random facts and queries: mostly a test of head matching and unification
+func TestDifferentialRandom(t *testing.T) {
+    r := rand.New(rand.NewSource(1))
+    for n := 0; n < 200; n++ {
+        rules := []rule{}
+        for i := r.Intn(5) + 1; i > 0; i-- {
+            rr := randomRule{}.Generate(r, 0).Interface().(randomRule).rule
+            rr.head.functor = "p"
+            rr.head.args = append(rr.head.args, symbol("x"), symbol("y"))[:2]
+            rr.body = nil
+            rules = append(rules, rr)
+        }
+        q := randomRule{}.Generate(r, 0).Interface().(randomRule).rule.head
+        q.functor = "p"
+        q.args = append(q.args, variable(0), variable(1))[:2]
+        query := nameVariables(rule{head: q}).head.String()
+        checkDifferential(t, fmt.Sprintf("random %d", n), rules, query)
+    }
+}
+
+func TestMinimize(t *testing.T) {
+    rules := MustParseRules(`
+        a(1).
+        b(X) :- a(X), c(X), d(X).
+        c(2).
+        d(3).`)
+    // pretend the bug is in calling d from b
+    fails := func(rs []rule) bool {
+        for _, r := range rs {
+            for _, g := range r.body {
+                if r.head.functor == "b" && g.functor == "d" {
+                    return true
+                }
+            }
+        }
+        return false
+    }
+    got := reproducer(minimize(rules, fails), "b(X)")
+    want := "b(A) :- d(A).\n?- b(X)."
+    if got != want {
+        t.Errorf("got %s want %s", got, want)
+    }
+}
+
+func loadRules(tb testing.TB, file string) []rule {
+    tb.Helper()
+    p := loadProgram(tb, file)
+    rules := []rule{}
+    p.program().eachProcedure(func(_ procEntry, proc procedure) {
+        rs, err := proc.decompile()
+        if err != nil {
+            tb.Fatal(err)
+        }
+        rules = append(rules, rs...)
+    })
+    return rules
+}
+
+// a case the oracle gives up on is not one it agrees with
+func TestDifferentialOracleSteps(t *testing.T) {
+    rules := MustParseRules(`
+        d(0). d(1). d(2). d(3). d(4). d(5). d(6). d(7). d(8). d(9).
+        q :- d(_), d(_), d(_), d(_), d(_), d(none).`)
+    if d, err := diverges(rules, "q"); err != errOracleSteps {
+        t.Errorf("got %q, %v want %v", d, err, errOracleSteps)
+    }
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "strings"
+)
+
+var opcodeNames = map[instruction]string{
+    CONST:   "const",
+    VAR:     "var",
+    FUNCTOR: "functor",
+    POP:     "pop",
+    ENTER:   "enter",
+    CALL:    "call",
+    EXIT:    "exit",
+    COMMIT:  "commit",
+    TRY:     "try",
+    JUMP:    "jump",
+    MARK:    "mark",
+    CUT:     "cut",
+}
+
+func (i instruction) String() string {
+    if s, ok := opcodeNames[i]; ok {
+        return s
+    }
+    return fmt.Sprintf("instruction(%d)", int64(i))
+}
+
+// hasOperand is true for instructions followed by an xr index, var number
+// or offset
+func (i instruction) hasOperand() bool {
+    return i == CONST || i == VAR || i == FUNCTOR || i == CALL || i == MARK || i == CUT || i.isJump()
+}
+
+// isJump is true for instructions whose operand is how many instructions
+// further to go on
+func (i instruction) isJump() bool {
+    return i == TRY || i == JUMP
+}
+
+// disassembled instructions, with operands resolved through the xr table.
+// Malformed code does not make this panic: it is meant for debugging.
+func (c clause) instructions() []string {
+    out := []string{}
+    for pc := 0; pc < len(c.bytecodes); pc++ {
+        ins := c.bytecodes[pc]
+        if !ins.hasOperand() {
+            out = append(out, ins.String())
+            continue
+        }
+        if pc+1 >= len(c.bytecodes) {
+            out = append(out, fmt.Sprintf("%s ?", ins))
+            continue
+        }
+        pc++
+        operand := c.bytecodes[pc]
+        if ins == VAR || ins == MARK || ins == CUT || ins.isJump() {
+            out = append(out, fmt.Sprintf("%s %d", ins, operand))
+            continue
+        }
+        if operand < 0 || int(operand) >= len(c.xrTable) {
+            out = append(out, fmt.Sprintf("%s ?%d", ins, operand))
+            continue
+        }
+        out = append(out, fmt.Sprintf("%s %s", ins, c.xrTable[operand].printEntry()))
+    }
+    return out
+}
+
+func (c clause) String() string {
+    xr := []string{}
+    for _, e := range c.xrTable {
+        xr = append(xr, e.printEntry())
+    }
+    return fmt.Sprintf("clause(xrtable(%s), %d, [%s])", strings.Join(xr, ", "), c.numVars, strings.Join(c.instructions(), ", "))
+}
+
+// disassemble writes the code of each clause, one instruction per line,
+// indenting the arguments of a functor until its pop
+func (p procedure) disassemble(w io.Writer) {
+    fmt.Fprintf(w, "%s/%d:\n", p.name, p.arity)
+    for n, c := range p.clauses {
+        fmt.Fprintf(w, "  clause %d, %d vars\n", n, c.numVars)
+        depth := 0
+        for _, ins := range c.instructions() {
+            if ins == "pop" {
+                depth = max(depth-1, 0)
+            }
+            fmt.Fprintf(w, "    %s%s\n", strings.Repeat("  ", depth), ins)
+            if strings.HasPrefix(ins, "functor") {
+                depth++
+            }
+        }
+    }
+}
@@ -0,0 +1,251 @@
+package main
+
+import "fmt"
+
+// Source-to-source transforms written in Prolog. While a file is loaded,
+// every clause read is given to term_expansion(Term, Expanded) and every
+// goal of a body to goal_expansion(Goal, Expanded), if they are defined
+// by then. That includes the goals inside control constructs and in the
+// meta args of meta predicates. A clause can expand to a list of clauses,
+// or [] for none; a goal expands to a goal or conjunction, which is
+// expanded again until goal_expansion gives a variant of it or no longer
+// applies. Grammar rules are translated after
+// term_expansion, so it gets them as they were written.
+//
+// The hooks run on a program of everything loaded so far, so they can
+// use what is defined before them in the same file. The clauses read
+// wait until a hook is about to run to be added to it, all at once.
+
+// maxGoalExpansions stops a goal_expansion that never stops applying
+const maxGoalExpansions = 1000
+
+// hook tells if the expansion hook pe is defined yet
+func (l *loader) hook(pe procEntry) bool {
+    if l.expander == nil {
+        return false
+    }
+    l.flush()
+    _, ok := l.expander.program().procedure(pe)
+    return ok
+}
+
+// callHook calls the hook pe with arg, and gets the expansion of its
+// first answer with the state after it. Variables of arg that the hook
+// binds are bound in that state, which st has to have room for.
+func (l *loader) callHook(pe procEntry, arg expression, st state) (expression, state, bool, error) {
+    out := variable(st.vc)
+    st.vc++
+    var ans state
+    found := false
+    _, err := l.expander.solve(pe, []expression{arg, out}, st, func(s state) bool {
+        ans, found = s, true
+        return false
+    })
+    if err != nil {
+        return nil, st, false, fmt.Errorf("%s: %w", pe.printEntry(), err)
+    }
+    if !found {
+        return nil, st, false, nil
+    }
+    return walkstar(ans.sub, out), ans, true, nil
+}
+
+// expandTerm gets the rules a clause term read in module expands to
+func (l *loader) expandTerm(module string, t expression) ([]rule, error) {
+    pe := moduleProc(module, "term_expansion", 2)
+    if !l.hook(pe) {
+        r, err := termRule(t)
+        if err != nil {
+            return nil, err
+        }
+        return []rule{r}, nil
+    }
+    out, _, ok, err := l.callHook(pe, t, state{sub: l.expander.store(), vc: int(nextVariable(t))})
+    if err != nil {
+        return nil, err
+    }
+    terms := []expression{t}
+    if ok {
+        terms = []expression{out}
+        if elems, isList := listElements(out); isList {
+            terms = elems
+        }
+    }
+    rules := []rule{}
+    for _, t := range terms {
+        r, err := termRule(t)
+        if err != nil {
+            return nil, err
+        }
+        rules = append(rules, renumberVariables(r))
+    }
+    return rules, nil
+}
+
+// expandGoals expands the goals of the body of a rule read in module,
+// and the goals inside them: in control constructs and the meta args of
+// calls to meta predicates
+func (l *loader) expandGoals(module string, imports map[functorEntry]procEntry, r rule) (rule, error) {
+    pe := moduleProc(module, "goal_expansion", 2)
+    if !l.hook(pe) || (r.guard == nil && r.body == nil) {
+        return r, nil
+    }
+    next := nextVariable(r.head)
+    for _, g := range append(append([]process{}, r.guard...), r.body...) {
+        next = max(next, nextVariable(g))
+    }
+    // the bindings the hooks made so far, for the whole rule
+    st := state{sub: l.expander.store(), vc: int(next)}
+    expansions := 0
+    var expandGoal func(g expression) (expression, error)
+    expandGoal = func(g expression) (expression, error) {
+        for !isVariable(g) && !isConjunction(g) {
+            e, after, ok, err := l.callHook(pe, g, st)
+            if err != nil {
+                return nil, err
+            }
+            if !ok || isVariant(e, walkstar(after.sub, g)) {
+                break
+            }
+            if expansions++; expansions > maxGoalExpansions {
+                return nil, fmt.Errorf("goal_expansion of %s does not stop", g.PrintExpression())
+            }
+            if _, err := toProcess(e); err != nil {
+                return nil, typeError("callable", e)
+            }
+            st, g = after, e
+        }
+        p, ok := g.(process)
+        if !ok {
+            return g, nil
+        }
+        spec := l.goalSpec(module, imports, p)
+        args := append([]expression{}, p.args...)
+        for i, s := range spec {
+            if s != "0" {
+                continue
+            }
+            arg, err := expandGoal(args[i])
+            if err != nil {
+                return nil, err
+            }
+            args[i] = arg
+        }
+        return process{functor: p.functor, args: args}, nil
+    }
+    expand := func(goals []process) ([]process, error) {
+        if goals == nil {
+            return nil, nil
+        }
+        out := []process{}
+        for _, g := range goals {
+            e, err := expandGoal(goalTerm(g))
+            if err != nil {
+                return nil, err
+            }
+            more, err := toGoals(e)
+            if err != nil {
+                return nil, typeError("callable", e)
+            }
+            out = append(out, more...)
+        }
+        return out, nil
+    }
+    guard, err := expand(r.guard)
+    if err != nil {
+        return rule{}, err
+    }
+    body, err := expand(r.body)
+    if err != nil {
+        return rule{}, err
+    }
+    if expansions == 0 {
+        return r, nil
+    }
+    r.guard, r.body = guard, body
+    r = r.mapVariables(func(v variable) expression {
+        return walkstar(st.sub, v)
+    })
+    return renumberVariables(r), nil
+}
+
+// goalSpec is the meta_predicate spec of a goal read in module, which
+// says which of its args are goals: a conjunction is taken as one
+func (l *loader) goalSpec(module string, imports map[functorEntry]procEntry, g process) []string {
+    if isConjunction(g) {
+        return []string{"0", "0"}
+    }
+    if pe, ok := imports[functor(g.functor, g.arity())]; ok {
+        return l.meta[pe]
+    }
+    if spec, ok := l.meta[moduleProc(module, g.functor, g.arity())]; ok {
+        return spec
+    }
+    return builtinMeta[proc(g.functor, g.arity())]
+}
+
+func isConjunction(e expression) bool {
+    p, ok := e.(process)
+    return ok && p.functor == Comma && p.arity() == 2
+}
+
+// definesHook tells if r is a clause of an expansion hook
+func definesHook(module string, r rule) bool {
+    if _, ok := r.directive(); ok {
+        return false
+    }
+    pe, _ := qualifiedHead(module, r.head)
+    return pe.arity == 2 && (pe.name == "term_expansion" || pe.name == "goal_expansion")
+}
+
+// startExpanding makes the program the hooks run on, once the first
+// of them is read: what is loaded, and the rules and imports of the file
+// read so far
+func (l *loader) startExpanding(module string, rules []rule, imports map[functorEntry]procEntry) {
+    procs := append(append([]procedure{}, l.procs...), compileModule(module, rules)...)
+    l.expander = NewInterpreter(append(procs, importProcedures(module, imports)...))
+}
+
+// a learnt clause is read but not yet in the program the hooks run on
+type learnt struct {
+    pe procEntry
+    c  clause
+}
+
+// learn adds a clause read to the program the hooks run on, once flushed
+func (l *loader) learn(module string, r rule) {
+    if l.expander == nil {
+        return
+    }
+    if _, ok := r.directive(); ok {
+        return
+    }
+    pe, head := qualifiedHead(module, r.head)
+    r.head = head
+    l.pending = append(l.pending, learnt{pe, compileClause(renumberVariables(r))})
+}
+
+// flush adds the clauses learnt since the last flush to the program the
+// hooks run on
+func (l *loader) flush() {
+    if len(l.pending) == 0 {
+        return
+    }
+    l.expander.update(func(p *Program) (*Program, error) {
+        for _, cl := range l.pending {
+            p = p.assertz(cl.pe, cl.c)
+        }
+        return p, nil
+    })
+    l.pending = nil
+}
+
+// install replaces procedures of the program the hooks run on. The
+// clauses learnt before go in first, to be replaced with the rest.
+func (l *loader) install(procs ...procedure) {
+    if l.expander == nil {
+        return
+    }
+    l.flush()
+    l.expander.install(procs...)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+var expansionSource = `
+    p(0).
+    term_expansion(double(X), [X, X]).
+    term_expansion(skip(_), []).
+    term_expansion((H --> B), (H --> (B, [end]))).
+    term_expansion(counted(N), count(M)) :- succ(N, M).
+    succ(N, M) :- M is N + 1.
+    goal_expansion(sq(X, Y), Y is X * X).
+    goal_expansion(twice(G), (G, G)).
+    goal_expansion(foo(X), bar(X)).
+    goal_expansion(fresh(_), fresh(_)).
+    double(p(1)).
+    skip(q(1)).
+    q(2).
+    counted(1).
+    area(S, A) :- sq(S, A).
+    r :- twice(writeln(hi)).
+    g --> [a].
+    bar(1).
+    fresh(_).
+    p1(X) :- foo(X).
+    p2(X) :- (fail ; foo(X)).
+    p3(X) :- (true -> foo(X)).
+    p4 :- \+ foo(2).
+    p5(X) :- call(foo(X)).
+    p6 :- fresh(a).
+`
+
+func writeSource(t *testing.T, src string) string {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), "src.pl")
+    if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func TestExpansion(t *testing.T) {
+    procs, err := loadFile(writeSource(t, expansionSource))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var out strings.Builder
+    i := NewInterpreter(procs)
+    i.setOutput(&out)
+    for _, tt := range []struct{
+        query string
+        vars  []string
+        want  []string
+    }{
+        // clauses read before a hook are not expanded
+        {query: "p(X)", vars: []string{"X"}, want: []string{"0", "1", "1"}},
+        {query: "q(X)", vars: []string{"X"}, want: []string{"2"}},
+        {query: "count(X)", vars: []string{"X"}, want: []string{"2"}},
+        {query: "area(3, A)", vars: []string{"A"}, want: []string{"9"}},
+        {query: "r", want: []string{""}},
+        // term_expansion gets grammar rules before they are translated
+        {query: "phrase(g, [a, end])", want: []string{""}},
+        {query: "phrase(g, [a])", want: []string{}},
+        // goals inside control constructs and meta args are expanded
+        {query: "p1(X)", vars: []string{"X"}, want: []string{"1"}},
+        {query: "p2(X)", vars: []string{"X"}, want: []string{"1"}},
+        {query: "p3(X)", vars: []string{"X"}, want: []string{"1"}},
+        {query: "p4", want: []string{""}},
+        {query: "p5(X)", vars: []string{"X"}, want: []string{"1"}},
+        // an expansion to a variant of the goal is where it stops
+        {query: "p6", want: []string{""}},
+    }{
+        got, err := answers(i, tt.query, tt.vars...)
+        if err != nil {
+            t.Errorf("%s: %v", tt.query, err)
+            continue
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: got %v want %v", tt.query, got, tt.want)
+        }
+    }
+    if out.String() != "hi\nhi\n" {
+        t.Errorf("wrote %q", out.String())
+    }
+    out.Reset()
+    mustInterpret(t, i, "listing(area/2)")
+    if want := "area(A,B) :- B is A*A.\n\n"; out.String() != want {
+        t.Errorf("got %q want %q", out.String(), want)
+    }
+}
+
+func TestExpansionErrors(t *testing.T) {
+    for _, src := range []string{
+        "term_expansion(a, 3).\na.",
+        "term_expansion(a, _) :- X is foo + 1.\na.",
+        "goal_expansion(a, (a, true)).\nb :- a.",
+        "goal_expansion(a, 1).\nb :- a.",
+    }{
+        if _, err := loadFile(writeSource(t, src)); err == nil {
+            t.Errorf("%q: expected error", src)
+        }
+    }
+}
+
+// Reading a clause after a hook is defined must not copy what was read
+// before it, so loading takes about as long per clause however many
+// there are
+func TestExpansionScales(t *testing.T) {
+    if testing.Short() {
+        t.Skip("times loading")
+    }
+    load := func(n int) time.Duration {
+        var sb strings.Builder
+        sb.WriteString("term_expansion(skip, []).\n")
+        for k := range n {
+            fmt.Fprintf(&sb, "f(%d).\n", k)
+        }
+        path := writeSource(t, sb.String())
+        start := time.Now()
+        procs, err := loadFile(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if p := procs[len(procs)-1]; len(p.clauses) != n {
+            t.Fatalf("%d clauses want %d", len(p.clauses), n)
+        }
+        return time.Since(start)
+    }
+    load(1000)
+    small, large := load(2000), load(16000)
+    // 8 times as many clauses; quadratic loading takes 64 times as long
+    if large > 24*small {
+        t.Errorf("loading 2000 clauses took %v, 16000 took %v", small, large)
+    }
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "strings"
+)
+
+// A Proof is how a goal was proven: by which clause of its procedure, and
+// the proofs of the goals in the body of that clause. Builtins have no
+// clause; control constructs like call/1 have the goals they called.
+type Proof struct {
+    Goal     expression // with the bindings at its exit
+    Proc     procEntry
+    Clause   int      // from 1, 0 for builtins
+    Pos      position // of the clause
+    Tabled   bool     // answered from a table, so without a proof of its own
+    Children []*Proof
+}
+
+// String writes the proof as a tree, a goal per line, indenting the
+// proofs of the body under the goal
+func (p *Proof) String() string {
+    var sb strings.Builder
+    p.write(&sb, 0)
+    return sb.String()
+}
+
+func (p *Proof) write(sb *strings.Builder, depth int) {
+    fmt.Fprintf(sb, "%s%s", strings.Repeat("    ", depth), p.Goal.PrintExpression())
+    switch {
+    case p.Tabled:
+        sb.WriteString("  % table")
+    case p.Clause == 0:
+        sb.WriteString("  % builtin")
+    case p.Pos.line == 0:
+        fmt.Fprintf(sb, "  %% clause %d of %s", p.Clause, p.Proc.printEntry())
+    default:
+        fmt.Fprintf(sb, "  %% clause %d of %s, %s", p.Clause, p.Proc.printEntry(), p.Pos)
+    }
+    sb.WriteString("\n")
+    for _, c := range p.Children {
+        c.write(sb, depth+1)
+    }
+}
+
+// An Explanation is an answer to a query with the proof of it
+type Explanation struct {
+    Bindings map[string]expression
+    Proof    *Proof
+}
+
+// an exit is a goal leaving through its exit port while explaining.
+// Exits form a list, newest first, that backtracking cuts back to what
+// it was when the goal gone back into was called.
+type exit struct {
+    inv  *invocation
+    goal expression
+    prev *exit
+}
+
+// startExplaining has the machine keep what it needs to prove its answers
+func (m *machine) startExplaining() {
+    m.startTracing()
+    m.trace.explain = true
+}
+
+// proof builds the proof of the answer just found from the exits
+func (t *tracing) proof() *Proof {
+    exits := []*exit{}
+    for e := t.exits; e != nil; e = e.prev {
+        exits = append(exits, e)
+    }
+    var root *Proof
+    children := map[*invocation][]*Proof{}
+    // goals exit after the goals in their body, so oldest first the
+    // children of a goal are all there by the time it exits
+    for n := len(exits) - 1; n >= 0; n-- {
+        e := exits[n]
+        p := &Proof{Goal: e.goal, Proc: e.inv.p, Tabled: e.inv.tabled, Children: children[e.inv]}
+        if e.inv.clauses != nil {
+            p.Clause = e.inv.clause + 1
+            p.Pos = e.inv.clauses[e.inv.clause].pos
+        }
+        delete(children, e.inv)
+        if e.inv.parent == nil {
+            root = p
+            continue
+        }
+        children[e.inv.parent] = append(children[e.inv.parent], p)
+    }
+    return root
+}
+
+// Explain answers a query like interpret does, with the proof of every answer
+func (i *interpreter) Explain(s string) ([]Explanation, error) {
+    return i.explainContext(context.Background(), s, Limits{})
+}
+
+func (i *interpreter) explainContext(ctx context.Context, s string, limits Limits) ([]Explanation, error) {
+    goals, vars, err := ParseProcesses(s)
+    if err != nil {
+        return nil, err
+    }
+    goal := queryGoal(goals)
+    m := i.newMachine(ctx, state{sub: i.store(), vc: len(vars)}, limits)
+    m.startExplaining()
+    defer m.trace.finish()
+    out := []Explanation{}
+    m.run(proc(goal.functor, goal.arity()), goal.args, func(ans state) bool {
+        out = append(out, Explanation{Bindings: answerBindings(ans, vars), Proof: m.trace.proof()})
+        return true
+    })
+    return out, m.err
+}
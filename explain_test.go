@@ -0,0 +1,104 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestExplain(t *testing.T) {
+    for _, s := range stores {
+        i := NewInterpreter(compileProcedures(MustParseRules(traceRules)))
+        i.setStore(s.store)
+        for _, tt := range []struct{
+            query string
+            want  []string
+        }{
+            {
+                query: "p(X)",
+                want:  []string{`p(2)  % clause 1 of p/1, line 2
+    q(2)  % clause 2 of q/1, line 4
+    r(2)  % clause 1 of r/1, line 5
+`},
+            },
+            {
+                query: "q(X)",
+                want:  []string{
+                    "q(1)  % clause 1 of q/1, line 3\n",
+                    "q(2)  % clause 2 of q/1, line 4\n",
+                },
+            },
+            {
+                query: "s(X)",
+                want:  []string{`s(b)  % clause 1 of s/1, line 6
+    member(b,[a,b])  % clause 2 of member/2, library:3
+        member(b,[b])  % clause 1 of member/2, library:2
+    b \= a  % builtin
+`},
+            },
+            {
+                query: "q(X), r(X)",
+                want:  []string{`call((q(2),r(2)))  % builtin
+    q(2)  % clause 2 of q/1, line 4
+    r(2)  % clause 1 of r/1, line 5
+`},
+            },
+            {
+                query: "r(1)",
+                want:  []string{},
+            },
+        }{
+            ex, err := i.Explain(tt.query)
+            if err != nil {
+                t.Errorf("%s: %s: %v", s.name, tt.query, err)
+                continue
+            }
+            got := []string{}
+            for _, e := range ex {
+                got = append(got, e.Proof.String())
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("%s: %s: got\n%s\nwant\n%s", s.name, tt.query, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+            }
+        }
+    }
+}
+
+// Explaining gives the same answers as interpret
+func TestExplainAnswers(t *testing.T) {
+    i := loadProgram(t, "testdata/nrev.pl")
+    ex, err := i.Explain("nrev([1,2,3], L)")
+    if err != nil || len(ex) != 1 {
+        t.Fatalf("got %v, %v", ex, err)
+    }
+    want := mustInterpret(t, i, "nrev([1,2,3], L)")[0]
+    if !reflect.DeepEqual(ex[0].Bindings, want) {
+        t.Errorf("got %v want %v", ex[0].Bindings, want)
+    }
+    p := ex[0].Proof
+    if p.Proc != proc("nrev", 2) || p.Clause != 2 || len(p.Children) != 2 {
+        t.Errorf("got %s", p)
+    }
+}
+
+func TestREPLExplain(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(traceRules)))
+    in := strings.Join([]string{
+        "explain p(X).",
+        "explain q(X).", ";",
+    }, "\n")
+    var sb strings.Builder
+    runREPL(i, strings.NewReader(in), &sb)
+    want := `?- p(2)  % clause 1 of p/1, line 2
+    q(2)  % clause 2 of q/1, line 4
+    r(2)  % clause 1 of r/1, line 5
+X = 2.
+?- q(1)  % clause 1 of q/1, line 3
+X = 1 q(2)  % clause 2 of q/1, line 4
+X = 2.
+?- 
+`
+    if got := sb.String(); got != want {
+        t.Errorf("got\n%s\nwant\n%s", got, want)
+    }
+}
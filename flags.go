@@ -0,0 +1,92 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+)
+
+// set_prolog_flag(Flag, Value) changes a flag of the program, for every
+// query that starts after it
+func builtinSetPrologFlag(m *machine, args []expression) bool {
+    name, err := m.atomArg(args[0])
+    if err != nil {
+        return m.throw(err)
+    }
+    if _, ok := defaultFlags[name]; !ok {
+        return m.throw(fmt.Errorf("domain error: prolog_flag expected, found %s", name))
+    }
+    values, ok := changeableFlags[name]
+    if !ok {
+        return m.throw(fmt.Errorf("permission error: cannot modify flag %s", name))
+    }
+    v := walkstar(m.state.sub, args[1])
+    if isVariable(v) {
+        return m.throw(errInstantiation)
+    }
+    for _, w := range values {
+        if w == v {
+            m.program, _ = m.update(func(prog *Program) (*Program, error) {
+                return prog.setFlag(name, v), nil
+            })
+            return true
+        }
+    }
+    return m.throw(fmt.Errorf("domain error: flag_value expected, found %s", v.PrintExpression()))
+}
+
+// current_prolog_flag(Flag, Value) is true for every flag and its value
+// in the program the query sees
+func generateCurrentPrologFlag(m *machine, args []expression) ([]clause, error) {
+    switch f := walk(m.state.sub, args[0]).(type) {
+    case variable:
+    case symbol:
+    default:
+        return nil, typeError("atom", f)
+    }
+    names := []string{}
+    for name := range defaultFlags {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    clauses := []clause{}
+    for _, name := range names {
+        v, _ := m.program.flag(name)
+        fact := rule{head: process{functor: "current_prolog_flag", args: []expression{symbol(name), v}}}
+        clauses = append(clauses, compileClause(fact))
+    }
+    return clauses, nil
+}
+
+// current_atom(A) is true for every atom in the atom table, in order
+func generateCurrentAtom(m *machine, args []expression) ([]clause, error) {
+    switch a := walk(m.state.sub, args[0]).(type) {
+    case variable:
+    case symbol:
+        if _, ok := m.program.atoms.get(atom(a)); !ok {
+            return nil, nil
+        }
+        return []clause{compileClause(rule{head: process{functor: "current_atom", args: []expression{a}}})}, nil
+    default:
+        return nil, typeError("atom", a)
+    }
+    clauses := []clause{}
+    m.program.atoms.each(func(a atom, _ struct{}) {
+        fact := rule{head: process{functor: "current_atom", args: []expression{symbol(a)}}}
+        clauses = append(clauses, compileClause(fact))
+    })
+    return clauses, nil
+}
+
+// unknownProcedure does what the unknown flag says to when p does not
+// exist: throw, fail, or warn and fail
+func (m *machine) unknownProcedure(p procEntry) bool {
+    v, _ := m.program.flag("unknown")
+    switch v {
+    case symbol("fail"):
+        return false
+    case symbol("warning"):
+        fmt.Fprintf(m.out, "Warning: unknown procedure %s\n", p.printEntry())
+        return false
+    }
+    return m.throw(fmt.Errorf("unknown procedure %s", p.printEntry()))
+}
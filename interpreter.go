@@ -1,107 +1,437 @@
 package main
 
+import (
+    "context"
+    "io"
+    "os"
+    "sort"
+    "strings"
+    "sync/atomic"
+)
+
+// An interpreter answers queries against the latest version of its
+// program. It is safe for concurrent use: each query runs on its own
+// machine against the program as it was when the query started, and
+// changes publish a new program rather than modifying the old one.
 type interpreter struct {
-    procedures map[procEntry]procedure
+    latest   atomic.Pointer[Program]
+    config   atomic.Pointer[settings]
+    debug    *debugger
+    profile  *Profile  // when set, every query adds to it
+    coverage *Coverage // likewise
+}
+
+// settings are how an interpreter runs queries. They are replaced as a
+// whole, so a query that has started keeps the ones it started with.
+type settings struct {
+    store    func() bindings // a fresh binding store for each query
+    out      io.Writer       // where builtins write output
+    parallel ParallelOptions
 }
 
+// NewInterpreter panics if the procedures do not verify
 func NewInterpreter(procedures []procedure) *interpreter {
-    procs := map[procEntry]procedure{}
-    for _, p := range procedures {
-        procs[proc(p.name, p.arity)] = p
+    p, err := NewProgram(procedures)
+    if err != nil {
+        panic(err)
+    }
+    i := &interpreter{debug: newDebugger()}
+    i.latest.Store(p)
+    i.config.Store(&settings{store: newSubstitution, out: os.Stdout})
+    return i
+}
+
+// configure publishes the settings with change applied
+func (i *interpreter) configure(change func(*settings)) {
+    for {
+        old := i.config.Load()
+        s := *old
+        change(&s)
+        if i.config.CompareAndSwap(old, &s) {
+            return
+        }
     }
-    return &interpreter{procedures: procs}
+}
+
+func (i *interpreter) setStore(store func() bindings) {
+    i.configure(func(s *settings) { s.store = store })
+}
+
+func (i *interpreter) setOutput(out io.Writer) {
+    i.configure(func(s *settings) { s.out = out })
+}
+
+func (i *interpreter) setParallel(opts ParallelOptions) {
+    i.configure(func(s *settings) { s.parallel = opts })
+}
+
+// store makes a fresh binding store of the kind queries use
+func (i *interpreter) store() bindings {
+    return i.config.Load().store()
+}
+
+func (i *interpreter) program() *Program {
+    return i.latest.Load()
+}
+
+// update publishes change applied to the latest program. If another
+// query publishes first, change is applied again on top of that.
+func (i *interpreter) update(change func(*Program) (*Program, error)) (*Program, error) {
+    for {
+        old := i.latest.Load()
+        p, err := change(old)
+        if err != nil {
+            return nil, err
+        }
+        if i.latest.CompareAndSwap(old, p) {
+            return p, nil
+        }
+    }
+}
+
+// install verifies procedures and then adds them, replacing any
+// procedure with the same name and arity. If any procedure does not
+// verify, nothing is installed.
+func (i *interpreter) install(procedures ...procedure) error {
+    _, err := i.update(func(p *Program) (*Program, error) {
+        return p.install(procedures...)
+    })
+    return err
+}
+
+func newSubstitution() bindings {
+    return NewAVL()
+}
+
+func newTrail() bindings {
+    return NewTrail()
 }
 
 // return all possible bindings. will overflow on infinite answers
-// proper support for backtracking would have to make this interactive
-// or support run* / runN difference (ie early return)
-func (i *interpreter) interpret(s string) []map[string]expression {
-    p, b := MustParseProcesses(s)
-    // parsing assigned some variables to vars in query
-    st := state{vc: len(b)}
+// use solve directly to stop early
+func (i *interpreter) interpret(s string) ([]map[string]expression, error) {
+    return i.interpretContext(context.Background(), s, Limits{})
+}
 
-    // TODO: multiple processes in query
-    input := arriveInput{
-        p: proc(p[0].functor, p[0].arity()),
-        args: p[0].args,
-        state: st,
+// interpretContext is interpret for queries that might not terminate:
+// it stops with an error when ctx is done or a limit is exceeded
+func (i *interpreter) interpretContext(ctx context.Context, s string, limits Limits) ([]map[string]expression, error) {
+    p, b, err := ParseProcesses(s)
+    if err != nil {
+        return nil, err
     }
+    // parsing assigned some variables to vars in query
+    st := state{sub: i.store(), vc: len(b)}
+    g := queryGoal(p)
     out := []map[string]expression{}
-    for _, ans := range i.arrive(input) {
-        m := map[string]expression{}
-        for s, v := range b {
-            e, ok := ans.sub.get(v)
-            if !ok {
-                m[s] = v
-                continue
-            }
-            e = ans.sub.walkstar(e)
-            m[s] = e
+    _, err = i.solveContext(ctx, proc(g.functor, g.arity()), g.args, st, limits, func(ans state) bool {
+        out = append(out, answerBindings(ans, b))
+        return true
+    })
+    return out, err
+}
+
+// queryGoal is the goal that runs the goals of a query, in a call/1
+// if there is more than one
+func queryGoal(goals []process) process {
+    if len(goals) == 1 {
+        return goals[0]
+    }
+    return process{functor: "call", args: []expression{conjunction(goals)}}
+}
+
+// answerBindings are the values of the named variables of a query. Goals
+// left waiting on them, like those of freeze/2, are a list under residualKey.
+func answerBindings(ans state, vars map[string]variable) map[string]expression {
+    m := map[string]expression{}
+    names := []string{}
+    for s := range vars {
+        if !strings.HasPrefix(s, "_") {
+            names = append(names, s)
+        }
+    }
+    sort.Slice(names, func(i, j int) bool { return vars[names[i]] < vars[names[j]] })
+    values := []expression{}
+    for _, s := range names {
+        m[s] = walkstar(ans.sub, vars[s])
+        values = append(values, m[s])
+    }
+    if ans.attributed {
+        if goals := residualGoals(ans, values); len(goals) > 0 {
+            m[residualKey] = makeList(goals, emptylist)
+        }
+    }
+    return m
+}
+
+// residualKey cannot clash with the name of a variable
+const residualKey = "$residual"
+
+// solve calls yield with every state in which the goal p(args) holds,
+// until yield returns false, there are no more answers or an error occurs
+func (i *interpreter) solve(p procEntry, args []expression, st state, yield func(state) bool) (stats, error) {
+    return i.solveContext(context.Background(), p, args, st, Limits{}, yield)
+}
+
+// solveContext is solve within limits, stopping when ctx is done
+func (i *interpreter) solveContext(ctx context.Context, p procEntry, args []expression, st state, limits Limits, yield func(state) bool) (stats, error) {
+    m := i.newMachine(ctx, st, limits)
+    defer m.trace.finish()
+    if m.parallel.All && m.trace == nil {
+        if _, ok := st.sub.(*substitution); ok {
+            err := m.solveParallel(p, args, st, yield)
+            return m.stats, err
         }
-        out = append(out, m)
     }
-    return out
+    m.run(p, args, yield)
+    return m.stats, m.err
+}
+
+// An Engine is what one query runs with: the interpreter, its settings
+// as they were when the query started, and how long it may run. The
+// machines of a query, like the branches of a parallel search, share it.
+type Engine struct {
+    *interpreter
+    store    func() bindings
+    out      io.Writer
+    parallel ParallelOptions
+    ctx      context.Context
+    limits   Limits
+}
+
+func (i *interpreter) newEngine(ctx context.Context, limits Limits) *Engine {
+    s := i.config.Load()
+    return &Engine{interpreter: i, store: s.store, out: s.out, parallel: s.parallel, ctx: ctx, limits: limits}
+}
+
+// newMachine makes a machine to run a query from st on, tracing it if
+// the debugger is on or the interpreter has a profile or coverage
+func (i *interpreter) newMachine(ctx context.Context, st state, limits Limits) *machine {
+    m := &machine{Engine: i.newEngine(ctx, limits), program: i.program(), state: st}
+    if i.debug.active() {
+        m.startTracing()
+    }
+    if i.profile != nil {
+        m.startTracing()
+        m.trace.prof = newProfiler(i.profile)
+    }
+    if i.coverage != nil {
+        m.startTracing()
+        m.trace.cover = newCoverer(i.coverage)
+    }
+    return m
+}
+
+// stats are counted for every query, mainly for benchmarking
+type stats struct {
+    inferences   int // calls, including those to builtins
+    peakBindings int // most variables bound at once
 }
 
 type state struct {
-    sub *substitution
-    vo  int // variable offset
-    vc  int // variable counter
+    sub        bindings
+    vo         int   // variable offset
+    vc         int   // variable counter
+    depth      int   // how many calls deep the current clause is
+    depthLimit int   // set by call_with_depth_limit/3, 0 if none
+    deadline   int64 // set by call_with_time_limit/2, in unix nanoseconds
+    attributed bool  // some variable has attributes, so unifying may wake goals
+}
+
+// frames are linked so choicepoints can share a continuation without copying it
+type frame struct {
+    pc    []instruction
+    xr    xrTable
+    vo    int
+    cutB  int
+    depth int
+    inv   *invocation // the goal of the clause, while tracing
+    next  *frame
 }
 
-type arriveInput struct {
-    p procEntry
-    args []expression
-    cont []frame
+// a choicepoint holds the clauses left to try for a call, and
+// everything needed to start matching them from scratch
+type choicepoint struct {
+    alts  []clause
+    args  []expression
+    cont  *frame
     state state
+    mark  int
+    fork  *branch // set instead of alts when another goroutine took them
+    next  *frame  // set instead of alts for the other branch of a disjunction
+    inv   *invocation
+    exits *exit // of the goals proven before a disjunction, when explaining
 }
 
-type frame struct {
-    pc  []instruction
-    xr  xrTable
-    vo  int
+// A machine is the engine that runs a single query.
+// The paper's arrive/execute recurse for every instruction and every call,
+// which on the Go stack means memory proportional to the whole derivation.
+// The machine instead keeps its registers here and loops over instructions,
+// with explicit stacks for continuations and choicepoints.
+type machine struct {
+    *Engine
+    program *Program // the program as this query sees it
+    pc      []instruction
+    xr      xrTable
+    args    []expression
+    stack   [][]expression
+    queue   []expression
+    cont    *frame
+    state   state
+    choices []choicepoint
+    cutB    int  // height of choices when the current clause was called
+    halted  bool // EXIT with no continuation left: we have an answer
+    err     error
+    stats   stats
+    reached int // deepest call so far, for call_with_depth_limit/3
+    par     *orParallel // set when running in parallel
+    branch  *branch
+    trace   *tracing // set when debugging
+    tables  *tables  // set once a tabled procedure is called
+}
+
+func (m *machine) run(p procEntry, args []expression, yield func(state) bool) {
+    m.loop(m.arrive(p, args), yield)
+}
+
+// loop executes instructions, backtracking on failure, until there
+// is nothing left to try
+func (m *machine) loop(ok bool, yield func(state) bool) {
+    for {
+        if !ok && (m.err != nil || !m.backtrack()) {
+            return
+        }
+        if m.halted {
+            m.halted = false
+            if !yield(m.state) {
+                return
+            }
+            ok = false
+            continue
+        }
+        ok = m.execute()
+    }
 }
 
-func (i *interpreter) arrive(in arriveInput) []state {
-    proc, ok := i.procedures[in.p]
+func (m *machine) arrive(p procEntry, args []expression) bool {
+    m.stats.inferences++
+    m.stats.peakBindings = max(m.stats.peakBindings, m.state.sub.len())
+    m.state.depth++
+    if err := m.checkLimits(); err != nil {
+        return m.throw(err)
+    }
+    m.reached = max(m.reached, m.state.depth)
+    if m.state.depthLimit > 0 && m.state.depth > m.state.depthLimit {
+        return false
+    }
+    if m.trace != nil && !m.traceCall(p, args) {
+        return false
+    }
+    proc, imported, ok := m.program.lookup(p)
     if !ok {
-        return i.arriveBuiltin(in)
-    }
-    ans := []state{}
-    st := in.state
-    for _, c := range proc.clauses {
-        st.vo = in.state.vc
-        st.vc = in.state.vc + c.numVars
-        execInput := executeInput{
-            pc: c.bytecodes,
-            xr: c.xrTable,
-            cont: in.cont,
-            args: in.args,
-            state: st,
+        return m.arriveBuiltin(p, args)
+    }
+    if imported && proc.meta != nil {
+        args = m.qualifyImported(p.module, proc.meta, args)
+    }
+    if proc.table != nil {
+        if m.trace != nil {
+            m.trace.inv.tabled = true
         }
-        b := i.execute(execInput)
-        ans = append(ans, b...)
+        return m.arriveTabled(proc, args)
     }
-    return ans
+    if m.trace != nil {
+        m.trace.inv.clauses = proc.clauses
+    }
+    return m.try(proc.clauses, args, m.cont, m.state)
 }
 
-func (i *interpreter) arriveBuiltin(in arriveInput) []state {
-    // TODO handle builtin call
-    execInput := executeInput{
-        cont: in.cont,
-        state: in.state,
+// arriveBuiltin calls the builtin p, which no module can have but user
+func (m *machine) arriveBuiltin(p procEntry, args []expression) bool {
+    if g, ok := generators[p.unqualified()]; ok {
+        alts, err := g(m, args)
+        if err != nil {
+            return m.throw(err)
+        }
+        return m.try(alts, args, m.cont, m.state)
     }
-    return i.executeExit(execInput)
+    b, ok := builtins[p.unqualified()]
+    if !ok {
+        return m.unknownProcedure(p)
+    }
+    if !b(m, args) {
+        return false
+    }
+    m.pc, m.args, m.stack = nil, nil, nil
+    return m.executeExit()
 }
 
-type executeInput struct {
-    pc []instruction
-    xr xrTable
-    cont []frame
-    args []expression
-    stack [][]expression
-    queue []expression
-    state state
+// try starts executing the first of alts, leaving a choicepoint
+// for the others. The last alternative leaves nothing behind.
+func (m *machine) try(alts []clause, args []expression, cont *frame, st state) bool {
+    if len(alts) == 0 {
+        return false
+    }
+    c := alts[0]
+    m.cutB = len(m.choices)
+    if inv := m.trace.current(); inv != nil && inv.clauses != nil {
+        inv.clause = len(inv.clauses) - len(alts)
+    }
+    if len(alts) > 1 {
+        cp := choicepoint{alts: alts[1:], args: args, cont: cont, state: st, inv: m.trace.current()}
+        if m.par != nil {
+            if b := m.fork(alts[1:], args, cont, st); b != nil {
+                cp = choicepoint{fork: b}
+            }
+        }
+        cp.mark = st.sub.mark(st.vc)
+        m.choices = append(m.choices, cp)
+    }
+    m.pc = c.bytecodes
+    m.xr = c.xrTable
+    m.args = args
+    m.stack = nil
+    m.queue = nil
+    m.cont = cont
+    m.state = st
+    m.state.vo = st.vc
+    m.state.vc = st.vc + c.numVars
+    return true
+}
+
+func (m *machine) backtrack() bool {
+    if m.trace != nil {
+        return m.traceBacktrack()
+    }
+    if len(m.choices) == 0 {
+        return false
+    }
+    cp := m.choices[len(m.choices)-1]
+    m.choices = m.choices[:len(m.choices)-1]
+    if cp.fork != nil {
+        // the alternatives are done elsewhere; in order, their answers go here
+        m.par.add(m.branch, branchItem{child: cp.fork})
+        return m.backtrack()
+    }
+    st := cp.state
+    st.sub = st.sub.undo(cp.mark, st.vc)
+    if cp.next != nil {
+        return m.resume(cp.next, st)
+    }
+    return m.try(cp.alts, cp.args, cp.cont, st)
+}
+
+// resume goes on with the code of a clause at f, from st
+func (m *machine) resume(f *frame, st state) bool {
+    m.pc = f.pc
+    m.xr = f.xr
+    m.args = nil
+    m.stack = nil
+    m.queue = nil
+    m.cont = f.next
+    m.cutB = f.cutB
+    m.state = st
+    return true
 }
 
 // Const/Var/Functor have two modes: matching args (downwards) and creating args (upwards)
@@ -109,167 +439,253 @@ type executeInput struct {
 // Otherwise we will build them up in queue. The paper uses difference lists here (!)
 // The paper also uses stack both as a stack of lists and as a queue of args!
 
-func (i *interpreter) execute(in executeInput) []state {
-    if len(in.pc) < 1 {
+// execute runs a single instruction and reports whether it succeeded
+func (m *machine) execute() bool {
+    if len(m.pc) < 1 {
         panic("executing empty instruction list")
     }
-    ins, pc := in.pc[0], in.pc[1:]
-    in.pc = pc
+    ins := m.pc[0]
+    m.pc = m.pc[1:]
     switch ins {
     case CONST:
-        return i.executeConst(in)
+        return m.executeConst()
     case VAR:
-        return i.executeVar(in)
+        return m.executeVar()
     case FUNCTOR:
-        return i.executeFunctor(in)
+        return m.executeFunctor()
     case POP:
-        return i.executePop(in)
+        return m.executePop()
     case ENTER:
-        return i.executeEnter(in)
+        return m.executeEnter()
     case CALL:
-        return i.executeCall(in)
+        return m.executeCall()
     case EXIT:
-        return i.executeExit(in)
-    default:
-        panic("unknown instruction")
+        return m.executeExit()
+    case COMMIT:
+        m.cut()
+        return true
+    case TRY:
+        return m.executeTry()
+    case JUMP:
+        if len(m.pc) < 1 {
+            panic("JUMP without offset")
+        }
+        m.pc = m.pc[1+m.pc[0]:]
+        return true
+    case MARK:
+        return m.executeMark()
+    case CUT:
+        return m.executeCut()
+    }
+    panic("unknown instruction")
+}
+
+// executeTry leaves a choicepoint for going on at the other branch of a
+// disjunction, in the clause and with the bindings of now
+func (m *machine) executeTry() bool {
+    if len(m.pc) < 1 {
+        panic("TRY without offset")
+    }
+    n := m.pc[0]
+    m.pc = m.pc[1:]
+    next := &frame{pc: m.pc[n:], xr: m.xr, cutB: m.cutB, next: m.cont}
+    cp := choicepoint{next: next, state: m.state, inv: m.trace.current()}
+    if m.trace != nil {
+        cp.exits = m.trace.exits
+    }
+    cp.mark = m.state.sub.mark(m.state.vc)
+    m.choices = append(m.choices, cp)
+    return true
+}
+
+func (m *machine) executeMark() bool {
+    if len(m.pc) < 1 {
+        panic("MARK without pointer")
+    }
+    v := variable(m.state.vo + int(m.pc[0]))
+    m.pc = m.pc[1:]
+    sub, ok := unify(m.state.sub, v, number(len(m.choices)))
+    if !ok {
+        return false
+    }
+    m.state.sub = sub
+    return true
+}
+
+// executeCut cuts back to a barrier, which cannot be below where the
+// clause was called from
+func (m *machine) executeCut() bool {
+    if len(m.pc) < 1 {
+        panic("CUT without pointer")
+    }
+    v := variable(m.state.vo + int(m.pc[0]))
+    m.pc = m.pc[1:]
+    h, ok := walk(m.state.sub, v).(number)
+    if !ok {
+        return false
     }
-    return nil
+    m.cutTo(min(max(int(h), m.cutB), len(m.choices)))
+    return true
 }
 
-func (i *interpreter) executeConst(in executeInput) []state {
-    if len(in.pc) < 1 {
+func (m *machine) executeConst() bool {
+    if len(m.pc) < 1 {
         panic("CONST without xr pointer")
     }
-    x := in.xr[in.pc[0]]
-    in.pc = in.pc[1:]
+    x := m.xr[m.pc[0]]
+    m.pc = m.pc[1:]
     // TODO: this kind of typecasting is inefficient and should be removed
-    if len(in.args) == 0 {
-        switch t := x.(type) {
-        case integer:
-            in.queue = append(in.queue, number(t))
-        case atom:
-            in.queue = append(in.queue, symbol(t))
-        default:
-            panic("CONST on nonatom")
-        }
-        return i.execute(in)
-    }
-    var sub *substitution
-    var ok bool
+    var e expression
     switch t := x.(type) {
     case integer:
-        sub, ok = in.state.sub.unify(in.args[0], number(t))
+        e = number(t)
     case atom:
-        sub, ok = in.state.sub.unify(in.args[0], symbol(t))
+        e = symbol(t)
     default:
         panic("CONST on nonatom")
     }
+    if len(m.args) == 0 {
+        m.queue = append(m.queue, e)
+        return true
+    }
+    sub, ok := unify(m.state.sub, m.args[0], e)
     if !ok {
-        return nil
+        return false
     }
-    in.args = in.args[1:]
-    in.state.sub = sub
-    return i.execute(in)
+    m.args = m.args[1:]
+    m.state.sub = sub
+    return true
 }
 
-func (i *interpreter) executeVar(in executeInput) []state {
-    if len(in.pc) < 1 {
+func (m *machine) executeVar() bool {
+    if len(m.pc) < 1 {
         panic("VAR without pointer")
     }
-    v := variable(in.state.vo + int(in.pc[0]))
-    in.pc = in.pc[1:]
-    if len(in.args) == 0 {
-        in.queue = append(in.queue, v)
-        return i.execute(in)
+    v := variable(m.state.vo + int(m.pc[0]))
+    m.pc = m.pc[1:]
+    if len(m.args) == 0 {
+        m.queue = append(m.queue, v)
+        return true
     }
-    sub, ok := in.state.sub.unify(in.args[0], v)
+    sub, ok := unify(m.state.sub, m.args[0], v)
     if !ok {
-        return nil
+        return false
     }
-    in.args = in.args[1:]
-    in.state.sub = sub
-    return i.execute(in)
+    m.args = m.args[1:]
+    m.state.sub = sub
+    return true
 }
 
-func (i *interpreter) executeFunctor(in executeInput) []state {
-    if len(in.pc) < 1 {
+func (m *machine) executeFunctor() bool {
+    if len(m.pc) < 1 {
         panic("FUNCTOR without xr pointer")
     }
-    x := in.xr[in.pc[0]].(functorEntry)
-    in.pc = in.pc[1:]
+    x := m.xr[m.pc[0]].(functorEntry)
+    m.pc = m.pc[1:]
     args := make([]expression, x.arity)
-    for n:=0; n<x.arity; n++ {
-        args[n] = variable(in.state.vc + n)
+    for n := 0; n < x.arity; n++ {
+        args[n] = variable(m.state.vc + n)
     }
-    p := process{
+    m.state.vc += x.arity
+    var p expression = process{
         functor: x.name,
         args:    args,
     }
-    if len(in.args) == 0 {
-        in.queue = append(in.queue, p)
-        in.stack = append([][]expression{in.args[1:]}, in.stack...) 
-        in.args = args
-        return i.execute(in)
+    if x == listFunctor {
+        p = list{head: args[0], tail: args[1]}
     }
-    sub, ok := in.state.sub.unify(in.args[0], p)
+    if len(m.args) == 0 {
+        // build the term with fresh args, then match the rest against those
+        m.queue = append(m.queue, p)
+        m.stack = append(m.stack, nil)
+        m.args = args
+        return true
+    }
+    sub, ok := unify(m.state.sub, m.args[0], p)
     if !ok {
-        return nil
+        return false
     }
-    in.stack = append([][]expression{in.args[1:]}, in.stack...) 
-    in.args = args
-    in.state.sub = sub
-    in.state.vc += x.arity
-    return i.execute(in)
+    m.stack = append(m.stack, m.args[1:])
+    m.args = args
+    m.state.sub = sub
+    return true
 }
 
-func (i *interpreter) executePop(in executeInput) []state {
-    if len(in.args) > 0 {
+func (m *machine) executePop() bool {
+    if len(m.args) > 0 {
         panic("POP with nonempty args")
     }
-    if len(in.stack) == 0 {
+    if len(m.stack) == 0 {
         panic("POP with empty stack")
     }
-    in.args = in.stack[0]
-    in.stack = in.stack[1:]
-    return i.execute(in)
+    m.args = m.stack[len(m.stack)-1]
+    m.stack = m.stack[:len(m.stack)-1]
+    return true
 }
 
-func (i *interpreter) executeEnter(in executeInput) []state {
-    if len(in.args) > 0 || len(in.stack) > 0 {
-        return nil  // failure to match, nonempty args/stack
+func (m *machine) executeEnter() bool {
+    // failure to match, nonempty args/stack
+    if len(m.args) > 0 || len(m.stack) > 0 {
+        return false
+    }
+    if m.trace != nil && m.trace.cover != nil {
+        m.trace.cover.enter(m.trace.inv)
     }
-    return i.execute(in)
+    if m.state.attributed {
+        if ok, called := m.wake(m.pc); called {
+            return ok
+        }
+    }
+    return true
 }
 
-func (i *interpreter) executeCall(in executeInput) []state {
-    if len(in.pc) < 1 {
+func (m *machine) executeCall() bool {
+    if len(m.pc) < 1 {
         panic("CALL without xr pointer")
     }
-    x := in.xr[in.pc[0]].(procEntry)
-    in.pc = in.pc[1:]
-    arriveIn := arriveInput{
-        p: x,
-        args: in.queue,
-        cont: append([]frame{{in.pc, in.xr, in.state.vo}}, in.cont...),
-        state: in.state,
+    x := m.xr[m.pc[0]].(procEntry)
+    m.pc = m.pc[1:]
+    args := m.queue
+    m.queue = nil
+    // last call optimisation: if only EXIT is left there is nothing to
+    // come back to, so the callee can return straight to our continuation
+    if len(m.pc) != 1 || m.pc[0] != EXIT || m.trace != nil {
+        m.cont = &frame{pc: m.pc, xr: m.xr, vo: m.state.vo, cutB: m.cutB, depth: m.state.depth, inv: m.trace.current(), next: m.cont}
     }
-    return i.arrive(arriveIn)
+    return m.arrive(x, args)
 }
 
-func (i *interpreter) executeExit(in executeInput) []state {
-    if len(in.pc) > 0 {
+func (m *machine) executeExit() bool {
+    if len(m.pc) > 0 {
         panic("EXIT on nonempty instruction list")
     }
-    if len(in.args) > 0 || len(in.stack) > 0 {
-        return nil  // failure to match, nonempty args/stack
+    if len(m.args) > 0 || len(m.stack) > 0 {
+        return false // failure to match, nonempty args/stack
+    }
+    if m.state.attributed {
+        if ok, called := m.wake(exitCode); called {
+            return ok
+        }
+    }
+    if m.trace != nil {
+        if ok, done := m.traceExit(); done {
+            return ok
+        }
+    }
+    if m.cont == nil {
+        m.halted = true
+        return true
     }
-    if len(in.cont) > 0 {
-        f, c := in.cont[0], in.cont[1:]
-        in.pc = f.pc
-        in.xr = f.xr
-        in.state.vo = f.vo
-        in.cont = c
-        return i.execute(in)
+    f := m.cont
+    m.pc = f.pc
+    m.xr = f.xr
+    m.state.vo = f.vo
+    m.cutB = f.cutB
+    m.state.depth = f.depth
+    if m.trace != nil {
+        m.trace.inv = f.inv
     }
-    return []state{in.state}
+    m.cont = f.next
+    m.queue = nil
+    return true
 }
@@ -0,0 +1,288 @@
+package main
+
+import (
+    "reflect"
+    "runtime/debug"
+    "strings"
+    "testing"
+)
+
+var appendRules = `
+    append(nil, L, L).
+    append(cons(X,L1), L2, cons(X,L3)) :- append(L1, L2, L3).`
+
+func TestInterpret(t *testing.T) {
+    for _, store := range []func() bindings{newSubstitution, newTrail} {
+        i := NewInterpreter(compileProcedures(MustParseRules(appendRules)))
+        i.setStore(store)
+        testInterpret(t, i)
+    }
+}
+
+func testInterpret(t *testing.T, i *interpreter) {
+    for n, tt := range []struct{
+        query string
+        want []map[string]expression
+    }{
+        {
+            query: "append(cons(a, nil), cons(b, nil), L)",
+            want: []map[string]expression{
+                {"L": process{functor: "cons", args: []expression{symbol("a"),
+                    process{functor: "cons", args: []expression{symbol("b"), emptylist}}}}},
+            },
+        },
+        {
+            query: "append(L, X, cons(a, nil))",
+            want: []map[string]expression{
+                {"L": emptylist, "X": process{functor: "cons", args: []expression{symbol("a"), emptylist}}},
+                {"L": process{functor: "cons", args: []expression{symbol("a"), emptylist}}, "X": emptylist},
+            },
+        },
+        {
+            query: "append(cons(a, nil), X, nil)",
+            want: []map[string]expression{},
+        },
+    }{
+        got := mustInterpret(t, i, tt.query)
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%d: got %v want %v", n, got, tt.want)
+        }
+    }
+}
+
+// Deterministic tail recursion should not grow the Go stack,
+// nor leave continuation frames or choicepoints behind.
+func TestLastCallOptimisation(t *testing.T) {
+    defer debug.SetMaxStack(debug.SetMaxStack(1 << 20))
+    const size = 100000
+    var l expression = emptylist
+    for n := 0; n < size; n++ {
+        l = process{functor: "cons", args: []expression{number(n), l}}
+    }
+    i := NewInterpreter(compileProcedures(MustParseRules(appendRules)))
+    i.setStore(newTrail)
+    m := &machine{Engine: i.newEngine(nil, Limits{}), program: i.program(), state: state{sub: i.store(), vc: 1}}
+    found := 0
+    m.run(proc("append", 3), []expression{l, emptylist, variable(0)}, func(st state) bool {
+        found++
+        // only the untried second clause of the final call to append
+        if m.cont != nil || len(m.choices) > 1 {
+            t.Errorf("left %d choicepoints and continuation %v", len(m.choices), m.cont)
+        }
+        e := walk(st.sub, variable(0))
+        for n := size - 1; n >= 0; n-- {
+            p, ok := e.(process)
+            if !ok || walk(st.sub, p.args[0]) != number(n) {
+                t.Fatalf("unexpected element at %d: %v", n, e)
+            }
+            e = walk(st.sub, p.args[1])
+        }
+        if e != emptylist {
+            t.Fatalf("expected end of list, got %v", e)
+        }
+        return true
+    })
+    if found != 1 {
+        t.Errorf("got %d answers want 1", found)
+    }
+}
+
+func TestListing(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(`
+    len([], 0).
+    len([_|T], N) :- len(T, M), N is M + 1.
+    max(X, Y, X) :- X >= Y, !.
+    max(_, Y, Y).`)))
+    var sb strings.Builder
+    i.setOutput(&sb)
+    mustInterpret(t, i, "listing(len/2)")
+    mustInterpret(t, i, "listing(max)")
+    want := `len(nil,0).
+len([A|B],C) :- len(B,D),C is D+1.
+
+max(A,B,A) :- A >= B,!.
+max(A,B,B).
+
+`
+    if got := sb.String(); got != want {
+        t.Errorf("got %s want %s", got, want)
+    }
+}
+
+func TestGuards(t *testing.T) {
+    rules := `
+    max(X, Y, Z) :- X >= Y | Z = X.
+    max(X, Y, Z) :- true | Z = Y.
+    first([X|_], Y) :- member(Y, [X]) | true.
+    pick(X) :- member(X, [a, b]) | true.
+    pick(c).
+    both(X) :- true | member(X, [a, b]).
+    both(c).`
+    for _, store := range []func() bindings{newSubstitution, newTrail} {
+        i := NewInterpreter(compileProcedures(MustParseRules(rules)))
+        i.setStore(store)
+        for n, tt := range []struct{
+            query string
+            want []string
+        }{
+            {query: "max(3, 2, Z)", want: []string{"3"}},
+            {query: "max(2, 3, Z)", want: []string{"3"}},
+            {query: "first([a, b], Z)", want: []string{"a"}},
+            // the guard is not retried and later clauses are discarded
+            {query: "pick(Z)", want: []string{"a"}},
+            // the body after the commit still backtracks
+            {query: "both(Z)", want: []string{"a", "b"}},
+        }{
+            got := []string{}
+            for _, ans := range mustInterpret(t, i, tt.query) {
+                got = append(got, ans["Z"].PrintExpression())
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("%d: got %q want %q", n, got, tt.want)
+            }
+        }
+        var sb strings.Builder
+        i.setOutput(&sb)
+        mustInterpret(t, i, "listing(max)")
+        want := `max(A,B,C) :- A >= B | C = A.
+max(A,B,C) :- true | C = B.
+
+`
+        if got := sb.String(); got != want {
+            t.Errorf("got %s want %s", got, want)
+        }
+    }
+}
+
+func TestAnonymousVariables(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(appendRules)))
+    got := mustInterpret(t, i, "append(_, cons(X, _), cons(a, cons(b, nil)))")
+    want := []map[string]expression{{"X": symbol("a")}, {"X": symbol("b")}}
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("got %v want %v", got, want)
+    }
+}
+
+func TestLists(t *testing.T) {
+    rules := `
+    app([], L, L).
+    app([X|L1], L2, [X|L3]) :- app(L1, L2, L3).
+    pair('.'(A, '.'(B, [])), A, B).`
+    for _, store := range []func() bindings{newSubstitution, newTrail} {
+        i := NewInterpreter(compileProcedures(MustParseRules(rules)))
+        i.setStore(store)
+        for _, tt := range []struct{
+            query string
+            want  []string
+        }{
+            {query: "app([a], [b, c], L)", want: []string{"[a,b,c]"}},
+            {query: "app(L, [c], [a, b, c])", want: []string{"[a,b]"}},
+            {query: "app([a|L], [c], [a, b, c])", want: []string{"[b]"}},
+            {query: "pair(L, 1, 2)", want: []string{"[1,2]"}},
+            {query: "pair([x, y, z], L, _)", want: []string{}},
+        }{
+            got := []string{}
+            for _, ans := range mustInterpret(t, i, tt.query) {
+                got = append(got, ans["L"].PrintExpression())
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("%s: got %v want %v", tt.query, got, tt.want)
+            }
+        }
+    }
+}
+
+func TestBuiltins(t *testing.T) {
+    rules := `
+    first(X, [X|_]) :- !.
+    first(X, [_|T]) :- first(X, T).
+    member(X, [X|_]).
+    member(X, [_|T]) :- member(X, T).
+    once_member(X, L) :- member(X, L), !.
+    max(X, Y, X) :- X = Y, !.
+    max(_, Y, Y).
+    other(X, Y) :- member(X, [a, b]), member(Y, [a, b]), X \= Y.`
+    for _, store := range []func() bindings{newSubstitution, newTrail} {
+        i := NewInterpreter(compileProcedures(MustParseRules(rules)))
+        i.setStore(store)
+        for _, tt := range []struct{
+            query string
+            want  []string
+        }{
+            {query: "first(X, [a, b])", want: []string{"a"}},
+            {query: "once_member(X, [a, b])", want: []string{"a"}},
+            {query: "max(a, a, X)", want: []string{"a"}},
+            {query: "max(a, b, X)", want: []string{"b"}},
+            {query: "other(X, b)", want: []string{"a"}},
+            {query: "X = f(a)", want: []string{"f(a)"}},
+            {query: "X \\= a", want: []string{}},
+            {query: "f(X) \\= g(a)", want: []string{"v#0"}},
+        }{
+            got := []string{}
+            for _, ans := range mustInterpret(t, i, tt.query) {
+                got = append(got, ans["X"].PrintExpression())
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("%s: got %v want %v", tt.query, got, tt.want)
+            }
+        }
+    }
+}
+
+func TestUnknownProcedure(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(appendRules)))
+    _, err := i.solve(proc("nope", 0), nil, state{sub: i.store()}, func(state) bool { return true })
+    if err == nil || err.Error() != "unknown procedure nope/0" {
+        t.Errorf("got %v", err)
+    }
+    if _, err := i.interpret("nope(X)"); err == nil {
+        t.Error("expected interpret to return the error")
+    }
+}
+
+// mustInterpret is interpret for queries that are not meant to fail
+// with an error
+func mustInterpret(t testing.TB, i *interpreter, q string) []map[string]expression {
+    t.Helper()
+    out, err := i.interpret(q)
+    if err != nil {
+        t.Fatalf("%s: %v", q, err)
+    }
+    return out
+}
+
+func TestOccursCheck(t *testing.T) {
+    x := variable(0)
+    cyclic := process{functor: "f", args: []expression{symbol("a"), list{head: x, tail: emptylist}}}
+    for _, store := range []func() bindings{newSubstitution, newTrail} {
+        // plain unification does not look into the term it binds to
+        if _, ok := unify(store(), x, cyclic); !ok {
+            t.Error("unify: expected to bind X to a term with X in it")
+        }
+        if _, ok := unifyWithOccursCheck(store(), x, cyclic); ok {
+            t.Error("unifyWithOccursCheck: expected X not to be bound to a term with X in it")
+        }
+        if _, ok := unifyWithOccursCheck(store(), x, process{functor: "f", args: []expression{variable(1)}}); !ok {
+            t.Error("unifyWithOccursCheck: expected X to be bound")
+        }
+    }
+    i := NewInterpreter(nil)
+    for query, want := range map[string]int{
+        "unify_with_occurs_check(X, f(X))":             0,
+        "unify_with_occurs_check(f(X, Y), f(Y, g(X)))": 0,
+        "unify_with_occurs_check(f(X, Y), f(Y, a))":    1,
+    }{
+        if got := len(mustInterpret(t, i, query)); got != want {
+            t.Errorf("%s: got %d answers want %d", query, got, want)
+        }
+    }
+}
+
+func TestQueryConjunction(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(appendRules)))
+    got := mustInterpret(t, i, "append(X, cons(b, nil), cons(a, cons(b, nil))), append(X, Y, cons(a, nil))")
+    want := []map[string]expression{{"X": process{functor: "cons", args: []expression{symbol("a"), emptylist}}, "Y": emptylist}}
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("got %v want %v", got, want)
+    }
+}
@@ -0,0 +1,21 @@
+package main
+
+// The library is the part of the system written in Prolog. It is
+// installed before the program, which can redefine any of it.
+const librarySource = `
+member(X, [X|_]).
+member(X, [_|T]) :- member(X, T).
+`
+
+// libraryFile is the file library clauses are read from
+const libraryFile = "library"
+
+var library = compileProcedures(libraryRules())
+
+func libraryRules() []rule {
+    rules := MustParseRules(librarySource)
+    for i := range rules {
+        rules[i].pos.file = libraryFile
+    }
+    return rules
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+    "errors"
+    "time"
+)
+
+// Limits bound the work a query may do. Zero means no limit.
+type Limits struct {
+    Inferences int // calls, as counted in stats
+    Depth      int // how deeply calls may nest
+}
+
+var (
+    ErrInferenceLimit = errors.New("inference limit exceeded")
+    ErrDepthLimit     = errors.New("depth limit exceeded")
+    ErrTimeLimit      = errors.New("time limit exceeded")
+)
+
+// the context and the clock are only looked at every so many inferences
+const checkInterval = 1024
+
+// checkLimits is called on every arrive, so the common case has to be cheap
+func (m *machine) checkLimits() error {
+    if m.limits.Inferences > 0 && m.stats.inferences > m.limits.Inferences {
+        return ErrInferenceLimit
+    }
+    if m.limits.Depth > 0 && m.state.depth > m.limits.Depth {
+        return ErrDepthLimit
+    }
+    if m.stats.inferences%checkInterval != 0 {
+        return nil
+    }
+    if m.branch != nil && m.branch.dead() {
+        return errPruned
+    }
+    if m.ctx != nil {
+        if err := m.ctx.Err(); err != nil {
+            return err
+        }
+    }
+    if m.state.deadline != 0 && time.Now().UnixNano() > m.state.deadline {
+        return ErrTimeLimit
+    }
+    return nil
+}
+
+// call_with_depth_limit(G, Limit, Result) calls G, failing any call
+// more than Limit deep, counting G itself as 1. Result is the deepest
+// call made, or depth_limit_exceeded if G fails having hit the limit.
+// The generated clauses have what they need to restore baked in:
+//
+//   call_with_depth_limit(G, L, R) :-
+//       '$depth_limit_set'(Abs, Base), call(G),
+//       '$depth_limit_true'(Base, OldLimit, OldReached, R).
+//   call_with_depth_limit(G, L, R) :-
+//       '$depth_limit_false'(Abs, OldReached, R).
+//
+// Calls made after G has exited must not count for G when it is retried,
+// so '$depth_limit_true' leaves a choicepoint to set reached back.
+func generateCallWithDepthLimit(m *machine, args []expression) ([]clause, error) {
+    limit, err := m.intArg(args[1])
+    if err != nil {
+        return nil, err
+    }
+    // the body of the clauses below runs one deeper than this call
+    base := m.state.depth + 1
+    abs := base + limit
+    if m.state.depthLimit > 0 {
+        abs = min(abs, m.state.depthLimit)
+    }
+    g, r := variable(0), variable(2)
+    head := process{functor: "call_with_depth_limit", args: []expression{g, variable(1), r}}
+    return []clause{
+        compileClause(rule{head: head, body: []process{
+            {functor: "$depth_limit_set", args: []expression{number(abs), number(base)}},
+            {functor: "call", args: []expression{g}},
+            {functor: "$depth_limit_true", args: []expression{number(base), number(m.state.depthLimit), number(m.reached), r}},
+        }}),
+        compileClause(rule{head: head, body: []process{
+            {functor: "$depth_limit_false", args: []expression{number(abs), number(m.reached), r}},
+        }}),
+    }, nil
+}
+
+// number gets an argument the generated clauses above are known to pass
+func (m *machine) number(e expression) int {
+    return int(walk(m.state.sub, e).(number))
+}
+
+func builtinDepthLimitSet(m *machine, args []expression) bool {
+    m.state.depthLimit = m.number(args[0])
+    m.reached = m.number(args[1])
+    return true
+}
+
+//   '$depth_limit_true'(B, L, O, R) :- '$depth_limit_exit'(B, L, O, R).
+//   '$depth_limit_true'(B, L, O, R) :- '$depth_limit_redo'(Reached), fail.
+func generateDepthLimitTrue(m *machine, args []expression) ([]clause, error) {
+    vars := []expression{variable(0), variable(1), variable(2), variable(3)}
+    head := process{functor: "$depth_limit_true", args: vars}
+    return []clause{
+        compileClause(rule{head: head, body: []process{{functor: "$depth_limit_exit", args: vars}}}),
+        compileClause(rule{head: head, body: []process{
+            {functor: "$depth_limit_redo", args: []expression{number(m.reached)}},
+            {functor: "fail"},
+        }}),
+    }, nil
+}
+
+func builtinDepthLimitRedo(m *machine, args []expression) bool {
+    m.reached = m.number(args[0])
+    return true
+}
+
+func builtinDepthLimitExit(m *machine, args []expression) bool {
+    base := m.number(args[0])
+    result := m.reached - base
+    m.state.depthLimit = m.number(args[1])
+    m.reached = max(m.reached, m.number(args[2]))
+    return m.unify(args[3], number(result))
+}
+
+func builtinDepthLimitFalse(m *machine, args []expression) bool {
+    exceeded := m.reached > m.number(args[0])
+    m.reached = max(m.reached, m.number(args[1]))
+    return exceeded && m.unify(args[2], symbol("depth_limit_exceeded"))
+}
+
+// call_with_time_limit(Seconds, G) calls G once, aborting the query
+// with ErrTimeLimit if it takes longer than Seconds:
+//
+//   call_with_time_limit(T, G) :-
+//       '$time_limit_set'(Deadline), call(G), !, '$time_limit_set'(OldDeadline).
+func generateCallWithTimeLimit(m *machine, args []expression) ([]clause, error) {
+    seconds, err := m.intArg(args[0])
+    if err != nil {
+        return nil, err
+    }
+    deadline := time.Now().Add(time.Duration(seconds) * time.Second).UnixNano()
+    if m.state.deadline != 0 {
+        deadline = min(deadline, m.state.deadline)
+    }
+    g := variable(1)
+    head := process{functor: "call_with_time_limit", args: []expression{variable(0), g}}
+    return []clause{
+        compileClause(rule{head: head, body: []process{
+            {functor: "$time_limit_set", args: []expression{number(deadline)}},
+            {functor: "call", args: []expression{g}},
+            {functor: "!"},
+            {functor: "$time_limit_set", args: []expression{number(m.state.deadline)}},
+        }}),
+    }, nil
+}
+
+func builtinTimeLimitSet(m *machine, args []expression) bool {
+    m.state.deadline = int64(m.number(args[0]))
+    if m.state.deadline != 0 && time.Now().UnixNano() > m.state.deadline {
+        return m.throw(ErrTimeLimit)
+    }
+    return true
+}
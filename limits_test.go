@@ -0,0 +1,90 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "reflect"
+    "testing"
+    "time"
+)
+
+var runawayRules = `
+    loop :- loop.
+    grow :- grow, true.
+    len([], 0).
+    len([_|T], N) :- len(T, M), N is M + 1.`
+
+func TestLimits(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(runawayRules)))
+    cancelled, cancel := context.WithCancel(context.Background())
+    cancel()
+    for n, tt := range []struct{
+        ctx    context.Context
+        query  string
+        limits Limits
+        want   error
+    }{
+        {query: "loop", limits: Limits{Inferences: 1000}, want: ErrInferenceLimit},
+        {query: "grow", limits: Limits{Depth: 1000}, want: ErrDepthLimit},
+        {query: "loop", limits: Limits{Depth: 1000}, want: ErrDepthLimit},
+        {query: "len([a, b, c], N)", limits: Limits{Depth: 3}, want: ErrDepthLimit},
+        {query: "len([a, b, c], N)", limits: Limits{Depth: 4, Inferences: 7}},
+        {query: "len([a, b, c], N)", limits: Limits{Inferences: 6}, want: ErrInferenceLimit},
+        // every goal of a query runs within the limits
+        {query: "len([a], N), loop", limits: Limits{Inferences: 1000}, want: ErrInferenceLimit},
+        {ctx: cancelled, query: "loop", want: context.Canceled},
+    }{
+        ctx := tt.ctx
+        if ctx == nil {
+            ctx = context.Background()
+        }
+        _, err := i.interpretContext(ctx, tt.query, tt.limits)
+        if !errors.Is(err, tt.want) {
+            t.Errorf("%d: %s: got error %v want %v", n, tt.query, err, tt.want)
+        }
+    }
+}
+
+func TestTimeout(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(runawayRules)))
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+    defer cancel()
+    if _, err := i.interpretContext(ctx, "loop", Limits{}); !errors.Is(err, context.DeadlineExceeded) {
+        t.Errorf("got error %v want %v", err, context.DeadlineExceeded)
+    }
+    if _, err := i.interpretContext(context.Background(), "call_with_time_limit(1, loop)", Limits{}); !errors.Is(err, ErrTimeLimit) {
+        t.Errorf("got error %v want %v", err, ErrTimeLimit)
+    }
+}
+
+func TestCallWithLimits(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(runawayRules)))
+    for n, tt := range []struct{
+        query string
+        vars  []string
+        want  []string
+    }{
+        {query: "call_with_depth_limit(true, 1, R)", vars: []string{"R"}, want: []string{"1"}},
+        {query: "call_with_depth_limit(len([a, b], N), 10, R)", vars: []string{"N", "R"}, want: []string{"2 3"}},
+        {query: "call_with_depth_limit(len([a, b], N), 3, R)", vars: []string{"N", "R"}, want: []string{"2 3"}},
+        {query: "call_with_depth_limit(len([a, b, c, d], N), 2, R)", vars: []string{"R"}, want: []string{"depth_limit_exceeded"}},
+        {query: "call_with_depth_limit(loop, 50, R)", vars: []string{"R"}, want: []string{"depth_limit_exceeded"}},
+        {query: "call_with_depth_limit(fail, 5, R)", vars: []string{"R"}, want: []string{}},
+        {query: "call_with_depth_limit(member(X, [a, b]), 5, R)", vars: []string{"X", "R"}, want: []string{"a 1", "b 2"}},
+        // the limit is lifted again afterwards
+        {query: "call((call_with_depth_limit(true, 1, R), len([a, b, c], N)))", vars: []string{"R", "N"}, want: []string{"1 3"}},
+        // an outer limit holds inside a more generous inner one; as in SWI,
+        // having hit it shows as Limit+1 when the goal succeeds anyway
+        {query: "call_with_depth_limit(call_with_depth_limit(len([a, b, c], N), 10, R), 3, S)", vars: []string{"R", "S"}, want: []string{"depth_limit_exceeded 4", "v#1 depth_limit_exceeded"}},
+        {query: "call_with_time_limit(5, member(X, [a, b]))", vars: []string{"X"}, want: []string{"a"}},
+    }{
+        got, err := answers(i, tt.query, tt.vars...)
+        if err != nil {
+            t.Errorf("%d: %s: %v", n, tt.query, err)
+            continue
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%d: %s: got %v want %v", n, tt.query, got, tt.want)
+        }
+    }
+}
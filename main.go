@@ -4,9 +4,37 @@ package main
 
 import (
     "fmt"
+    "os"
 )
 
 func main() {
+    if len(os.Args) > 1 && os.Args[1] == "qcompile" {
+        // qcompile FILE.pl ... writes FILE.qlf for each
+        for _, path := range os.Args[2:] {
+            out, err := qcompile(path)
+            if err != nil {
+                fmt.Fprintln(os.Stderr, err)
+                os.Exit(1)
+            }
+            fmt.Println("wrote", out)
+        }
+        return
+    }
+    if len(os.Args) > 1 && os.Args[1] == "repl" {
+        // repl FILE ... answers queries about the programs in the files
+        procs := []procedure{}
+        for _, path := range os.Args[2:] {
+            p, err := loadFile(path)
+            if err != nil {
+                fmt.Fprintln(os.Stderr, err)
+                os.Exit(1)
+            }
+            procs = append(procs, p...)
+        }
+        runREPL(NewInterpreter(procs), os.Stdin, os.Stdout)
+        return
+    }
+
     s := MustParseRules(`
     append(nil, L, L).
     append(cons(X,L1), L2, cons(X,L3)) :- append(L1, L2, L3).`)
@@ -14,7 +42,11 @@ func main() {
     i := NewInterpreter(procs)
 
     q := `append(cons(a, cons(b, nil)), cons(c, nil), L)`
-    b := i.interpret(q)  // expect: L = cons(a, cons(b, cons(c, nil))).
+    b, err := i.interpret(q)  // expect: L = cons(a, cons(b, cons(c, nil))).
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
     for _, ans := range b {
         fmt.Println("L =", ans["L"])
     }
@@ -22,7 +54,11 @@ func main() {
     fmt.Println()
 
     q = `append(L, X, cons(a, cons(b, cons(c, nil))))`
-    b = i.interpret(q)
+    b, err = i.interpret(q)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
     for _, ans := range b {
         fmt.Println("L =", ans["L"])
         fmt.Println("X =", ans["X"])
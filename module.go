@@ -0,0 +1,440 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// Modules keep the procedures of a file apart from everything else. A
+// file that starts with
+//
+//   :- module(lists, [append/3, member/2]).
+//
+// defines lists:append/3 and so on, and only the exported ones can be
+// imported by a file that says :- use_module(lists). Everything not in a
+// module is in user, and a call in a module that the module neither
+// defines nor imports goes to user, which is where the builtins are too.
+//
+// Calls are resolved when a file is loaded: a call to an imported
+// procedure is compiled as a call to the module that defines it. Calls
+// made while running, with call/1 or M:G, find imports through the
+// import procedures the loader installs.
+
+// builtinMeta are the meta_predicate specs of the builtins that take goals
+var builtinMeta = map[procEntry][]string{
+    proc("call", 1):                  {"0"},
+    proc(";", 2):                     {"0", "0"},
+    proc("->", 2):                    {"0", "0"},
+    proc("\\+", 1):                   {"0"},
+    proc("assertz", 1):               {":"},
+    proc("clause", 2):                {":", "?"},
+    proc("freeze", 2):                {"?", "0"},
+    proc("when", 2):                  {"+", "0"},
+    proc("call_with_depth_limit", 3): {"0", "+", "?"},
+    proc("call_with_time_limit", 2):  {"+", "0"},
+    proc("parallel", 1):              {"0"},
+    proc("profile", 1):               {"0"},
+    proc("phrase", 2):                {"2", "?"},
+    proc("phrase", 3):                {"2", "?", "?"},
+}
+
+func init() {
+    for n := 2; n <= 8; n++ {
+        spec := []string{fmt.Sprint(n - 1)}
+        for range n - 1 {
+            spec = append(spec, "?")
+        }
+        builtinMeta[proc("call", n)] = spec
+    }
+}
+
+// moduleDirective tells if d is handled by the loader rather than the compiler
+func moduleDirective(d process) bool {
+    switch {
+    case d.functor == "module" && d.arity() == 2:
+        return true
+    case d.functor == "use_module" && (d.arity() == 1 || d.arity() == 2):
+        return true
+    }
+    return false
+}
+
+// moduleDeclaration reads module(Name, Exports)
+func moduleDeclaration(d process) (string, []functorEntry, error) {
+    name, ok := d.args[0].(symbol)
+    if !ok {
+        return "", nil, typeError("atom", d.args[0])
+    }
+    exports, err := predicateIndicators(d.args[1])
+    return moduleName(name), exports, err
+}
+
+// predicateIndicators reads a list of Name/Arity
+func predicateIndicators(e expression) ([]functorEntry, error) {
+    elems, ok := listElements(e)
+    if !ok {
+        return nil, typeError("list", e)
+    }
+    pis := []functorEntry{}
+    for _, pi := range elems {
+        name, arity, ok := predicateIndicator(pi)
+        if !ok {
+            return nil, typeError("predicate_indicator", pi)
+        }
+        pis = append(pis, functor(name, arity))
+    }
+    return pis, nil
+}
+
+// metaSpecs reads what a meta_predicate directive declares: a comma list
+// of heads whose args are 0..9 for a goal that is called with that many
+// more args, : for a term that needs the module, or one of ? + - * ^
+func metaSpecs(e expression) (map[procEntry][]string, error) {
+    specs := map[procEntry][]string{}
+    for {
+        t, ok := e.(process)
+        if !ok {
+            return nil, typeError("meta_predicate head", e)
+        }
+        head := t
+        if t.functor == Comma && t.arity() == 2 {
+            head, ok = t.args[0].(process)
+            if !ok {
+                return nil, typeError("meta_predicate head", t.args[0])
+            }
+        }
+        spec := []string{}
+        for _, arg := range head.args {
+            s := arg.PrintExpression()
+            if _, ok := arg.(number); ok && len(s) == 1 {
+                spec = append(spec, s)
+                continue
+            }
+            if !strings.Contains(":?+-*^", s) || len(s) != 1 {
+                return nil, typeError("meta argument specifier", arg)
+            }
+            spec = append(spec, s)
+        }
+        specs[proc(head.functor, head.arity())] = spec
+        if head.functor == t.functor && head.arity() == t.arity() {
+            return specs, nil
+        }
+        e = t.args[1]
+    }
+}
+
+// isMetaArg tells if an argument with spec is qualified with the module
+func isMetaArg(spec string) bool {
+    return spec == ":" || spec == "^" || (spec >= "0" && spec <= "9")
+}
+
+// metaArgs are the specs as the args of a meta_predicate head
+func metaArgs(spec []string) []expression {
+    args := []expression{}
+    for _, s := range spec {
+        if s >= "0" && s <= "9" {
+            args = append(args, number(s[0]-'0'))
+        } else {
+            args = append(args, symbol(s))
+        }
+    }
+    return args
+}
+
+// qualifyMeta qualifies the meta args of g with module, unless they are already
+func qualifyMeta(module string, g process, spec []string) process {
+    if len(spec) != g.arity() {
+        return g
+    }
+    args := make([]expression, len(g.args))
+    for i, arg := range g.args {
+        args[i] = arg
+        if q, ok := arg.(process); isMetaArg(spec[i]) && !(ok && q.functor == ":" && q.arity() == 2) {
+            args[i] = process{functor: ":", args: []expression{moduleAtom(module), arg}}
+        }
+    }
+    return process{functor: g.functor, args: args}
+}
+
+// metaSpec gets the meta_predicate specs of the procedure p
+func (p *Program) metaSpec(pe procEntry) []string {
+    if pr, ok := p.procedure(pe); ok {
+        return pr.meta
+    }
+    return builtinMeta[pe.unqualified()]
+}
+
+// qualifyImported qualifies the meta args of a call from module to a
+// meta predicate it imports. Calls written in a clause are qualified when
+// it is loaded; this is for those only made when running, such as by
+// call/N or a goal in a variable.
+func (m *machine) qualifyImported(module string, spec []string, args []expression) []expression {
+    g := process{args: make([]expression, len(args))}
+    for i, arg := range args {
+        g.args[i] = walk(m.state.sub, arg)
+    }
+    return qualifyMeta(module, g, spec).args
+}
+
+// M:G calls G in module M, for when M or G is only known when running.
+// It is tried as the clause M:G :- M:G, compiled on the spot.
+func generateQualified(m *machine, args []expression) ([]clause, error) {
+    if _, err := m.callable(process{functor: ":", args: args}); err != nil {
+        return nil, err
+    }
+    g := walkstar(m.state.sub, process{functor: ":", args: args})
+    body, err := toGoals(g)
+    if err != nil {
+        return nil, typeError("callable", g)
+    }
+    for i, b := range body {
+        pe, inner := qualifiedGoal(b)
+        if pe.module == "" {
+            continue
+        }
+        if spec := m.program.metaSpec(pe); spec != nil {
+            body[i] = process{functor: ":", args: []expression{symbol(pe.module), goalTerm(qualifyMeta(pe.module, inner, spec))}}
+        }
+    }
+    r := rule{head: g.(process), body: body}
+    return []clause{compileClause(renumberVariables(r))}, nil
+}
+
+// a loader loads files and the files they use, each of them once
+type loader struct {
+    files    map[string]*moduleFile // by path; nil while it is being loaded
+    meta     map[procEntry][]string // of the procedures loaded so far
+    procs    []procedure
+    expander *interpreter // runs the expansion hooks, once there are any
+    pending  []learnt     // clauses read that the expander does not have yet
+}
+
+// a moduleFile is what a loaded file gives to the files that use it
+type moduleFile struct {
+    module  string // empty for a file that is not a module
+    exports []functorEntry
+}
+
+func newLoader() *loader {
+    return &loader{files: map[string]*moduleFile{}, meta: map[procEntry][]string{}}
+}
+
+// load loads the file at path and the modules it uses
+func (l *loader) load(path string) (*moduleFile, error) {
+    path = filepath.Clean(path)
+    if f, ok := l.files[path]; ok {
+        if f == nil {
+            return nil, fmt.Errorf("%s: circular use_module", path)
+        }
+        return f, nil
+    }
+    if strings.HasSuffix(path, ".qlf") {
+        r, err := os.Open(path)
+        if err != nil {
+            return nil, err
+        }
+        defer r.Close()
+        procs, err := LoadProcedures(r)
+        if err != nil {
+            return nil, err
+        }
+        l.add(procs)
+        l.files[path] = &moduleFile{}
+        return l.files[path], nil
+    }
+    b, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    terms, err := readTerms(string(b))
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    l.files[path] = nil
+    f := &moduleFile{}
+    imports := map[functorEntry]procEntry{}
+    local := map[functorEntry]bool{}
+    rules := []rule{}
+    for _, st := range terms {
+        pos := position{file: path, line: st.line}
+        expanded, err := l.expandTerm(f.module, st.term)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", pos, err)
+        }
+        for _, r := range expanded {
+            r.pos = pos
+            d, ok := r.directive()
+            t, _ := d.(process)
+            switch {
+            case !ok:
+                if pe, _ := qualifiedHead(f.module, r.head); pe.module == f.module {
+                    local[pe.functorEntry] = true
+                }
+            case t.functor == "module" && t.arity() == 2 && len(rules) == 0:
+                // termRule checked it
+                f.module, f.exports, _ = moduleDeclaration(t)
+            case t.functor == "use_module" && (t.arity() == 1 || t.arity() == 2):
+                if err := l.useModule(path, t, imports); err != nil {
+                    return nil, fmt.Errorf("%s: %w", pos, err)
+                }
+                l.install(importProcedures(f.module, imports)...)
+            case t.functor == "meta_predicate" && t.arity() == 1:
+                specs, _ := metaSpecs(t.args[0])
+                for pe, spec := range specs {
+                    l.meta[moduleProc(f.module, pe.name, pe.arity)] = spec
+                }
+            }
+            if r, err = l.expandGoals(f.module, imports, r); err != nil {
+                return nil, fmt.Errorf("%s: %w", pos, err)
+            }
+            rules = append(rules, r)
+            if l.expander == nil && definesHook(f.module, r) {
+                l.startExpanding(f.module, rules, imports)
+            } else {
+                l.learn(f.module, r)
+            }
+        }
+    }
+    for fe, pe := range imports {
+        if local[fe] {
+            return nil, fmt.Errorf("%s: %s is imported from %s and defined here", path, fe.printEntry(), moduleAtom(pe.module))
+        }
+    }
+    for i, r := range rules {
+        if _, ok := r.directive(); ok {
+            continue
+        }
+        rules[i] = l.resolveRule(f.module, local, imports, r)
+    }
+    l.add(compileModule(f.module, rules))
+    l.procs = append(l.procs, importProcedures(f.module, imports)...)
+    l.files[path] = f
+    return f, nil
+}
+
+// add adds loaded procedures, which the expansion hooks can use from now on
+func (l *loader) add(procs []procedure) {
+    for _, p := range procs {
+        if p.meta != nil {
+            l.meta[p.entry()] = p.meta
+        }
+    }
+    l.procs = append(l.procs, procs...)
+    l.install(procs...)
+}
+
+// importProcedures are the procedures that stand for what module imports
+func importProcedures(module string, imports map[functorEntry]procEntry) []procedure {
+    procs := []procedure{}
+    for fe, pe := range imports {
+        procs = append(procs, procedure{name: fe.name, arity: fe.arity, module: module, from: pe.module})
+    }
+    return procs
+}
+
+// useModule loads the module of a use_module directive in the file at
+// path and adds what it imports to imports. A file is found relative to
+// the directory of path. library(Name) is built in, so there is nothing
+// to load for it.
+func (l *loader) useModule(path string, d process, imports map[functorEntry]procEntry) error {
+    spec := d.args[0]
+    if t, ok := spec.(process); ok && t.functor == "library" && t.arity() == 1 {
+        return nil
+    }
+    name, ok := spec.(symbol)
+    if !ok {
+        return typeError("file name", spec)
+    }
+    file := string(name)
+    if !filepath.IsAbs(file) {
+        file = filepath.Join(filepath.Dir(path), file)
+    }
+    if _, err := os.Stat(file); err != nil && filepath.Ext(file) == "" {
+        file += ".pl"
+    }
+    f, err := l.load(file)
+    if err != nil {
+        return err
+    }
+    if f.module == "" {
+        return nil
+    }
+    wanted := f.exports
+    if d.arity() == 2 {
+        if wanted, err = predicateIndicators(d.args[1]); err != nil {
+            return err
+        }
+        for _, fe := range wanted {
+            if !exports(f, fe) {
+                return fmt.Errorf("%s does not export %s", f.module, fe.printEntry())
+            }
+        }
+    }
+    for _, fe := range wanted {
+        pe := moduleProc(f.module, fe.name, fe.arity)
+        if old, ok := imports[fe]; ok && old != pe {
+            return fmt.Errorf("%s is imported from both %s and %s", fe.printEntry(), moduleAtom(old.module), f.module)
+        }
+        imports[fe] = pe
+    }
+    return nil
+}
+
+func exports(f *moduleFile, fe functorEntry) bool {
+    for _, e := range f.exports {
+        if e == fe {
+            return true
+        }
+    }
+    return false
+}
+
+// resolveRule qualifies the goals of a clause of module with the module
+// they call: the module itself for what it defines, the module defining
+// it for what it imports and user for builtins. The meta args of calls
+// are qualified with module, so goals passed to another module are still
+// called in this one.
+func (l *loader) resolveRule(module string, local map[functorEntry]bool, imports map[functorEntry]procEntry, r rule) rule {
+    resolve := func(goals []process) []process {
+        if goals == nil {
+            return nil
+        }
+        out := []process{}
+        for _, g := range goals {
+            out = append(out, l.resolveGoal(module, local, imports, g))
+        }
+        return out
+    }
+    r.guard = resolve(r.guard)
+    r.body = resolve(r.body)
+    return r
+}
+
+func (l *loader) resolveGoal(module string, local map[functorEntry]bool, imports map[functorEntry]procEntry, g process) process {
+    if g.functor == ":" && g.arity() == 2 {
+        return g
+    }
+    fe := functor(g.functor, g.arity())
+    target := moduleProc(module, g.functor, g.arity())
+    spec := l.meta[target]
+    if pe, ok := imports[fe]; ok {
+        target, spec = pe, l.meta[pe]
+    } else if !local[fe] && isBuiltin(proc(g.functor, g.arity())) {
+        target, spec = proc(g.functor, g.arity()), builtinMeta[proc(g.functor, g.arity())]
+    }
+    if spec != nil && (module != "" || target.module != "") {
+        g = qualifyMeta(module, g, spec)
+    }
+    if target.module == "" {
+        return g
+    }
+    return process{functor: ":", args: []expression{symbol(target.module), goalTerm(g)}}
+}
+
+func isBuiltin(p procEntry) bool {
+    _, b := builtins[p]
+    _, g := generators[p]
+    return b || g
+}
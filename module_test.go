@@ -0,0 +1,187 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+var moduleFiles = map[string]string{
+    "lists.pl": `
+    :- module(lists, [append/3, rev/2, twice/1, ma/2]).
+    :- meta_predicate twice(0), ma(1, ?).
+    append([], L, L).
+    append([H|T], L, [H|R]) :- append(T, L, R).
+    rev(L, R) :- rev(L, [], R).
+    rev([], A, A).
+    rev([H|T], A, R) :- rev(T, [H|A], R).
+    twice(G) :- call(G), call(G).
+    ma(G, X) :- call(G, X).
+    helper(lists).
+    say :- writeln(lists).
+    `,
+    "main.pl": `
+    :- use_module(lists).
+    helper(main).
+    go(R) :- append([1], [2], L), rev(L, R).
+    h(X) :- helper(X).
+    hl(X) :- lists:helper(X).
+    say :- writeln(main).
+    t :- twice(say).
+    viacall(X) :- call(ma(helper), X).
+    `,
+    "some.pl": `
+    :- use_module(lists, [append/3]).
+    r(R) :- rev([1, 2], R).
+    `,
+    "private.pl": `
+    :- use_module(lists, [helper/1]).
+    `,
+    "clash.pl": `
+    :- use_module(lists).
+    append(_, _, _).
+    `,
+}
+
+func writeModuleFiles(t *testing.T) string {
+    t.Helper()
+    dir := t.TempDir()
+    for name, src := range moduleFiles {
+        if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return dir
+}
+
+func TestModules(t *testing.T) {
+    dir := writeModuleFiles(t)
+    procs, err := loadFile(filepath.Join(dir, "main.pl"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var out strings.Builder
+    i := NewInterpreter(procs)
+    i.setOutput(&out)
+    for _, tt := range []struct{
+        query string
+        vars  []string
+        want  []string
+        out   string
+        err   bool
+    }{
+        {query: "go(R)", vars: []string{"R"}, want: []string{"[2,1]"}},
+        // each module has its own helper/1
+        {query: "h(X)", vars: []string{"X"}, want: []string{"main"}},
+        {query: "hl(X)", vars: []string{"X"}, want: []string{"lists"}},
+        {query: "lists:helper(X)", vars: []string{"X"}, want: []string{"lists"}},
+        {query: "call((M = lists, M:helper(X)))", vars: []string{"X"}, want: []string{"lists"}},
+        // the goal passed to twice/1 is called in user
+        {query: "t", want: []string{""}, out: "main\nmain\n"},
+        {query: "lists:twice(say)", want: []string{""}, out: "lists\nlists\n"},
+        // so is one passed through an import only found when running
+        {query: "ma(helper, X)", vars: []string{"X"}, want: []string{"main"}},
+        {query: "viacall(X)", vars: []string{"X"}, want: []string{"main"}},
+        {query: "call((G = ma(helper, X), G))", vars: []string{"X"}, want: []string{"main"}},
+        // imports are found by goals made while running
+        {query: "call(append(X, Y, [1]))", vars: []string{"X", "Y"}, want: []string{"nil [1]", "[1] nil"}},
+        // what is not exported is not imported
+        {query: "rev([1], [], R)", err: true},
+        {query: "lists:rev([1], [], R)", vars: []string{"R"}, want: []string{"[1]"}},
+        {query: "M:helper(X)", err: true},
+    }{
+        out.Reset()
+        got, err := answers(i, tt.query, tt.vars...)
+        if (err != nil) != tt.err {
+            t.Errorf("%s: %v", tt.query, err)
+            continue
+        }
+        if !tt.err && !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: got %v want %v", tt.query, got, tt.want)
+        }
+        if out.String() != tt.out {
+            t.Errorf("%s: wrote %q want %q", tt.query, out.String(), tt.out)
+        }
+    }
+}
+
+func TestUseModule(t *testing.T) {
+    dir := writeModuleFiles(t)
+    procs, err := loadFile(filepath.Join(dir, "some.pl"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    i := NewInterpreter(procs)
+    if got, err := answers(i, "append([1], [2], L)", "L"); err != nil || !reflect.DeepEqual(got, []string{"[1,2]"}) {
+        t.Errorf("got %v %v", got, err)
+    }
+    // rev/2 was not asked for
+    if _, err := answers(i, "r(_)"); err == nil {
+        t.Error("expected error")
+    }
+    for _, file := range []string{"private.pl", "clash.pl"} {
+        if _, err := loadFile(filepath.Join(dir, file)); err == nil {
+            t.Errorf("%s: expected error", file)
+        }
+    }
+}
+
+func TestQualifiedClauses(t *testing.T) {
+    var out strings.Builder
+    i := NewInterpreter(compileProcedures(MustParseRules(`
+    m:foo(1).
+    m:foo(2).
+    foo(user).
+    bar(X) :- m:foo(X).
+    m:both(X) :- foo(X).
+    `)))
+    i.setOutput(&out)
+    for _, tt := range []struct{
+        query string
+        vars  []string
+        want  []string
+    }{
+        {query: "foo(X)", vars: []string{"X"}, want: []string{"user"}},
+        {query: "bar(X)", vars: []string{"X"}, want: []string{"1", "2"}},
+        {query: "call(m:foo(X))", vars: []string{"X"}, want: []string{"1", "2"}},
+        // the body of a clause is in the module of the file
+        {query: "m:both(X)", vars: []string{"X"}, want: []string{"user"}},
+        // what a module does not have comes from user
+        {query: "m:member(X, [a])", vars: []string{"X"}, want: []string{"a"}},
+        {query: "call((assertz(m:baz(1)), m:baz(X)))", vars: []string{"X"}, want: []string{"1"}},
+        {query: "clause(m:foo(X), B)", vars: []string{"X", "B"}, want: []string{"1 true", "2 true"}},
+    }{
+        got, err := answers(i, tt.query, tt.vars...)
+        if err != nil {
+            t.Errorf("%s: %v", tt.query, err)
+            continue
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: got %v want %v", tt.query, got, tt.want)
+        }
+    }
+    mustInterpret(t, i, "listing(m:foo/1)")
+    mustInterpret(t, i, "listing(bar/1)")
+    if want := "m:foo(1).\nm:foo(2).\n\nbar(A) :- m:foo(A).\n\n"; out.String() != want {
+        t.Errorf("got %q want %q", out.String(), want)
+    }
+}
+
+func TestModuleQlf(t *testing.T) {
+    dir := writeModuleFiles(t)
+    if _, err := qcompile(filepath.Join(dir, "main.pl")); err != nil {
+        t.Fatal(err)
+    }
+    procs, err := loadFile(filepath.Join(dir, "main.qlf"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    i := NewInterpreter(procs)
+    for query, want := range map[string]string{"go(R)": "[2,1]", "hl(R)": "lists"} {
+        if got, err := answers(i, query, "R"); err != nil || !reflect.DeepEqual(got, []string{want}) {
+            t.Errorf("%s: got %v %v", query, got, err)
+        }
+    }
+}
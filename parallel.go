@@ -0,0 +1,300 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "runtime"
+    "sync"
+    "sync/atomic"
+)
+
+// Or-parallel execution. With the persistent substitution, a choicepoint
+// holds everything needed to explore its alternatives from scratch, so it
+// can be handed to another goroutine instead of being pushed. The machine
+// that made it pushes a marker in its place and goes on with the first
+// alternative; a cut that removes the marker cancels the branch.
+//
+// Cut in an alternative only prunes the alternatives after it, which go
+// with it to the same branch. A cut further up, in a clause waiting in the
+// continuation, would prune branches that are already running, so a
+// choicepoint is only handed out if there is no cut left in the continuation.
+
+// ParallelOptions configure or-parallel execution
+type ParallelOptions struct {
+    Workers int  // goroutines per parallel search; 0 means one per CPU
+    Ordered bool // give answers in the order sequential execution would
+    All     bool // run every query in parallel, not just parallel/1 goals
+}
+
+// a branch is the part of the search tree explored by one goroutine
+type branch struct {
+    parent    *branch
+    cancelled atomic.Bool
+    // guarded by the mutex of the search
+    items []branchItem
+    done  bool
+    err   error
+}
+
+// an item is either an answer or the place where the answers of a child
+// branch go: where sequential execution would have backtracked into the
+// alternatives it took. Until then a cut can still cancel the child, so
+// its answers are not given.
+type branchItem struct {
+    answer state
+    child  *branch
+}
+
+func (b *branch) dead() bool {
+    for ; b != nil; b = b.parent {
+        if b.cancelled.Load() {
+            return true
+        }
+    }
+    return false
+}
+
+// orParallel is one parallel search
+type orParallel struct {
+    opts    ParallelOptions
+    workers chan struct{} // a token for every goroutine that may be started
+    wg      sync.WaitGroup
+    changed chan struct{} // signalled when a branch gets an item or is done
+    mu      sync.Mutex
+    stats   stats // of the machines that are done
+}
+
+// the machine of a cancelled branch stops with this
+var errPruned = errors.New("branch pruned by cut")
+
+// solveParallel calls yield with the answers of p(args) as the goroutines
+// sharing the search find them, until yield returns false, there are no
+// more answers or an error occurs. Then it stops the goroutines.
+func (m *machine) solveParallel(p procEntry, args []expression, st state, yield func(state) bool) error {
+    opts := m.parallel
+    if opts.Workers < 0 {
+        return fmt.Errorf("domain error: not_less_than_zero expected, found %d", opts.Workers)
+    }
+    if opts.Workers == 0 {
+        opts.Workers = runtime.NumCPU()
+    }
+    par := &orParallel{opts: opts, workers: make(chan struct{}, opts.Workers-1), changed: make(chan struct{}, 1)}
+    // a parallel/1 inside a branch dies with it
+    root := &branch{parent: m.branch}
+    rm := &machine{Engine: m.Engine, program: m.program, state: st, par: par, branch: root}
+    par.wg.Add(1)
+    go func() {
+        defer par.wg.Done()
+        rm.run(p, args, par.yield(root))
+        par.done(rm)
+    }()
+    var err error
+    if opts.Ordered {
+        _, err = par.streamOrdered(root, yield)
+    } else {
+        err = par.stream(root, yield)
+    }
+    root.cancelled.Store(true)
+    par.wg.Wait()
+    m.stats.inferences += par.stats.inferences
+    m.stats.peakBindings = max(m.stats.peakBindings, par.stats.peakBindings)
+    return err
+}
+
+// add gives b an item
+func (par *orParallel) add(b *branch, it branchItem) {
+    par.mu.Lock()
+    b.items = append(b.items, it)
+    par.mu.Unlock()
+    par.signal()
+}
+
+func (par *orParallel) signal() {
+    select {
+    case par.changed <- struct{}{}:
+    default:
+    }
+}
+
+func (par *orParallel) yield(b *branch) func(state) bool {
+    return func(st state) bool {
+        par.add(b, branchItem{answer: st})
+        return true
+    }
+}
+
+// done records how the machine of a branch ended. The branches it
+// forked that it never backtracked into can give no answers, so they
+// are cancelled.
+func (par *orParallel) done(m *machine) {
+    for _, cp := range m.choices {
+        if cp.fork != nil {
+            cp.fork.cancelled.Store(true)
+        }
+    }
+    par.mu.Lock()
+    if m.err != nil && m.err != errPruned {
+        m.branch.err = m.err
+    }
+    m.branch.done = true
+    par.stats.inferences += m.stats.inferences
+    par.stats.peakBindings = max(par.stats.peakBindings, m.stats.peakBindings)
+    par.mu.Unlock()
+    par.signal()
+}
+
+// item waits for the nth item of b. If b is done without one, it
+// returns false and the error b ended with.
+func (par *orParallel) item(b *branch, n int) (branchItem, bool, error) {
+    for {
+        par.mu.Lock()
+        if n < len(b.items) {
+            it := b.items[n]
+            par.mu.Unlock()
+            return it, true, nil
+        }
+        done, err := b.done, b.err
+        par.mu.Unlock()
+        if done {
+            return branchItem{}, false, err
+        }
+        <-par.changed
+    }
+}
+
+// streamOrdered gives the answers of b and its children in the order
+// sequential execution would, reporting whether yield wants more
+func (par *orParallel) streamOrdered(b *branch, yield func(state) bool) (bool, error) {
+    for n := 0; ; n++ {
+        it, ok, err := par.item(b, n)
+        if !ok {
+            return true, err
+        }
+        if it.child != nil {
+            if more, err := par.streamOrdered(it.child, yield); !more || err != nil {
+                return more, err
+            }
+            continue
+        }
+        if !yield(it.answer) {
+            return false, nil
+        }
+    }
+}
+
+// stream gives the answers of root and its children as they come
+func (par *orParallel) stream(root *branch, yield func(state) bool) error {
+    type cursor struct {
+        b *branch
+        n int // items taken so far
+    }
+    open := []*cursor{{b: root}}
+    for len(open) > 0 {
+        var items []branchItem
+        var err error
+        par.mu.Lock()
+        running := open[:0]
+        for _, c := range open {
+            items = append(items, c.b.items[c.n:]...)
+            c.n = len(c.b.items)
+            switch {
+            case !c.b.done:
+                running = append(running, c)
+            case c.b.err != nil && err == nil:
+                err = c.b.err
+            }
+        }
+        open = running
+        par.mu.Unlock()
+        for _, it := range items {
+            if it.child != nil {
+                open = append(open, &cursor{b: it.child})
+                continue
+            }
+            if !yield(it.answer) {
+                return nil
+            }
+        }
+        if err != nil {
+            return err
+        }
+        if len(items) == 0 && len(open) > 0 {
+            <-par.changed
+        }
+    }
+    return nil
+}
+
+// fork hands alts to a new branch if a worker is free and no cut can
+// reach them, returning the branch
+func (m *machine) fork(alts []clause, args []expression, cont *frame, st state) *branch {
+    if _, ok := st.sub.(*substitution); !ok {
+        return nil
+    }
+    select {
+    case m.par.workers <- struct{}{}:
+    default:
+        return nil
+    }
+    for f := cont; f != nil; f = f.next {
+        if hasCut(f.pc, f.xr) {
+            <-m.par.workers
+            return nil
+        }
+    }
+    b := &branch{parent: m.branch}
+    m.par.wg.Add(1)
+    go func() {
+        defer m.par.wg.Done()
+        defer func() { <-m.par.workers }()
+        bm := &machine{Engine: m.Engine, program: m.program, par: m.par, branch: b}
+        bm.loop(bm.try(alts, args, cont, st), m.par.yield(b))
+        m.par.done(bm)
+    }()
+    return b
+}
+
+// hasCut reports whether code calls !/0, commits or cuts to a barrier
+func hasCut(pc []instruction, xr xrTable) bool {
+    for i := 0; i < len(pc); i++ {
+        if pc[i] == COMMIT || pc[i] == CUT {
+            return true
+        }
+        if pc[i] == CALL && i+1 < len(pc) && xr[pc[i+1]] == proc("!", 0) {
+            return true
+        }
+        if pc[i].hasOperand() {
+            i++
+        }
+    }
+    return false
+}
+
+// parallel(G) finds all answers of G in parallel, then succeeds once
+// for each. Cut inside G only cuts G.
+func generateParallel(m *machine, args []expression) ([]clause, error) {
+    if _, err := m.callable(args[0]); err != nil {
+        return nil, err
+    }
+    g := walkstar(m.state.sub, args[0])
+    if _, ok := m.state.sub.(*substitution); !ok || m.trace != nil {
+        // branches cannot share a trail, nor the debugger, so this is
+        // parallel(G) :- G.
+        body, err := toGoals(g)
+        if err != nil {
+            return nil, typeError("callable", g)
+        }
+        r := rule{head: process{functor: "parallel", args: []expression{g}}, body: body}
+        return []clause{compileClause(renumberVariables(r))}, nil
+    }
+    clauses := []clause{}
+    err := m.solveParallel(proc("call", 1), []expression{g}, m.state, func(ans state) bool {
+        head := process{functor: "parallel", args: []expression{walkstar(ans.sub, g)}}
+        clauses = append(clauses, compileClause(renumberVariables(rule{head: head})))
+        return true
+    })
+    if err != nil {
+        return nil, err
+    }
+    return clauses, nil
+}
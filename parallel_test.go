@@ -0,0 +1,175 @@
+package main
+
+import (
+    "context"
+    "reflect"
+    "slices"
+    "sort"
+    "testing"
+)
+
+var parallelRules = `
+    max(X, Y, X) :- X >= Y, !.
+    max(_, Y, Y).
+    p(X) :- X = 1, !.
+    p(X) :- loop.
+    loop :- loop.
+    first(X, L) :- member(X, L), !.
+    pick(X) :- member(X, [a, b]) | true.
+    pick(c).
+    pairs(X, Y) :- member(X, [1, 2, 3]), member(Y, [a, b]).
+    bad(X) :- member(X, [1, 2, 3]), X > 2, Y is X + foo.`
+
+func TestParallel(t *testing.T) {
+    for _, ordered := range []bool{false, true} {
+        i := NewInterpreter(compileProcedures(MustParseRules(parallelRules)))
+        i.setParallel(ParallelOptions{Workers: 4, Ordered: ordered})
+        for n, tt := range []struct{
+            query string
+            vars  []string
+            want  []string
+        }{
+            {query: "parallel(pairs(X, Y))", vars: []string{"X", "Y"}, want: []string{"1 a", "1 b", "2 a", "2 b", "3 a", "3 b"}},
+            // a cut in the first clause cancels the branch running the second
+            {query: "parallel(max(3, 1, M))", vars: []string{"M"}, want: []string{"3"}},
+            {query: "parallel(max(1, 3, M))", vars: []string{"M"}, want: []string{"3"}},
+            {query: "parallel(p(X))", vars: []string{"X"}, want: []string{"1"}},
+            // a cut waiting in the continuation keeps member/2 from forking
+            {query: "parallel(first(X, [a, b, c]))", vars: []string{"X"}, want: []string{"a"}},
+            {query: "parallel((member(X, [a, b, c]), !))", vars: []string{"X"}, want: []string{"a"}},
+            {query: "parallel(member(X, []))", vars: []string{"X"}, want: []string{}},
+            // so does a commit
+            {query: "parallel(pick(X))", vars: []string{"X"}, want: []string{"a"}},
+        }{
+            got, err := answers(i, tt.query, tt.vars...)
+            if err != nil {
+                t.Errorf("%d: %s: %v", n, tt.query, err)
+                continue
+            }
+            if !ordered {
+                sort.Strings(got)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("%d: %s: got %v want %v", n, tt.query, got, tt.want)
+            }
+        }
+        if _, err := answers(i, "parallel(bad(X))"); err == nil {
+            t.Error("expected error from a branch")
+        }
+    }
+}
+
+// Every query run in parallel gives the answers sequential execution
+// does, in the same order if asked to
+func TestParallelPrograms(t *testing.T) {
+    for _, tt := range benchmarkPrograms {
+        if tt.name == "tak" || tt.name == "zebra" {
+            continue // too slow under the race detector
+        }
+        i := loadProgram(t, tt.file)
+        _, b := MustParseProcesses(tt.query)
+        vars := []string{}
+        for name := range b {
+            vars = append(vars, name)
+        }
+        sort.Strings(vars)
+        want, err := answers(i, tt.query, vars...)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, ordered := range []bool{false, true} {
+            i.setParallel(ParallelOptions{Workers: 4, Ordered: ordered, All: true})
+            got, err := answers(i, tt.query, vars...)
+            i.setParallel(ParallelOptions{})
+            if err != nil {
+                t.Fatal(err)
+            }
+            want := want
+            if !ordered {
+                sort.Strings(got)
+                want = slices.Sorted(slices.Values(want))
+            }
+            if !reflect.DeepEqual(got, want) {
+                t.Errorf("%s ordered=%v: got %v want %v", tt.name, ordered, got, want)
+            }
+        }
+    }
+}
+
+func TestParallelTrail(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(parallelRules)))
+    i.setStore(newTrail)
+    got, err := answers(i, "parallel(max(3, 1, M))", "M")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := []string{"3"}; !reflect.DeepEqual(got, want) {
+        t.Errorf("got %v want %v", got, want)
+    }
+}
+
+// Answers are given as they are found, so a query with infinitely many
+// of them stops when no more are wanted
+func TestParallelStream(t *testing.T) {
+    for _, ordered := range []bool{false, true} {
+        i := NewInterpreter(compileProcedures(MustParseRules(`
+        nat(0).
+        nat(N) :- nat(M), N is M + 1.
+        pair(X, Y) :- nat(X), member(Y, [a, b]).`)))
+        i.setParallel(ParallelOptions{Workers: 4, Ordered: ordered, All: true})
+        p, b := MustParseProcesses("pair(X, Y)")
+        got := []string{}
+        _, err := i.solve(proc(p[0].functor, p[0].arity()), p[0].args, state{sub: i.store(), vc: len(b)}, func(st state) bool {
+            got = append(got, walkstar(st.sub, b["X"]).PrintExpression()+" "+walkstar(st.sub, b["Y"]).PrintExpression())
+            return len(got) < 5
+        })
+        if err != nil {
+            t.Fatalf("ordered=%v: %v", ordered, err)
+        }
+        if len(got) != 5 {
+            t.Errorf("ordered=%v: got %d answers want 5", ordered, len(got))
+        }
+        if want := []string{"0 a", "0 b", "1 a", "1 b", "2 a"}; ordered && !reflect.DeepEqual(got, want) {
+            t.Errorf("got %v want %v", got, want)
+        }
+    }
+}
+
+func TestParallelStats(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(parallelRules)))
+    p, b := MustParseProcesses("pairs(X, Y)")
+    seq, err := i.solve(proc(p[0].functor, p[0].arity()), p[0].args, state{sub: i.store(), vc: len(b)}, func(state) bool { return true })
+    if err != nil {
+        t.Fatal(err)
+    }
+    i.setParallel(ParallelOptions{Workers: 4, All: true})
+    par, err := i.solve(proc(p[0].functor, p[0].arity()), p[0].args, state{sub: i.store(), vc: len(b)}, func(state) bool { return true })
+    if err != nil {
+        t.Fatal(err)
+    }
+    // branches start from a choicepoint, not a call, so the count is the same
+    if par.inferences != seq.inferences {
+        t.Errorf("got %d inferences want %d", par.inferences, seq.inferences)
+    }
+}
+
+func TestParallelWorkers(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(parallelRules)))
+    for _, workers := range []int{-1, 1} {
+        i.setParallel(ParallelOptions{Workers: workers})
+        got, err := answers(i, "parallel(pairs(X, Y))", "X", "Y")
+        if workers < 0 {
+            if err == nil {
+                t.Errorf("%d workers: no error", workers)
+            }
+            continue
+        }
+        if err != nil || len(got) != 6 {
+            t.Errorf("%d workers: got %v, error %v", workers, got, err)
+        }
+    }
+    i.setParallel(ParallelOptions{Workers: -1, All: true})
+    if _, err := i.interpretContext(context.Background(), "pairs(X, Y)", Limits{}); err == nil {
+        t.Error("-1 workers: no error")
+    }
+}
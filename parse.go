@@ -1,7 +1,9 @@
 package main
 
 import (
+    "fmt"
     "strconv"
+    "strings"
 )
 
 type syntaxError struct {
@@ -12,154 +14,518 @@ func (e syntaxError) Error() string {
     return e.msg
 }
 
+type operator struct {
+    prec int
+    typ  string // xfx, xfy, yfx, fy or fx
+}
+
+var infixOps = map[string]operator{
+    ":-":   {1200, "xfx"},
+    "-->":  {1200, "xfx"},
+    ";":    {1100, "xfy"},
+    "|":    {1100, "xfy"},
+    "->":   {1050, "xfy"},
+    ",":    {1000, "xfy"},
+    "=":    {700, "xfx"},
+    "\\=":  {700, "xfx"},
+    "==":   {700, "xfx"},
+    "\\==": {700, "xfx"},
+    "@<":   {700, "xfx"},
+    "@>":   {700, "xfx"},
+    "@=<":  {700, "xfx"},
+    "@>=":  {700, "xfx"},
+    "=..":  {700, "xfx"},
+    "is":   {700, "xfx"},
+    ":=":   {700, "xfx"},
+    "=:=":  {700, "xfx"},
+    "=\\=": {700, "xfx"},
+    "<":    {700, "xfx"},
+    ">":    {700, "xfx"},
+    "=<":   {700, "xfx"},
+    ">=":   {700, "xfx"},
+    "#=":   {700, "xfx"},
+    "#\\=":  {700, "xfx"},
+    "#<":   {700, "xfx"},
+    "#>":   {700, "xfx"},
+    "#=<":  {700, "xfx"},
+    "#>=":  {700, "xfx"},
+    "in":   {700, "xfx"},
+    "ins":  {700, "xfx"},
+    "..":   {450, "xfx"},
+    ":":    {200, "xfy"},
+    "+":    {500, "yfx"},
+    "-":    {500, "yfx"},
+    "/\\":  {500, "yfx"},
+    "\\/":  {500, "yfx"},
+    "xor":  {500, "yfx"},
+    "*":    {400, "yfx"},
+    "/":    {400, "yfx"},
+    "//":   {400, "yfx"},
+    "mod":  {400, "yfx"},
+    "rem":  {400, "yfx"},
+    "<<":   {400, "yfx"},
+    ">>":   {400, "yfx"},
+    "**":   {200, "xfx"},
+    "^":    {200, "xfy"},
+}
+
+var prefixOps = map[string]operator{
+    ":-":    {1200, "fx"},
+    "?-":    {1200, "fx"},
+    "table": {1150, "fx"},
+    "meta_predicate": {1150, "fx"},
+    "\\+":   {900, "fy"},
+    "-":     {200, "fy"},
+    "+":     {200, "fy"},
+    "\\":    {200, "fy"},
+}
+
 func MustParseRules(input string) []rule {
-    tokens := tokenize(input)
+    rules, err := ParseRules(input)
+    if err != nil {
+        panic(err)
+    }
+    return rules
+}
+
+func ParseRules(input string) ([]rule, error) {
+    terms, err := readTerms(input)
+    if err != nil {
+        return nil, err
+    }
     rules := []rule{}
-    for len(tokens) > 0 {
-        r, n, err := parseRule(tokens)
+    for _, st := range terms {
+        r, err := termRule(st.term)
         if err != nil {
-            panic(err)
+            return nil, fmt.Errorf("line %d: %w", st.line, err)
         }
-        tokens = tokens[n:]
+        r.pos.line = st.line
         rules = append(rules, r)
     }
-    return rules
+    return rules, nil
 }
 
-func MustParseProcesses(input string) ([]process, map[string]variable) {
-    tokens := tokenize(input)
-    processes := []process{}
-    b := map[string]variable{}
+// a sourceTerm is a clause as it was read, before it is made a rule
+type sourceTerm struct {
+    term expression
+    line int
+}
+
+// readTerms reads the clause terms of a program
+func readTerms(input string) ([]sourceTerm, error) {
+    tokens, lines := tokenizeLines(input)
+    terms := []sourceTerm{}
     for len(tokens) > 0 {
-        p, n, err := parseProcess(b, tokens)
+        t, n, err := parseClause(tokens)
         if err != nil {
-            panic(err)
+            return nil, err
         }
-        processes = append(processes, p)
-        if len(tokens) > n {
-            if tokens[n] != Comma {
-                panic("expected comma")
-            }
-            tokens = tokens[n+1:]
-            continue
+        terms = append(terms, sourceTerm{term: t, line: lines[0]})
+        tokens, lines = tokens[n:], lines[n:]
+    }
+    return terms, nil
+}
+
+// termRule makes a rule of a clause term, translating a grammar rule
+// and checking a directive
+func termRule(t expression) (rule, error) {
+    if p, ok := t.(process); ok && p.functor == "-->" && p.arity() == 2 {
+        next := nextVariable(t)
+        fresh := func() variable {
+            next++
+            return next - 1
+        }
+        var err error
+        if t, err = dcgRule(p.args[0], p.args[1], fresh); err != nil {
+            return rule{}, err
+        }
+    }
+    r, err := toRule(t)
+    if err != nil {
+        return rule{}, err
+    }
+    if d, ok := r.directive(); ok {
+        if err := checkDirective(d); err != nil {
+            return rule{}, err
+        }
+    }
+    return r, nil
+}
+
+// nextVariable is the variable after the highest in e
+func nextVariable(e expression) variable {
+    switch t := e.(type) {
+    case variable:
+        return t + 1
+    case list:
+        return max(nextVariable(t.head), nextVariable(t.tail))
+    case process:
+        next := variable(0)
+        for _, arg := range t.args {
+            next = max(next, nextVariable(arg))
         }
-        tokens = tokens[n:]
+        return next
+    }
+    return 0
+}
+
+// checkDirective reports errors in the directives the compiler knows
+func checkDirective(d expression) error {
+    t, ok := d.(process)
+    switch {
+    case ok && t.functor == "table" && t.arity() == 1:
+        _, err := tableSpecs(t.args[0])
+        return err
+    case ok && t.functor == "meta_predicate" && t.arity() == 1:
+        _, err := metaSpecs(t.args[0])
+        return err
+    case ok && t.functor == "module" && t.arity() == 2:
+        _, _, err := moduleDeclaration(t)
+        return err
+    }
+    return nil
+}
+
+func MustParseProcesses(input string) ([]process, map[string]variable) {
+    processes, b, err := ParseProcesses(input)
+    if err != nil {
+        panic(err)
     }
     return processes, b
 }
 
+// ParseProcesses parses a query, returning its goals and the variables named in it
+func ParseProcesses(input string) ([]process, map[string]variable, error) {
+    tokens := tokenize(input)
+    b := map[string]variable{}
+    t, n, err := parseTerm(b, tokens, 1200)
+    if err != nil {
+        return nil, nil, err
+    }
+    if len(tokens) > n && (tokens[n] != Period || len(tokens) > n+1) {
+        return nil, nil, syntaxError{"expected end of query"}
+    }
+    processes, err := toGoals(t)
+    if err != nil {
+        return nil, nil, err
+    }
+    return processes, b, nil
+}
+
 // parseRule returns a rule, amount of tokens parsed, and error
 // variables in rules are numbered by first occurence, starting at 0
 // actual vars will be assigned during copying of a matched rule with fresh vars
 func parseRule(tokens []token) (rule, int, error) {
-    b := map[string]variable{}
-    head, n, err := parseProcess(b, tokens)
+    t, n, err := parseClause(tokens)
     if err != nil {
         return rule{}, 0, err
     }
-    if tokens[n] == Period {
-        return rule{head:head}, n+1, nil
+    r, err := termRule(t)
+    if err != nil {
+        return rule{}, 0, err
     }
-    if tokens[n] != Turnstile || len(tokens) < n+1 {
-        return rule{}, 0, syntaxError{"expected turnstile"}
+    return r, n, nil
+}
+
+// parseClause returns a clause term up to its period, and the amount of
+// tokens parsed including the period
+func parseClause(tokens []token) (expression, int, error) {
+    if len(tokens) == 0 || len(tokens[0]) == 0 {
+        return nil, 0, syntaxError{"not enough tokens to parse process"}
     }
-    consumed := n+1
-    body := []process{}
-    for {
-        r, n, err := parseProcess(b, tokens[consumed:])
+    b := map[string]variable{}
+    t, n, err := parseTerm(b, tokens, 1200)
+    if err != nil {
+        return nil, 0, err
+    }
+    if len(tokens) <= n || tokens[n] != Period {
+        return nil, 0, syntaxError{"expected period"}
+    }
+    return t, n+1, nil
+}
+
+// toRule splits a clause term into head and body goals
+func toRule(t expression) (rule, error) {
+    p, ok := t.(process)
+    if !ok || p.functor != Turnstile || p.arity() != 2 {
+        head, err := toProcess(t)
+        return rule{head: head}, err
+    }
+    head, err := toProcess(p.args[0])
+    if err != nil {
+        return rule{}, err
+    }
+    r := rule{head: head}
+    body := p.args[1]
+    // head :- guard | body
+    if g, ok := body.(process); ok && g.functor == Commit && g.arity() == 2 {
+        r.guard, err = toGoals(g.args[0])
         if err != nil {
-            return rule{}, 0, err
+            return rule{}, err
         }
-        body = append(body, r)
-        consumed += n
-        if tokens[consumed] == Period {
-            return rule{head:head, body:body}, consumed+1, nil
+        body = g.args[1]
+    }
+    r.body, err = toGoals(body)
+    if err != nil {
+        return rule{}, err
+    }
+    if r.guard != nil && len(r.body) == 1 && r.body[0].functor == string(true_value) && r.body[0].arity() == 0 {
+        r.body = nil
+    }
+    return r, nil
+}
+
+// toGoals flattens a conjunction into its goals. M:(A, B) is M:A, M:B.
+func toGoals(t expression) ([]process, error) {
+    if p, ok := t.(process); ok && p.functor == ":" && p.arity() == 2 {
+        if c, ok := p.args[1].(process); ok && c.functor == Comma && c.arity() == 2 {
+            return toGoals(process{functor: Comma, args: []expression{
+                process{functor: ":", args: []expression{p.args[0], c.args[0]}},
+                process{functor: ":", args: []expression{p.args[0], c.args[1]}},
+            }})
         }
-        if tokens[consumed] != Comma {
-            return rule{}, 0, syntaxError{"expected comma"}
+    }
+    if p, ok := t.(process); ok && p.functor == Comma && p.arity() == 2 {
+        left, err := toGoals(p.args[0])
+        if err != nil {
+            return nil, err
         }
-        consumed++
+        right, err := toGoals(p.args[1])
+        if err != nil {
+            return nil, err
+        }
+        return append(left, right...), nil
+    }
+    p, err := toProcess(t)
+    if err != nil {
+        return nil, err
+    }
+    return []process{p}, nil
+}
+
+// toProcess turns a callable term into a process; a variable X becomes call(X)
+func toProcess(t expression) (process, error) {
+    switch e := t.(type) {
+    case process:
+        return e, nil
+    case symbol:
+        return process{functor: string(e)}, nil
+    case variable:
+        return process{functor: "call", args: []expression{e}}, nil
     }
+    return process{}, syntaxError{fmt.Sprintf("not callable: %s", t.PrintExpression())}
 }
 
 // parseProcess returns a process, amount of tokens parsed, and error
 func parseProcess(b map[string]variable, tokens []token) (process, int, error) {
-    if len(tokens) < 2 {
+    if len(tokens) == 0 || len(tokens[0]) == 0 {
         return process{}, 0, syntaxError{"not enough tokens to parse process"}
     }
-    if tokens[1] != OpenParen {
-        return parseInfix(b, tokens)
+    t, n, err := parseTerm(b, tokens, 999)
+    if err != nil {
+        return process{}, 0, err
+    }
+    p, err := toProcess(t)
+    if err != nil {
+        return process{}, 0, err
+    }
+    return p, n, nil
+}
+
+// parseExpression returns an expression, amount of tokens parsed, and error
+func parseExpression(b map[string]variable, tokens []token) (expression, int, error) {
+    return parseTerm(b, tokens, 999)
+}
+
+// parseTerm parses a term of at most precedence maxPrec,
+// returning it with the amount of tokens parsed
+func parseTerm(b map[string]variable, tokens []token, maxPrec int) (expression, int, error) {
+    left, leftPrec, n, err := parsePrimary(b, tokens, maxPrec)
+    if err != nil {
+        return nil, 0, err
+    }
+    for n < len(tokens) {
+        op, ok := infixOps[string(tokens[n])]
+        if !ok || op.prec > maxPrec {
+            break
+        }
+        leftMax, rightMax := op.prec-1, op.prec-1
+        switch op.typ {
+        case "yfx":
+            leftMax = op.prec
+        case "xfy":
+            rightMax = op.prec
+        }
+        if leftPrec > leftMax {
+            break
+        }
+        right, rn, err := parseTerm(b, tokens[n+1:], rightMax)
+        if err != nil {
+            return nil, 0, err
+        }
+        left = process{functor: string(tokens[n]), args: []expression{left, right}}
+        leftPrec = op.prec
+        n += rn + 1
+    }
+    return left, n, nil
+}
+
+// parsePrimary parses a term without infix operators, except as arguments.
+// It also returns the precedence of the term it parsed.
+func parsePrimary(b map[string]variable, tokens []token, maxPrec int) (expression, int, int, error) {
+    if len(tokens) == 0 || len(tokens[0]) == 0 {
+        return nil, 0, 0, syntaxError{"not enough tokens to parse expression"}
+    }
+    t := tokens[0]
+    switch {
+    case t == OpenParen || t == OpenGroup:
+        e, n, err := parseTerm(b, tokens[1:], 1200)
+        if err != nil {
+            return nil, 0, 0, err
+        }
+        if len(tokens) <= n+1 || tokens[n+1] != CloseParen {
+            return nil, 0, 0, syntaxError{"expected close parens"}
+        }
+        return e, 0, n+2, nil
+    case t == OpenBracket:
+        e, n, err := parseList(b, tokens)
+        return e, 0, n, err
+    case t == OpenCurly:
+        if len(tokens) > 1 && tokens[1] == CloseCurly {
+            return symbol("{}"), 0, 2, nil
+        }
+        e, n, err := parseTerm(b, tokens[1:], 1200)
+        if err != nil {
+            return nil, 0, 0, err
+        }
+        if len(tokens) <= n+1 || tokens[n+1] != CloseCurly {
+            return nil, 0, 0, syntaxError{"expected close curly bracket"}
+        }
+        return process{functor: "{}", args: []expression{e}}, 0, n+2, nil
+    case t.IsNumber():
+        e, n, err := parseNumber(string(t))
+        return e, 0, n, err
+    case t == Underscore:
+        // every _ is a fresh variable that is not reported in answers
+        v := variable(len(b))
+        b[fmt.Sprintf("_#%d", v)] = v
+        return v, 0, 1, nil
+    case t.IsVariable():
+        e, n, err := parseVariable(b, string(t))
+        return e, 0, n, err
+    case t.IsString():
+        s, err := unquote(string(t))
+        if err != nil {
+            return nil, 0, 0, err
+        }
+        codes := []expression{}
+        for _, r := range s {
+            codes = append(codes, number(r))
+        }
+        return makeList(codes, emptylist), 0, 1, nil
+    case t.IsPunctuation():
+        return nil, 0, 0, syntaxError{fmt.Sprintf("unexpected %q", t)}
+    }
+    name := string(t)
+    if t.IsQuoted() {
+        s, err := unquote(name)
+        if err != nil {
+            return nil, 0, 0, err
+        }
+        name = s
+    }
+    if len(tokens) > 1 && tokens[1] == OpenParen {
+        return parseCompound(b, name, tokens)
+    }
+    if t == "-" && len(tokens) > 1 && tokens[1].IsNumber() {
+        n, _, err := parseNumber(string(tokens[1]))
+        return -n, 0, 2, err
     }
-    // parse normal process form: functor(arg0, arg1, ...)
-    functor := string(tokens[0])
-    if tokens[1] != OpenParen {
-        return process{}, 0, syntaxError{"expected open parens"}
+    if op, ok := prefixOps[name]; ok && !t.IsQuoted() && len(tokens) > 1 && canStartTerm(tokens[1]) {
+        prec := op.prec
+        if prec > maxPrec {
+            prec = 999
+        }
+        argMax := prec - 1
+        if op.typ == "fy" {
+            argMax = prec
+        }
+        arg, n, err := parseTerm(b, tokens[1:], argMax)
+        if err != nil {
+            return nil, 0, 0, err
+        }
+        return process{functor: name, args: []expression{arg}}, prec, n+1, nil
+    }
+    if name == "[]" {
+        return emptylist, 0, 1, nil
+    }
+    prec := 0
+    if op, ok := infixOps[name]; ok && !t.IsQuoted() {
+        prec = op.prec
+    }
+    if op, ok := prefixOps[name]; ok && !t.IsQuoted() {
+        prec = op.prec
+    }
+    if prec > maxPrec {
+        prec = 0
+    }
+    s, n, err := parseSymbol(b, name)
+    return s, prec, n, err
+}
+
+// canStartTerm decides whether a prefix operator is applied to t
+// or should be read as an atom itself
+func canStartTerm(t token) bool {
+    if t.IsPunctuation() {
+        return false
     }
+    if _, ok := infixOps[string(t)]; ok {
+        _, prefix := prefixOps[string(t)]
+        return prefix || t == OpenParen
+    }
+    return true
+}
+
+// parse normal process form: functor(arg0, arg1, ...)
+func parseCompound(b map[string]variable, functor string, tokens []token) (expression, int, int, error) {
     consumed := 2
     args := []expression{}
     for {
         e, n, err := parseExpression(b, tokens[consumed:])
         if err != nil {
-            return process{}, 0, err
+            return nil, 0, 0, err
         }
         args = append(args, e)
         consumed += n
+        if len(tokens) <= consumed {
+            return nil, 0, 0, syntaxError{"expected close parens"}
+        }
         if tokens[consumed] == CloseParen {
-            return process{functor:functor, args:args}, consumed+1, nil
+            return makeCompound(functor, args), 0, consumed+1, nil
         }
         if tokens[consumed] != Comma {
-            return process{}, 0, syntaxError{"expected comma"}
+            return nil, 0, 0, syntaxError{"expected comma"}
         }
         consumed++
     }
 }
 
-func parseInfix(b map[string]variable, tokens []token) (process, int, error) {
-    if len(tokens) < 3 {
-        return process{}, 0, syntaxError{"not enough tokens to parse infix"}
-    }
-    if !tokens[0].IsVariable() {
-        return process{}, 0, syntaxError{"expected variable in arg0"}
+// makeCompound turns '.'(H, T) into a list, everything else into a process
+func makeCompound(functor string, args []expression) expression {
+    if functor == listFunctor.name && len(args) == 2 {
+        return list{head: args[0], tail: args[1]}
     }
-    arg0, n0, err := parseExpression(b, tokens)
-    if err != nil {
-        return process{}, 0, err
-    }
-    f := string(tokens[n0])
-    arg1, n1, err := parseExpression(b, tokens[n0+1:])
-    if err != nil {
-        return process{}, 0, err
-    }
-    return process{functor:f, args:[]expression{arg0, arg1}}, n0+n1+1, nil
+    return process{functor: functor, args: args}
 }
 
-// parseExpression returns an expression, amount of tokens parsed, and error
-func parseExpression(b map[string]variable, tokens []token) (expression, int, error) {
-    if len(tokens[0]) == 0 {
-        return nil, 0, syntaxError{"not enough tokens to parse expression"}
-    }
-    switch tokens[0] {
-    case OpenBracket: return parseList(b, tokens)
-    case Underscore: return underscore, 1, nil
-    case True: return true_value, 1, nil
-    case False: return false_value, 1, nil
-    }
-    if tokens[0].IsNumber() {
-        return parseNumber(string(tokens[0]))
-    }
-    if tokens[0].IsVariable() {
-        return parseVariable(b, string(tokens[0]))
-    }
-    if tokens[0].IsSymbol() {
-        if len(tokens) > 1 && tokens[1] == OpenParen {
-            return parseProcess(b, tokens)
+func parseNumber(s string) (number, int, error) {
+    if strings.HasPrefix(s, "0'") {
+        r, err := unquote("'" + s[2:] + "'")
+        if err != nil || len(r) == 0 {
+            return number(0), 0, syntaxError{"bad character code"}
         }
-        return parseSymbol(b, string(tokens[0]))
+        return number([]rune(r)[0]), 1, nil
     }
-    return nil, 0, syntaxError{"unknown expression"}
-}
-
-func parseNumber(s string) (number, int, error) {
     n, err := strconv.ParseInt(s, 10, 64)
     if err != nil {
         return number(0), 0, err
@@ -180,7 +546,7 @@ func parseSymbol(b map[string]variable, s string) (symbol, int, error) {
 }
 
 func parseList(b map[string]variable, tokens []token) (expression, int, error) {
-    if tokens[0] == OpenBracket && tokens[1] == CloseBracket {
+    if len(tokens) > 1 && tokens[0] == OpenBracket && tokens[1] == CloseBracket {
         return emptylist, 2, nil
     }
     head := []expression{}
@@ -188,10 +554,13 @@ func parseList(b map[string]variable, tokens []token) (expression, int, error) {
     for {
         h, n, err := parseExpression(b, tokens[consumed:])
         if err != nil {
-            return nil, 0, syntaxError{}
+            return nil, 0, err
         }
         head = append(head, h)
         consumed += n
+        if len(tokens) <= consumed {
+            return nil, 0, syntaxError{"expected closing bracket"}
+        }
         if tokens[consumed] != Comma {
             break 
         }
@@ -206,12 +575,12 @@ func parseList(b map[string]variable, tokens []token) (expression, int, error) {
             return nil, 0, err
         }
         consumed += n+1
-        if tokens[consumed] != CloseBracket {
+        if len(tokens) <= consumed || tokens[consumed] != CloseBracket {
             return nil, 0, syntaxError{"expected closing bracket"}
         }
         return makeList(head, tail), consumed+1, nil
     }
-    return nil, 0, syntaxError{}
+    return nil, 0, syntaxError{"expected closing bracket"}
 }
 
 func makeList(head []expression, tail expression) expression {
@@ -221,3 +590,34 @@ func makeList(head []expression, tail expression) expression {
     }
     return out
 }
+
+// unquote strips the quotes off a quoted atom or string and resolves escapes
+func unquote(s string) (string, error) {
+    q := s[0]
+    if len(s) < 2 || s[len(s)-1] != q {
+        return "", syntaxError{"unterminated quoted"}
+    }
+    s = s[1:len(s)-1]
+    var sb strings.Builder
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        switch {
+        case c == q && i+1 < len(s) && s[i+1] == q:
+            i++
+        case c == '\\' && i+1 < len(s):
+            i++
+            switch s[i] {
+            case 'n':
+                c = '\n'
+            case 't':
+                c = '\t'
+            case '0':
+                c = 0
+            default:
+                c = s[i]
+            }
+        }
+        sb.WriteByte(c)
+    }
+    return sb.String(), nil
+}
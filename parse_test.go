@@ -2,6 +2,7 @@ package main
 
 import (
     "reflect"
+    "strings"
     "testing"
 )
 
@@ -167,6 +168,14 @@ func TestParseRule(t *testing.T) {
             },
             wantN:  9,
         },
+        {
+            tokens: []token{"p", "(", "X", ")", ":-", "q", "(", "X", ")", "|", "true", "."},
+            want:   rule{
+                head:  process{functor:"p", args: []expression{variable(0)}},
+                guard: []process{{functor:"q", args: []expression{variable(0)}}},
+            },
+            wantN:  12,
+        },
     }{
         got, gotN, err := parseRule(tt.tokens)
         if err != tt.err {
@@ -203,6 +212,14 @@ func TestTokenize(t *testing.T) {
             input: "A1 is A + X,",
             want : []token{"A1", "is", "A", "+", "X", ","},
         },
+        {
+            input: "a :- % comment\n /* block */ b =.. 'q r', f (x).",
+            want : []token{"a", ":-", "b", "=..", "'q r'", ",", "f", " (", "x", ")", "."},
+        },
+        {
+            input: "X = \"a\\\"b\", Y = 0'c",
+            want : []token{"X", "=", "\"a\\\"b\"", ",", "Y", "=", "0'c"},
+        },
     }{
         got := tokenize(tt.input)
         if !reflect.DeepEqual(got, tt.want) {
@@ -211,3 +228,109 @@ func TestTokenize(t *testing.T) {
     }
 }
 
+
+func TestParseRulesLines(t *testing.T) {
+    rules, err := ParseRules(`
+% a comment
+a.
+b :-
+    a.   /* spanning
+    lines */ c(
+  x).
+
+`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    got := []int{}
+    for _, r := range rules {
+        got = append(got, r.pos.line)
+    }
+    if want := []int{3, 4, 6}; !reflect.DeepEqual(got, want) {
+        t.Errorf("got %v want %v", got, want)
+    }
+}
+
+func TestParseTerm(t *testing.T) {
+    for _, tt := range []struct{
+        input string
+        want  string
+    }{
+        {input: "X = a + b * c", want: "=(A,+(a,*(b,c)))"},
+        {input: "a - b - c", want: "-(-(a,b),c)"},
+        {input: "a , b ; c -> d", want: ";(','(a,b),->(c,d))"},
+        {input: "- 1", want: "-1"},
+        {input: "- X", want: "-(A)"},
+        {input: "\\+ a = b", want: "\\+(=(a,b))"},
+        {input: "f(a, (b, c))", want: "f(a,','(b,c))"},
+        {input: "- (1)", want: "-(1)"},
+        {input: "'hello world'('It''s')", want: "hello world(It's)"},
+        {input: "\"ab\"", want: "[97|[98|nil]]"},
+        {input: "0'a + 0'\\n", want: "+(97,10)"},
+        {input: "{a, b}", want: "{}(','(a,b))"},
+        {input: "[a|T]", want: "[a|A]"},
+        {input: "f(_, _, X, X)", want: "f(A,B,C,C)"},
+    }{
+        b := map[string]variable{}
+        got, n, err := parseTerm(b, tokenize(tt.input), 1200)
+        if err != nil {
+            t.Errorf("%s: %v", tt.input, err)
+            continue
+        }
+        if n != len(tokenize(tt.input)) {
+            t.Errorf("%s: parsed %d tokens", tt.input, n)
+        }
+        if s := canonical(got); s != tt.want {
+            t.Errorf("%s: got %s want %s", tt.input, s, tt.want)
+        }
+    }
+    for _, bad := range []string{"a b", "f(a", "[a", "a =", ")", "'abc"} {
+        tokens := tokenize(bad)
+        if _, n, err := parseTerm(map[string]variable{}, tokens, 1200); err == nil && n == len(tokens) {
+            t.Errorf("%s: expected error", bad)
+        }
+    }
+}
+
+// canonical writes a term without operators, naming variables A, B, ...
+func canonical(e expression) string {
+    switch t := e.(type) {
+    case variable:
+        return string(rune('A' + int(t)))
+    case list:
+        return "[" + canonical(t.head) + "|" + canonical(t.tail) + "]"
+    case process:
+        args := []string{}
+        for _, arg := range t.args {
+            args = append(args, canonical(arg))
+        }
+        f := t.functor
+        if f == Comma {
+            f = "','"
+        }
+        return f + "(" + strings.Join(args, ",") + ")"
+    }
+    return e.PrintExpression()
+}
+
+func TestPrintExpression(t *testing.T) {
+    for _, input := range []string{
+        "a:-b,c",
+        "x = a+b*c",
+        "x is (a+b)*c",
+        "a-(b-c)",
+        "\\+ a",
+        "f(-1, - a, (a,b))",
+        "[1,2|t]",
+    }{
+        e, _, err := parseTerm(map[string]variable{}, tokenize(input), 1200)
+        if err != nil {
+            t.Errorf("%s: %v", input, err)
+            continue
+        }
+        again, _, err := parseTerm(map[string]variable{}, tokenize(e.PrintExpression()), 1200)
+        if err != nil || !reflect.DeepEqual(again, e) {
+            t.Errorf("%s: printed as %s, which reads back as %v", input, e.PrintExpression(), again)
+        }
+    }
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+    "compress/gzip"
+    "io"
+    "sort"
+    "time"
+)
+
+// WritePprof writes the profile in the gzipped protocol buffer format of
+// pprof, with a function for every procedure and a sample for every
+// call path, so go tool pprof can show where a query spends its time.
+//
+// Only the fields of profile.proto that are needed are written:
+//
+//   Profile:   1 sample_type, 2 sample, 4 location, 5 function,
+//              6 string_table, 9 time_nanos, 10 duration_nanos,
+//              11 period_type, 12 period
+//   ValueType: 1 type, 2 unit
+//   Sample:    1 location_id, 2 value
+//   Location:  1 id, 4 line
+//   Line:      1 function_id
+//   Function:  1 id, 2 name, 3 system_name
+func (p *Profile) WritePprof(w io.Writer) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    var b protobuf
+    strings := map[string]int{}
+    str := func(s string) uint64 {
+        n, ok := strings[s]
+        if !ok {
+            n = len(strings)
+            strings[s] = n
+        }
+        return uint64(n)
+    }
+    str("")
+    valueType := func(typ, unit string) []byte {
+        var v protobuf
+        v.uint(1, str(typ))
+        v.uint(2, str(unit))
+        return v
+    }
+    b.bytes(1, valueType("calls", "count"))
+    b.bytes(1, valueType("time", "nanoseconds"))
+
+    keys := []string{}
+    for k := range p.samples {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    ids := map[procEntry]uint64{}
+    procs := []procEntry{}
+    for _, k := range keys {
+        s := p.samples[k]
+        var sb protobuf
+        locations := []uint64{}
+        for _, pe := range s.stack {
+            id, ok := ids[pe]
+            if !ok {
+                id = uint64(len(ids) + 1)
+                ids[pe] = id
+                procs = append(procs, pe)
+            }
+            locations = append(locations, id)
+        }
+        sb.packed(1, locations)
+        sb.packed(2, []uint64{uint64(s.calls), uint64(s.time)})
+        b.bytes(2, sb)
+    }
+    // one location and one function per procedure, with the same id
+    for _, pe := range procs {
+        var line, loc, fn protobuf
+        line.uint(1, ids[pe])
+        loc.uint(1, ids[pe])
+        loc.bytes(4, line)
+        b.bytes(4, loc)
+        fn.uint(1, ids[pe])
+        fn.uint(2, str(pe.printEntry()))
+        fn.uint(3, str(pe.printEntry()))
+        b.bytes(5, fn)
+    }
+    table := make([]string, len(strings))
+    for s, n := range strings {
+        table[n] = s
+    }
+    for _, s := range table {
+        b.bytes(6, []byte(s))
+    }
+    b.uint(9, uint64(p.start.UnixNano()))
+    b.uint(10, uint64(time.Since(p.start)))
+    b.bytes(11, valueType("time", "nanoseconds"))
+    b.uint(12, 1)
+
+    z := gzip.NewWriter(w)
+    if _, err := z.Write(b); err != nil {
+        return err
+    }
+    return z.Close()
+}
+
+// protobuf encodes the fields of a message
+type protobuf []byte
+
+func (b *protobuf) varint(x uint64) {
+    for x >= 0x80 {
+        *b = append(*b, byte(x)|0x80)
+        x >>= 7
+    }
+    *b = append(*b, byte(x))
+}
+
+func (b *protobuf) uint(field int, x uint64) {
+    b.varint(uint64(field) << 3)
+    b.varint(x)
+}
+
+func (b *protobuf) bytes(field int, x []byte) {
+    b.varint(uint64(field)<<3 | 2)
+    b.varint(uint64(len(x)))
+    *b = append(*b, x...)
+}
+
+func (b *protobuf) packed(field int, xs []uint64) {
+    var p protobuf
+    for _, x := range xs {
+        p.varint(x)
+    }
+    b.bytes(field, p)
+}
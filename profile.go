@@ -0,0 +1,270 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "sort"
+    "strings"
+    "sync"
+    "text/tabwriter"
+    "time"
+)
+
+// A Profile collects how often the ports of every procedure were passed
+// and how long was spent in it, over all queries run with it. Set it as
+// the profile of an interpreter, or use profile/1 for a single goal.
+type Profile struct {
+    mu      sync.Mutex
+    procs   map[procEntry]*ProcStats
+    samples map[string]*sample // by call path
+    start   time.Time
+}
+
+// ProcStats are what a profile knows about one procedure. Inclusive time
+// counts the procedures it calls as well, exclusive time only itself.
+type ProcStats struct {
+    Calls, Redos, Exits, Fails int
+    Inclusive, Exclusive       time.Duration
+}
+
+// a sample is the time spent with a call path as the stack, leaf first
+type sample struct {
+    stack []procEntry
+    calls int64
+    time  time.Duration
+}
+
+func NewProfile() *Profile {
+    return &Profile{procs: map[procEntry]*ProcStats{}, samples: map[string]*sample{}, start: time.Now()}
+}
+
+// a profiler does the bookkeeping for one query, to be added to its
+// profile when the query is done. Profiling uses the ports of the
+// debugger, which is why a profiled query runs with a tracing machine.
+type profiler struct {
+    profile *Profile
+    procs   map[procEntry]*ProcStats
+    active  map[procEntry]int // open boxes, so recursion counts once for inclusive time
+    entered map[procEntry]time.Time
+    paths   []pathNode
+    index   map[callPath]int
+    running *invocation // whose clause is being run
+    last    time.Time
+}
+
+// call paths form a tree: a path is its parent path plus one procedure
+type callPath struct {
+    parent int // -1 for the query
+    p      procEntry
+}
+
+type pathNode struct {
+    callPath
+    calls int64
+    time  time.Duration
+}
+
+func newProfiler(p *Profile) *profiler {
+    return &profiler{
+        profile: p,
+        procs:   map[procEntry]*ProcStats{},
+        active:  map[procEntry]int{},
+        entered: map[procEntry]time.Time{},
+        index:   map[callPath]int{},
+        last:    time.Now(),
+    }
+}
+
+func (pr *profiler) stats(p procEntry) *ProcStats {
+    s, ok := pr.procs[p]
+    if !ok {
+        s = &ProcStats{}
+        pr.procs[p] = s
+    }
+    return s
+}
+
+// path numbers the call path of inv
+func (pr *profiler) path(inv *invocation) int {
+    cp := callPath{parent: -1, p: inv.p}
+    if inv.parent != nil {
+        cp.parent = inv.parent.path
+    }
+    n, ok := pr.index[cp]
+    if !ok {
+        n = len(pr.paths)
+        pr.paths = append(pr.paths, pathNode{callPath: cp})
+        pr.index[cp] = n
+    }
+    return n
+}
+
+// port counts inv passing port p. Time since the last port goes to
+// the goal that was running.
+func (pr *profiler) port(p Port, inv *invocation) {
+    now := time.Now()
+    pr.tick(now)
+    s := pr.stats(inv.p)
+    switch p {
+    case CallPort:
+        s.Calls++
+        inv.path = pr.path(inv)
+        pr.paths[inv.path].calls++
+        pr.enter(inv.p, now)
+        pr.running = inv
+    case RedoPort:
+        s.Redos++
+        pr.enter(inv.p, now)
+        pr.running = inv
+    case ExitPort:
+        s.Exits++
+        pr.leave(inv.p, now)
+        pr.running = inv.parent
+    case FailPort:
+        s.Fails++
+        pr.leave(inv.p, now)
+        pr.running = inv.parent
+    }
+}
+
+// tick gives the time since the last port to the goal that was running
+func (pr *profiler) tick(now time.Time) {
+    if r := pr.running; r != nil && r.path >= 0 {
+        d := now.Sub(pr.last)
+        pr.stats(r.p).Exclusive += d
+        pr.paths[r.path].time += d
+    }
+    pr.last = now
+}
+
+func (pr *profiler) enter(p procEntry, now time.Time) {
+    if pr.active[p] == 0 {
+        pr.entered[p] = now
+    }
+    pr.active[p]++
+}
+
+func (pr *profiler) leave(p procEntry, now time.Time) {
+    if pr.active[p] == 0 {
+        return
+    }
+    pr.active[p]--
+    if pr.active[p] == 0 {
+        pr.stats(p).Inclusive += now.Sub(pr.entered[p])
+    }
+}
+
+// finish closes the boxes the query left open and adds what the
+// profiler counted to its profile
+func (pr *profiler) finish() {
+    now := time.Now()
+    pr.tick(now)
+    for p, n := range pr.active {
+        if n > 0 {
+            pr.stats(p).Inclusive += now.Sub(pr.entered[p])
+        }
+    }
+    prof := pr.profile
+    prof.mu.Lock()
+    defer prof.mu.Unlock()
+    for p, s := range pr.procs {
+        ps, ok := prof.procs[p]
+        if !ok {
+            ps = &ProcStats{}
+            prof.procs[p] = ps
+        }
+        ps.Calls += s.Calls
+        ps.Redos += s.Redos
+        ps.Exits += s.Exits
+        ps.Fails += s.Fails
+        ps.Inclusive += s.Inclusive
+        ps.Exclusive += s.Exclusive
+    }
+    for n, t := range pr.paths {
+        stack := []procEntry{}
+        for i := n; i >= 0; i = pr.paths[i].parent {
+            stack = append(stack, pr.paths[i].p)
+        }
+        keys := []string{}
+        for _, p := range stack {
+            keys = append(keys, p.printEntry())
+        }
+        key := strings.Join(keys, ";")
+        s, ok := prof.samples[key]
+        if !ok {
+            s = &sample{stack: stack}
+            prof.samples[key] = s
+        }
+        s.calls += t.calls
+        s.time += t.time
+    }
+}
+
+// Stats returns what the profile knows about procedure name/arity
+func (p *Profile) Stats(name string, arity int) ProcStats {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if s, ok := p.procs[proc(name, arity)]; ok {
+        return *s
+    }
+    return ProcStats{}
+}
+
+// WriteTable writes the profile as a table, the procedures that took
+// longest first
+func (p *Profile) WriteTable(w io.Writer) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    procs := []procEntry{}
+    for pe := range p.procs {
+        procs = append(procs, pe)
+    }
+    sort.Slice(procs, func(i, j int) bool {
+        a, b := p.procs[procs[i]], p.procs[procs[j]]
+        if a.Inclusive != b.Inclusive {
+            return a.Inclusive > b.Inclusive
+        }
+        return procs[i].printEntry() < procs[j].printEntry()
+    })
+    tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+    fmt.Fprintln(tw, "Procedure\tCalls\tRedos\tExits\tFails\tInclusive\tExclusive\t")
+    for _, pe := range procs {
+        s := p.procs[pe]
+        fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\t\n", pe.printEntry(), s.Calls, s.Redos, s.Exits, s.Fails, s.Inclusive, s.Exclusive)
+    }
+    return tw.Flush()
+}
+
+// profile(G) runs G like once/1, collecting a profile that is written
+// out when G is done
+func generateProfile(m *machine, args []expression) ([]clause, error) {
+    if _, err := m.callable(args[0]); err != nil {
+        return nil, err
+    }
+    g := walkstar(m.state.sub, args[0])
+    prof := NewProfile()
+    sub := &machine{Engine: m.Engine, program: m.program, state: m.state}
+    sub.startTracing()
+    sub.trace.prof = newProfiler(prof)
+    mark := m.state.sub.mark(m.state.vc)
+    var answer expression
+    sub.run(proc("call", 1), []expression{g}, func(ans state) bool {
+        answer = walkstar(ans.sub, g)
+        return false
+    })
+    sub.trace.finish()
+    m.stats.inferences += sub.stats.inferences
+    // the trail is shared with the machine that ran G
+    m.state.sub = m.state.sub.undo(mark, m.state.vc)
+    if sub.err != nil {
+        return nil, sub.err
+    }
+    if err := prof.WriteTable(m.out); err != nil {
+        return nil, err
+    }
+    if answer == nil {
+        return nil, nil
+    }
+    head := process{functor: "profile", args: []expression{answer}}
+    return []clause{compileClause(renumberVariables(rule{head: head}))}, nil
+}
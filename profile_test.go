@@ -0,0 +1,344 @@
+package main
+
+import (
+    "bytes"
+    "compress/gzip"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "maps"
+    "reflect"
+    "slices"
+    "strings"
+    "testing"
+)
+
+func TestProfile(t *testing.T) {
+    for _, s := range stores {
+        i := NewInterpreter(compileProcedures(MustParseRules(traceRules)))
+        i.setStore(s.store)
+        i.profile = NewProfile()
+        if got, err := answers(i, "p(X)", "X"); err != nil || !reflect.DeepEqual(got, []string{"2"}) {
+            t.Fatalf("%s: got %v, %v", s.name, got, err)
+        }
+        for _, tt := range []struct{
+            name  string
+            arity int
+            want  ProcStats
+        }{
+            {name: "p", arity: 1, want: ProcStats{Calls: 1, Exits: 1}},
+            {name: "q", arity: 1, want: ProcStats{Calls: 1, Redos: 1, Exits: 2}},
+            {name: "r", arity: 1, want: ProcStats{Calls: 2, Exits: 1, Fails: 1}},
+        }{
+            got := i.profile.Stats(tt.name, tt.arity)
+            if got.Inclusive < got.Exclusive {
+                t.Errorf("%s: %s/%d inclusive %s less than exclusive %s", s.name, tt.name, tt.arity, got.Inclusive, got.Exclusive)
+            }
+            got.Inclusive, got.Exclusive = 0, 0
+            if got != tt.want {
+                t.Errorf("%s: %s/%d got %+v want %+v", s.name, tt.name, tt.arity, got, tt.want)
+            }
+        }
+    }
+}
+
+// Recursive calls count once for inclusive time
+func TestProfileRecursion(t *testing.T) {
+    i := loadProgram(t, "testdata/nrev.pl")
+    i.profile = NewProfile()
+    if _, _, err := runProgram(i, "bench(L)", false); err != nil {
+        t.Fatal(err)
+    }
+    bench, nrev, app := i.profile.Stats("bench", 1), i.profile.Stats("nrev", 2), i.profile.Stats("app", 3)
+    if nrev.Calls != 31 || app.Calls != 465 || app.Exits != 465 {
+        t.Errorf("got nrev %+v app %+v", nrev, app)
+    }
+    if bench.Inclusive < nrev.Inclusive || nrev.Inclusive < app.Inclusive {
+        t.Errorf("inclusive times bench %s nrev %s app %s", bench.Inclusive, nrev.Inclusive, app.Inclusive)
+    }
+    if total := bench.Exclusive + nrev.Exclusive + app.Exclusive; total > bench.Inclusive {
+        t.Errorf("exclusive times add up to %s, more than %s", total, bench.Inclusive)
+    }
+}
+
+func TestProfileBuiltin(t *testing.T) {
+    for _, s := range stores {
+        i := NewInterpreter(compileProcedures(MustParseRules(traceRules)))
+        i.setStore(s.store)
+        var sb strings.Builder
+        i.setOutput(&sb)
+        got, err := answers(i, "profile(p(X))", "X")
+        if err != nil || !reflect.DeepEqual(got, []string{"2"}) {
+            t.Fatalf("%s: got %v, %v", s.name, got, err)
+        }
+        out := sb.String()
+        for _, want := range []string{"Procedure", "p/1", "q/1", "r/1"} {
+            if !strings.Contains(out, want) {
+                t.Errorf("%s: %q not in\n%s", s.name, want, out)
+            }
+        }
+        if got, _ := answers(i, "profile(r(1))"); len(got) != 0 {
+            t.Errorf("%s: got %v", s.name, got)
+        }
+        if _, err := answers(i, "profile(X)"); err == nil {
+            t.Errorf("%s: expected instantiation error", s.name)
+        }
+    }
+}
+
+func TestWritePprof(t *testing.T) {
+    i := loadProgram(t, "testdata/nrev.pl")
+    i.profile = NewProfile()
+    if _, _, err := runProgram(i, "bench(L)", false); err != nil {
+        t.Fatal(err)
+    }
+    var buf bytes.Buffer
+    if err := i.profile.WritePprof(&buf); err != nil {
+        t.Fatal(err)
+    }
+    z, err := gzip.NewReader(&buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    b, err := io.ReadAll(z)
+    if err != nil {
+        t.Fatal(err)
+    }
+    prof, err := decodePprof(b)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(prof.strings) == 0 || prof.strings[0] != "" {
+        t.Fatalf("string table %q does not start with the empty string", prof.strings)
+    }
+    str := func(n uint64) string {
+        if n >= uint64(len(prof.strings)) {
+            t.Fatalf("string %d not in a table of %d", n, len(prof.strings))
+        }
+        return prof.strings[n]
+    }
+    types := []string{}
+    for _, vt := range prof.sampleTypes {
+        types = append(types, str(vt[0])+"/"+str(vt[1]))
+    }
+    if want := []string{"calls/count", "time/nanoseconds"}; !reflect.DeepEqual(types, want) {
+        t.Errorf("sample types %v want %v", types, want)
+    }
+    if got := str(prof.periodType[0]) + "/" + str(prof.periodType[1]); got != "time/nanoseconds" {
+        t.Errorf("period type %s", got)
+    }
+    names := map[uint64]string{}
+    for _, fn := range prof.functions {
+        if str(fn.name) != str(fn.systemName) {
+            t.Errorf("function %d: name %q system name %q", fn.id, str(fn.name), str(fn.systemName))
+        }
+        names[fn.id] = str(fn.name)
+    }
+    if len(names) != len(prof.functions) {
+        t.Errorf("%d functions with %d ids", len(prof.functions), len(names))
+    }
+    locations := map[uint64]string{}
+    for id, fn := range prof.locations {
+        name, ok := names[fn]
+        if !ok {
+            t.Errorf("location %d has unknown function %d", id, fn)
+        }
+        locations[id] = name
+    }
+    if len(locations) != len(names) {
+        t.Errorf("%d locations for %d functions", len(locations), len(names))
+    }
+    // every call path comes back with its counts
+    i.profile.mu.Lock()
+    defer i.profile.mu.Unlock()
+    if len(prof.samples) != len(i.profile.samples) {
+        t.Errorf("got %d samples want %d", len(prof.samples), len(i.profile.samples))
+    }
+    for _, s := range prof.samples {
+        stack := []string{}
+        for _, id := range s.locations {
+            name, ok := locations[id]
+            if !ok {
+                t.Fatalf("sample has unknown location %d", id)
+            }
+            stack = append(stack, name)
+        }
+        key := strings.Join(stack, ";")
+        want, ok := i.profile.samples[key]
+        if !ok {
+            t.Errorf("sample %s not in the profile", key)
+            continue
+        }
+        if wv := []uint64{uint64(want.calls), uint64(want.time)}; !reflect.DeepEqual(s.values, wv) {
+            t.Errorf("sample %s: values %v want %v", key, s.values, wv)
+        }
+    }
+    for _, want := range []string{"bench/1", "nrev/2", "app/3"} {
+        if !slices.Contains(slices.Collect(maps.Values(names)), want) {
+            t.Errorf("no function %s", want)
+        }
+    }
+}
+
+// pprofProfile is what TestWritePprof reads back of profile.proto
+type pprofProfile struct {
+    sampleTypes [][2]uint64 // type and unit
+    samples     []pprofSample
+    locations   map[uint64]uint64 // id to the function of its line
+    functions   []pprofFunction
+    strings     []string
+    periodType  [2]uint64
+}
+
+type pprofSample struct {
+    locations []uint64
+    values    []uint64
+}
+
+type pprofFunction struct {
+    id, name, systemName uint64
+}
+
+// protoField is one field of an encoded message: a varint, or the bytes
+// of a length delimited field
+type protoField struct {
+    num   int
+    value uint64
+    bytes []byte
+}
+
+func decodeProto(b []byte) ([]protoField, error) {
+    fields := []protoField{}
+    for len(b) > 0 {
+        key, n := binary.Uvarint(b)
+        if n <= 0 {
+            return nil, fmt.Errorf("bad key")
+        }
+        b = b[n:]
+        f := protoField{num: int(key >> 3)}
+        switch key & 7 {
+        case 0:
+            f.value, n = binary.Uvarint(b)
+            if n <= 0 {
+                return nil, fmt.Errorf("field %d: bad varint", f.num)
+            }
+            b = b[n:]
+        case 2:
+            l, n := binary.Uvarint(b)
+            if n <= 0 || uint64(len(b)-n) < l {
+                return nil, fmt.Errorf("field %d: bad length", f.num)
+            }
+            f.bytes = b[n : n+int(l)]
+            b = b[n+int(l):]
+        default:
+            return nil, fmt.Errorf("field %d: unexpected wire type %d", f.num, key&7)
+        }
+        fields = append(fields, f)
+    }
+    return fields, nil
+}
+
+// decodePacked reads a packed repeated varint field
+func decodePacked(b []byte) ([]uint64, error) {
+    xs := []uint64{}
+    for len(b) > 0 {
+        x, n := binary.Uvarint(b)
+        if n <= 0 {
+            return nil, fmt.Errorf("bad packed varint")
+        }
+        xs = append(xs, x)
+        b = b[n:]
+    }
+    return xs, nil
+}
+
+// decodeMessage decodes b and gives every field to f by number
+func decodeMessage(b []byte, f func(protoField) error) error {
+    fields, err := decodeProto(b)
+    if err != nil {
+        return err
+    }
+    for _, field := range fields {
+        if err := f(field); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func decodeValueType(b []byte) ([2]uint64, error) {
+    var vt [2]uint64
+    err := decodeMessage(b, func(f protoField) error {
+        if f.num == 1 || f.num == 2 {
+            vt[f.num-1] = f.value
+        }
+        return nil
+    })
+    return vt, err
+}
+
+func decodePprof(b []byte) (pprofProfile, error) {
+    p := pprofProfile{locations: map[uint64]uint64{}}
+    err := decodeMessage(b, func(f protoField) error {
+        var err error
+        switch f.num {
+        case 1:
+            var vt [2]uint64
+            vt, err = decodeValueType(f.bytes)
+            p.sampleTypes = append(p.sampleTypes, vt)
+        case 2:
+            var s pprofSample
+            err = decodeMessage(f.bytes, func(f protoField) error {
+                var err error
+                switch f.num {
+                case 1:
+                    s.locations, err = decodePacked(f.bytes)
+                case 2:
+                    s.values, err = decodePacked(f.bytes)
+                }
+                return err
+            })
+            p.samples = append(p.samples, s)
+        case 4:
+            var id, fn uint64
+            err = decodeMessage(f.bytes, func(f protoField) error {
+                switch f.num {
+                case 1:
+                    id = f.value
+                case 4:
+                    return decodeMessage(f.bytes, func(f protoField) error {
+                        if f.num == 1 {
+                            fn = f.value
+                        }
+                        return nil
+                    })
+                }
+                return nil
+            })
+            if _, ok := p.locations[id]; ok {
+                return fmt.Errorf("location %d twice", id)
+            }
+            p.locations[id] = fn
+        case 5:
+            var fn pprofFunction
+            err = decodeMessage(f.bytes, func(f protoField) error {
+                switch f.num {
+                case 1:
+                    fn.id = f.value
+                case 2:
+                    fn.name = f.value
+                case 3:
+                    fn.systemName = f.value
+                }
+                return nil
+            })
+            p.functions = append(p.functions, fn)
+        case 6:
+            p.strings = append(p.strings, string(f.bytes))
+        case 11:
+            p.periodType, err = decodeValueType(f.bytes)
+        }
+        return err
+    })
+    return p, err
+}
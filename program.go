@@ -0,0 +1,163 @@
+package main
+
+import (
+    "math"
+    "sync/atomic"
+)
+
+// A Program is a set of compiled procedures, with the Prolog flags and
+// the atom table, that does not change once made. Changing it makes a new
+// Program sharing everything that did not change, so any number of
+// queries can run against one without locks.
+type Program struct {
+    procedures *ptree[procEntry, procedure]
+    flags      map[string]expression // those set away from defaultFlags
+    atoms      *ptree[atom, struct{}] // every atom the code mentions
+}
+
+// NewProgram verifies the procedures and puts them on top of the library
+func NewProgram(procedures []procedure) (*Program, error) {
+    p, err := (&Program{}).install(library...)
+    if err != nil {
+        return nil, err
+    }
+    return p.install(procedures...)
+}
+
+// procedure finds the procedure called by pe. An import is followed to
+// the module it is from, and what a module does not have is looked for
+// in user.
+func (p *Program) procedure(pe procEntry) (procedure, bool) {
+    pr, _, ok := p.lookup(pe)
+    return pr, ok
+}
+
+// lookup is procedure, also telling if pe is an import
+func (p *Program) lookup(pe procEntry) (pr procedure, imported, ok bool) {
+    pr, ok = p.procedures.get(pe)
+    switch {
+    case ok && pr.from != "":
+        // the loader only imports what a module defines, so this ends
+        pr, ok = p.procedure(moduleProc(pr.from, pe.name, pe.arity))
+        return pr, true, ok
+    case !ok && pe.module != "":
+        return p.lookup(pe.unqualified())
+    }
+    return pr, false, ok
+}
+
+// eachProcedure calls f with every procedure, in order of module, name
+// and arity
+func (p *Program) eachProcedure(f func(procEntry, procedure)) {
+    p.procedures.each(f)
+}
+
+// install returns a program with the procedures added, replacing any
+// procedure with the same name and arity. If any procedure does not
+// verify, it returns an error instead.
+func (p *Program) install(procedures ...procedure) (*Program, error) {
+    for _, pr := range procedures {
+        if err := verifyProcedure(pr); err != nil {
+            return nil, err
+        }
+    }
+    q := *p
+    for _, pr := range procedures {
+        q.procedures = q.procedures.set(pr.entry(), pr)
+        q.atoms = addAtom(q.atoms, atom(pr.name))
+        for _, c := range pr.clauses {
+            q.atoms = addAtoms(q.atoms, c)
+        }
+    }
+    return &q, nil
+}
+
+// assertz returns a program with c added to the end of procedure pe
+func (p *Program) assertz(pe procEntry, c clause) *Program {
+    q := *p
+    old, _ := p.procedures.get(pe)
+    clauses, claimed := appendClause(old, c)
+    q.procedures = p.procedures.set(pe, procedure{
+        name:    pe.name,
+        arity:   pe.arity,
+        module:  pe.module,
+        clauses: clauses,
+        claimed: claimed,
+        table:   old.table,
+        meta:    old.meta,
+    })
+    q.atoms = addAtoms(addAtom(p.atoms, atom(pe.name)), c)
+    return &q
+}
+
+// appendClause appends c to the clauses of pr. Older programs share the
+// backing array, so it is only appended to in place by the first program
+// to claim the next free slot; the others copy.
+func appendClause(pr procedure, c clause) ([]clause, *atomic.Int64) {
+    n := len(pr.clauses)
+    if pr.claimed != nil && cap(pr.clauses) > n && pr.claimed.CompareAndSwap(int64(n), int64(n+1)) {
+        return append(pr.clauses, c), pr.claimed
+    }
+    clauses := make([]clause, n+1, max(2*n, 4))
+    copy(clauses, pr.clauses)
+    clauses[n] = c
+    claimed := &atomic.Int64{}
+    claimed.Store(int64(n + 1))
+    return clauses, claimed
+}
+
+// the flags every program starts with
+var defaultFlags = map[string]expression{
+    "bounded":                   symbol("true"),
+    "max_integer":               number(math.MaxInt64),
+    "min_integer":               number(math.MinInt64),
+    "integer_rounding_function": symbol("toward_zero"),
+    "unknown":                   symbol("error"),
+}
+
+// changeableFlags are the values the flags that can be set can take
+var changeableFlags = map[string][]expression{
+    "unknown": {symbol("error"), symbol("fail"), symbol("warning")},
+}
+
+func (p *Program) flag(name string) (expression, bool) {
+    if v, ok := p.flags[name]; ok {
+        return v, true
+    }
+    v, ok := defaultFlags[name]
+    return v, ok
+}
+
+// setFlag returns a program with flag name set to v
+func (p *Program) setFlag(name string, v expression) *Program {
+    q := *p
+    q.flags = make(map[string]expression, len(p.flags)+1)
+    for k, v := range p.flags {
+        q.flags[k] = v
+    }
+    q.flags[name] = v
+    return &q
+}
+
+// addAtoms adds the atoms c mentions to the atom table t
+func addAtoms(t *ptree[atom, struct{}], c clause) *ptree[atom, struct{}] {
+    for _, e := range c.xrTable {
+        switch x := e.(type) {
+        case atom:
+            t = addAtom(t, x)
+        case functorEntry:
+            t = addAtom(t, atom(x.name))
+        case procEntry:
+            t = addAtom(t, atom(x.name))
+        }
+    }
+    return t
+}
+
+// addAtom leaves t as it is if it has a already
+func addAtom(t *ptree[atom, struct{}], a atom) *ptree[atom, struct{}] {
+    if _, ok := t.get(a); ok {
+        return t
+    }
+    return t.set(a, struct{}{})
+}
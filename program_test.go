@@ -0,0 +1,222 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "reflect"
+    "slices"
+    "sort"
+    "strings"
+    "sync"
+    "testing"
+)
+
+// These are meant to be run with go test -race
+
+func TestConcurrentQueries(t *testing.T) {
+    for _, tt := range benchmarkPrograms {
+        if tt.name == "tak" || tt.name == "zebra" {
+            continue // too slow under the race detector
+        }
+        i := loadProgram(t, tt.file)
+        i.setStore(newTrail)
+        var wg sync.WaitGroup
+        for g := 0; g < 8; g++ {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                for n := 0; n < 3; n++ {
+                    got, _, err := runProgram(i, tt.query, tt.all)
+                    if err != nil {
+                        t.Errorf("%s: %v", tt.name, err)
+                        return
+                    }
+                    if got != tt.want {
+                        t.Errorf("%s: got %s want %s", tt.name, got, tt.want)
+                        return
+                    }
+                }
+            }()
+        }
+        wg.Wait()
+    }
+}
+
+func TestConcurrentAssert(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(`
+    fact(none, 0).
+    add(G, 0).
+    add(G, N) :- N > 0, assertz(fact(G, N)), M is N - 1, add(G, M).`)))
+    const goroutines, facts = 8, 50
+    var wg sync.WaitGroup
+    for g := 0; g < goroutines; g++ {
+        wg.Add(2)
+        go func() {
+            defer wg.Done()
+            if _, err := i.interpretContext(context.Background(), fmt.Sprintf("add(%d, %d)", g, facts), Limits{}); err != nil {
+                t.Error(err)
+            }
+            // our own clauses are all there, whatever the others did
+            got, err := i.interpretContext(context.Background(), fmt.Sprintf("fact(%d, N)", g), Limits{})
+            if err != nil || len(got) != facts {
+                t.Errorf("%d: got %d facts, error %v", g, len(got), err)
+            }
+        }()
+        go func() {
+            defer wg.Done()
+            for n := 0; n < 20; n++ {
+                if _, err := i.interpretContext(context.Background(), "fact(G, N)", Limits{}); err != nil {
+                    t.Error(err)
+                }
+            }
+        }()
+    }
+    wg.Wait()
+    got, err := i.interpretContext(context.Background(), "fact(G, N)", Limits{})
+    if err != nil || len(got) != goroutines*facts+1 {
+        t.Errorf("got %d facts want %d, error %v", len(got), goroutines*facts+1, err)
+    }
+}
+
+func TestProgramSnapshot(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(`p(1).`)))
+    before := i.program()
+    mustInterpret(t, i, "assertz(p(2))")
+    mustInterpret(t, i, "assertz(q(1))")
+    if p, _ := before.procedure(proc("p", 1)); len(p.clauses) != 1 {
+        t.Errorf("old program has %d clauses for p/1 want 1", len(p.clauses))
+    }
+    if _, ok := before.procedure(proc("q", 1)); ok {
+        t.Error("old program has q/1")
+    }
+    if p, _ := i.program().procedure(proc("p", 1)); len(p.clauses) != 2 {
+        t.Errorf("new program has %d clauses for p/1 want 2", len(p.clauses))
+    }
+}
+
+func TestAssertShares(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(`p(0). q(0).`)))
+    for n := 1; n <= 1000; n++ {
+        mustInterpret(t, i, fmt.Sprintf("assertz(p(%d))", n))
+    }
+    before := i.program()
+    q, _ := before.procedure(proc("q", 1))
+    // two programs grown from the same one do not see each other's clauses
+    a := before.assertz(proc("p", 1), compileClause(MustParseRules(`p(a).`)[0]))
+    b := before.assertz(proc("p", 1), compileClause(MustParseRules(`p(b).`)[0]))
+    for _, tt := range []struct{
+        prog *Program
+        want string
+    }{
+        {prog: before, want: "p(1000)"},
+        {prog: a, want: "p(a)"},
+        {prog: b, want: "p(b)"},
+    } {
+        p, _ := tt.prog.procedure(proc("p", 1))
+        rules, err := p.decompile()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := goalTerm(rules[len(rules)-1].head).PrintExpression(); got != tt.want {
+            t.Errorf("last clause %s want %s", got, tt.want)
+        }
+    }
+    // the procedures that did not change are not copied
+    if got, _ := a.procedure(proc("q", 1)); &got.clauses[0] != &q.clauses[0] {
+        t.Error("assertz copied q/1")
+    }
+}
+
+func TestFlags(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(`p :- nope.`)))
+    var out strings.Builder
+    i.setOutput(&out)
+    for n, tt := range []struct{
+        query string
+        vars  []string
+        want  []string
+        err   bool
+    }{
+        {query: "current_prolog_flag(bounded, X)", vars: []string{"X"}, want: []string{"true"}},
+        {query: "current_prolog_flag(unknown, X)", vars: []string{"X"}, want: []string{"error"}},
+        {query: "current_prolog_flag(nope, X)", vars: []string{"X"}, want: []string{}},
+        {query: "current_prolog_flag(1, X)", err: true},
+        {query: "p", err: true},
+        {query: "set_prolog_flag(unknown, fail)", want: []string{""}},
+        {query: "current_prolog_flag(unknown, X)", vars: []string{"X"}, want: []string{"fail"}},
+        {query: "p", want: []string{}},
+        {query: "set_prolog_flag(unknown, warning)", want: []string{""}},
+        {query: "p", want: []string{}},
+        {query: "set_prolog_flag(unknown, maybe)", err: true},
+        {query: "set_prolog_flag(bounded, false)", err: true},
+        {query: "set_prolog_flag(nope, true)", err: true},
+        {query: "set_prolog_flag(X, true)", err: true},
+    } {
+        got, err := answers(i, tt.query, tt.vars...)
+        if (err != nil) != tt.err {
+            t.Errorf("%d: %s: error %v", n, tt.query, err)
+            continue
+        }
+        if !tt.err && !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%d: %s: got %q want %q", n, tt.query, got, tt.want)
+        }
+    }
+    if got, want := out.String(), "Warning: unknown procedure nope/0\n"; got != want {
+        t.Errorf("wrote %q want %q", got, want)
+    }
+}
+
+func TestCurrentAtom(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(`colour(red). colour(green).`)))
+    for n, tt := range []struct{
+        query string
+        want  []string
+    }{
+        {query: "current_atom(red)", want: []string{""}},
+        {query: "current_atom(colour)", want: []string{""}},
+        {query: "current_atom(blue)", want: []string{}},
+        {query: "assertz(colour(blue))", want: []string{""}},
+        {query: "current_atom(blue)", want: []string{""}},
+    } {
+        got, err := answers(i, tt.query)
+        if err != nil {
+            t.Errorf("%d: %s: %v", n, tt.query, err)
+            continue
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%d: %s: got %q want %q", n, tt.query, got, tt.want)
+        }
+    }
+    got, err := answers(i, "current_atom(X)", "X")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !sort.StringsAreSorted(got) || !slices.Contains(got, "green") {
+        t.Errorf("current_atom(X) gave %q", got)
+    }
+}
+
+func TestConcurrentSettings(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(`p(1). p(2).`)))
+    var wg sync.WaitGroup
+    for g := 0; g < 4; g++ {
+        wg.Add(2)
+        go func() {
+            defer wg.Done()
+            for n := 0; n < 50; n++ {
+                if got, err := answers(i, "p(X)", "X"); err != nil || len(got) != 2 {
+                    t.Errorf("got %q, error %v", got, err)
+                    return
+                }
+            }
+        }()
+        go func() {
+            defer wg.Done()
+            for n := 0; n < 50; n++ {
+                i.setStore([]func() bindings{newSubstitution, newTrail}[n%2])
+                i.setParallel(ParallelOptions{Workers: 2, All: n%3 == 0})
+            }
+        }()
+    }
+    wg.Wait()
+}
@@ -0,0 +1,135 @@
+package main
+
+import "cmp"
+
+// a ptree is a persistent AVL tree like the substitution in avl.go, for
+// keys of any type that orders itself. Setting a key copies only the path
+// down to it, so a Program can change one procedure without copying the
+// others.
+type ptree[K ordered[K], V any] struct {
+    key    K
+    value  V
+    left   *ptree[K, V]
+    right  *ptree[K, V]
+    height int
+    size   int
+}
+
+type ordered[K any] interface {
+    compare(K) int
+}
+
+func (n *ptree[K, V]) get(k K) (V, bool) {
+    for n != nil {
+        switch c := k.compare(n.key); {
+        case c < 0:
+            n = n.left
+        case c > 0:
+            n = n.right
+        default:
+            return n.value, true
+        }
+    }
+    var zero V
+    return zero, false
+}
+
+// set returns the tree with k set to v
+func (n *ptree[K, V]) set(k K, v V) *ptree[K, V] {
+    if n == nil {
+        return &ptree[K, V]{key: k, value: v, height: 1, size: 1}
+    }
+    newn := *n
+    switch c := k.compare(n.key); {
+    case c < 0:
+        newn.left = n.left.set(k, v)
+    case c > 0:
+        newn.right = n.right.set(k, v)
+    default:
+        newn.value = v
+        return &newn
+    }
+    return newn.rebalance()
+}
+
+// each calls f with every key and value in order
+func (n *ptree[K, V]) each(f func(K, V)) {
+    if n == nil {
+        return
+    }
+    n.left.each(f)
+    f(n.key, n.value)
+    n.right.each(f)
+}
+
+func (n *ptree[K, V]) len() int {
+    if n == nil {
+        return 0
+    }
+    return n.size
+}
+
+func (n *ptree[K, V]) getHeight() int {
+    if n == nil {
+        return 0
+    }
+    return n.height
+}
+
+func (n *ptree[K, V]) resetHeight() {
+    n.height = max(n.left.getHeight(), n.right.getHeight()) + 1
+    n.size = n.left.len() + n.right.len() + 1
+}
+
+// rebalance fixes up n, which is a copy, after one side grew by one
+func (n *ptree[K, V]) rebalance() *ptree[K, V] {
+    n.resetHeight()
+    switch balance := n.left.getHeight() - n.right.getHeight(); {
+    case balance > 1:
+        if n.left.left.getHeight() < n.left.right.getHeight() {
+            l := *n.left
+            n.left = l.rotateLeft()
+        }
+        return n.rotateRight()
+    case balance < -1:
+        if n.right.right.getHeight() < n.right.left.getHeight() {
+            r := *n.right
+            n.right = r.rotateRight()
+        }
+        return n.rotateLeft()
+    }
+    return n
+}
+
+// rotations work on copies: n and the child that moves up are fresh
+func (n *ptree[K, V]) rotateLeft() *ptree[K, V] {
+    r := *n.right
+    n.right = r.left
+    n.resetHeight()
+    r.left = n
+    r.resetHeight()
+    return &r
+}
+
+func (n *ptree[K, V]) rotateRight() *ptree[K, V] {
+    l := *n.left
+    n.left = l.right
+    n.resetHeight()
+    l.right = n
+    l.resetHeight()
+    return &l
+}
+
+func (a atom) compare(b atom) int {
+    return cmp.Compare(a, b)
+}
+
+func (p procEntry) compare(q procEntry) int {
+    if c := cmp.Compare(p.module, q.module); c != 0 {
+        return c
+    }
+    if c := cmp.Compare(p.name, q.name); c != 0 {
+        return c
+    }
+    return cmp.Compare(p.arity, q.arity)
+}
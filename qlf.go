@@ -0,0 +1,346 @@
+package main
+
+// The qlf format stores compiled procedures, so a program does not have
+// to be parsed and compiled again every time it is loaded.
+//
+// All integers are varints as written by encoding/binary: counts, lengths
+// and arities are unsigned, integer constants and instructions signed.
+// Strings are a length followed by that many bytes of UTF-8.
+//
+//   file      = magic version count procedure*
+//   magic     = "BPQL"
+//   version   = 4
+//   procedure = name arity count clause* table module count meta* from
+//   module    = the module of the procedure, empty for user, as a string
+//   meta      = the meta_predicate spec of an argument, as a string
+//   from      = for an import, the module it is from, else empty
+//   clause    = count entry* numVars count instruction* source line
+//   source    = the file the clause was read from, as a string
+//   entry     = 0 integer          an integer constant
+//             | 1 name             an atom
+//             | 2 name arity       a functor, for FUNCTOR
+//             | 3 name arity       a procedure, for CALL
+//             | 4 module name arity  a procedure of a module
+//   table     = 0                  not tabled
+//             | 1 mode moded join  tabled; moded is the argument that mode
+//                                  combines answers for plus 1, or 0
+//   mode      = 0 variant | 1 min | 2 max | 3 lattice
+//   join      = name arity         for lattice only
+//
+// Version 1 files, which have no source and line, version 2 files,
+// which have no table, and version 3 files, which have no modules, can
+// still be loaded.
+// Loading verifies the code, so a bad file is an error rather
+// than a panic once the interpreter executes it.
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+const (
+    qlfMagic   = "BPQL"
+    qlfVersion = 4
+    // nothing in a sane file comes close; this stops a corrupt
+    // count from making us allocate all memory
+    qlfMaxCount = 1 << 24
+)
+
+const (
+    qlfInteger byte = iota
+    qlfAtom
+    qlfFunctor
+    qlfProc
+    qlfModuleProc
+)
+
+var errBadQLF = errors.New("not a qlf file")
+
+func SaveProcedures(w io.Writer, procs []procedure) error {
+    bw := bufio.NewWriter(w)
+    q := qlfWriter{w: bw}
+    q.bytes([]byte(qlfMagic))
+    q.uint(qlfVersion)
+    q.uint(uint64(len(procs)))
+    for _, p := range procs {
+        q.string(p.name)
+        q.uint(uint64(p.arity))
+        q.uint(uint64(len(p.clauses)))
+        for _, c := range p.clauses {
+            q.uint(uint64(len(c.xrTable)))
+            for _, e := range c.xrTable {
+                q.entry(e)
+            }
+            q.uint(uint64(c.numVars))
+            q.uint(uint64(len(c.bytecodes)))
+            for _, ins := range c.bytecodes {
+                q.int(int64(ins))
+            }
+            q.string(c.pos.file)
+            q.uint(uint64(c.pos.line))
+        }
+        q.table(p.table)
+        q.string(p.module)
+        q.uint(uint64(len(p.meta)))
+        for _, spec := range p.meta {
+            q.string(spec)
+        }
+        q.string(p.from)
+    }
+    if q.err != nil {
+        return q.err
+    }
+    return bw.Flush()
+}
+
+func LoadProcedures(r io.Reader) ([]procedure, error) {
+    q := qlfReader{r: bufio.NewReader(r)}
+    magic := make([]byte, len(qlfMagic))
+    if _, err := io.ReadFull(q.r, magic); err != nil || string(magic) != qlfMagic {
+        return nil, errBadQLF
+    }
+    version := q.uint()
+    if q.err == nil && (version < 1 || version > qlfVersion) {
+        return nil, fmt.Errorf("qlf version %d not supported", version)
+    }
+    // counts are not trusted for allocating: read until they run out or data does
+    procs := []procedure{}
+    for n := q.count(); n > 0 && q.err == nil; n-- {
+        p := procedure{name: q.string(), arity: int(q.count())}
+        for j := q.count(); j > 0 && q.err == nil; j-- {
+            c := clause{xrTable: xrTable{}}
+            for k := q.count(); k > 0 && q.err == nil; k-- {
+                c.xrTable = append(c.xrTable, q.entry())
+            }
+            c.numVars = int(q.count())
+            for k := q.count(); k > 0 && q.err == nil; k-- {
+                c.bytecodes = append(c.bytecodes, instruction(q.int()))
+            }
+            if version > 1 {
+                c.pos = position{file: q.string(), line: int(q.count())}
+            }
+            if q.err != nil {
+                return nil, q.err
+            }
+            if err := verifyClause(c, p.arity); err != nil {
+                return nil, fmt.Errorf("%s/%d clause %d: %w", p.name, p.arity, len(p.clauses), err)
+            }
+            p.clauses = append(p.clauses, c)
+        }
+        if version > 2 {
+            p.table = q.table(p.arity)
+        }
+        if version > 3 {
+            p.module = q.string()
+            for k := q.count(); k > 0 && q.err == nil; k-- {
+                p.meta = append(p.meta, q.string())
+            }
+            p.from = q.string()
+            if p.meta != nil && len(p.meta) != p.arity {
+                return nil, fmt.Errorf("%s: %d meta specs", p.entry().printEntry(), len(p.meta))
+            }
+        }
+        procs = append(procs, p)
+    }
+    if q.err != nil {
+        return nil, q.err
+    }
+    return procs, q.err
+}
+
+type qlfWriter struct {
+    w   *bufio.Writer
+    err error
+}
+
+func (q *qlfWriter) bytes(b []byte) {
+    if q.err == nil {
+        _, q.err = q.w.Write(b)
+    }
+}
+
+func (q *qlfWriter) uint(n uint64) {
+    q.bytes(binary.AppendUvarint(nil, n))
+}
+
+func (q *qlfWriter) int(n int64) {
+    q.bytes(binary.AppendVarint(nil, n))
+}
+
+func (q *qlfWriter) string(s string) {
+    q.uint(uint64(len(s)))
+    q.bytes([]byte(s))
+}
+
+func (q *qlfWriter) entry(e entry) {
+    switch t := e.(type) {
+    case integer:
+        q.bytes([]byte{qlfInteger})
+        q.int(int64(t))
+    case atom:
+        q.bytes([]byte{qlfAtom})
+        q.string(string(t))
+    case functorEntry:
+        q.bytes([]byte{qlfFunctor})
+        q.string(t.name)
+        q.uint(uint64(t.arity))
+    case procEntry:
+        if t.module != "" {
+            q.bytes([]byte{qlfModuleProc})
+            q.string(t.module)
+        } else {
+            q.bytes([]byte{qlfProc})
+        }
+        q.string(t.name)
+        q.uint(uint64(t.arity))
+    default:
+        if q.err == nil {
+            q.err = fmt.Errorf("cannot save xr entry %T", e)
+        }
+    }
+}
+
+func (q *qlfWriter) table(t *tableSpec) {
+    if t == nil {
+        q.uint(0)
+        return
+    }
+    q.uint(1)
+    q.uint(uint64(t.mode))
+    q.uint(uint64(t.moded + 1))
+    if t.mode == tableLattice {
+        q.string(t.join.name)
+        q.uint(uint64(t.join.arity))
+    }
+}
+
+// qlfReader remembers the first error; after that everything reads as zero
+type qlfReader struct {
+    r   *bufio.Reader
+    err error
+}
+
+func (q *qlfReader) fail(err error) {
+    if q.err != nil {
+        return
+    }
+    if err == io.EOF {
+        err = io.ErrUnexpectedEOF
+    }
+    q.err = err
+}
+
+func (q *qlfReader) uint() uint64 {
+    if q.err != nil {
+        return 0
+    }
+    n, err := binary.ReadUvarint(q.r)
+    q.fail(err)
+    return n
+}
+
+func (q *qlfReader) int() int64 {
+    if q.err != nil {
+        return 0
+    }
+    n, err := binary.ReadVarint(q.r)
+    q.fail(err)
+    return n
+}
+
+func (q *qlfReader) count() uint64 {
+    n := q.uint()
+    if n > qlfMaxCount {
+        q.fail(fmt.Errorf("qlf count %d too large", n))
+        return 0
+    }
+    return n
+}
+
+func (q *qlfReader) string() string {
+    n := q.count()
+    if q.err != nil {
+        return ""
+    }
+    var sb strings.Builder
+    _, err := io.CopyN(&sb, q.r, int64(n))
+    q.fail(err)
+    return sb.String()
+}
+
+func (q *qlfReader) entry() entry {
+    if q.err != nil {
+        return nil
+    }
+    tag, err := q.r.ReadByte()
+    if err != nil {
+        q.fail(err)
+        return nil
+    }
+    switch tag {
+    case qlfInteger:
+        return integer(q.int())
+    case qlfAtom:
+        return atom(q.string())
+    case qlfFunctor:
+        return functor(q.string(), int(q.count()))
+    case qlfProc:
+        return proc(q.string(), int(q.count()))
+    case qlfModuleProc:
+        return moduleProc(q.string(), q.string(), int(q.count()))
+    }
+    q.fail(fmt.Errorf("unknown xr entry tag %d", tag))
+    return nil
+}
+
+func (q *qlfReader) table(arity int) *tableSpec {
+    if q.uint() == 0 || q.err != nil {
+        return nil
+    }
+    t := &tableSpec{mode: tableMode(q.uint()), moded: int(q.count()) - 1}
+    switch {
+    case t.mode > tableLattice:
+        q.fail(fmt.Errorf("unknown table mode %d", t.mode))
+    case t.moded >= arity || (t.moded < 0) != (t.mode == tableVariant):
+        q.fail(fmt.Errorf("bad moded argument %d", t.moded+1))
+    case t.mode == tableLattice:
+        t.join = proc(q.string(), int(q.count()))
+    }
+    return t
+}
+
+// loadFile reads a program, either Prolog source or a qlf file, with
+// the modules it uses
+func loadFile(path string) ([]procedure, error) {
+    l := newLoader()
+    if _, err := l.load(path); err != nil {
+        return nil, err
+    }
+    return l.procs, nil
+}
+
+// qcompile compiles the Prolog source in path to a qlf file next to it
+func qcompile(path string) (string, error) {
+    if !strings.HasSuffix(path, ".pl") {
+        path += ".pl"
+    }
+    procs, err := loadFile(path)
+    if err != nil {
+        return "", err
+    }
+    out := strings.TrimSuffix(path, ".pl") + ".qlf"
+    f, err := os.Create(out)
+    if err != nil {
+        return "", err
+    }
+    if err := SaveProcedures(f, procs); err != nil {
+        f.Close()
+        return "", err
+    }
+    return out, f.Close()
+}
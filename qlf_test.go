@@ -0,0 +1,126 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "os"
+    "path/filepath"
+    "reflect"
+    "sort"
+    "testing"
+)
+
+func TestSaveLoadProcedures(t *testing.T) {
+    for _, tt := range benchmarkPrograms {
+        b, err := os.ReadFile(tt.file)
+        if err != nil {
+            t.Fatal(err)
+        }
+        procs := compileProcedures(MustParseRules(string(b)))
+        var buf bytes.Buffer
+        if err := SaveProcedures(&buf, procs); err != nil {
+            t.Fatal(err)
+        }
+        got, err := LoadProcedures(&buf)
+        if err != nil {
+            t.Errorf("%s: %v", tt.name, err)
+            continue
+        }
+        if !reflect.DeepEqual(got, procs) {
+            t.Errorf("%s: got %v want %v", tt.name, got, procs)
+        }
+    }
+}
+
+func TestLoadProceduresRejectsBadData(t *testing.T) {
+    save := func(procs ...procedure) []byte {
+        var buf bytes.Buffer
+        if err := SaveProcedures(&buf, procs); err != nil {
+            t.Fatal(err)
+        }
+        return buf.Bytes()
+    }
+    good := save(compileProcedure(MustParseRules(appendRules)))
+    for i, tt := range [][]byte{
+        nil,
+        []byte("ELF\x7f"),
+        []byte("BPQL\x05"),
+        good[:len(good)-3],
+        // CONST pointing past the end of its xr table
+        save(procedure{name: "p", arity: 1, clauses: []clause{
+            {xrTable: xrTable{constant("a")}, bytecodes: []instruction{CONST, 1, EXIT}},
+        }}),
+        // FUNCTOR on an atom
+        save(procedure{name: "p", arity: 1, clauses: []clause{
+            {xrTable: xrTable{constant("a")}, bytecodes: []instruction{FUNCTOR, 0, POP, EXIT}},
+        }}),
+        // VAR beyond numVars
+        save(procedure{name: "p", arity: 1, clauses: []clause{
+            {numVars: 1, bytecodes: []instruction{VAR, 1, EXIT}},
+        }}),
+        // a huge count
+        append([]byte("BPQL\x01"), 0xff, 0xff, 0xff, 0xff, 0xff, 0x01),
+    }{
+        if _, err := LoadProcedures(bytes.NewReader(tt)); err == nil {
+            t.Errorf("%d: expected error", i)
+        }
+    }
+}
+
+// Version 1 files have no source positions
+func TestLoadVersion1(t *testing.T) {
+    var buf bytes.Buffer
+    bw := bufio.NewWriter(&buf)
+    q := qlfWriter{w: bw}
+    q.bytes([]byte(qlfMagic))
+    q.uint(1)
+    q.uint(1)
+    q.string("p")
+    q.uint(0)
+    q.uint(1)
+    q.uint(0)
+    q.uint(0)
+    q.uint(1)
+    q.int(int64(EXIT))
+    bw.Flush()
+    got, err := LoadProcedures(&buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := []procedure{{name: "p", clauses: []clause{{xrTable: xrTable{}, bytecodes: []instruction{EXIT}}}}}
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("got %v want %v", got, want)
+    }
+}
+
+func FuzzLoadProcedures(f *testing.F) {
+    var buf bytes.Buffer
+    SaveProcedures(&buf, []procedure{compileProcedure(MustParseRules(appendRules))})
+    f.Add(buf.Bytes())
+    f.Fuzz(func(t *testing.T, b []byte) {
+        // should never panic
+        LoadProcedures(bytes.NewReader(b))
+    })
+}
+
+func TestQcompile(t *testing.T) {
+    dir := t.TempDir()
+    src := filepath.Join(dir, "app.pl")
+    if err := os.WriteFile(src, []byte(appendRules), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    i := NewInterpreter(nil)
+    mustInterpret(t, i, "qcompile('" + filepath.Join(dir, "app") + "')")
+    procs, err := loadFile(filepath.Join(dir, "app.qlf"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    want, err := loadFile(src)
+    if err != nil {
+        t.Fatal(err)
+    }
+    sort.Slice(procs, func(i, j int) bool { return procs[i].name < procs[j].name })
+    if !reflect.DeepEqual(procs, want) {
+        t.Errorf("got %v want %v", procs, want)
+    }
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "sort"
+    "strings"
+)
+
+// a repl reads queries and prints their answers. After each answer it
+// reads a line: ; asks for the next answer, anything else stops. While
+// tracing, it asks what to do at every leashed port.
+type repl struct {
+    i   *interpreter
+    in  *bufio.Reader
+    out io.Writer
+}
+
+func runREPL(i *interpreter, in io.Reader, out io.Writer) {
+    r := &repl{i: i, in: bufio.NewReader(in), out: out}
+    i.setOutput(out)
+    i.SetTraceHook(r.prompt)
+    for {
+        fmt.Fprint(out, "?- ")
+        q, err := r.readQuery()
+        if err != nil {
+            fmt.Fprintln(out)
+            return
+        }
+        r.query(q)
+    }
+}
+
+// readQuery reads lines up to one ending in a period
+func (r *repl) readQuery() (string, error) {
+    var sb strings.Builder
+    for {
+        line, err := r.in.ReadString('\n')
+        sb.WriteString(line)
+        q := strings.TrimSpace(sb.String())
+        if strings.HasSuffix(q, ".") {
+            return q, nil
+        }
+        if err != nil {
+            return "", err
+        }
+    }
+}
+
+func (r *repl) readLine() string {
+    line, _ := r.in.ReadString('\n')
+    return strings.TrimSpace(line)
+}
+
+// query answers q. A query starting with explain is answered with the
+// proof of every answer.
+func (r *repl) query(q string) {
+    rest, explain := strings.CutPrefix(q, "explain ")
+    if explain {
+        q = rest
+    }
+    goals, vars, err := ParseProcesses(q)
+    if err != nil {
+        fmt.Fprintf(r.out, "error: %v\n", err)
+        return
+    }
+    goal := queryGoal(goals)
+    m := r.i.newMachine(nil, state{sub: r.i.store(), vc: len(vars)}, Limits{})
+    if explain {
+        m.startExplaining()
+    }
+    more := true
+    m.run(proc(goal.functor, goal.arity()), goal.args, func(ans state) bool {
+        if explain {
+            fmt.Fprint(r.out, m.trace.proof())
+        }
+        // only ask for more if there could be any
+        if len(m.choices) == 0 {
+            fmt.Fprintf(r.out, "%s.\n", answerString(ans, vars))
+            more = false
+            return false
+        }
+        fmt.Fprintf(r.out, "%s ", answerString(ans, vars))
+        more = r.readLine() == ";"
+        return more
+    })
+    switch err := m.err; {
+    case errors.Is(err, ErrAborted):
+        fmt.Fprintln(r.out, "% Execution Aborted")
+    case err != nil:
+        fmt.Fprintf(r.out, "error: %v\n", err)
+    case more:
+        fmt.Fprintln(r.out, "false.")
+    }
+}
+
+// answerString writes the bindings of the named variables of a query,
+// then the goals left waiting on them
+func answerString(ans state, vars map[string]variable) string {
+    names := []string{}
+    for name := range vars {
+        if !strings.HasPrefix(name, "_") {
+            names = append(names, name)
+        }
+    }
+    sort.Slice(names, func(i, j int) bool { return vars[names[i]] < vars[names[j]] })
+    lines := []string{}
+    terms := []expression{}
+    for _, name := range names {
+        lines = append(lines, fmt.Sprintf("%s = %s", name, walkstar(ans.sub, vars[name]).PrintExpression()))
+        terms = append(terms, vars[name])
+    }
+    if ans.attributed {
+        for _, g := range residualGoals(ans, terms) {
+            lines = append(lines, g.PrintExpression())
+        }
+    }
+    if len(lines) == 0 {
+        return "true"
+    }
+    return strings.Join(lines, ",\n")
+}
+
+// prompt is the trace hook of the repl. It prints the port and, if the
+// port is leashed, asks how to go on.
+func (r *repl) prompt(ev TraceEvent) TraceAction {
+    if !ev.Leashed {
+        fmt.Fprintln(r.out, ev)
+        return TraceCreep
+    }
+    for {
+        fmt.Fprintf(r.out, "%s ? ", ev)
+        switch r.readLine() {
+        case "", "c":
+            return TraceCreep
+        case "s":
+            return TraceSkip
+        case "l":
+            return TraceLeap
+        case "f":
+            return TraceFail
+        case "r":
+            return TraceRetry
+        case "a":
+            return TraceAbort
+        }
+        fmt.Fprintln(r.out, "creep (c or return), skip (s), leap (l), fail (f), retry (r), abort (a)")
+    }
+}
@@ -2,15 +2,45 @@ package main
 
 import "reflect"
 
+// bindings is where unification records what variables are bound to.
+// The persistent substitution shares structure between versions, so old
+// states stay valid for free; the trail mutates in place and undoes.
+type bindings interface {
+	get(v variable) (expression, bool)
+	put(v variable, e expression) bindings
+	// mark is called when a choicepoint is made with vc variables in use
+	mark(vc int) int
+	// undo returns the bindings as they were at mark
+	undo(mark, vc int) bindings
+	// len is the number of variables bound
+	len() int
+}
+
 func (s *substitution) get(v variable) (expression, bool) {
 	return s.Lookup(v)
 }
 
-func (s *substitution) put(v variable, e expression) *substitution {
+func (s *substitution) put(v variable, e expression) bindings {
 	return s.Insert(v, e)
 }
 
-func (s *substitution) walk(u expression) expression {
+// a choicepoint keeps the old version of the tree, so there is nothing to undo
+func (s *substitution) mark(vc int) int {
+	return 0
+}
+
+func (s *substitution) undo(mark, vc int) bindings {
+	return s
+}
+
+func (s *substitution) len() int {
+	if s == nil {
+		return 0
+	}
+	return s.size
+}
+
+func walk(s bindings, u expression) expression {
 	uvar, ok := u.(variable)
 	if !ok {
 		return u
@@ -19,46 +49,95 @@ func (s *substitution) walk(u expression) expression {
 	if !ok {
 		return u
 	}
-	return s.walk(e)
+	if _, ok := e.(attributes); ok {
+		return u
+	}
+	return walk(s, e)
 }
 
-func (s *substitution) walkstar(u expression) expression {
-	v := s.walk(u)
+// walkAttributes is walk that also returns the attributes of the
+// variable it ends at, if it has any
+func walkAttributes(s bindings, u expression) (expression, attributes) {
+	for {
+		uvar, ok := u.(variable)
+		if !ok {
+			return u, nil
+		}
+		e, ok := s.get(uvar)
+		if !ok {
+			return u, nil
+		}
+		if a, ok := e.(attributes); ok {
+			return u, a
+		}
+		u = e
+	}
+}
+
+func walkstar(s bindings, u expression) expression {
+	v := walk(s, u)
 	switch t := v.(type) {
 	case variable:
 		return t
 	case list:
-		return list{head: s.walkstar(t.head), tail: s.walkstar(t.tail)}
+		return list{head: walkstar(s, t.head), tail: walkstar(s, t.tail)}
     case process:
         args := make([]expression, len(t.args))
         for i:=0; i<len(t.args); i++ {
-            args[i] = s.walkstar(t.args[i])
+            args[i] = walkstar(s, t.args[i])
         }
         return process{functor: t.functor, args: args}
 	}
 	return v
 }
 
-func (s *substitution) extend(v variable, e expression) (*substitution, bool) {
-	if s.occursCheck(v, e) {
+// extend binds v to e. If v has attributes, their hooks are woken:
+// they run once the unification is done.
+func extend(s bindings, v variable, a attributes, e expression, occurs bool) (bindings, bool) {
+	if occurs && occursCheck(s, v, e) {
 		return nil, false
 	}
-	return s.put(v, e), true
+	s = s.put(v, e)
+	if a != nil {
+		w := pendingWakeups(s)
+		s = s.put(wakeVar, append(w[:len(w):len(w)], wakeup{attrs: a, value: e}))
+	}
+	return s, true
+}
+
+// unify does not do the occurs check, as is usual for Prolog:
+// checking would walk the whole term for every binding
+func unify(s bindings, u, v expression) (bindings, bool) {
+	return unifyWith(s, u, v, false)
+}
+
+func unifyWithOccursCheck(s bindings, u, v expression) (bindings, bool) {
+	return unifyWith(s, u, v, true)
 }
 
-func (s *substitution) unify(u, v expression) (*substitution, bool) {
-	u0 := s.walk(u)
-	v0 := s.walk(v)
+func unifyWith(s bindings, u, v expression, occurs bool) (bindings, bool) {
+	u0, ua := walkAttributes(s, u)
+	v0, va := walkAttributes(s, v)
 	if reflect.DeepEqual(u0, v0) {
 		return s, true
 	}
 	uvar, uok := u0.(variable)
-	if uok {
-		return s.extend(uvar, v0)
-	}
 	vvar, vok := v0.(variable)
+	// a plain variable is bound to an attributed one, which wakes nothing
+	if uok && (ua == nil || !vok || va != nil) {
+		return extend(s, uvar, ua, v0, occurs)
+	}
 	if vok {
-		return s.extend(vvar, u0)
+		return extend(s, vvar, va, u0, occurs)
+	}
+	ul, uok := u0.(list)
+	vl, vok := v0.(list)
+	if uok && vok {
+		s, ok := unifyWith(s, ul.head, vl.head, occurs)
+		if !ok {
+			return nil, false
+		}
+		return unifyWith(s, ul.tail, vl.tail, occurs)
 	}
 	up, uok := u0.(process)
 	vp, vok := v0.(process)
@@ -68,7 +147,7 @@ func (s *substitution) unify(u, v expression) (*substitution, bool) {
         }
         s0 := s
         for i:=0; i<len(up.args); i++ {
-            s, ok := s0.unify(up.args[i], vp.args[i])
+            s, ok := unifyWith(s0, up.args[i], vp.args[i], occurs)
             if !ok {
                 return nil, false
             }
@@ -79,14 +158,20 @@ func (s *substitution) unify(u, v expression) (*substitution, bool) {
 	return nil, false
 }
 
-func (s *substitution) occursCheck(v variable, e expression) bool {
-	e0 := s.walk(e)
+func occursCheck(s bindings, v variable, e expression) bool {
+	e0 := walk(s, e)
 	if evar, ok := e0.(variable); ok {
 		return v == evar
 	}
-	elist, ok := e0.(list)
-	if !ok {
-		return false
+	switch t := e0.(type) {
+	case list:
+		return occursCheck(s, v, t.head) || occursCheck(s, v, t.tail)
+	case process:
+		for _, arg := range t.args {
+			if occursCheck(s, v, arg) {
+				return true
+			}
+		}
 	}
-	return s.occursCheck(v, elist.head) || s.occursCheck(v, elist.tail)
+	return false
 }
@@ -0,0 +1,473 @@
+package main
+
+// Tabling remembers the answers of calls to procedures declared with
+// :- table p/N, so that left recursion terminates and every answer is
+// given once. Calls are told apart by variant: two calls share a table
+// if they are the same up to renaming their variables.
+//
+// Tables are filled by iterating to a fixpoint, as in linear tabling.
+// A table is evaluated by running the clauses of its procedure, and a
+// call to a variant that is being evaluated gets the answers found so
+// far. Tables that call each other form a strongly connected component:
+// its leader, the oldest of them, runs its clauses again until a round
+// adds no answers to any table in it, and then all of them are complete.
+//
+// A table can also keep a single answer for every variant of the other
+// arguments, combining the values of one argument with min, max or a
+// lattice join: :- table path(_,_,min).
+//
+// Tables live as long as the query that made them.
+
+import (
+    "fmt"
+    "slices"
+    "strings"
+)
+
+// a tableMode says what a tabled procedure does with new answers
+type tableMode int
+
+const (
+    tableVariant tableMode = iota // keep all of them
+    tableMin                      // keep the least value of the moded argument
+    tableMax                      // keep the greatest
+    tableLattice                  // keep the join of them
+)
+
+var tableModeNames = []string{"_", "min", "max", "lattice"}
+
+// a tableSpec is the table directive of a procedure
+type tableSpec struct {
+    mode  tableMode
+    moded int       // the argument that mode combines, -1 for tableVariant
+    join  procEntry // for tableLattice, called as join(Old, New, Joined)
+}
+
+// directive writes the spec as the directive for procedure p
+func (s *tableSpec) directive(p procEntry) string {
+    if s.mode == tableVariant {
+        return fmt.Sprintf(":- table %s.", p.printEntry())
+    }
+    args := make([]string, p.arity)
+    for i := range args {
+        args[i] = "_"
+    }
+    args[s.moded] = tableModeNames[s.mode]
+    if s.mode == tableLattice {
+        args[s.moded] = fmt.Sprintf("lattice(%s)", s.join.printEntry())
+    }
+    return fmt.Sprintf(":- table %s(%s).", p.name, strings.Join(args, ","))
+}
+
+// tableSpecs reads what a table directive declares: a comma list of
+// Name/Arity, or of heads with a mode for one argument
+func tableSpecs(e expression) (map[procEntry]*tableSpec, error) {
+    specs := map[procEntry]*tableSpec{}
+    var add func(e expression) error
+    add = func(e expression) error {
+        switch t := e.(type) {
+        case variable:
+            return errInstantiation
+        case symbol:
+            specs[proc(string(t), 0)] = &tableSpec{moded: -1}
+            return nil
+        case process:
+            if t.functor == "," && t.arity() == 2 {
+                if err := add(t.args[0]); err != nil {
+                    return err
+                }
+                return add(t.args[1])
+            }
+            if t.functor == "/" && t.arity() == 2 {
+                name, ok := t.args[0].(symbol)
+                arity, ok2 := t.args[1].(number)
+                if !ok || !ok2 || arity < 0 {
+                    return typeError("predicate_indicator", t)
+                }
+                specs[proc(string(name), int(arity))] = &tableSpec{moded: -1}
+                return nil
+            }
+            spec := &tableSpec{moded: -1}
+            for i, arg := range t.args {
+                mode, join, err := tableArgMode(arg)
+                if err != nil {
+                    return err
+                }
+                if mode == tableVariant {
+                    continue
+                }
+                if spec.moded >= 0 {
+                    return fmt.Errorf("table %s: only one argument can have a mode", t.PrintExpression())
+                }
+                spec.mode, spec.moded, spec.join = mode, i, join
+            }
+            specs[proc(t.functor, t.arity())] = spec
+            return nil
+        }
+        return typeError("callable", e)
+    }
+    if err := add(e); err != nil {
+        return nil, err
+    }
+    return specs, nil
+}
+
+func tableArgMode(e expression) (tableMode, procEntry, error) {
+    switch t := e.(type) {
+    case variable:
+        return tableVariant, procEntry{}, nil
+    case symbol:
+        switch t {
+        case underscore:
+            return tableVariant, procEntry{}, nil
+        case "min":
+            return tableMin, procEntry{}, nil
+        case "max":
+            return tableMax, procEntry{}, nil
+        }
+    case process:
+        if t.functor == "lattice" && t.arity() == 1 {
+            pi, ok := t.args[0].(process)
+            if ok && pi.functor == "/" && pi.arity() == 2 {
+                name, ok := pi.args[0].(symbol)
+                if ok && pi.args[1] == number(3) {
+                    return tableLattice, proc(string(name), 3), nil
+                }
+            }
+            return 0, procEntry{}, typeError("lattice(Name/3)", t)
+        }
+    }
+    return 0, procEntry{}, typeError("table mode", e)
+}
+
+// tables are the answer tables of a query, shared by the machines that
+// evaluate its tabled calls
+type tables struct {
+    byCall map[string]*answerTable // by variant of the call
+    stack  []*answerTable          // being evaluated, oldest first
+    added  int                     // answers added or improved so far
+    round  int                     // evaluations started so far
+}
+
+type answerTable struct {
+    complete   bool
+    evaluating bool
+    index      int // on the stack, while evaluating
+    low        int // the oldest table on the stack it used answers of
+    round      int // when it was last evaluated
+    scc        []*answerTable // evaluated under this one, to complete with it
+    answers    []process
+    byKey      map[string]int // answer by variant of its unmoded arguments
+    clauses    []clause       // the answers compiled, nil if out of date
+}
+
+// variantKey is the same for terms that are variants of each other, and
+// only for those
+func variantKey(p process) string {
+    var b strings.Builder
+    writeKey(&b, renumberVariables(rule{head: p}).head)
+    return b.String()
+}
+
+// isVariant tells if a and b are the same up to renaming their variables
+func isVariant(a, b expression) bool {
+    return variantKey(process{args: []expression{a}}) == variantKey(process{args: []expression{b}})
+}
+
+// writeKey writes e with its atoms quoted and its variables as a NUL and
+// their number, which no term read from source can print as
+func writeKey(b *strings.Builder, e expression) {
+    switch t := e.(type) {
+    case variable:
+        fmt.Fprintf(b, "\x00%d", t)
+    case number:
+        fmt.Fprintf(b, "%d", t)
+    case symbol:
+        b.WriteString(t.quoted())
+    case list:
+        b.WriteString("[")
+        writeKey(b, t.head)
+        b.WriteString("|")
+        writeKey(b, t.tail)
+        b.WriteString("]")
+    case process:
+        b.WriteString(symbol(t.functor).quoted())
+        if len(t.args) == 0 {
+            return
+        }
+        b.WriteString("(")
+        for i, arg := range t.args {
+            if i > 0 {
+                b.WriteString(",")
+            }
+            writeKey(b, arg)
+        }
+        b.WriteString(")")
+    default:
+        fmt.Fprintf(b, "\x00%T:%s", e, e.PrintExpression())
+    }
+}
+
+// arriveTabled calls the tabled procedure pr, trying its answers as if
+// they were its clauses
+func (m *machine) arriveTabled(pr procedure, args []expression) bool {
+    if m.tables == nil {
+        m.tables = &tables{byCall: map[string]*answerTable{}}
+    }
+    ts := m.tables
+    goal := process{functor: pr.name, args: make([]expression, len(args))}
+    for i, arg := range args {
+        goal.args[i] = walkstar(m.state.sub, arg)
+    }
+    key := variantKey(goal)
+    if pr.module != "" {
+        key = pr.module + ":" + key
+    }
+    t, ok := ts.byCall[key]
+    if !ok {
+        t = &answerTable{byKey: map[string]int{}, round: -1}
+        ts.byCall[key] = t
+    }
+    switch {
+    case t.complete:
+    case t.evaluating:
+        // a variant of a call being evaluated: go on with the answers so far
+        ts.dependsOn(t.index)
+    case t.round == ts.round:
+        // evaluated already since anything else was, so nothing is new
+        ts.dependsOn(t.low)
+    default:
+        if err := m.evaluate(t, pr, goal); err != nil {
+            return m.throw(err)
+        }
+    }
+    return m.try(t.answerClauses(), args, m.cont, m.state)
+}
+
+// dependsOn notes that the table being evaluated used answers of the
+// incomplete table at index on the stack
+func (ts *tables) dependsOn(index int) {
+    if len(ts.stack) == 0 {
+        return
+    }
+    top := ts.stack[len(ts.stack)-1]
+    top.low = min(top.low, index)
+}
+
+// evaluate fills t with the answers of the clauses of pr for goal. If t
+// leads its component this is all of them; otherwise what the tables it
+// depends on gave so far, and its leader evaluates it again.
+func (m *machine) evaluate(t *answerTable, pr procedure, goal process) error {
+    ts := m.tables
+    t.evaluating = true
+    t.index = len(ts.stack)
+    ts.stack = append(ts.stack, t)
+    defer func() {
+        ts.stack = ts.stack[:t.index]
+        t.evaluating = false
+    }()
+    for {
+        added := ts.added
+        ts.round++
+        t.round = ts.round
+        t.low = t.index
+        answers, err := m.solveClauses(pr.clauses, goal)
+        if err != nil {
+            return err
+        }
+        for _, ans := range answers {
+            if err := m.addAnswer(t, pr.table, ans); err != nil {
+                return err
+            }
+        }
+        if t.low < t.index {
+            // the leader is further down the stack
+            parent := ts.stack[t.index-1]
+            parent.low = min(parent.low, t.low)
+            parent.scc = append(parent.scc, t)
+            parent.scc = append(parent.scc, t.scc...)
+            t.scc = nil
+            return nil
+        }
+        if ts.added == added {
+            t.complete = true
+            for _, u := range t.scc {
+                u.complete = true
+            }
+            t.scc = nil
+            return nil
+        }
+    }
+}
+
+// subMachine makes a machine to run goals on for m, from where m is.
+// Bindings it makes have to be undone by the caller.
+func (m *machine) subMachine() *machine {
+    sub := &machine{Engine: m.Engine, program: m.program, state: m.state, tables: m.tables}
+    if m.trace != nil {
+        sub.startTracing()
+        sub.trace.cover = m.trace.cover
+        sub.trace.on = m.trace.on
+    }
+    return sub
+}
+
+// solveClauses returns goal as every answer of clauses gives it
+func (m *machine) solveClauses(clauses []clause, goal process) ([]process, error) {
+    sub := m.subMachine()
+    mark := m.state.sub.mark(m.state.vc)
+    answers := []process{}
+    sub.loop(sub.try(clauses, goal.args, nil, sub.state), func(ans state) bool {
+        p := process{functor: goal.functor, args: make([]expression, len(goal.args))}
+        for i, arg := range goal.args {
+            p.args[i] = walkstar(ans.sub, arg)
+        }
+        answers = append(answers, p)
+        return true
+    })
+    m.stats.inferences += sub.stats.inferences
+    m.state.sub = m.state.sub.undo(mark, m.state.vc)
+    return answers, sub.err
+}
+
+// addAnswer adds ans to t if it is new, or if it improves on the answer
+// t has for its unmoded arguments
+func (m *machine) addAnswer(t *answerTable, spec *tableSpec, ans process) error {
+    ans = renumberVariables(rule{head: ans}).head
+    key := ans
+    if spec.mode != tableVariant {
+        // the moded argument is left out, so answers differing only in
+        // it share a key
+        key.args = slices.Delete(slices.Clone(ans.args), spec.moded, spec.moded+1)
+    }
+    k := variantKey(key)
+    i, ok := t.byKey[k]
+    if !ok {
+        t.byKey[k] = len(t.answers)
+        t.answers = append(t.answers, ans)
+        if t.clauses != nil {
+            t.clauses = append(t.clauses, compileClause(rule{head: ans}))
+        }
+        m.tables.added++
+        return nil
+    }
+    if spec.mode == tableVariant {
+        return nil
+    }
+    old, cur := t.answers[i].args[spec.moded], ans.args[spec.moded]
+    var better expression
+    switch spec.mode {
+    case tableMin:
+        if compareTerms(cur, old) < 0 {
+            better = cur
+        }
+    case tableMax:
+        if compareTerms(cur, old) > 0 {
+            better = cur
+        }
+    case tableLattice:
+        joined, err := m.join(spec.join, old, cur)
+        if err != nil {
+            return err
+        }
+        if joined != nil && !isVariant(joined, old) {
+            better = joined
+        }
+    }
+    if better == nil {
+        return nil
+    }
+    improved := process{functor: ans.functor, args: append([]expression{}, t.answers[i].args...)}
+    improved.args[spec.moded] = better
+    t.answers[i] = renumberVariables(rule{head: improved}).head
+    t.clauses = nil
+    m.tables.added++
+    return nil
+}
+
+// join calls p(Old, Cur, Joined) for the first Joined, nil if it fails
+func (m *machine) join(p procEntry, old, cur expression) (expression, error) {
+    sub := m.subMachine()
+    mark := m.state.sub.mark(m.state.vc)
+    joined := sub.fresh()
+    var out expression
+    sub.run(p, []expression{old, cur, joined}, func(ans state) bool {
+        out = walkstar(ans.sub, joined)
+        return false
+    })
+    m.stats.inferences += sub.stats.inferences
+    m.state.sub = m.state.sub.undo(mark, m.state.vc)
+    return out, sub.err
+}
+
+// answerClauses are the answers of t as facts
+func (t *answerTable) answerClauses() []clause {
+    if t.clauses == nil {
+        t.clauses = make([]clause, 0, len(t.answers))
+        for _, ans := range t.answers {
+            t.clauses = append(t.clauses, compileClause(rule{head: ans}))
+        }
+    }
+    return t.clauses
+}
+
+// compareTerms orders terms in the standard order: variables, then
+// numbers, atoms and compound terms. Compound terms are ordered by
+// arity, then name, then arguments from left to right.
+func compareTerms(a, b expression) int {
+    ra, rb := termRank(a), termRank(b)
+    if ra != rb {
+        return ra - rb
+    }
+    switch x := a.(type) {
+    case variable:
+        return int(x) - int(b.(variable))
+    case number:
+        y := b.(number)
+        switch {
+        case x < y:
+            return -1
+        case x > y:
+            return 1
+        }
+        return 0
+    case symbol:
+        return strings.Compare(string(x), string(b.(symbol)))
+    }
+    fa, argsA := compoundParts(a)
+    fb, argsB := compoundParts(b)
+    if len(argsA) != len(argsB) {
+        return len(argsA) - len(argsB)
+    }
+    if c := strings.Compare(fa, fb); c != 0 {
+        return c
+    }
+    for i := range argsA {
+        if c := compareTerms(argsA[i], argsB[i]); c != 0 {
+            return c
+        }
+    }
+    return 0
+}
+
+func termRank(e expression) int {
+    switch e.(type) {
+    case variable:
+        return 0
+    case number:
+        return 1
+    case symbol:
+        return 2
+    }
+    return 3
+}
+
+// compoundParts gives the name and arguments of a compound term; a list
+// cell is '.'(Head, Tail)
+func compoundParts(e expression) (string, []expression) {
+    if l, ok := e.(list); ok {
+        return ".", []expression{l.head, l.tail}
+    }
+    p := e.(process)
+    return p.functor, p.args
+}
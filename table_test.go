@@ -0,0 +1,176 @@
+package main
+
+import (
+    "bytes"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+var tableRules = `
+    :- table path/2.
+    path(X, Y) :- path(X, Z), edge(Z, Y).
+    path(X, Y) :- edge(X, Y).
+
+    :- table reach/2.
+    reach(X, Y) :- edge(X, Y).
+    reach(X, Y) :- edge(X, Z), reach(Z, Y).
+
+    edge(a, b).
+    edge(b, c).
+    edge(c, a).
+    edge(c, d).
+
+    :- table even/1, odd/1.
+    even(0).
+    even(N) :- odd(M), M < 6, N is M + 1.
+    odd(N) :- even(M), M < 6, N is M + 1.
+
+    :- table twice/1.
+    twice(X) :- member(X, [a, b, a]).
+    twice(X) :- member(X, [b, c]).
+
+    :- table dist(_,_,min).
+    dist(X, Y, D) :- road(X, Y, D).
+    dist(X, Y, D) :- dist(X, Z, D1), road(Z, Y, D2), D is D1 + D2.
+
+    :- table longest(_,_,max).
+    longest(X, Y, D) :- road(X, Y, D).
+    longest(X, Y, D) :- longest(X, Z, D1), road(Z, Y, D2), D is D1 + D2, D < 10.
+
+    road(a, b, 1).
+    road(b, c, 2).
+    road(a, c, 5).
+    road(c, a, 1).
+
+    :- table hops(_,_,lattice(fewer/3)).
+    hops(X, Y, n(1)) :- road(X, Y, _).
+    hops(X, Y, n(N)) :- hops(X, Z, n(M)), road(Z, Y, _), N is M + 1.
+    fewer(n(A), n(B), n(A)) :- A =< B.
+    fewer(n(A), n(B), n(B)) :- A > B.
+
+    :- table nothing/1.
+
+    :- table quoted/1.
+    quoted('f(a)').
+    quoted(f(a)).
+    quoted('_').
+    quoted(_).
+    quoted_f(Y) :- quoted(X), X = f(Y).
+`
+
+func TestTabling(t *testing.T) {
+    for _, s := range stores {
+        i := NewInterpreter(compileProcedures(MustParseRules(tableRules)))
+        i.setStore(s.store)
+        for _, tt := range []struct{
+            query string
+            vars  []string
+            want  []string
+        }{
+            // left recursion terminates
+            {query: "path(a, Y)", vars: []string{"Y"}, want: []string{"b", "c", "a", "d"}},
+            {query: "path(d, Y)", vars: []string{"Y"}, want: []string{}},
+            // so does right recursion through a cycle, with a table per start
+            {query: "reach(b, Y)", vars: []string{"Y"}, want: []string{"c", "a", "d", "b"}},
+            {query: "reach(X, a)", vars: []string{"X"}, want: []string{"c", "a", "b"}},
+            // mutual recursion is completed as one component
+            {query: "even(X)", vars: []string{"X"}, want: []string{"0", "2", "4", "6"}},
+            {query: "odd(X)", vars: []string{"X"}, want: []string{"1", "3", "5"}},
+            // duplicates are removed
+            {query: "twice(X)", vars: []string{"X"}, want: []string{"a", "b", "c"}},
+            // answer subsumption
+            {query: "dist(a, Y, D)", vars: []string{"Y", "D"}, want: []string{"b 1", "c 3", "a 4"}},
+            {query: "longest(a, c, D)", vars: []string{"D"}, want: []string{"9"}},
+            {query: "hops(a, Y, H)", vars: []string{"Y", "H"}, want: []string{"b n(1)", "c n(1)", "a n(2)"}},
+            // declared but without clauses
+            {query: "nothing(X)", vars: []string{"X"}, want: []string{}},
+            // answers that print alike unquoted are still different
+            {query: "quoted(X)", vars: []string{"X"}, want: []string{"f(a)", "f(a)", "_", "v#1"}},
+            {query: "quoted_f(Y)", vars: []string{"Y"}, want: []string{"a", "v#1"}},
+        }{
+            got, err := answers(i, tt.query, tt.vars...)
+            if err != nil {
+                t.Errorf("%s: %s: %v", s.name, tt.query, err)
+                continue
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("%s: %s: got %v want %v", s.name, tt.query, got, tt.want)
+            }
+        }
+    }
+}
+
+// Errors while filling a table reach the query
+func TestTablingError(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(`
+        :- table p/1.
+        p(X) :- X is foo + 1.`)))
+    if _, err := answers(i, "p(X)", "X"); err == nil {
+        t.Error("expected error")
+    }
+}
+
+func TestTableDirective(t *testing.T) {
+    for _, tt := range []struct{
+        src string
+        err bool
+    }{
+        {src: ":- table p/1, q/2."},
+        {src: ":- table p(_, min), q(_, _, lattice(j/3))."},
+        {src: ":- table p(min, max).", err: true},
+        {src: ":- table p(_, lattice(j/2)).", err: true},
+        {src: ":- table p(_, sum).", err: true},
+        {src: ":- table p/x.", err: true},
+        {src: ":- table X.", err: true},
+    }{
+        _, err := ParseRules(tt.src)
+        if (err != nil) != tt.err {
+            t.Errorf("%s: got %v", tt.src, err)
+        }
+    }
+}
+
+func TestTableListing(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(tableRules)))
+    var sb strings.Builder
+    i.setOutput(&sb)
+    if _, err := answers(i, "listing(dist)"); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := answers(i, "listing(hops)"); err != nil {
+        t.Fatal(err)
+    }
+    for _, want := range []string{":- table dist(_,_,min).\n", ":- table hops(_,_,lattice(fewer/3)).\n"} {
+        if !strings.Contains(sb.String(), want) {
+            t.Errorf("%q not in\n%s", want, sb.String())
+        }
+    }
+}
+
+func TestSaveLoadTables(t *testing.T) {
+    procs := compileProcedures(MustParseRules(tableRules))
+    var buf bytes.Buffer
+    if err := SaveProcedures(&buf, procs); err != nil {
+        t.Fatal(err)
+    }
+    got, err := LoadProcedures(&buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(got, procs) {
+        t.Errorf("got %v want %v", got, procs)
+    }
+}
+
+// Answers from a table have no proof of their own
+func TestExplainTabled(t *testing.T) {
+    i := NewInterpreter(compileProcedures(MustParseRules(tableRules)))
+    ex, err := i.Explain("path(a, d)")
+    if err != nil || len(ex) != 1 {
+        t.Fatalf("got %v, %v", ex, err)
+    }
+    if got, want := ex[0].Proof.String(), "path(a,d)  % table\n"; got != want {
+        t.Errorf("got %q want %q", got, want)
+    }
+}
@@ -0,0 +1,12 @@
+% Naive reverse of a 30 element list, the classic LIPS benchmark.
+% One reversal is 496 logical inferences.
+
+app([], L, L).
+app([X|L1], L2, [X|L3]) :- app(L1, L2, L3).
+
+nrev([], []).
+nrev([X|Rest], Ans) :- nrev(Rest, L), app(L, [X], Ans).
+
+bench(L) :-
+    nrev([1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20,
+          21,22,23,24,25,26,27,28,29,30], L).
@@ -0,0 +1,30 @@
+% N queens by generate and test: try every permutation of the rows.
+
+queens(N, Qs) :-
+    range(1, N, Ns),
+    permutation(Ns, Qs),
+    safe(Qs).
+
+range(N, N, [N]) :- !.
+range(M, N, [M|Ns]) :-
+    M < N,
+    M1 is M + 1,
+    range(M1, N, Ns).
+
+permutation([], []).
+permutation(Xs, [X|Ys]) :-
+    select(X, Xs, Zs),
+    permutation(Zs, Ys).
+
+select(X, [X|Xs], Xs).
+select(X, [Y|Ys], [Y|Zs]) :- select(X, Ys, Zs).
+
+safe([]).
+safe([Q|Qs]) :- noattack(Q, Qs, 1), safe(Qs).
+
+noattack(_, [], _).
+noattack(Q, [Q1|Qs], D) :-
+    Q =\= Q1 + D,
+    Q =\= Q1 - D,
+    D1 is D + 1,
+    noattack(Q, Qs, D1).
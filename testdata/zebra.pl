@@ -0,0 +1,37 @@
+% The zebra puzzle: who owns the zebra, and who drinks water?
+% house(Colour, Nationality, Pet, Drink, Smokes)
+
+houses([
+    house(_, norwegian, _, _, _),
+    _,
+    house(_, _, _, milk, _),
+    _,
+    _
+]).
+
+right_of(A, B, [B, A | _]).
+right_of(A, B, [_ | Y]) :- right_of(A, B, Y).
+
+next_to(A, B, [A, B | _]).
+next_to(A, B, [B, A | _]).
+next_to(A, B, [_ | Y]) :- next_to(A, B, Y).
+
+member(X, [X|_]).
+member(X, [_|Y]) :- member(X, Y).
+
+zebra(Owner, Water) :-
+    houses(Hs),
+    member(house(red, english, _, _, _), Hs),
+    member(house(_, spanish, dog, _, _), Hs),
+    member(house(green, _, _, coffee, _), Hs),
+    member(house(_, ukrainian, _, tea, _), Hs),
+    right_of(house(green, _, _, _, _), house(ivory, _, _, _, _), Hs),
+    member(house(_, _, snails, _, winston), Hs),
+    member(house(yellow, _, _, _, kools), Hs),
+    next_to(house(_, _, _, _, chesterfield), house(_, _, fox, _, _), Hs),
+    next_to(house(_, _, _, _, kools), house(_, _, horse, _, _), Hs),
+    member(house(_, _, _, orange_juice, lucky), Hs),
+    member(house(_, japanese, _, _, parliament), Hs),
+    next_to(house(_, norwegian, _, _, _), house(blue, _, _, _, _), Hs),
+    member(house(_, Owner, zebra, _, _), Hs),
+    member(house(_, Water, _, water, _), Hs).
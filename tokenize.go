@@ -9,9 +9,12 @@ type token string
 
 const (
     OpenParen token = "("
+    OpenGroup = " (" // a paren after layout only groups, it never opens arguments
     CloseParen = ")"
     OpenBracket = "["
     CloseBracket = "]"
+    OpenCurly = "{"
+    CloseCurly = "}"
     Comma = ","
     Period = "."
     Underscore = "_"
@@ -28,63 +31,152 @@ func (t token) IsNumber() bool {
 }
 
 func (t token) IsVariable() bool {
-    return unicode.IsUpper(rune(t[0]))
+    return unicode.IsUpper(rune(t[0])) || t[0] == '_'
 }
 
 func (t token) IsSymbol() bool {
     return unicode.IsLower(rune(t[0]))
 }
 
+func (t token) IsQuoted() bool {
+    return t[0] == '\''
+}
+
+func (t token) IsString() bool {
+    return t[0] == '"'
+}
+
 func (t token) IsOperator() bool {
-    return t == Assign || t == Is
+    _, infix := infixOps[string(t)]
+    _, prefix := prefixOps[string(t)]
+    return infix || prefix
 }
 
+// IsPunctuation is true for tokens that can never start a term
+func (t token) IsPunctuation() bool {
+    switch t {
+    case CloseParen, CloseBracket, CloseCurly, Comma, Commit, Period:
+        return true
+    }
+    return false
+}
+
+const symbolChars = "+-*/\\^<>=~:.?@#&$"
+
 func tokenize(s string) []token {
-    out := []token{}
-    s = strings.TrimSpace(s)
+    tokens, _ := tokenizeLines(s)
+    return tokens
+}
+
+// tokenizeLines also returns the line each token starts on, counting from 1
+func tokenizeLines(input string) ([]token, []int) {
+    out, lines := []token{}, []int{}
+    line, seen := 1, 0
+    // skipLayout trims both ends, so trim the end first to keep what
+    // is left a suffix of input
+    input = strings.TrimRightFunc(input, unicode.IsSpace)
+    // lineAt counts newlines up to s, which is always a suffix of input
+    lineAt := func(s string) int {
+        at := len(input) - len(s)
+        line += strings.Count(input[seen:at], "\n")
+        seen = at
+        return line
+    }
+    s := skipLayout(input)
     for len(s) > 0 {
-        var punct token
-        switch s[:1] {
-        case "(": punct = OpenParen
-        case ")": punct = CloseParen
-        case "[": punct = OpenBracket
-        case "]": punct = CloseBracket
-        case "|": punct = Commit
-        case ",": punct = Comma
-        case ".": punct = Period
-        case "_": punct = Underscore
+        n := tokenLength(s)
+        t := token(s[:n])
+        out = append(out, t)
+        lines = append(lines, lineAt(s))
+        rest := skipLayout(s[n:])
+        if len(rest) > 0 && rest[0] == '(' && len(rest) < len(s[n:]) {
+            out = append(out, OpenGroup)
+            lines = append(lines, lineAt(rest))
+            rest = skipLayout(rest[1:])
         }
-        if len(punct) > 0 {
-            out = append(out, punct)
-            s = s[1:]
-            s = strings.TrimSpace(s)
-            continue
-        }
-        if len(s) > 2 {
-            if len(punct) > 0 && strings.IndexAny(s, "\t\n (") == 3 {
-                out = append(out, punct)
-                s = s[3:]
-                s = strings.TrimSpace(s)
-                continue
+        s = rest
+    }
+    return out, lines
+}
+
+// skipLayout drops whitespace and comments
+func skipLayout(s string) string {
+    for {
+        s = strings.TrimSpace(s)
+        switch {
+        case strings.HasPrefix(s, "%"):
+            i := strings.IndexByte(s, '\n')
+            if i < 0 {
+                return ""
             }
+            s = s[i:]
+        case strings.HasPrefix(s, "/*"):
+            i := strings.Index(s[2:], "*/")
+            if i < 0 {
+                return ""
+            }
+            s = s[i+4:]
+        default:
+            return s
         }
-        if len(s) > 1 {
-            switch s[:2] {
-            case ":-": punct = Turnstile
-            case ":=": punct = Assign
-            case "is": punct = Is
+    }
+}
+
+func tokenLength(s string) int {
+    c := s[0]
+    switch {
+    case strings.IndexByte("()[]{},|!;", c) >= 0:
+        return 1
+    case c == '\'' || c == '"':
+        return quotedLength(s)
+    case c >= '0' && c <= '9':
+        if strings.HasPrefix(s, "0'") && len(s) > 2 {
+            // character code
+            if s[2] == '\\' && len(s) > 3 {
+                return 4
             }
-            if len(punct) > 0 && strings.IndexAny(s, "\t\n (") == 2 {
-                out = append(out, punct)
-                s = s[2:]
-                s = strings.TrimSpace(s)
+            return 3
+        }
+        return runLength(s, func(r rune) bool { return unicode.IsDigit(r) })
+    case c == '_' || unicode.IsLetter(rune(c)):
+        return runLength(s, isAlphaNum)
+    case strings.IndexByte(symbolChars, c) >= 0:
+        return runLength(s, isSymbolChar)
+    }
+    return 1
+}
+
+func isAlphaNum(r rune) bool {
+    return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isSymbolChar(r rune) bool {
+    return strings.ContainsRune(symbolChars, r)
+}
+
+func runLength(s string, f func(rune) bool) int {
+    for i, r := range s {
+        if !f(r) {
+            return i
+        }
+    }
+    return len(s)
+}
+
+// quotedLength includes both quotes; a doubled quote or a backslash escapes
+func quotedLength(s string) int {
+    q := s[0]
+    for i := 1; i < len(s); i++ {
+        switch s[i] {
+        case '\\':
+            i++
+        case q:
+            if i+1 < len(s) && s[i+1] == q {
+                i++
                 continue
             }
+            return i + 1
         }
-        i := strings.IndexAny(s, "\t\n (),|].")
-        out = append(out, token(s[:i]))
-        s = s[i:]
-        s = strings.TrimSpace(s)
     }
-    return out
+    return len(s)
 }
@@ -0,0 +1,91 @@
+package main
+
+// trail is a binding store in the style of the WAM: variables are cells
+// on a mutable heap and binding one overwrites its cell in place. Bindings
+// of variables older than the newest choicepoint are recorded on the trail,
+// so backtracking can reset them. Everything younger is simply cut off.
+//
+// An attributed variable has its attributes in its cell. Binding it or
+// changing them overwrites the cell, so the old contents are trailed too.
+type trail struct {
+    cells    []expression // nil means unbound
+    entries  []variable   // -v-1 for a cell that had attributes
+    olds     []expression // the attributes of those, in order
+    boundary int          // vc at the newest choicepoint
+    bound    int
+    woken    expression // kept at wakeVar
+}
+
+func NewTrail() *trail {
+    return &trail{}
+}
+
+func (t *trail) get(v variable) (expression, bool) {
+    if v < 0 {
+        return t.woken, t.woken != nil
+    }
+    if int(v) >= len(t.cells) {
+        return nil, false
+    }
+    e := t.cells[v]
+    return e, e != nil
+}
+
+func (t *trail) put(v variable, e expression) bindings {
+    if v < 0 {
+        t.woken = e
+        return t
+    }
+    if n := int(v) + 1; n > len(t.cells) {
+        t.cells = append(t.cells, make([]expression, n-len(t.cells))...)
+    }
+    old := t.cells[v]
+    t.cells[v] = e
+    // conditional trailing: young variables are reclaimed on backtracking anyway
+    young := int(v) >= t.boundary
+    switch {
+    case old == nil:
+        t.bound++
+        if !young {
+            t.entries = append(t.entries, v)
+        }
+    case !young:
+        t.entries = append(t.entries, -v-1)
+        t.olds = append(t.olds, old)
+    }
+    return t
+}
+
+func (t *trail) mark(vc int) int {
+    t.boundary = vc
+    return len(t.entries)
+}
+
+func (t *trail) undo(mark, vc int) bindings {
+    for i := len(t.entries) - 1; i >= mark; i-- {
+        v := t.entries[i]
+        if v < 0 {
+            t.cells[-v-1] = t.olds[len(t.olds)-1]
+            t.olds = t.olds[:len(t.olds)-1]
+            continue
+        }
+        t.cells[v] = nil
+        t.bound--
+    }
+    t.entries = t.entries[:mark]
+    t.woken = nil
+    if vc < len(t.cells) {
+        for _, e := range t.cells[vc:] {
+            if e != nil {
+                t.bound--
+            }
+        }
+        clear(t.cells[vc:])
+        t.cells = t.cells[:vc]
+    }
+    return t
+}
+
+func (t *trail) len() int {
+    return t.bound
+}
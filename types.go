@@ -28,6 +28,20 @@ func (s symbol) PrintExpression() string {
     return string(s)
 }
 
+// quoted is how the atom has to be written to be read back as itself
+func (s symbol) quoted() string {
+    switch {
+    case s == "[]" || s == "{}" || s == "!" || s == ";":
+        return string(s)
+    case len(s) > 0 && token(s).IsSymbol() && runLength(string(s), isAlphaNum) == len(s):
+        return string(s)
+    case len(s) > 0 && runLength(string(s), isSymbolChar) == len(s):
+        return string(s)
+    }
+    r := strings.NewReplacer("\\", "\\\\", "'", "\\'", "\n", "\\n", "\t", "\\t")
+    return "'" + r.Replace(string(s)) + "'"
+}
+
 const (
     emptylist   symbol = "nil"
     underscore  symbol = "_"
@@ -41,10 +55,20 @@ type list struct {
 }
 
 func (l list) PrintExpression() string {
-    if l.tail == emptylist {
-        return fmt.Sprintf("[%s]", l.head.PrintExpression())
+    elems := []string{}
+    var e expression = l
+    for {
+        t, ok := e.(list)
+        if !ok {
+            break
+        }
+        elems = append(elems, t.head.PrintExpression())
+        e = t.tail
+    }
+    if e == emptylist {
+        return fmt.Sprintf("[%s]", strings.Join(elems, ","))
     }
-    return fmt.Sprintf("[%s|%s]", l.head.PrintExpression(), l.tail.PrintExpression())
+    return fmt.Sprintf("[%s|%s]", strings.Join(elems, ","), e.PrintExpression())
 }
 
 type process struct {
@@ -57,12 +81,18 @@ func (p process) arity() int {
 }
 
 func (p process) isPredefined() bool {
-    // only predefined functors for now
-    return p.functor == ":=" || p.functor == "isplus" || p.functor == "is"
+    _, ok := builtins[proc(p.functor, p.arity())]
+    return ok
 }
 
 func (p process) isInfix() bool {
-    return p.functor == ":=" || p.functor == "is"
+    _, ok := infixOps[p.functor]
+    return ok && p.arity() == 2
+}
+
+func (p process) isPrefix() bool {
+    _, ok := prefixOps[p.functor]
+    return ok && p.arity() == 1
 }
 
 func (p process) String() string {
@@ -70,28 +100,111 @@ func (p process) String() string {
 }
 
 func (p process) PrintExpression() string {
+    if len(p.args) == 0 {
+        return p.functor
+    }
+    if p.isInfix() {
+        op := infixOps[p.functor]
+        leftMax, rightMax := op.prec-1, op.prec-1
+        switch op.typ {
+        case "yfx":
+            leftMax = op.prec
+        case "xfy":
+            rightMax = op.prec
+        }
+        left, right := printOperand(p.args[0], leftMax), printOperand(p.args[1], rightMax)
+        switch {
+        case p.functor == Comma:
+            return fmt.Sprintf("%s,%s", left, right)
+        case token(p.functor).IsSymbol() || op.prec >= 700 || strings.HasPrefix(right, "-"):
+            return fmt.Sprintf("%s %s %s", left, p.functor, right)
+        }
+        return fmt.Sprintf("%s%s%s", left, p.functor, right)
+    }
+    if p.isPrefix() {
+        op := prefixOps[p.functor]
+        argMax := op.prec-1
+        if op.typ == "fy" {
+            argMax = op.prec
+        }
+        arg := printOperand(p.args[0], argMax)
+        if _, ok := p.args[0].(number); ok || token(p.functor).IsSymbol() || strings.HasPrefix(arg, "(") {
+            return fmt.Sprintf("%s %s", p.functor, arg)
+        }
+        return p.functor + arg
+    }
     args := []string{}
     for _, arg := range p.args {
-        args = append(args, arg.PrintExpression())
-    }
-    if p.isInfix() && len(args) == 2 {
-        return fmt.Sprintf("%s %s %s", args[0], p.functor, args[1])
+        args = append(args, printOperand(arg, 999))
     }
     return fmt.Sprintf("%s(%s)", p.functor, strings.Join(args, ","))
 }
 
+// printOperand puts parens around operator terms that bind looser than max
+func printOperand(e expression, max int) string {
+    s := e.PrintExpression()
+    p, ok := e.(process)
+    if !ok {
+        return s
+    }
+    prec := 0
+    if p.isInfix() {
+        prec = infixOps[p.functor].prec
+    } else if p.isPrefix() {
+        prec = prefixOps[p.functor].prec
+    }
+    if prec > max {
+        return "(" + s + ")"
+    }
+    return s
+}
+
 type rule struct {
-    head process
-    body []process
+    head  process
+    guard []process // goals before the commit in head :- guard | body, nil if none
+    body  []process
+    pos   position
+}
+
+// position is where a clause was read from. The file is empty for
+// clauses not read from a file, the line 0 for those not read at all.
+type position struct {
+    file string
+    line int
+}
+
+// directive returns the goal of a directive, :- G
+func (r rule) directive() (expression, bool) {
+    if r.head.functor != string(Turnstile) || r.head.arity() != 1 || r.body != nil {
+        return nil, false
+    }
+    return r.head.args[0], true
+}
+
+func (p position) String() string {
+    if p.file == "" {
+        return fmt.Sprintf("line %d", p.line)
+    }
+    return fmt.Sprintf("%s:%d", p.file, p.line)
 }
 
 func (r rule) String() string {
+    if r.guard != nil {
+        return fmt.Sprintf("%s :- %s | %s.", r.head, printGoals(r.guard), printGoals(r.body))
+    }
     if len(r.body) == 0 {
         return fmt.Sprintf("%s.", r.head)
     }
-    body := []string{}
-    for _, p := range r.body {
-        body = append(body, p.String())
+    return fmt.Sprintf("%s :- %s.", r.head, printGoals(r.body))
+}
+
+func printGoals(goals []process) string {
+    if len(goals) == 0 {
+        return "true"
+    }
+    s := []string{}
+    for _, p := range goals {
+        s = append(s, printOperand(p, 999))
     }
-    return fmt.Sprintf("%s :- %s.", r.head, strings.Join(body, ","))
+    return strings.Join(s, ",")
 }
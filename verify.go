@@ -0,0 +1,191 @@
+package main
+
+import (
+    "fmt"
+)
+
+// verifyClause checks that code for a clause of a procedure with the given
+// arity can be executed without the interpreter panicking: operands are in
+// range and refer to the right kind of xr entry, every FUNCTOR gets exactly
+// as many args as its arity before its POP, the head has arity args, there
+// is at most one ENTER and it comes before any CALL, every CALL gets as many
+// args as its procedure takes, there is at most one COMMIT, between goals
+// of the body, and the code ends in EXIT. TRY, JUMP, MARK and CUT come
+// between goals of the body too, and TRY and JUMP go forward to the start
+// of a goal or to EXIT, without going past COMMIT.
+// compileClause always produces code that verifies; anything else should be
+// verified before it is installed.
+func verifyClause(c clause, arity int) error {
+    if c.numVars < 0 {
+        return fmt.Errorf("negative number of vars %d", c.numVars)
+    }
+    // args still expected by each open functor
+    open := []int{}
+    args := 0 // head args, or after ENTER the args queued for the next CALL
+    entered, committed := false, false
+    commit := -1
+    // where goals start, and the jumps as from, to
+    goals := map[int]bool{}
+    jumps := [][2]int{}
+    // addArg counts an argument in whatever we are building at the moment
+    addArg := func(pc int) error {
+        if len(open) == 0 {
+            args++
+            return nil
+        }
+        if open[len(open)-1] == 0 {
+            return fmt.Errorf("too many args for functor at %d", pc)
+        }
+        open[len(open)-1]--
+        return nil
+    }
+    for pc := 0; pc < len(c.bytecodes); pc++ {
+        ins := c.bytecodes[pc]
+        var x entry
+        if ins.hasOperand() {
+            if pc+1 >= len(c.bytecodes) {
+                return fmt.Errorf("%s without operand at %d", ins, pc)
+            }
+            operand := c.bytecodes[pc+1]
+            switch {
+            case ins == VAR || ins == MARK || ins == CUT:
+                if operand < 0 || int(operand) >= c.numVars {
+                    return fmt.Errorf("var %d out of range at %d", operand, pc)
+                }
+            case ins.isJump():
+                if operand < 0 {
+                    return fmt.Errorf("%s backwards at %d", ins, pc)
+                }
+                jumps = append(jumps, [2]int{pc, pc + 2 + int(operand)})
+            default:
+                if operand < 0 || int(operand) >= len(c.xrTable) {
+                    return fmt.Errorf("%s xr index %d out of range at %d", ins, operand, pc)
+                }
+                x = c.xrTable[operand]
+            }
+        }
+        if entered && len(open) == 0 && args == 0 {
+            goals[pc] = true
+        }
+        switch ins {
+        case CONST:
+            switch x.(type) {
+            case integer, atom:
+            default:
+                return fmt.Errorf("const on %s at %d", printEntry(x), pc)
+            }
+            if err := addArg(pc); err != nil {
+                return err
+            }
+        case VAR:
+            if err := addArg(pc); err != nil {
+                return err
+            }
+        case FUNCTOR:
+            f, ok := x.(functorEntry)
+            if !ok || f.arity < 1 {
+                return fmt.Errorf("functor on %s at %d", printEntry(x), pc)
+            }
+            if err := addArg(pc); err != nil {
+                return err
+            }
+            open = append(open, f.arity)
+        case POP:
+            if len(open) == 0 {
+                return fmt.Errorf("pop without functor at %d", pc)
+            }
+            if n := open[len(open)-1]; n > 0 {
+                return fmt.Errorf("pop with %d args missing at %d", n, pc)
+            }
+            open = open[:len(open)-1]
+        case ENTER:
+            if entered {
+                return fmt.Errorf("second enter at %d", pc)
+            }
+            if len(open) > 0 {
+                return fmt.Errorf("enter inside functor at %d", pc)
+            }
+            if args != arity {
+                return fmt.Errorf("head with %d args for arity %d", args, arity)
+            }
+            entered = true
+            args = 0
+        case CALL:
+            p, ok := x.(procEntry)
+            if !ok {
+                return fmt.Errorf("call on %s at %d", printEntry(x), pc)
+            }
+            if !entered {
+                return fmt.Errorf("call before enter at %d", pc)
+            }
+            if len(open) > 0 {
+                return fmt.Errorf("call inside functor at %d", pc)
+            }
+            if args != p.arity {
+                return fmt.Errorf("call of %s with %d args at %d", p.printEntry(), args, pc)
+            }
+            args = 0
+        case COMMIT:
+            if !entered || committed {
+                return fmt.Errorf("commit outside a body or twice at %d", pc)
+            }
+            if len(open) > 0 || args > 0 {
+                return fmt.Errorf("commit inside a goal at %d", pc)
+            }
+            committed = true
+            commit = pc
+        case TRY, JUMP, MARK, CUT:
+            if !entered || len(open) > 0 || args > 0 {
+                return fmt.Errorf("%s outside a body or inside a goal at %d", ins, pc)
+            }
+        case EXIT:
+            if pc != len(c.bytecodes)-1 {
+                return fmt.Errorf("exit before end of code at %d", pc)
+            }
+            if len(open) > 0 {
+                return fmt.Errorf("exit inside functor at %d", pc)
+            }
+            if !entered && args != arity {
+                return fmt.Errorf("head with %d args for arity %d", args, arity)
+            }
+            if entered && args > 0 {
+                return fmt.Errorf("%d args left without a call at %d", args, pc)
+            }
+            for _, j := range jumps {
+                if !goals[j[1]] {
+                    return fmt.Errorf("jump at %d to %d, which does not start a goal", j[0], j[1])
+                }
+                if j[0] < commit && commit < j[1] {
+                    return fmt.Errorf("jump at %d past commit", j[0])
+                }
+            }
+            return nil
+        default:
+            return fmt.Errorf("unknown instruction %d at %d", ins, pc)
+        }
+        if ins.hasOperand() {
+            pc++
+        }
+    }
+    return fmt.Errorf("code does not end in exit")
+}
+
+func verifyProcedure(p procedure) error {
+    if p.arity < 0 {
+        return fmt.Errorf("%s/%d: negative arity", p.name, p.arity)
+    }
+    for n, c := range p.clauses {
+        if err := verifyClause(c, p.arity); err != nil {
+            return fmt.Errorf("%s/%d clause %d: %w", p.name, p.arity, n, err)
+        }
+    }
+    return nil
+}
+
+// printEntry also works for missing entries
+func printEntry(e entry) string {
+    if e == nil {
+        return "nothing"
+    }
+    return e.printEntry()
+}
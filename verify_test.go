@@ -0,0 +1,158 @@
+package main
+
+import (
+    "strings"
+    "testing"
+    "testing/quick"
+)
+
+func TestVerifyClause(t *testing.T) {
+    cons := functor("cons", 2)
+    for i, tt := range []struct{
+        clause clause
+        arity  int
+        err    string
+    }{
+        {
+            clause: compileClause(MustParseRules(appendRules)[1]),
+            arity:  3,
+        },
+        {
+            clause: clause{bytecodes: []instruction{CONST}},
+            err:    "const without operand",
+        },
+        {
+            clause: clause{xrTable: xrTable{constant("a")}, bytecodes: []instruction{CONST, 1, EXIT}},
+            arity:  1,
+            err:    "const xr index 1 out of range",
+        },
+        {
+            clause: clause{xrTable: xrTable{cons}, bytecodes: []instruction{CONST, 0, EXIT}},
+            arity:  1,
+            err:    "const on cons/2",
+        },
+        {
+            clause: clause{xrTable: xrTable{constant("a")}, bytecodes: []instruction{FUNCTOR, 0, POP, EXIT}},
+            arity:  1,
+            err:    "functor on a",
+        },
+        {
+            clause: clause{numVars: 1, bytecodes: []instruction{VAR, 1, EXIT}},
+            arity:  1,
+            err:    "var 1 out of range",
+        },
+        {
+            clause: clause{numVars: 1, xrTable: xrTable{cons}, bytecodes: []instruction{FUNCTOR, 0, VAR, 0, POP, EXIT}},
+            arity:  1,
+            err:    "pop with 1 args missing",
+        },
+        {
+            clause: clause{numVars: 1, xrTable: xrTable{cons}, bytecodes: []instruction{FUNCTOR, 0, VAR, 0, VAR, 0, VAR, 0, POP, EXIT}},
+            arity:  1,
+            err:    "too many args for functor",
+        },
+        {
+            clause: clause{numVars: 1, xrTable: xrTable{cons}, bytecodes: []instruction{FUNCTOR, 0, VAR, 0, VAR, 0, EXIT}},
+            arity:  1,
+            err:    "exit inside functor",
+        },
+        {
+            clause: clause{bytecodes: []instruction{POP, EXIT}},
+            err:    "pop without functor",
+        },
+        {
+            clause: clause{bytecodes: []instruction{ENTER, ENTER, EXIT}},
+            err:    "second enter",
+        },
+        {
+            clause: clause{xrTable: xrTable{proc("p", 0)}, bytecodes: []instruction{CALL, 0, EXIT}},
+            err:    "call before enter",
+        },
+        {
+            clause: clause{numVars: 1, xrTable: xrTable{proc("p", 0)}, bytecodes: []instruction{ENTER, VAR, 0, CALL, 0, EXIT}},
+            err:    "call of p/0 with 1 args",
+        },
+        {
+            clause: clause{xrTable: xrTable{cons}, bytecodes: []instruction{ENTER, CALL, 0, EXIT}},
+            err:    "call on cons/2",
+        },
+        {
+            clause: clause{bytecodes: []instruction{EXIT, EXIT}},
+            err:    "exit before end of code",
+        },
+        {
+            clause: clause{numVars: 1, bytecodes: []instruction{ENTER, VAR, 0}},
+            err:    "does not end in exit",
+        },
+        {
+            clause: clause{numVars: 1, bytecodes: []instruction{VAR, 0, EXIT}},
+            arity:  2,
+            err:    "head with 1 args for arity 2",
+        },
+        {
+            clause: clause{bytecodes: []instruction{12, EXIT}},
+            err:    "unknown instruction 12",
+        },
+        {
+            clause: compileClause(MustParseRules("max(X, Y, Z) :- X >= Y | Z = X.")[0]),
+            arity:  3,
+        },
+        {
+            clause: clause{bytecodes: []instruction{COMMIT, EXIT}},
+            err:    "commit outside a body",
+        },
+        {
+            clause: clause{bytecodes: []instruction{ENTER, COMMIT, COMMIT, EXIT}},
+            err:    "or twice",
+        },
+        {
+            clause: clause{xrTable: xrTable{constant("a"), proc("p", 1)}, bytecodes: []instruction{ENTER, CONST, 0, COMMIT, CALL, 1, EXIT}},
+            err:    "commit inside a goal",
+        },
+        {
+            clause: compileClause(MustParseRules("p(X) :- (X = 1 -> true ; \\+ X = 2), !.")[0]),
+            arity:  1,
+        },
+        {
+            clause: clause{bytecodes: []instruction{TRY, 0, ENTER, EXIT}},
+            err:    "try outside a body",
+        },
+        {
+            clause: clause{bytecodes: []instruction{ENTER, JUMP, -2, EXIT}},
+            err:    "jump backwards",
+        },
+        {
+            clause: clause{xrTable: xrTable{constant("a"), proc("p", 1)}, bytecodes: []instruction{ENTER, TRY, 1, CONST, 0, CALL, 1, EXIT}},
+            err:    "does not start a goal",
+        },
+        {
+            clause: clause{bytecodes: []instruction{ENTER, TRY, 1, COMMIT, EXIT}},
+            err:    "past commit",
+        },
+        {
+            clause: clause{bytecodes: []instruction{ENTER, CUT, 0, EXIT}},
+            err:    "var 0 out of range",
+        },
+    }{
+        err := verifyClause(tt.clause, tt.arity)
+        switch {
+        case tt.err == "" && err != nil:
+            t.Errorf("%d: unexpected error %v", i, err)
+        case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+            t.Errorf("%d: got %v want %s", i, err, tt.err)
+        }
+    }
+}
+
+func TestCompiledCodeVerifies(t *testing.T) {
+    f := func(rr randomRule) bool {
+        err := verifyClause(compileClause(rr.rule), rr.rule.head.arity())
+        if err != nil {
+            t.Logf("%s: %v", rr.rule, err)
+        }
+        return err == nil
+    }
+    if err := quick.Check(f, &quick.Config{MaxCount: 1000}); err != nil {
+        t.Error(err)
+    }
+}
@@ -2,6 +2,8 @@ package main
 
 import (
     "fmt"
+    "strings"
+    "sync/atomic"
 )
 
 // partial overlap with parsing types, but let's keep them separate
@@ -9,17 +11,32 @@ import (
 type procedure struct {
     name    string
     arity   int
+    module  string // empty for user
     clauses []clause
+    table   *tableSpec    // set for tabled procedures
+    meta    []string      // the meta_predicate specs of the args, if declared
+    from    string        // for an import, the module it is imported from
+    claimed *atomic.Int64 // set by assertz: how much of the array under clauses is taken
+}
+
+// entry is the key of the procedure in a program
+func (p procedure) entry() procEntry {
+    return moduleProc(p.module, p.name, p.arity)
 }
 
 func (p procedure) String() string {
-    return fmt.Sprintf("procedure(%s/%d, %v)", p.name, p.arity, p.clauses)
+    clauses := []string{}
+    for _, c := range p.clauses {
+        clauses = append(clauses, c.String())
+    }
+    return fmt.Sprintf("procedure(%s/%d, [%s])", p.name, p.arity, strings.Join(clauses, ", "))
 }
 
 type clause struct {
     xrTable xrTable
     numVars int
     bytecodes []instruction
+    pos     position
 }
 
 type instruction int64
@@ -32,6 +49,11 @@ const (
     ENTER
     CALL
     EXIT
+    COMMIT // the guard succeeded: discard the other clauses
+    TRY    // leave a choicepoint that goes on Operand instructions further
+    JUMP   // go on Operand instructions further
+    MARK   // bind var Operand to the height of the choices, as a cut barrier
+    CUT    // cut the choices back to the barrier in var Operand
 )
 
 type xrTable []entry
@@ -76,34 +98,129 @@ func functor(name string, arity int) functorEntry {
     return functorEntry{name, arity}
 }
 
-// a procedure call
+// lists are compiled as compound terms with this functor
+var listFunctor = functor(".", 2)
+
+// a procedure call. Procedures not in a module are in user, which has
+// the empty name, and so is every builtin.
 type procEntry struct {
     functorEntry
+    module  string
 }
 
 func proc(name string, arity int) procEntry {
-    return procEntry{functorEntry{name, arity}}
+    return procEntry{functorEntry{name, arity}, ""}
 }
 
-type procKey struct {
-    name    string
-    arity   int
+func moduleProc(module, name string, arity int) procEntry {
+    return procEntry{functorEntry{name, arity}, module}
+}
+
+func (p procEntry) printEntry() string {
+    if p.module == "" {
+        return p.functorEntry.printEntry()
+    }
+    return fmt.Sprintf("%s:%s/%d", p.module, p.name, p.arity)
+}
+
+// unqualified is the procedure of the same name in user
+func (p procEntry) unqualified() procEntry {
+    return proc(p.name, p.arity)
 }
 
 func compileProcedures(rules []rule) []procedure {
-    m := map[procKey][]rule{}
+    return compileModule("", rules)
+}
+
+// compileModule compiles the clauses of a file in module. Heads without
+// a module of their own and the table and meta_predicate directives are
+// for procedures of module.
+func compileModule(module string, rules []rule) []procedure {
+    m := map[procEntry][]rule{}
+    tabled := map[procEntry]*tableSpec{}
+    meta := map[procEntry][]string{}
+    order := []procEntry{}
     for _, r := range rules {
-        k := procKey{r.head.functor, r.head.arity()}
+        if d, ok := r.directive(); ok {
+            t, _ := d.(process)
+            switch {
+            case t.functor == "table" && t.arity() == 1:
+                // ParseRules checked the specs
+                specs, _ := tableSpecs(t.args[0])
+                for pe, spec := range specs {
+                    tabled[moduleProc(module, pe.name, pe.arity)] = spec
+                }
+                continue
+            case t.functor == "meta_predicate" && t.arity() == 1:
+                specs, _ := metaSpecs(t.args[0])
+                for pe, spec := range specs {
+                    meta[moduleProc(module, pe.name, pe.arity)] = spec
+                }
+                continue
+            case moduleDirective(t):
+                continue
+            }
+        }
+        k, head := qualifiedHead(module, r.head)
+        r.head = head
+        if _, ok := m[k]; !ok {
+            order = append(order, k)
+        }
         m[k] = append(m[k], r)
     }
     procedures := []procedure{}
-    for _, rules := range m {
-        p := compileProcedure(rules)
+    for _, k := range order {
+        p := compileProcedure(m[k])
+        p.module = k.module
+        p.table = tabled[k]
+        p.meta = meta[k]
         procedures = append(procedures, p)
     }
+    // tabled procedures without clauses fail rather than not exist
+    for k, spec := range tabled {
+        if _, ok := m[k]; !ok {
+            procedures = append(procedures, procedure{name: k.name, arity: k.arity, module: k.module, table: spec, meta: meta[k]})
+            m[k] = nil
+        }
+    }
+    for k, spec := range meta {
+        if _, ok := m[k]; !ok {
+            procedures = append(procedures, procedure{name: k.name, arity: k.arity, module: k.module, meta: spec})
+        }
+    }
     return procedures
 }
 
+// qualifiedHead gets the procedure a clause head M:H defines, and H.
+// A head without a module is for a procedure of module.
+func qualifiedHead(module string, head process) (procEntry, process) {
+    for head.functor == ":" && head.arity() == 2 {
+        m, ok := head.args[0].(symbol)
+        h, err := toProcess(head.args[1])
+        if !ok || err != nil || isVariable(head.args[1]) {
+            break
+        }
+        module, head = moduleName(m), h
+    }
+    return moduleProc(module, head.functor, head.arity()), head
+}
+
+// moduleName is the name of a module atom: user is the empty name
+func moduleName(m symbol) string {
+    if m == "user" {
+        return ""
+    }
+    return string(m)
+}
+
+// moduleAtom is the atom for a module name
+func moduleAtom(module string) symbol {
+    if module == "" {
+        return "user"
+    }
+    return symbol(module)
+}
+
 func compileProcedure(rules []rule) procedure {
     clauses := []clause{}
     for _, r := range rules {
@@ -114,30 +231,218 @@ func compileProcedure(rules []rule) procedure {
 }
 
 func compileClause(r rule) clause {
-    xrMap := map[entry]int{}
-    byteCodes := compileArgs(xrMap, r.head.args)
-    if len(r.body) > 0 {
-        byteCodes = append(byteCodes, ENTER)
-    }
-    for _, b := range r.body {
-        byteCodes = append(byteCodes, compileArgs(xrMap, b.args)...)
-        p := proc(b.functor, b.arity())
-        i := len(xrMap)
-        if v, ok := xrMap[p]; ok {
-            i = v
-        } else {
-            xrMap[p] = i
+    next := nextVariable(r.head)
+    for _, g := range append(append([]process{}, r.guard...), r.body...) {
+        next = max(next, nextVariable(g))
+    }
+    c := clauseCompiler{xrMap: map[entry]int{}, barrier: int(next)}
+    c.code = compileArgs(c.xrMap, r.head.args)
+    if len(r.body) > 0 || r.guard != nil {
+        c.code = append(c.code, ENTER)
+    }
+    if r.guard != nil {
+        for _, g := range r.guard {
+            c.goal(goalTerm(g))
         }
-        byteCodes = append(byteCodes, CALL, instruction(i))
+        c.code = append(c.code, COMMIT)
     }
-    byteCodes = append(byteCodes, EXIT)
-    xr := make(xrTable, len(xrMap))
-    for k, v := range xrMap {
+    for _, g := range r.body {
+        c.goal(goalTerm(g))
+    }
+    c.code = append(c.code, EXIT)
+    xr := make(xrTable, len(c.xrMap))
+    for k, v := range c.xrMap {
         xr[v] = k
     }
     // already done in parsing, so just find highest VAR
-    numVars := highestVar(byteCodes)
-    return clause{xr, numVars, byteCodes}
+    numVars := highestVar(c.code)
+    return clause{xr, numVars, c.code, r.pos}
+}
+
+// a clauseCompiler compiles the goals of a body. Conjunctions, A;B, C->T
+// and \+G are compiled inline, so a cut in their goals cuts the clause.
+// The condition of C->T and the goal of \+G get a cut barrier: a var
+// after those of the clause, bound to the height of the choices before
+// them, which is cut back to once they succeed.
+type clauseCompiler struct {
+    xrMap   map[entry]int
+    code    []instruction
+    barrier int // the var for the next cut barrier
+}
+
+func (c *clauseCompiler) goal(g expression) {
+    p, ok := g.(process)
+    if !ok {
+        if s, isAtom := g.(symbol); isAtom {
+            c.call(process{functor: string(s)})
+            return
+        }
+        c.call(process{functor: "call", args: []expression{g}})
+        return
+    }
+    if inner, ok := qualifiedControl(p); ok {
+        c.goal(inner)
+        return
+    }
+    switch {
+    case p.functor == Comma && p.arity() == 2:
+        c.goal(p.args[0])
+        c.goal(p.args[1])
+    case p.functor == ";" && p.arity() == 2:
+        if cond, then, ok := ifThen(p.args[0]); ok {
+            c.ifThenElse(cond, then, p.args[1])
+            return
+        }
+        try := c.jump(TRY)
+        c.goal(p.args[0])
+        end := c.jump(JUMP)
+        c.land(try)
+        c.goal(p.args[1])
+        c.land(end)
+    case p.functor == "->" && p.arity() == 2:
+        c.ifThenElse(p.args[0], p.args[1], symbol("fail"))
+    case p.functor == "\\+" && p.arity() == 1:
+        v := c.mark()
+        try := c.jump(TRY)
+        c.condition(p.args[0])
+        c.code = append(c.code, CUT, v)
+        c.call(process{functor: "fail"})
+        c.land(try)
+    default:
+        c.call(p)
+    }
+}
+
+// ifThenElse compiles C->T;E, and C->T as C->T;fail
+func (c *clauseCompiler) ifThenElse(cond, then, els expression) {
+    v := c.mark()
+    try := c.jump(TRY)
+    c.condition(cond)
+    c.code = append(c.code, CUT, v)
+    c.goal(then)
+    end := c.jump(JUMP)
+    c.land(try)
+    c.goal(els)
+    c.land(end)
+}
+
+// condition compiles a goal that is called as if by call/1, so that a
+// cut in it only cuts it
+func (c *clauseCompiler) condition(g expression) {
+    if hasControlCut(g) {
+        g = process{functor: "call", args: []expression{g}}
+    }
+    c.goal(g)
+}
+
+func (c *clauseCompiler) call(g process) {
+    p, g := qualifiedGoal(g)
+    c.code = append(c.code, compileArgs(c.xrMap, g.args)...)
+    i := len(c.xrMap)
+    if v, ok := c.xrMap[p]; ok {
+        i = v
+    } else {
+        c.xrMap[p] = i
+    }
+    c.code = append(c.code, CALL, instruction(i))
+}
+
+// mark adds a MARK of a new cut barrier and returns its var
+func (c *clauseCompiler) mark() instruction {
+    v := instruction(c.barrier)
+    c.barrier++
+    c.code = append(c.code, MARK, v)
+    return v
+}
+
+// jump adds ins with an operand to be set by land, and returns where it is
+func (c *clauseCompiler) jump(ins instruction) int {
+    c.code = append(c.code, ins, 0)
+    return len(c.code) - 1
+}
+
+// land makes the jump at operand go on from here
+func (c *clauseCompiler) land(operand int) {
+    c.code[operand] = instruction(len(c.code) - operand - 1)
+}
+
+// qualifiedControl is M:G for a control construct G as the construct
+// with M:A for each of its goals A
+func qualifiedControl(p process) (expression, bool) {
+    if p.functor != ":" || p.arity() != 2 {
+        return nil, false
+    }
+    g, ok := p.args[1].(process)
+    if !ok || !isControl(g) {
+        return nil, false
+    }
+    args := make([]expression, len(g.args))
+    for i, arg := range g.args {
+        args[i] = process{functor: ":", args: []expression{p.args[0], arg}}
+    }
+    return process{functor: g.functor, args: args}, true
+}
+
+func isControl(p process) bool {
+    switch {
+    case p.arity() == 2:
+        return p.functor == Comma || p.functor == ";" || p.functor == "->"
+    case p.arity() == 1:
+        return p.functor == "\\+"
+    }
+    return false
+}
+
+// hasControlCut tells if a cut in g would cut the clause g is inline in
+func hasControlCut(g expression) bool {
+    switch t := g.(type) {
+    case symbol:
+        return t == "!"
+    case process:
+        if t.functor == ":" && t.arity() == 2 {
+            return hasControlCut(t.args[1])
+        }
+        if t.arity() == 0 {
+            return t.functor == "!"
+        }
+        if t.arity() == 2 && (t.functor == Comma || t.functor == ";") {
+            return hasControlCut(t.args[0]) || hasControlCut(t.args[1])
+        }
+        if t.arity() == 2 && t.functor == "->" {
+            return hasControlCut(t.args[1])
+        }
+    }
+    return false
+}
+
+// qualifiedGoal gets the procedure a goal calls and its args. M:G with
+// M an atom and G callable calls G in M; anything else is called as is.
+func qualifiedGoal(g process) (procEntry, process) {
+    if g.functor != ":" || g.arity() != 2 {
+        return proc(g.functor, g.arity()), g
+    }
+    if _, ok := g.args[0].(symbol); !ok || isVariable(g.args[1]) {
+        return proc(g.functor, g.arity()), g
+    }
+    if _, err := toProcess(g.args[1]); err != nil {
+        return proc(g.functor, g.arity()), g
+    }
+    return qualifiedHead("", g)
+}
+
+// renumberVariables numbers variables from 0 in order of appearance, as
+// compileClause expects. Parsing does this already, but terms built while
+// running a query can contain any variable.
+func renumberVariables(r rule) rule {
+    vars := map[variable]expression{}
+    return r.mapVariables(func(v variable) expression {
+        if n, ok := vars[v]; ok {
+            return n
+        }
+        n := variable(len(vars))
+        vars[v] = n
+        return n
+    })
 }
 
 func compileArgs(xrMap map[entry]int, args []expression) []instruction {
@@ -181,6 +486,16 @@ func compileExpression(xrMap map[entry]int, e expression) []instruction {
         instrs := []instruction{FUNCTOR, instruction(i)}
         instrs = append(instrs, compileArgs(xrMap, t.args)...)
         return append(instrs, POP)
+    case list:
+        i := len(xrMap)
+        if v, ok := xrMap[listFunctor]; ok {
+            i = v
+        } else {
+            xrMap[listFunctor] = i
+        }
+        instrs := []instruction{FUNCTOR, instruction(i)}
+        instrs = append(instrs, compileArgs(xrMap, []expression{t.head, t.tail})...)
+        return append(instrs, POP)
     default:
         panic(fmt.Sprintf("unknown type %T", e))
     }
@@ -191,10 +506,10 @@ func highestVar(b []instruction) int {
     var highest int = -1
     for i:=0; i<len(b); i++ {
         switch b[i] {
-        case VAR:
+        case VAR, MARK, CUT:
             highest = max(highest, int(b[i+1]))
             i++
-        case CALL, CONST, FUNCTOR:
+        case CALL, CONST, FUNCTOR, TRY, JUMP:
             i++
         }
     }
@@ -2,6 +2,7 @@ package main
 
 import (
     "reflect"
+    "strings"
     "testing"
 )
 
@@ -58,3 +59,47 @@ func TestCompileProcedure(t *testing.T) {
         }
     }
 }
+
+func TestDisassemble(t *testing.T) {
+    p := compileProcedure(MustParseRules(appendRules))
+    want := "procedure(append/3, [" +
+        "clause(xrtable(nil), 1, [const nil, var 0, var 0, exit]), " +
+        "clause(xrtable(cons/2, append/3), 4, [functor cons/2, var 0, var 1, pop, var 2, functor cons/2, var 0, var 3, pop, enter, var 1, var 2, var 3, call append/3, exit])])"
+    if got := p.String(); got != want {
+        t.Errorf("got %s want %s", got, want)
+    }
+    var sb strings.Builder
+    p.disassemble(&sb)
+    want = `append/3:
+  clause 0, 1 vars
+    const nil
+    var 0
+    var 0
+    exit
+  clause 1, 4 vars
+    functor cons/2
+      var 0
+      var 1
+    pop
+    var 2
+    functor cons/2
+      var 0
+      var 3
+    pop
+    enter
+    var 1
+    var 2
+    var 3
+    call append/3
+    exit
+`
+    if got := sb.String(); got != want {
+        t.Errorf("got %s want %s", got, want)
+    }
+    // malformed code is shown, not panicked on
+    c := clause{xrTable: xrTable{constant("a")}, bytecodes: []instruction{CONST, 3, 42, CALL}}
+    want = "clause(xrtable(a), 0, [const ?3, instruction(42), call ?])"
+    if got := c.String(); got != want {
+        t.Errorf("got %s want %s", got, want)
+    }
+}